@@ -0,0 +1,183 @@
+package secureio
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+const (
+	authenticationStringNumbers = 3
+	authenticationStringEmojis  = 7
+)
+
+type authenticationStringStatus uint32
+
+const (
+	authenticationStringStatusUnknown = authenticationStringStatus(iota)
+	authenticationStringStatusConfirmed
+	authenticationStringStatusRejected
+)
+
+// authenticationStringEmojiTable is the table of emojis (and their names)
+// used by AuthenticationString. It's the same table as used by
+// the Matrix protocol for SAS verification, so the users might already
+// be familiar with it.
+var authenticationStringEmojiTable = [64]struct {
+	Emoji string
+	Name  string
+}{
+	{"🐶", "Dog"}, {"🐱", "Cat"}, {"🦁", "Lion"}, {"🐎", "Horse"},
+	{"🦄", "Unicorn"}, {"🐷", "Pig"}, {"🐘", "Elephant"}, {"🐰", "Rabbit"},
+	{"🐼", "Panda"}, {"🐓", "Rooster"}, {"🐧", "Penguin"}, {"🐢", "Turtle"},
+	{"🐟", "Fish"}, {"🐙", "Octopus"}, {"🦋", "Butterfly"}, {"🌷", "Flower"},
+	{"🌳", "Tree"}, {"🌵", "Cactus"}, {"🍄", "Mushroom"}, {"🌏", "Globe"},
+	{"🌙", "Moon"}, {"☁️", "Cloud"}, {"🔥", "Fire"}, {"🍌", "Banana"},
+	{"🍎", "Apple"}, {"🍓", "Strawberry"}, {"🌽", "Corn"}, {"🍕", "Pizza"},
+	{"🎂", "Cake"}, {"❤️", "Heart"}, {"😀", "Smiley"}, {"🤖", "Robot"},
+	{"🎩", "Hat"}, {"👓", "Glasses"}, {"🔧", "Spanner"}, {"🎅", "Santa"},
+	{"👍", "Thumbs Up"}, {"☂️", "Umbrella"}, {"⌛", "Hourglass"}, {"⏰", "Clock"},
+	{"🎁", "Gift"}, {"💡", "Light Bulb"}, {"📕", "Book"}, {"✏️", "Pencil"},
+	{"📎", "Paperclip"}, {"✂️", "Scissors"}, {"🔒", "Lock"}, {"🔑", "Key"},
+	{"🔨", "Hammer"}, {"☎️", "Telephone"}, {"🏁", "Flag"}, {"🚂", "Train"},
+	{"🚲", "Bicycle"}, {"✈️", "Aeroplane"}, {"🚀", "Rocket"}, {"🏆", "Trophy"},
+	{"⚽", "Ball"}, {"🎸", "Guitar"}, {"🎺", "Trumpet"}, {"🔔", "Bell"},
+	{"⚓", "Anchor"}, {"🎧", "Headphones"}, {"📁", "Folder"}, {"📌", "Pin"},
+}
+
+// AuthenticationString is a short authentication string (SAS) of a session.
+// It is derived from the identities of both sides and the first key
+// exchange of the session, so it is the same on both sides only if
+// there is no man-in-the-middle.
+//
+// The users are supposed to compare it through an independent channel
+// (for example by voice) and then call
+// `(*Session).ConfirmAuthenticationString` or
+// `(*Session).RejectAuthenticationString`.
+//
+// The string is short, so it does not protect against an active attacker
+// who is able to brute-force its key exchange keys to get the same
+// string on both sides. Use it only as an addition to the trust-on-first-use
+// mode (see `KnownPeers`).
+type AuthenticationString struct {
+	// Numbers is three numbers in range [1000, 9191].
+	Numbers [authenticationStringNumbers]uint16
+
+	// Emojis is indexes in the emoji table, see methods `Emoji` and `Words`.
+	Emojis [authenticationStringEmojis]uint8
+}
+
+func newAuthenticationString(transcript []byte) *AuthenticationString {
+	h := hash(transcript, Salt, []byte("authenticationString"))
+	authString := &AuthenticationString{}
+
+	// 3 numbers of 13 bits each
+	numbersBits := uint64(h[0])<<32 | uint64(h[1])<<24 | uint64(h[2])<<16 | uint64(h[3])<<8 | uint64(h[4])
+	for idx := range authString.Numbers {
+		shift := uint(40 - 13*(idx+1))
+		authString.Numbers[idx] = uint16((numbersBits>>shift)&0x1fff) + 1000
+	}
+
+	// 7 emojis of 6 bits each
+	emojisBits := uint64(h[5])<<40 | uint64(h[6])<<32 | uint64(h[7])<<24 |
+		uint64(h[8])<<16 | uint64(h[9])<<8 | uint64(h[10])
+	for idx := range authString.Emojis {
+		shift := uint(48 - 6*(idx+1))
+		authString.Emojis[idx] = uint8((emojisBits >> shift) & 0x3f)
+	}
+
+	return authString
+}
+
+// Decimal returns the numeric representation of the string,
+// for example "4021-8816-1437".
+func (authString *AuthenticationString) Decimal() string {
+	return fmt.Sprintf("%d-%d-%d", authString.Numbers[0], authString.Numbers[1], authString.Numbers[2])
+}
+
+// Emoji returns the emoji representation of the string.
+func (authString *AuthenticationString) Emoji() string {
+	emojis := make([]string, 0, len(authString.Emojis))
+	for _, idx := range authString.Emojis {
+		emojis = append(emojis, authenticationStringEmojiTable[idx].Emoji)
+	}
+	return strings.Join(emojis, " ")
+}
+
+// Words returns the names of the emojis (see `Emoji`), for example
+// ["Dog", "Rocket", "Hat", "Dog", "Pin", "Moon", "Key"].
+func (authString *AuthenticationString) Words() []string {
+	words := make([]string, 0, len(authString.Emojis))
+	for _, idx := range authString.Emojis {
+		words = append(words, authenticationStringEmojiTable[idx].Name)
+	}
+	return words
+}
+
+// String implements fmt.Stringer.
+func (authString *AuthenticationString) String() string {
+	return authString.Decimal()
+}
+
+// AuthenticationString returns the short authentication string of the
+// session. It is the same during the whole session (it does not change
+// on key re-exchanges).
+//
+// Returns ErrKeyExchangeNotCompleted if there was no successful
+// key exchange, yet.
+//
+// See `AuthenticationString`.
+func (sess *Session) AuthenticationString() (*AuthenticationString, error) {
+	if sess.keyExchanger == nil {
+		return nil, newErrKeyExchangeNotCompleted()
+	}
+	authString := sess.keyExchanger.getAuthenticationString()
+	if authString == nil {
+		return nil, newErrKeyExchangeNotCompleted()
+	}
+	return authString, nil
+}
+
+// ConfirmAuthenticationString marks the session as verified by the user
+// (the AuthenticationString on both sides is the same).
+//
+// See also `IsAuthenticationStringConfirmed`.
+func (sess *Session) ConfirmAuthenticationString() error {
+	if _, err := sess.AuthenticationString(); err != nil {
+		return err
+	}
+	atomic.CompareAndSwapUint32(&sess.authenticationStringStatus,
+		uint32(authenticationStringStatusUnknown), uint32(authenticationStringStatusConfirmed))
+	return nil
+}
+
+// IsAuthenticationStringConfirmed returns true if
+// `ConfirmAuthenticationString` was called.
+func (sess *Session) IsAuthenticationStringConfirmed() bool {
+	return authenticationStringStatus(atomic.LoadUint32(&sess.authenticationStringStatus)) ==
+		authenticationStringStatusConfirmed
+}
+
+// RejectAuthenticationString should be called if the AuthenticationString
+// on both sides differs (so there could be a man-in-the-middle). It
+// closes the session and marks the remote identity as untrusted if the
+// TrustStore of the session implements RemoteIdentityRejecter
+// (for example `(*KnownPeers).TrustStore` and `RemoteIdentitySet`).
+func (sess *Session) RejectAuthenticationString() error {
+	atomic.StoreUint32(&sess.authenticationStringStatus, uint32(authenticationStringStatusRejected))
+
+	var rejectErr error
+	if rejecter, ok := sess.trustStore.(RemoteIdentityRejecter); ok {
+		if remoteIdentity := sess.GetRemoteIdentity(); remoteIdentity != nil {
+			rejectErr = rejecter.RejectRemoteIdentity(sess, remoteIdentity.Keys.Public)
+		}
+	}
+
+	closeErr := sess.Close()
+	if rejectErr != nil {
+		return xerrors.Errorf("unable to reject the remote identity: %w", rejectErr)
+	}
+	return closeErr
+}
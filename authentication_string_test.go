@@ -0,0 +1,55 @@
+package secureio_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	xerrors "github.com/xaionaro-go/errors"
+
+	. "github.com/xaionaro-go/secureio"
+)
+
+func TestSession_AuthenticationString(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	knownPeers, err := NewKnownPeers(``)
+	require.NoError(t, err)
+
+	sess0 := identity0.NewSessionWithTrustStore(knownPeers.TrustStore(`peer1`), conn0, &testLogger{t}, nil)
+	_, err = sess0.AuthenticationString()
+	assert.True(t, err.(*xerrors.Error).Has(ErrKeyExchangeNotCompleted{}))
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, nil)
+	require.NoError(t, sess1.Start(ctx))
+
+	assert.Equal(t, SessionStateEstablished, sess0.WaitForState(ctx, SessionStateEstablished))
+	assert.Equal(t, SessionStateEstablished, sess1.WaitForState(ctx, SessionStateEstablished))
+
+	authString0, err := sess0.AuthenticationString()
+	require.NoError(t, err)
+	authString1, err := sess1.AuthenticationString()
+	require.NoError(t, err)
+	assert.Equal(t, authString0, authString1)
+	assert.Equal(t, authString0.Decimal(), authString1.String())
+	assert.Len(t, authString0.Words(), 7)
+	assert.NotEmpty(t, authString0.Emoji())
+
+	assert.False(t, sess1.IsAuthenticationStringConfirmed())
+	assert.NoError(t, sess1.ConfirmAuthenticationString())
+	assert.True(t, sess1.IsAuthenticationStringConfirmed())
+
+	assert.Equal(t, identity1.Keys.Public, knownPeers.Get(`peer1`))
+	assert.NoError(t, sess0.RejectAuthenticationString())
+	assert.False(t, sess0.IsAuthenticationStringConfirmed())
+	assert.Nil(t, knownPeers.Get(`peer1`))
+	assert.True(t, knownPeers.IsRevoked(identity1.Keys.Public))
+
+	_ = sess1.Close()
+	waitForClosure(t, sess0, sess1)
+}
@@ -0,0 +1,241 @@
+package secureio
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+const (
+	certificateVersion = 1
+
+	// CertificateMaxPrincipals is the maximal amount of principals
+	// of a Certificate.
+	CertificateMaxPrincipals = 255
+
+	// CertificateMaxPrincipalLength is the maximal length of
+	// a principal of a Certificate.
+	CertificateMaxPrincipalLength = 255
+)
+
+var (
+	// certificateSignaturePrefix is used to make sure a signature of
+	// a certificate could not be used as a signature of anything else.
+	certificateSignaturePrefix = []byte("xaionaro-go/secureio.Certificate\x00")
+)
+
+// Certificate is an identity certificate: it binds the public key
+// of an identity ("SubjectKey") to a list of principals (for example:
+// host names or user names) for a period of time. A certificate is
+// signed by a certificate authority which is an `Identity` as well.
+//
+// If a local identity has a certificate (see `Identity.Certificate`)
+// then it's sent to the remote side on key exchanges, so the remote side
+// could trust the CA public key instead of each identity key
+// (see `CertificateAuthoritySet`).
+type Certificate struct {
+	// SubjectKey is the public key of the certified identity.
+	SubjectKey ed25519.PublicKey
+
+	// Serial is an arbitrary number defined by the certificate authority.
+	Serial uint64
+
+	// ValidAfter and ValidBefore define the validity window of
+	// the certificate. The precision is one second.
+	ValidAfter  time.Time
+	ValidBefore time.Time
+
+	// Principals is the list of names the certificate is valid for.
+	Principals []string
+
+	// SignatureKey is the public key of the certificate authority
+	// which signed the certificate.
+	SignatureKey ed25519.PublicKey
+
+	// Signature is the signature of the certificate made by
+	// the certificate authority.
+	Signature []byte
+}
+
+type certificateHeaders struct {
+	Version     uint8
+	SubjectKey  [PublicKeySize]byte
+	Serial      uint64
+	ValidAfter  int64
+	ValidBefore int64
+}
+
+// NewCertificate is a constructor of an unsigned Certificate.
+//
+// To sign the certificate use `(*Identity).SignCertificate`.
+func NewCertificate(
+	subjectKey ed25519.PublicKey,
+	validAfter, validBefore time.Time,
+	principals ...string,
+) *Certificate {
+	return &Certificate{
+		SubjectKey:  subjectKey,
+		ValidAfter:  validAfter.Truncate(time.Second),
+		ValidBefore: validBefore.Truncate(time.Second),
+		Principals:  principals,
+	}
+}
+
+// SignCertificate signs the certificate `cert` using the identity as
+// a certificate authority. It sets fields SignatureKey and Signature.
+func (i *Identity) SignCertificate(cert *Certificate) error {
+	cert.SignatureKey = i.Keys.Public
+	cert.Signature = nil
+	body, err := cert.marshalBody()
+	if err != nil {
+		return err
+	}
+
+	signature := make([]byte, keySignatureSize)
+	if err := i.Sign(signature, certificateSignedData(body)); err != nil {
+		return err
+	}
+	cert.Signature = signature
+	return nil
+}
+
+func certificateSignedData(body []byte) []byte {
+	result := make([]byte, 0, len(certificateSignaturePrefix)+len(body))
+	result = append(result, certificateSignaturePrefix...)
+	return append(result, body...)
+}
+
+func (cert *Certificate) marshalBody() ([]byte, error) {
+	if len(cert.SubjectKey) != PublicKeySize {
+		return nil, newErrInvalidCertificate(`invalid subject key length`)
+	}
+	if len(cert.SignatureKey) != PublicKeySize {
+		return nil, newErrInvalidCertificate(`invalid signature key length`)
+	}
+	if len(cert.Principals) > CertificateMaxPrincipals {
+		return nil, newErrInvalidCertificate(fmt.Sprintf(`too many principals: %d > %d`,
+			len(cert.Principals), CertificateMaxPrincipals))
+	}
+
+	var buf bytes.Buffer
+	hdr := certificateHeaders{
+		Version:     certificateVersion,
+		Serial:      cert.Serial,
+		ValidAfter:  cert.ValidAfter.Unix(),
+		ValidBefore: cert.ValidBefore.Unix(),
+	}
+	copy(hdr.SubjectKey[:], cert.SubjectKey)
+	_ = binary.Write(&buf, binaryOrderType, &hdr)
+
+	buf.WriteByte(uint8(len(cert.Principals)))
+	for _, principal := range cert.Principals {
+		if len(principal) > CertificateMaxPrincipalLength {
+			return nil, newErrInvalidCertificate(fmt.Sprintf(`too long principal: %d > %d`,
+				len(principal), CertificateMaxPrincipalLength))
+		}
+		buf.WriteByte(uint8(len(principal)))
+		buf.WriteString(principal)
+	}
+
+	buf.Write(cert.SignatureKey)
+	return buf.Bytes(), nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+//
+// The certificate should be signed.
+func (cert *Certificate) MarshalBinary() ([]byte, error) {
+	if len(cert.Signature) != keySignatureSize {
+		return nil, newErrInvalidCertificate(`not signed`)
+	}
+	body, err := cert.marshalBody()
+	if err != nil {
+		return nil, err
+	}
+	return append(body, cert.Signature...), nil
+}
+
+// ParseCertificate parses a certificate serialized by
+// `(*Certificate).MarshalBinary`.
+//
+// It does not verify the certificate, see `(*Certificate).Verify`.
+func ParseCertificate(b []byte) (*Certificate, error) {
+	r := bytes.NewReader(b)
+
+	var hdr certificateHeaders
+	if err := binary.Read(r, binaryOrderType, &hdr); err != nil {
+		return nil, newErrInvalidCertificate(`too short`)
+	}
+	if hdr.Version != certificateVersion {
+		return nil, newErrInvalidCertificate(fmt.Sprintf(`unsupported version %d`, hdr.Version))
+	}
+
+	cert := &Certificate{
+		SubjectKey:  append(ed25519.PublicKey{}, hdr.SubjectKey[:]...),
+		Serial:      hdr.Serial,
+		ValidAfter:  time.Unix(hdr.ValidAfter, 0),
+		ValidBefore: time.Unix(hdr.ValidBefore, 0),
+	}
+
+	principalsCount, err := r.ReadByte()
+	if err != nil {
+		return nil, newErrInvalidCertificate(`too short`)
+	}
+	for idx := 0; idx < int(principalsCount); idx++ {
+		principalLength, err := r.ReadByte()
+		if err != nil {
+			return nil, newErrInvalidCertificate(`too short`)
+		}
+		principal := make([]byte, principalLength)
+		if _, err := io.ReadFull(r, principal); err != nil {
+			return nil, newErrInvalidCertificate(`too short`)
+		}
+		cert.Principals = append(cert.Principals, string(principal))
+	}
+
+	if r.Len() != PublicKeySize+keySignatureSize {
+		return nil, newErrInvalidCertificate(fmt.Sprintf(`invalid length of the tail: %d != %d`,
+			r.Len(), PublicKeySize+keySignatureSize))
+	}
+	tail := b[len(b)-r.Len():]
+	cert.SignatureKey = append(ed25519.PublicKey{}, tail[:PublicKeySize]...)
+	cert.Signature = append([]byte{}, tail[PublicKeySize:]...)
+	return cert, nil
+}
+
+// IsValidAt returns true if `t` is inside the validity window
+// of the certificate.
+func (cert *Certificate) IsValidAt(t time.Time) bool {
+	return !t.Before(cert.ValidAfter) && t.Before(cert.ValidBefore)
+}
+
+// Verify checks if the certificate is signed by the certificate
+// authority with public key `caPubKey` and if it is valid at moment `t`.
+func (cert *Certificate) Verify(caPubKey ed25519.PublicKey, t time.Time) error {
+	if !bytes.Equal(cert.SignatureKey, caPubKey) {
+		return newErrInvalidCertificate(`signed by another certificate authority`)
+	}
+	body, err := cert.marshalBody()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(caPubKey, certificateSignedData(body), cert.Signature) {
+		return xerrors.Errorf("invalid certificate signature: %w", newErrInvalidSignature())
+	}
+	return cert.checkValidity(t)
+}
+
+func (cert *Certificate) checkValidity(t time.Time) error {
+	if t.Before(cert.ValidAfter) {
+		return newErrCertificateNotYetValid(cert.ValidAfter)
+	}
+	if !t.Before(cert.ValidBefore) {
+		return newErrCertificateExpired(cert.ValidBefore)
+	}
+	return nil
+}
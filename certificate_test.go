@@ -0,0 +1,175 @@
+package secureio_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	xerrors "github.com/xaionaro-go/errors"
+
+	. "github.com/xaionaro-go/secureio"
+)
+
+func testCAIdentity(t *testing.T) *Identity {
+	_, caKey, err := ed25519.GenerateKey(rand.New(rand.NewSource(2)))
+	require.NoError(t, err)
+	caIdentity, err := NewIdentityFromPrivateKey(caKey)
+	require.NoError(t, err)
+	return caIdentity
+}
+
+func testCertificate(t *testing.T, ca, subject *Identity, validAfter, validBefore time.Time, principals ...string) *Certificate {
+	cert := NewCertificate(subject.Keys.Public, validAfter, validBefore, principals...)
+	require.NoError(t, ca.SignCertificate(cert))
+	return cert
+}
+
+func TestCertificate(t *testing.T) {
+	caIdentity := testCAIdentity(t)
+	identity0, _, conn0, conn1 := testPair(t)
+	_ = conn0.Close()
+	_ = conn1.Close()
+
+	now := time.Now()
+	cert := testCertificate(t, caIdentity, identity0, now.Add(-time.Hour), now.Add(time.Hour), `node0`, ``, `node0.example.org`)
+
+	b, err := cert.MarshalBinary()
+	require.NoError(t, err)
+	parsedCert, err := ParseCertificate(b)
+	require.NoError(t, err)
+	assert.Equal(t, cert.Principals, parsedCert.Principals)
+	assert.True(t, cert.ValidBefore.Equal(parsedCert.ValidBefore))
+
+	assert.NoError(t, parsedCert.Verify(caIdentity.Keys.Public, now))
+	assert.True(t, parsedCert.IsValidAt(now))
+	assert.False(t, parsedCert.IsValidAt(now.Add(2*time.Hour)))
+
+	err = parsedCert.Verify(caIdentity.Keys.Public, now.Add(2*time.Hour))
+	assert.True(t, err.(*xerrors.Error).Has(ErrCertificateExpired{}), err)
+	err = parsedCert.Verify(caIdentity.Keys.Public, now.Add(-2*time.Hour))
+	assert.True(t, err.(*xerrors.Error).Has(ErrCertificateNotYetValid{}), err)
+	err = parsedCert.Verify(identity0.Keys.Public, now)
+	assert.True(t, err.(*xerrors.Error).Has(ErrInvalidCertificate{}), err)
+
+	parsedCert.Principals[0] = `node1`
+	err = parsedCert.Verify(caIdentity.Keys.Public, now)
+	assert.True(t, err.(*xerrors.Error).Has(ErrInvalidSignature{}), err)
+
+	for length := 0; length < len(b); length++ {
+		_, err = ParseCertificate(b[:length])
+		assert.Error(t, err)
+	}
+
+	_, err = NewCertificate(identity0.Keys.Public, now, now).MarshalBinary()
+	assert.Error(t, err)
+}
+
+func TestCertificateAuthoritySet(t *testing.T) {
+	caIdentity := testCAIdentity(t)
+	identity0, identity1, conn0, conn1 := testPair(t)
+	_ = conn0.Close()
+	_ = conn1.Close()
+
+	caSet, err := NewCertificateAuthoritySet(caIdentity.Keys.Public)
+	require.NoError(t, err)
+
+	now := time.Now()
+	remoteIdentity, err := caSet.VerifyCertificate(nil, testCertificate(t, caIdentity, identity0, now.Add(-time.Hour), now.Add(time.Hour), `node0`))
+	require.NoError(t, err)
+	assert.Equal(t, identity0.Keys.Public, remoteIdentity.Keys.Public)
+	assert.Equal(t, []string{`node0`}, remoteIdentity.Certificate.Principals)
+
+	_, err = caSet.VerifyCertificate(nil, testCertificate(t, identity1, identity0, now.Add(-time.Hour), now.Add(time.Hour)))
+	assert.True(t, err.(*xerrors.Error).Has(ErrUnknownCertificateAuthority{}), err)
+
+	_, err = caSet.VerifyCertificate(nil, testCertificate(t, caIdentity, identity0, now.Add(-2*time.Hour), now.Add(-time.Hour)))
+	assert.True(t, err.(*xerrors.Error).Has(ErrCertificateExpired{}), err)
+
+	// The validity period is checked using the clock of the session
+	sess := identity1.NewSession(identity0, conn1, &testLogger{t}, &SessionOptions{
+		Clock: NewFakeClock(now.Add(-90 * time.Minute)),
+	})
+	_, err = caSet.VerifyCertificate(sess, testCertificate(t, caIdentity, identity0, now.Add(-2*time.Hour), now.Add(-time.Hour)))
+	assert.NoError(t, err)
+
+	assert.Nil(t, caSet.FindRemoteIdentity(identity0.Keys.Public))
+	assert.True(t, caSet.Remove(caIdentity.Keys.Public))
+	assert.False(t, caSet.Remove(caIdentity.Keys.Public))
+}
+
+func TestSession_certificate(t *testing.T) {
+	ctx := context.Background()
+
+	caIdentity := testCAIdentity(t)
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	now := time.Now()
+	identity0.Certificate = testCertificate(t, caIdentity, identity0, now.Add(-time.Hour), now.Add(time.Hour), `node0`)
+	identity1.Certificate = testCertificate(t, caIdentity, identity1, now.Add(-time.Hour), now.Add(time.Hour), `node1`, `node1.example.org`)
+
+	caSet, err := NewCertificateAuthoritySet(caIdentity.Keys.Public)
+	require.NoError(t, err)
+
+	sess0 := identity0.NewSessionWithTrustStore(caSet, conn0, &testLogger{t}, nil)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSessionWithTrustStore(caSet, conn1, &testLogger{t}, nil)
+	require.NoError(t, sess1.Start(ctx))
+
+	_, err = sess1.Write([]byte(`unit-test`))
+	require.NoError(t, err)
+	readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+	n, err := sess0.Read(readBuf)
+	require.NoError(t, err)
+	assert.Equal(t, `unit-test`, string(readBuf[:n]))
+
+	assert.Equal(t, identity1.Keys.Public, sess0.GetRemoteIdentity().Keys.Public)
+	assert.Equal(t, []string{`node1`, `node1.example.org`}, sess0.GetRemoteIdentity().Certificate.Principals)
+	assert.Equal(t, []string{`node0`}, sess1.GetRemoteIdentity().Certificate.Principals)
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_certificateExpired(t *testing.T) {
+	ctx := context.Background()
+
+	caIdentity := testCAIdentity(t)
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	now := time.Now()
+	identity1.Certificate = testCertificate(t, caIdentity, identity1, now.Add(-2*time.Hour), now.Add(-time.Hour), `node1`)
+
+	caSet, err := NewCertificateAuthoritySet(caIdentity.Keys.Public)
+	require.NoError(t, err)
+
+	expiredChan := make(chan struct{}, 1)
+	sess0 := identity0.NewSessionWithTrustStore(caSet, conn0, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		if err.(*xerrors.Error).Has(ErrCertificateExpired{}) {
+			select {
+			case expiredChan <- struct{}{}:
+			default:
+			}
+		}
+		return false
+	}), nil)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		return false
+	}), nil)
+	require.NoError(t, sess1.Start(ctx))
+
+	<-expiredChan
+	assert.Nil(t, sess0.GetRemoteIdentity())
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
@@ -0,0 +1,158 @@
+package secureio
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/aead/chacha20/chacha"
+)
+
+// cipherKeys is a generation of the cipher keys of a session: the keys
+// derived from the current secrets and the aux cipher keys (see
+// KeyExchangerOptions.PSKs).
+//
+// The keys are copies, so the secrets could be destroyed right when they
+// are rotated out. The keys are read without locks (see
+// Session.acquireCipherKeys), so they are destroyed only after the
+// generation is retired and the last user released it.
+type cipherKeys struct {
+	// keys are the cipher keys by secretID, nil if there was no
+	// successful key exchange, yet.
+	keys [][]byte
+
+	// auxKeys are the aux cipher keys (the first one is the local one).
+	auxKeys [][]byte
+
+	// isClosed means the session is closed, and there are no keys.
+	isClosed bool
+
+	options     *KeyExchangerOptions
+	usersCount  int64
+	isRetired   uint32
+	isDestroyed uint32
+}
+
+// newCipherKeys returns a new generation of the cipher keys based on
+// the secrets `secrets` and the aux cipher keys `auxKeys`.
+func (sess *Session) newCipherKeys(secrets, auxKeys [][]byte) *cipherKeys {
+	keys := &cipherKeys{
+		options: &sess.options.KeyExchangerOptions,
+	}
+	copyKey := func(src []byte) []byte {
+		if src == nil {
+			return nil
+		}
+		key := make([]byte, chacha.KeySize)
+		copy(key, src)
+		if err := protectKey(keys.options, key); err != nil {
+			sess.lockMemoryError(err)
+		}
+		return key
+	}
+	if secrets != nil {
+		keys.keys = make([][]byte, 0, len(secrets))
+		for _, secret := range secrets {
+			keys.keys = append(keys.keys, copyKey(secret))
+		}
+	}
+	for _, auxKey := range auxKeys {
+		keys.auxKeys = append(keys.auxKeys, copyKey(auxKey))
+	}
+	return keys
+}
+
+// auxKey returns the aux cipher key of the local side (or nil if there
+// is no aux cipher key).
+func (keys *cipherKeys) auxKey() []byte {
+	if len(keys.auxKeys) == 0 {
+		return nil
+	}
+	return keys.auxKeys[0]
+}
+
+// copy returns a copy of the cipher keys (not the aux ones).
+func (keys *cipherKeys) copy() [][]byte {
+	if keys.keys == nil {
+		return nil
+	}
+	result := make([][]byte, 0, len(keys.keys))
+	for _, key := range keys.keys {
+		if key == nil {
+			result = append(result, nil)
+			continue
+		}
+		result = append(result, append([]byte(nil), key...))
+	}
+	return result
+}
+
+// release should be called when the keys are not used anymore (see
+// Session.acquireCipherKeys).
+func (keys *cipherKeys) release() {
+	if atomic.AddInt64(&keys.usersCount, -1) == 0 && atomic.LoadUint32(&keys.isRetired) != 0 {
+		keys.destroy()
+	}
+}
+
+// retire marks the generation as not current anymore, so it is destroyed
+// when it is released by the last user.
+func (keys *cipherKeys) retire() {
+	atomic.StoreUint32(&keys.isRetired, 1)
+	if atomic.LoadInt64(&keys.usersCount) == 0 {
+		keys.destroy()
+	}
+}
+
+func (keys *cipherKeys) destroy() {
+	if !atomic.CompareAndSwapUint32(&keys.isDestroyed, 0, 1) {
+		return
+	}
+	for _, key := range keys.keys {
+		if key != nil {
+			destroyKey(keys.options, key)
+		}
+	}
+	for _, key := range keys.auxKeys {
+		if key != nil {
+			destroyKey(keys.options, key)
+		}
+	}
+}
+
+func (sess *Session) loadCipherKeys() *cipherKeys {
+	return (*cipherKeys)(
+		atomic.LoadPointer(
+			(*unsafe.Pointer)((unsafe.Pointer)(
+				&sess.cipherKeys,
+			)),
+		),
+	)
+}
+
+// acquireCipherKeys returns the current generation of the cipher keys.
+// The keys will not be destroyed until `release` is called.
+func (sess *Session) acquireCipherKeys() *cipherKeys {
+	for {
+		keys := sess.loadCipherKeys()
+		atomic.AddInt64(&keys.usersCount, 1)
+		if sess.loadCipherKeys() == keys {
+			// The generation was not retired before it was acquired
+			return keys
+		}
+		keys.release()
+	}
+}
+
+// replaceCipherKeys sets the new generation of the cipher keys and
+// retires the previous one.
+//
+// It should be called with sess.locker locked.
+func (sess *Session) replaceCipherKeys(newKeys *cipherKeys) {
+	oldKeys := (*cipherKeys)(atomic.SwapPointer(
+		(*unsafe.Pointer)((unsafe.Pointer)(&sess.cipherKeys)),
+		(unsafe.Pointer)(newKeys),
+	))
+	if oldKeys != nil {
+		oldKeys.retire()
+	}
+}
@@ -0,0 +1,315 @@
+package secureio
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+)
+
+// CipherSuite is the identifier of the set of algorithms used to encrypt
+// and authenticate the traffic of a session. The cipher suite is selected
+// once per session during the key exchange, see
+// KeyExchangerOptions.CipherSuites.
+type CipherSuite uint8
+
+const (
+	// CipherSuiteUndefined is an invalid value. It also means "not selected, yet".
+	CipherSuiteUndefined = CipherSuite(iota)
+
+	// CipherSuiteXChaCha20Poly1305 is XChaCha20 with Poly1305 checksums.
+	// It is the original cipher suite of the protocol, so it is used
+	// with remote sides which does not support cipher suites negotiation.
+	CipherSuiteXChaCha20Poly1305
+
+	// CipherSuiteChaCha20Poly1305 is the ChaCha20-Poly1305 AEAD
+	// (RFC 8439). Each packet (except the packet ID) is encrypted and
+	// authenticated by the AEAD, the packet ID and the SessionID of
+	// the sender are the additional data.
+	CipherSuiteChaCha20Poly1305
+
+	// CipherSuiteAES256GCM is the AES-256-GCM AEAD (NIST SP 800-38D),
+	// used the same way as CipherSuiteChaCha20Poly1305. It is much faster
+	// than the ChaCha20-based cipher suites on CPUs with AES-NI.
+	CipherSuiteAES256GCM
+
+	cipherSuiteEndOfRange
+)
+
+var (
+	// DefaultCipherSuites is the default value of
+	// KeyExchangerOptions.CipherSuites.
+	DefaultCipherSuites = []CipherSuite{
+		CipherSuiteXChaCha20Poly1305,
+		CipherSuiteChaCha20Poly1305,
+		CipherSuiteAES256GCM,
+	}
+)
+
+func (suite CipherSuite) String() string {
+	switch suite {
+	case CipherSuiteUndefined:
+		return `undefined`
+	case CipherSuiteXChaCha20Poly1305:
+		return `xchacha20-poly1305`
+	case CipherSuiteChaCha20Poly1305:
+		return `chacha20-poly1305`
+	case CipherSuiteAES256GCM:
+		return `aes-256-gcm`
+	}
+	return fmt.Sprintf(`unknown_%d`, uint8(suite))
+}
+
+// IsSupported returns true if the cipher suite is implemented by
+// this version of the package.
+func (suite CipherSuite) IsSupported() bool {
+	return suite != CipherSuiteUndefined && suite < cipherSuiteEndOfRange
+}
+
+// selectCipherSuite returns the cipher suite which will be used by both
+// sides. The result does not depend on which side calls the function:
+// the suite with the minimal sum of the positions in both lists
+// of preferences is selected (and the one with the lowest value
+// if there are few such suites).
+//
+// Returns CipherSuiteUndefined if there are no common cipher suites.
+func selectCipherSuite(local, remote []CipherSuite) CipherSuite {
+	result := CipherSuiteUndefined
+	bestRank := -1
+	for localRank, suite := range local {
+		if !suite.IsSupported() {
+			continue
+		}
+		for remoteRank, remoteSuite := range remote {
+			if remoteSuite != suite {
+				continue
+			}
+			rank := localRank + remoteRank
+			if bestRank < 0 || rank < bestRank || (rank == bestRank && suite < result) {
+				result = suite
+				bestRank = rank
+			}
+			break
+		}
+	}
+	return result
+}
+
+type checksumType uint8
+
+const (
+	checksumTypeHeaders = checksumType(iota + 1)
+	checksumTypeMessages
+)
+
+// cipherSuiteImplementation is the implementation of a CipherSuite. It is
+// either a streamCipherSuiteImplementation or
+// an aeadCipherSuiteImplementation.
+//
+// `iv` is the initialization vector of a packet, it always ends with
+// the packetID. All the other bytes (if any) are the SessionID of
+// the sender.
+type cipherSuiteImplementation interface {
+	// resetCache forgets (and overwrites) the keys derived from
+	// the cipher keys. It is called when the cipher keys are rotated and
+	// when the session is closed.
+	resetCache()
+}
+
+// streamCipherSuiteImplementation is a cipher suite which encrypts
+// the packets with a stream cipher, while the packets are authenticated
+// by the checksums of the container headers (see
+// messagesContainerHeadersData.Set).
+type streamCipherSuiteImplementation interface {
+	cipherSuiteImplementation
+
+	// XORKeyStream encrypts (or decrypts) `src` to `dst`.
+	XORKeyStream(key, iv, dst, src []byte)
+
+	// Sum calculates the checksum of `data` to `dst`.
+	Sum(dst *[poly1305.TagSize]byte, key, iv []byte, sumType checksumType, data []byte)
+}
+
+// aeadCipherSuiteImplementation is a cipher suite which encrypts and
+// authenticates the packets with an AEAD. The checksums of the container
+// headers are not used (they are zero). Instead, the container without
+// the headers checksum is sealed by the AEAD with `iv` as the additional
+// data, and the packet is the packetID followed by the result. So
+// the authentication tag takes the place of the headers checksum, and
+// the packets have the same size as with the other cipher suites.
+type aeadCipherSuiteImplementation interface {
+	cipherSuiteImplementation
+
+	// Seal encrypts and authenticates `plaintext` (and `iv`), and
+	// appends the result to `dst`.
+	Seal(key, iv, dst, plaintext []byte) []byte
+
+	// Open authenticates and decrypts `ciphertext` (and authenticates
+	// `iv`), and appends the result to `dst`.
+	Open(key, iv, dst, ciphertext []byte) ([]byte, error)
+}
+
+// newImplementation returns a new instance of the implementation of
+// the cipher suite. An instance caches the derived keys, so it should not
+// be shared between sessions.
+func (suite CipherSuite) newImplementation() cipherSuiteImplementation {
+	switch suite {
+	case CipherSuiteChaCha20Poly1305:
+		return newChaCha20Poly1305CipherSuite()
+	case CipherSuiteAES256GCM:
+		return newAES256GCMCipherSuite()
+	}
+	return xchacha20Poly1305CipherSuite{}
+}
+
+// xchacha20Poly1305CipherSuite implements CipherSuiteXChaCha20Poly1305.
+type xchacha20Poly1305CipherSuite struct{}
+
+func (xchacha20Poly1305CipherSuite) XORKeyStream(key, iv, dst, src []byte) {
+	encrypt(key, iv, dst, src)
+}
+
+func (xchacha20Poly1305CipherSuite) Sum(
+	dst *[poly1305.TagSize]byte,
+	key, iv []byte,
+	_ checksumType,
+	data []byte,
+) {
+	poly1305Key := calculatePoly1305Key(iv[len(iv)-len(packetID{}):], key)
+	poly1305.Sum(dst, data, &poly1305Key)
+}
+
+func (xchacha20Poly1305CipherSuite) resetCache() {}
+
+// aeadCipherSuite implements the cipher suites based on a standard AEAD
+// with 96-bit nonces (see aeadCipherSuiteImplementation).
+//
+// The AEAD key is derived from the cipher key and the SessionID of
+// the sender, so the nonce could be built only from the packetID
+// (which is unique within a session).
+//
+// The derived keys are cached by a hash of the cipher key and
+// the SessionID, so the cache does not hold copies of the cipher keys.
+type aeadCipherSuite struct {
+	label     string
+	newAEAD   func(key []byte) (cipher.AEAD, error)
+	stateLock sync.Mutex
+	states    map[[hashSize]byte]*aeadCipherSuiteState
+}
+
+// aeadCipherSuiteState is a derived key (see aeadCipherSuite).
+//
+// It is read-locked while it is used, so it is destroyed only after
+// it is not used anymore.
+type aeadCipherSuiteState struct {
+	locker sync.RWMutex
+	key    []byte
+	aead   cipher.AEAD
+}
+
+// destroy overwrites the derived key. The AEAD keeps its own copy (or
+// key schedule) which is only dropped, because the standard library
+// provides no way to overwrite it.
+func (state *aeadCipherSuiteState) destroy() {
+	state.locker.Lock()
+	defer state.locker.Unlock()
+	zeroBytes(state.key)
+	state.aead = nil
+}
+
+const (
+	// aeadCipherSuiteMaxStates is the maximal amount of cached derived
+	// keys. A session uses a few cipher keys (see secretIDs) and two
+	// SessionIDs (the local one and the remote one), and a rekey adds
+	// new cipher keys.
+	aeadCipherSuiteMaxStates = 4 * secretIDs
+)
+
+func newChaCha20Poly1305CipherSuite() *aeadCipherSuite {
+	return &aeadCipherSuite{
+		label:   `chacha20poly1305`,
+		newAEAD: chacha20poly1305.New,
+	}
+}
+
+func newAES256GCMCipherSuite() *aeadCipherSuite {
+	return &aeadCipherSuite{
+		label: `aes256gcm`,
+		newAEAD: func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		},
+	}
+}
+
+// getState returns the read-locked state for the cipher key `key` and
+// the SessionID of `iv`. The caller should unlock it after use.
+func (suite *aeadCipherSuite) getState(key, iv []byte) *aeadCipherSuiteState {
+	sessionIDBytes := iv[:len(iv)-len(packetID{})]
+	var cacheKey [hashSize]byte
+	copy(cacheKey[:], hash(key, sessionIDBytes, Salt, []byte(suite.label+".cacheKey")))
+
+	suite.stateLock.Lock()
+	defer suite.stateLock.Unlock()
+	if state := suite.states[cacheKey]; state != nil {
+		state.locker.RLock()
+		return state
+	}
+
+	derivedKey := hash(key, sessionIDBytes, Salt, []byte(suite.label))[:chacha20poly1305.KeySize]
+	aead, err := suite.newAEAD(derivedKey)
+	if err != nil {
+		panic(err) // should not happen: the key size is always correct
+	}
+	state := &aeadCipherSuiteState{
+		key:  derivedKey,
+		aead: aead,
+	}
+	if len(suite.states) >= aeadCipherSuiteMaxStates || suite.states == nil {
+		suite.destroyStates()
+		suite.states = map[[hashSize]byte]*aeadCipherSuiteState{}
+	}
+	suite.states[cacheKey] = state
+	state.locker.RLock()
+	return state
+}
+
+// destroyStates destroys all the cached states.
+//
+// It should be called with suite.stateLock locked.
+func (suite *aeadCipherSuite) destroyStates() {
+	for _, state := range suite.states {
+		state.destroy()
+	}
+	suite.states = nil
+}
+
+func (suite *aeadCipherSuite) resetCache() {
+	suite.stateLock.Lock()
+	defer suite.stateLock.Unlock()
+	suite.destroyStates()
+}
+
+func (suite *aeadCipherSuite) nonce(iv []byte) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(nonce[len(nonce)-len(packetID{}):], iv[len(iv)-len(packetID{}):])
+	return nonce
+}
+
+func (suite *aeadCipherSuite) Seal(key, iv, dst, plaintext []byte) []byte {
+	state := suite.getState(key, iv)
+	defer state.locker.RUnlock()
+	return state.aead.Seal(dst, suite.nonce(iv), plaintext, iv)
+}
+
+func (suite *aeadCipherSuite) Open(key, iv, dst, ciphertext []byte) ([]byte, error) {
+	state := suite.getState(key, iv)
+	defer state.locker.RUnlock()
+	return state.aead.Open(dst, suite.nonce(iv), ciphertext, iv)
+}
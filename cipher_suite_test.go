@@ -0,0 +1,121 @@
+package secureio
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/poly1305"
+)
+
+func TestCipherSuites(t *testing.T) {
+	rand.Seed(0)
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+
+	iv := make([]byte, ivSize)
+	_, err = rand.Read(iv)
+	assert.NoError(t, err)
+
+	plainBytes := make([]byte, 65534)
+	_, err = rand.Read(plainBytes)
+	assert.NoError(t, err)
+
+	for _, suite := range DefaultCipherSuites {
+		t.Run(suite.String(), func(t *testing.T) {
+			switch impl := suite.newImplementation().(type) {
+			case streamCipherSuiteImplementation:
+				testStreamCipherSuite(t, suite, impl, key, iv, plainBytes)
+			case aeadCipherSuiteImplementation:
+				testAEADCipherSuite(t, suite, impl, key, iv, plainBytes)
+			default:
+				t.Fatalf("unexpected implementation %T", impl)
+			}
+		})
+	}
+}
+
+func testStreamCipherSuite(
+	t *testing.T,
+	suite CipherSuite,
+	impl streamCipherSuiteImplementation,
+	key, iv, plainBytes []byte,
+) {
+	encryptedBytes := make([]byte, len(plainBytes))
+	impl.XORKeyStream(key, iv, encryptedBytes, plainBytes)
+	assert.NotEqual(t, plainBytes, encryptedBytes)
+
+	decryptedBytes := make([]byte, len(plainBytes))
+	suite.newImplementation().(streamCipherSuiteImplementation).XORKeyStream(key, iv, decryptedBytes, encryptedBytes)
+	assert.Equal(t, plainBytes, decryptedBytes)
+
+	var messagesSum, anotherSum [poly1305.TagSize]byte
+	impl.Sum(&messagesSum, key, iv, checksumTypeMessages, plainBytes)
+	suite.newImplementation().(streamCipherSuiteImplementation).Sum(&anotherSum, key, iv, checksumTypeMessages, plainBytes)
+	assert.Equal(t, messagesSum, anotherSum)
+
+	impl.Sum(&anotherSum, key, iv, checksumTypeMessages, encryptedBytes)
+	assert.NotEqual(t, messagesSum, anotherSum)
+}
+
+func testAEADCipherSuite(
+	t *testing.T,
+	suite CipherSuite,
+	impl aeadCipherSuiteImplementation,
+	key, iv, plainBytes []byte,
+) {
+	sealed := impl.Seal(key, iv, nil, plainBytes)
+	assert.Len(t, sealed, len(plainBytes)+poly1305.TagSize)
+	assert.NotEqual(t, plainBytes, sealed[:len(plainBytes)])
+
+	opened, err := suite.newImplementation().(aeadCipherSuiteImplementation).Open(key, iv, nil, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, plainBytes, opened)
+
+	// The ciphertext, the tag and the IV (the SessionID and
+	// the packetID) are authenticated
+	for _, idx := range []int{0, len(plainBytes), len(sealed) - 1} {
+		sealed[idx]++
+		_, err = impl.Open(key, iv, nil, sealed)
+		assert.Error(t, err, idx)
+		sealed[idx]--
+	}
+	for _, idx := range []int{0, len(iv) - 1} {
+		anotherIV := append([]byte(nil), iv...)
+		anotherIV[idx]++
+		_, err = impl.Open(key, anotherIV, nil, sealed)
+		assert.Error(t, err, idx)
+	}
+
+	anotherKey := append([]byte(nil), key...)
+	anotherKey[0]++
+	_, err = impl.Open(anotherKey, iv, nil, sealed)
+	assert.Error(t, err)
+
+	_, err = impl.Open(key, iv, nil, sealed)
+	assert.NoError(t, err)
+}
+
+func TestSelectCipherSuite(t *testing.T) {
+	for _, testCase := range []struct {
+		local, remote []CipherSuite
+		expected      CipherSuite
+	}{
+		{DefaultCipherSuites, DefaultCipherSuites, CipherSuiteXChaCha20Poly1305},
+		{DefaultCipherSuites, []CipherSuite{CipherSuiteXChaCha20Poly1305}, CipherSuiteXChaCha20Poly1305},
+		{DefaultCipherSuites, []CipherSuite{CipherSuiteAES256GCM}, CipherSuiteAES256GCM},
+		{
+			[]CipherSuite{CipherSuiteAES256GCM, CipherSuiteChaCha20Poly1305},
+			[]CipherSuite{CipherSuiteChaCha20Poly1305, CipherSuiteAES256GCM},
+			CipherSuiteChaCha20Poly1305,
+		},
+		{[]CipherSuite{CipherSuiteAES256GCM}, []CipherSuite{CipherSuiteXChaCha20Poly1305}, CipherSuiteUndefined},
+		{[]CipherSuite{CipherSuite(255)}, []CipherSuite{CipherSuite(255)}, CipherSuiteUndefined},
+	} {
+		assert.Equal(t, testCase.expected, selectCipherSuite(testCase.local, testCase.remote))
+		assert.Equal(t, testCase.expected, selectCipherSuite(testCase.remote, testCase.local))
+	}
+}
@@ -0,0 +1,83 @@
+package secureio
+
+import (
+	"time"
+)
+
+// Clock is a source of time (see SessionOptions.Clock).
+//
+// See also FakeClock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer creates a new Timer which sends the time to its channel
+	// after duration `d`. See also time.NewTimer.
+	NewTimer(d time.Duration) Timer
+
+	// NewTicker creates a new Ticker which sends the time to its channel
+	// each period `d`. See also time.NewTicker.
+	NewTicker(d time.Duration) Ticker
+
+	// After waits for duration `d` to elapse and then sends the time
+	// to the returned channel. See also time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is a timer created by Clock.NewTimer (see time.Timer).
+type Timer interface {
+	// C returns the channel the time is sent to when the timer fires.
+	C() <-chan time.Time
+
+	// Stop prevents the Timer from firing. It returns false if the timer
+	// has already fired or been stopped.
+	Stop() bool
+
+	// Reset changes the timer to fire after duration `d`. It returns
+	// true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a ticker created by Clock.NewTicker (see time.Ticker).
+type Ticker interface {
+	// C returns the channel the ticks are sent to.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// systemClock is the default Clock, it is based on package "time".
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return timeNow()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (timer systemTimer) C() <-chan time.Time {
+	return timer.Timer.C
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (ticker systemTicker) C() <-chan time.Time {
+	return ticker.Ticker.C
+}
@@ -0,0 +1,84 @@
+package secureio
+
+import (
+	"time"
+)
+
+// deadline is a deadline of I/O operations as in
+// net.Conn.SetDeadline. It is measured using a Clock.
+type deadline struct {
+	locker       lockerMutex
+	clock        Clock
+	timer        Timer
+	stopChan     chan struct{}
+	exceededChan chan struct{}
+}
+
+func newDeadline(clock Clock) *deadline {
+	return &deadline{
+		clock:        clock,
+		exceededChan: make(chan struct{}),
+	}
+}
+
+// Set sets the new deadline. A zero value means no deadline.
+func (d *deadline) Set(t time.Time) {
+	d.locker.LockDo(func() {
+		if d.stopChan != nil {
+			d.timer.Stop()
+			close(d.stopChan)
+			d.stopChan = nil
+		}
+
+		select {
+		case <-d.exceededChan:
+			d.exceededChan = make(chan struct{})
+		default:
+		}
+
+		if t.IsZero() {
+			return
+		}
+
+		duration := t.Sub(d.clock.Now())
+		if duration <= 0 {
+			close(d.exceededChan)
+			return
+		}
+
+		timer := d.clock.NewTimer(duration)
+		stopChan := make(chan struct{})
+		exceededChan := d.exceededChan
+		d.timer = timer
+		d.stopChan = stopChan
+		go func() {
+			select {
+			case <-stopChan:
+				return
+			case <-timer.C():
+			}
+			d.locker.LockDo(func() {
+				if d.stopChan != stopChan {
+					// The deadline was changed concurrently.
+					return
+				}
+				d.stopChan = nil
+				close(exceededChan)
+			})
+		}()
+	})
+}
+
+// Exceeded returns a channel which is closed when the deadline
+// is exceeded. The channel should be re-requested after each Set.
+//
+// A nil deadline is never exceeded.
+func (d *deadline) Exceeded() (result <-chan struct{}) {
+	if d == nil {
+		return nil
+	}
+	d.locker.LockDo(func() {
+		result = d.exceededChan
+	})
+	return
+}
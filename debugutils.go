@@ -1,6 +1,8 @@
 package secureio
 
 import (
+	"fmt"
+
 	"github.com/mohae/deepcopy"
 )
 
@@ -20,3 +22,27 @@ func copyForDebugItem(item interface{}) interface{} {
 		return deepcopy.Copy(item)
 	}
 }
+
+// secretForDebug is a key to be passed to the debug output. Only
+// a fingerprint of the key is copied to the debug output, so the key
+// itself never leaks to the logs.
+type secretForDebug []byte
+
+func (secret secretForDebug) duplicate() interface{} {
+	if secret == nil {
+		return `<nil>`
+	}
+	fingerprint := hash(secret, Salt, []byte("debugFingerprint"))
+	return fmt.Sprintf(`<secret:%x>`, fingerprint[:4])
+}
+
+// secretsForDebug is the same as secretForDebug, but for a set of keys.
+type secretsForDebug [][]byte
+
+func (secrets secretsForDebug) duplicate() interface{} {
+	result := make([]interface{}, 0, len(secrets))
+	for _, secret := range secrets {
+		result = append(result, secretForDebug(secret).duplicate())
+	}
+	return result
+}
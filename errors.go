@@ -1,8 +1,12 @@
 package secureio
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"io"
+	"net"
+	"os"
+	"time"
 
 	"golang.org/x/crypto/poly1305"
 
@@ -115,6 +119,21 @@ func (err ErrCannotLoadKeys) Error() string {
 	return "cannot load keys"
 }
 
+// ErrCannotLockMemory is an error indicates if it was unable to lock
+// the memory of the keys (see KeyExchangerOptions.LockKeysInMemory).
+type ErrCannotLockMemory struct {
+	OriginalError error
+}
+
+func newErrCannotLockMemory(origErr error) error {
+	err := errors.New(ErrCannotLockMemory{OriginalError: origErr})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrCannotLockMemory) Error() string {
+	return fmt.Sprintf("cannot lock the memory of the keys: %v", err.OriginalError)
+}
+
 // ErrAlreadyClosed is an error indicates there was an attempt
 // to use a resource which is already marked as closed.
 // For example, it could mean a try to use a closed session or connection.
@@ -129,6 +148,12 @@ func (err ErrAlreadyClosed) Error() string {
 	return "already closed"
 }
 
+// Is returns true if `target` is net.ErrClosed, so the closure could be
+// detected the same way as with the connections of the standard library.
+func (err ErrAlreadyClosed) Is(target error) bool {
+	return target == net.ErrClosed
+}
+
 // ErrKeyExchangeTimeout is an error indicates that there was no
 // successful key exchange too long. So this session does not work properly
 // or/and cannot be trusted and therefore considered erroneous.
@@ -143,6 +168,37 @@ func (err ErrKeyExchangeTimeout) Error() string {
 	return "key exchange timeout"
 }
 
+// ErrDeadlineExceeded is an error returned by Read and Write methods
+// of a Session if a deadline set by SetDeadline, SetReadDeadline or
+// SetWriteDeadline is exceeded. It implements net.Error and
+// matches os.ErrDeadlineExceeded in errors.Is.
+type ErrDeadlineExceeded struct{}
+
+// newErrDeadlineExceeded returns the error itself (not wrapped) because
+// callers of net.Conn usually check the timeouts via type assertion
+// to net.Error.
+func newErrDeadlineExceeded() error {
+	return ErrDeadlineExceeded{}
+}
+func (err ErrDeadlineExceeded) Error() string {
+	return "i/o timeout"
+}
+
+// Timeout implements net.Error.
+func (err ErrDeadlineExceeded) Timeout() bool {
+	return true
+}
+
+// Temporary implements net.Error.
+func (err ErrDeadlineExceeded) Temporary() bool {
+	return true
+}
+
+// Is returns true if `target` is os.ErrDeadlineExceeded.
+func (err ErrDeadlineExceeded) Is(target error) bool {
+	return target == os.ErrDeadlineExceeded
+}
+
 // ErrTooShort is an error used when it was unable to parse something
 // because the data (in the binary representation) is too short.
 // For example if there was received only one byte while it
@@ -217,6 +273,24 @@ func (err ErrPayloadTooBig) Error() string {
 	return fmt.Sprintf("the payload is too big (%v > %v)", err.RealSize, err.MaxSize)
 }
 
+// ErrFrameTooBig means the length prefix of a packet received through
+// a byte stream exceeds the packet size limit
+// (see SessionOptions.StreamFraming). The stream cannot be parsed
+// anymore, so the session is closed.
+type ErrFrameTooBig struct {
+	MaxSize  uint
+	RealSize uint
+}
+
+func newErrFrameTooBig(maxSize, realSize uint) error {
+	err := errors.New(ErrFrameTooBig{maxSize, realSize})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrFrameTooBig) Error() string {
+	return fmt.Sprintf("the frame is too big (%v > %v)", err.RealSize, err.MaxSize)
+}
+
 // errMonopolized is an error means that there was an attempt to lock a buffer
 // which is already locked by an exclusive locking. This cases are
 // handled just by retries.
@@ -307,6 +381,435 @@ func (err ErrCannotPauseOrUnpauseFromThisState) Error() string {
 	return fmt.Sprintf("cannot pause/unpause from this state")
 }
 
+// ErrCannotReplaceBackendFromThisState is returned by ReplaceBackend()
+// if the session is not in a required state.
+//
+// To replace the backend the session must be in state
+// SessionStateEstablished or SessionStatePaused.
+type ErrCannotReplaceBackendFromThisState struct {
+	State SessionState
+}
+
+func newErrCannotReplaceBackendFromThisState(state SessionState) error {
+	err := errors.New(ErrCannotReplaceBackendFromThisState{State: state})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrCannotReplaceBackendFromThisState) Error() string {
+	return fmt.Sprintf("cannot replace the backend from state %v", err.State)
+}
+
+// ErrUnsupportedKeyFormat is an error indicates if a key file (or a key
+// line) is in a format which is not supported (or is recognized,
+// but cannot be used; for example a passphrase-protected OpenSSH key).
+//
+// Format is the description of the format which was found.
+type ErrUnsupportedKeyFormat struct {
+	Format string
+}
+
+func newErrUnsupportedKeyFormat(format string) error {
+	err := errors.New(ErrUnsupportedKeyFormat{Format: format})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrUnsupportedKeyFormat) Error() string {
+	return fmt.Sprintf("unsupported key format: %s", err.Format)
+}
+
+// ErrPassphraseRequired is an error indicates if a private key file
+// is passphrase-protected, but no passphrase was provided
+// (see `NewIdentityWithPassphrase`).
+type ErrPassphraseRequired struct{}
+
+func newErrPassphraseRequired() error {
+	err := errors.New(ErrPassphraseRequired{})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrPassphraseRequired) Error() string {
+	return "the private key is passphrase-protected, but no passphrase provided"
+}
+
+// ErrWrongPassphrase is an error indicates if a private key file
+// cannot be decrypted using the provided passphrase.
+type ErrWrongPassphrase struct{}
+
+func newErrWrongPassphrase() error {
+	err := errors.New(ErrWrongPassphrase{})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrWrongPassphrase) Error() string {
+	return "wrong passphrase (or the key file is corrupted)"
+}
+
+// ErrUntrustedRemoteIdentity is an error indicates if the remote side
+// has introduced an identity which is not trusted by the TrustStore
+// of the session. The message from the remote side is ignored.
+type ErrUntrustedRemoteIdentity struct {
+	PublicKey [PublicKeySize]byte
+}
+
+func newErrUntrustedRemoteIdentity(pubKey ed25519.PublicKey) error {
+	errValue := ErrUntrustedRemoteIdentity{}
+	copy(errValue.PublicKey[:], pubKey)
+	err := errors.New(errValue)
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrUntrustedRemoteIdentity) Error() string {
+	return fmt.Sprintf("untrusted remote identity: %X", err.PublicKey[:])
+}
+
+// ErrInvalidCertificate is an error indicates if a certificate
+// is malformed or is not signed properly.
+type ErrInvalidCertificate struct {
+	Reason string
+}
+
+func newErrInvalidCertificate(reason string) error {
+	err := errors.New(ErrInvalidCertificate{Reason: reason})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrInvalidCertificate) Error() string {
+	return fmt.Sprintf("invalid certificate: %s", err.Reason)
+}
+
+// ErrCertificateExpired is an error indicates if a certificate
+// is already expired.
+type ErrCertificateExpired struct {
+	ValidBefore time.Time
+}
+
+func newErrCertificateExpired(validBefore time.Time) error {
+	err := errors.New(ErrCertificateExpired{ValidBefore: validBefore})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrCertificateExpired) Error() string {
+	return fmt.Sprintf("the certificate has expired at %v", err.ValidBefore)
+}
+
+// ErrCertificateNotYetValid is an error indicates if the validity window
+// of a certificate has not started yet.
+type ErrCertificateNotYetValid struct {
+	ValidAfter time.Time
+}
+
+func newErrCertificateNotYetValid(validAfter time.Time) error {
+	err := errors.New(ErrCertificateNotYetValid{ValidAfter: validAfter})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrCertificateNotYetValid) Error() string {
+	return fmt.Sprintf("the certificate is not valid until %v", err.ValidAfter)
+}
+
+// ErrUnknownCertificateAuthority is an error indicates if a certificate
+// is signed by a certificate authority which is not trusted.
+type ErrUnknownCertificateAuthority struct {
+	PublicKey [PublicKeySize]byte
+}
+
+func newErrUnknownCertificateAuthority(pubKey ed25519.PublicKey) error {
+	errValue := ErrUnknownCertificateAuthority{}
+	copy(errValue.PublicKey[:], pubKey)
+	err := errors.New(errValue)
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrUnknownCertificateAuthority) Error() string {
+	return fmt.Sprintf("unknown certificate authority: %X", err.PublicKey[:])
+}
+
+// ErrPeerKeyChanged is an error indicates if the remote side has
+// introduced a key which differs from the key recorded in KnownPeers
+// for the same peer name. It could mean a man-in-the-middle attack (or
+// just that the remote side has regenerated its keys).
+type ErrPeerKeyChanged struct {
+	PeerName string
+	KnownKey [PublicKeySize]byte
+	NewKey   [PublicKeySize]byte
+}
+
+func newErrPeerKeyChanged(peerName string, knownKey, newKey ed25519.PublicKey) error {
+	errValue := ErrPeerKeyChanged{PeerName: peerName}
+	copy(errValue.KnownKey[:], knownKey)
+	copy(errValue.NewKey[:], newKey)
+	err := errors.New(errValue)
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrPeerKeyChanged) Error() string {
+	return fmt.Sprintf("the key of peer '%s' has changed: known:%X != received:%X",
+		err.PeerName, err.KnownKey[:], err.NewKey[:])
+}
+
+// ErrInvalidPeerName is an error indicates if a peer name cannot
+// be used as a key of KnownPeers (for example if it is empty or
+// contains whitespaces).
+type ErrInvalidPeerName struct {
+	PeerName string
+}
+
+func newErrInvalidPeerName(peerName string) error {
+	err := errors.New(ErrInvalidPeerName{PeerName: peerName})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrInvalidPeerName) Error() string {
+	return fmt.Sprintf("invalid peer name: '%s'", err.PeerName)
+}
+
+// ErrKeyExchangeNotCompleted is an error indicates if there was an
+// attempt to use a result of the key exchange before the first
+// successful key exchange.
+type ErrKeyExchangeNotCompleted struct{}
+
+func newErrKeyExchangeNotCompleted() error {
+	err := errors.New(ErrKeyExchangeNotCompleted{})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrKeyExchangeNotCompleted) Error() string {
+	return "the key exchange is not completed, yet"
+}
+
+// ErrHybridKeyExchangeUnsupported is an error indicates if the hybrid
+// key exchange is enabled (see KeyExchangerOptions.EnableHybridKeyExchange),
+// but it cannot be performed. For example if the remote side does not
+// support it.
+type ErrHybridKeyExchangeUnsupported struct {
+	Reason string
+}
+
+func newErrHybridKeyExchangeUnsupported(reason string) error {
+	err := errors.New(ErrHybridKeyExchangeUnsupported{Reason: reason})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrHybridKeyExchangeUnsupported) Error() string {
+	return fmt.Sprintf("[kx] the hybrid key exchange is not supported: %s", err.Reason)
+}
+
+// ErrNoCommonCipherSuite is an error indicates if the local side and
+// the remote side have no cipher suites supported by both of them
+// (see KeyExchangerOptions.CipherSuites).
+type ErrNoCommonCipherSuite struct {
+	LocalCipherSuites  string
+	RemoteCipherSuites string
+}
+
+func newErrNoCommonCipherSuite(localCipherSuites, remoteCipherSuites []CipherSuite) error {
+	err := errors.New(ErrNoCommonCipherSuite{
+		LocalCipherSuites:  fmt.Sprint(localCipherSuites),
+		RemoteCipherSuites: fmt.Sprint(remoteCipherSuites),
+	})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrNoCommonCipherSuite) Error() string {
+	return fmt.Sprintf("[kx] no common cipher suites: local %s, remote %s",
+		err.LocalCipherSuites, err.RemoteCipherSuites)
+}
+
+// ErrProtocolVersionMismatch is an error indicates if the ranges of
+// the protocol versions supported by the local side and the remote side
+// do not intersect (see KeyExchangerOptions.MinProtocolVersion).
+type ErrProtocolVersionMismatch struct {
+	LocalMinVersion  ProtocolVersion
+	LocalMaxVersion  ProtocolVersion
+	RemoteMinVersion ProtocolVersion
+	RemoteMaxVersion ProtocolVersion
+}
+
+func newErrProtocolVersionMismatch(localMin, localMax, remoteMin, remoteMax ProtocolVersion) error {
+	err := errors.New(ErrProtocolVersionMismatch{
+		LocalMinVersion:  localMin,
+		LocalMaxVersion:  localMax,
+		RemoteMinVersion: remoteMin,
+		RemoteMaxVersion: remoteMax,
+	})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrProtocolVersionMismatch) Error() string {
+	return fmt.Sprintf("[kx] incompatible protocol versions: local supports %v-%v, remote supports %v-%v",
+		err.LocalMinVersion, err.LocalMaxVersion, err.RemoteMinVersion, err.RemoteMaxVersion)
+}
+
+// ErrInvalidTimestamp is an error indicates if the timestamp of
+// a key exchange message differs from the local time more than
+// KeyExchangerOptions.MaximalTimeDifference. The message is ignored.
+type ErrInvalidTimestamp struct {
+	RemoteTime            time.Time
+	LocalTime             time.Time
+	MaximalTimeDifference time.Duration
+}
+
+func newErrInvalidTimestamp(remoteTime, localTime time.Time, maxDiff time.Duration) error {
+	err := errors.New(ErrInvalidTimestamp{
+		RemoteTime:            remoteTime,
+		LocalTime:             localTime,
+		MaximalTimeDifference: maxDiff,
+	})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrInvalidTimestamp) Error() string {
+	return fmt.Sprintf("[kx] the timestamp of the message %v differs from the local time %v more than %v",
+		err.RemoteTime, err.LocalTime, err.MaximalTimeDifference)
+}
+
+// ErrInvalidKeyCreatedAt is an error indicates if a key exchange message
+// has a key creation counter lower than the already received one (or
+// the same counter with another key). It could be a replay of an old
+// message. The message is ignored.
+type ErrInvalidKeyCreatedAt struct {
+	KeyCreatedAt     uint64
+	LastKeyCreatedAt uint64
+}
+
+func newErrInvalidKeyCreatedAt(keyCreatedAt, lastKeyCreatedAt uint64) error {
+	err := errors.New(ErrInvalidKeyCreatedAt{
+		KeyCreatedAt:     keyCreatedAt,
+		LastKeyCreatedAt: lastKeyCreatedAt,
+	})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrInvalidKeyCreatedAt) Error() string {
+	return fmt.Sprintf("[kx] the key creation counter has not increased: %d (the last one is %d)",
+		err.KeyCreatedAt, err.LastKeyCreatedAt)
+}
+
+// ErrReflectedMessage is an error indicates if a key exchange message
+// has the SessionID of the local session, so it is a local message sent
+// back to the local side. The message is ignored.
+type ErrReflectedMessage struct{}
+
+func newErrReflectedMessage() error {
+	err := errors.New(ErrReflectedMessage{})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrReflectedMessage) Error() string {
+	return "[kx] received a key exchange message of the local session"
+}
+
+// ErrOldRemoteSessionID is an error indicates if a key exchange message
+// was sent by a remote session which is not newer than the already known
+// one. It could be a replay of a message of a previous session. The message
+// is ignored.
+type ErrOldRemoteSessionID struct {
+	SessionID        SessionID
+	CurrentSessionID SessionID
+}
+
+func newErrOldRemoteSessionID(sessionID, currentSessionID SessionID) error {
+	err := errors.New(ErrOldRemoteSessionID{
+		SessionID:        sessionID,
+		CurrentSessionID: currentSessionID,
+	})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrOldRemoteSessionID) Error() string {
+	return fmt.Sprintf("[kx] the remote session %v is older than the current one %v",
+		err.SessionID, err.CurrentSessionID)
+}
+
+// ErrInvalidResumptionTicket is an error indicates if a resumption ticket
+// presented by the remote side cannot be accepted (see ResumptionTicket).
+// The session is established without the resumption.
+type ErrInvalidResumptionTicket struct {
+	Reason string
+}
+
+func newErrInvalidResumptionTicket(reason string) error {
+	err := errors.New(ErrInvalidResumptionTicket{Reason: reason})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrInvalidResumptionTicket) Error() string {
+	return fmt.Sprintf("[kx] invalid resumption ticket: %s", err.Reason)
+}
+
+// ErrUnknownPSK is an error indicates if the remote side uses a PSK
+// which is not in KeyExchangerOptions.PSKs.
+type ErrUnknownPSK struct {
+	ID string
+}
+
+func newErrUnknownPSK(id string) error {
+	err := errors.New(ErrUnknownPSK{ID: id})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrUnknownPSK) Error() string {
+	return fmt.Sprintf("[kx] the remote side uses an unknown PSK: '%s'", err.ID)
+}
+
+// ErrPSKRequired is an error indicates if a session created by
+// NewPSKSession has no PSK (see KeyExchangerOptions.PSKs).
+type ErrPSKRequired struct{}
+
+func newErrPSKRequired() error {
+	err := errors.New(ErrPSKRequired{})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrPSKRequired) Error() string {
+	return "a PSK is required for a session without an identity"
+}
+
+// ErrKeyingMaterialTooLong is an error indicates if the requested length
+// of the exported keying material is more than the KDF could produce
+// (see `(*Session).ExportKeyingMaterial`).
+type ErrKeyingMaterialTooLong struct {
+	Length    uint
+	MaxLength uint
+}
+
+func newErrKeyingMaterialTooLong(length, maxLength uint) error {
+	err := errors.New(ErrKeyingMaterialTooLong{Length: length, MaxLength: maxLength})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrKeyingMaterialTooLong) Error() string {
+	return fmt.Sprintf("requested keying material is too long: %d > %d", err.Length, err.MaxLength)
+}
+
+// ErrUnknownPath is an error indicates if there is no path with
+// the requested ID in a Multipath.
+type ErrUnknownPath struct {
+	PathID PathID
+}
+
+func newErrUnknownPath(pathID PathID) error {
+	err := errors.New(ErrUnknownPath{PathID: pathID})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrUnknownPath) Error() string {
+	return fmt.Sprintf("unknown path: %d", err.PathID)
+}
+
+// ErrNoPaths is an error indicates if a packet is written to a Multipath
+// which has no paths.
+type ErrNoPaths struct{}
+
+func newErrNoPaths() error {
+	err := errors.New(ErrNoPaths{})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err ErrNoPaths) Error() string {
+	return "there are no paths to write to"
+}
+
 type errLocalPrivateKeyIsNil struct{}
 
 func newErrLocalPrivateKeyIsNil() *errors.Error {
@@ -329,6 +832,17 @@ func (err errRemotePublicKeyIsNil) Error() string {
 	return fmt.Sprintf("[curve25519] remote public key is nil")
 }
 
+type errKEMSharedKeyIsNil struct{}
+
+func newErrKEMSharedKeyIsNil() *errors.Error {
+	err := errors.New(errKEMSharedKeyIsNil{})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err errKEMSharedKeyIsNil) Error() string {
+	return fmt.Sprintf("[kx] ML-KEM shared key is not known, yet")
+}
+
 type errRemoteKeyHasNotChanged struct{}
 
 func newErrRemoteKeyHasNotChanged() error {
@@ -421,3 +935,16 @@ func (err errOutOfRange) Error() string {
 	return fmt.Sprintf("requested a position out of range: %d > %d",
 		err.RequestedPos, err.RangeLength)
 }
+
+type errDuplicateExtension struct {
+	Type uint8
+}
+
+func newErrDuplicateExtension(extType uint8) error {
+	err := errors.New(errDuplicateExtension{Type: extType})
+	err.Traceback.CutOffFirstNLines += 2
+	return err
+}
+func (err errDuplicateExtension) Error() string {
+	return fmt.Sprintf("duplicate extension of type %d", err.Type)
+}
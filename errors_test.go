@@ -3,8 +3,11 @@ package secureio
 import (
 	"errors"
 	"fmt"
+	"net"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -20,26 +23,55 @@ func TestErrTypes(t *testing.T) {
 		newErrInvalidSignature(),
 		newErrWrongKeyLength(0, 0),
 		newErrCannotLoadKeys(errors.New("unit-test")),
+		newErrCannotLockMemory(errors.New("unit-test")),
 		newErrAlreadyClosed(),
 		newErrKeyExchangeTimeout(),
 		newErrTooShort(0, 0),
 		newErrUnencrypted(),
 		newErrInvalidChecksum(nil, nil),
 		newErrPayloadTooBig(0, 0),
+		newErrFrameTooBig(0, 0),
 		newErrMonopolized(),
 		newErrNotMonopolized(),
 		newErrCanceled(),
 		newErrAnswersModeMismatch(0, 0),
 		newErrCannotSetReadDeadline(nil),
 		newErrCannotPauseOrUnpauseFromThisState(),
+		newErrCannotReplaceBackendFromThisState(SessionStateNew),
+		newErrUnsupportedKeyFormat("unit-test"),
+		newErrUntrustedRemoteIdentity(nil),
+		newErrPassphraseRequired(),
+		newErrWrongPassphrase(),
+		newErrInvalidCertificate("unit-test"),
+		newErrCertificateExpired(time.Time{}),
+		newErrCertificateNotYetValid(time.Time{}),
+		newErrUnknownCertificateAuthority(nil),
+		newErrPeerKeyChanged("unit-test", nil, nil),
+		newErrInvalidPeerName("unit-test"),
+		newErrKeyExchangeNotCompleted(),
 		newErrLocalPrivateKeyIsNil(),
 		newErrRemotePublicKeyIsNil(),
+		newErrKEMSharedKeyIsNil(),
+		newErrHybridKeyExchangeUnsupported("unit-test"),
+		newErrNoCommonCipherSuite(nil, nil),
+		newErrInvalidTimestamp(time.Time{}, time.Time{}, 0),
+		newErrInvalidKeyCreatedAt(0, 1),
+		newErrOldRemoteSessionID(SessionID{}, SessionID{}),
+		newErrReflectedMessage(),
+		newErrInvalidResumptionTicket("unit-test"),
+		newErrUnknownPSK("unit-test"),
+		newErrPSKRequired(),
+		newErrKeyingMaterialTooLong(2, 1),
+		newErrUnknownPath(1),
+		newErrNoPaths(),
+		newErrProtocolVersionMismatch(ProtocolVersionCurrent, ProtocolVersionCurrent, ProtocolVersionLegacy, ProtocolVersionLegacy),
 		newErrRemoteKeyHasNotChanged(),
 		newErrInvalidPublicKey(),
 		newErrNegotiationTimeout("unit-test"),
 		newErrNegotiationCancelled("unit-test"),
 		newErrAlreadyStarted(),
 		newErrUnknownSubType(-1),
+		newErrDuplicateExtension(0),
 	} {
 		_ = err.Error() // check if there's no panic
 
@@ -54,4 +86,9 @@ func TestErrTypes(t *testing.T) {
 	}
 
 	assert.Nil(t, newErrCannotLoadKeys(nil))
+
+	// ErrDeadlineExceeded is not wrapped, see newErrDeadlineExceeded.
+	netErr, ok := newErrDeadlineExceeded().(net.Error)
+	assert.True(t, ok && netErr.Timeout())
+	assert.True(t, errors.Is(newErrDeadlineExceeded(), os.ErrDeadlineExceeded))
 }
@@ -0,0 +1,182 @@
+package secureio
+
+import (
+	"context"
+	"time"
+)
+
+// FakeClock is a Clock which time moves only when method Advance is
+// called. It is supposed to be used in tests to check timeouts
+// deterministically (without waiting for them in real time).
+type FakeClock struct {
+	locker      lockerMutex
+	now         time.Time
+	waiters     []*fakeClockWaiter
+	changedChan chan struct{}
+}
+
+type fakeClockWaiter struct {
+	clock    *FakeClock
+	deadline time.Time
+	period   time.Duration
+	ch       chan time.Time
+}
+
+// NewFakeClock returns a new instance of FakeClock which shows
+// time `now` until Advance is called.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:         now,
+		changedChan: make(chan struct{}),
+	}
+}
+
+// Now implements Clock.
+func (clock *FakeClock) Now() (result time.Time) {
+	clock.locker.LockDo(func() {
+		result = clock.now
+	})
+	return
+}
+
+// NewTimer implements Clock.
+func (clock *FakeClock) NewTimer(d time.Duration) Timer {
+	waiter := &fakeClockWaiter{
+		clock: clock,
+		ch:    make(chan time.Time, 1),
+	}
+	waiter.Reset(d)
+	return waiter
+}
+
+// NewTicker implements Clock.
+func (clock *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic(`non-positive interval for FakeClock.NewTicker`)
+	}
+	waiter := &fakeClockWaiter{
+		clock:  clock,
+		period: d,
+		ch:     make(chan time.Time, 1),
+	}
+	waiter.Reset(d)
+	return fakeClockTicker{waiter}
+}
+
+// After implements Clock.
+func (clock *FakeClock) After(d time.Duration) <-chan time.Time {
+	return clock.NewTimer(d).C()
+}
+
+// Advance moves the time of the clock forward by `d` and fires
+// the timers and tickers which are expired by then.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.locker.LockDo(func() {
+		clock.now = clock.now.Add(d)
+		waiters := clock.waiters[:0]
+		for _, waiter := range clock.waiters {
+			if waiter.deadline.After(clock.now) {
+				waiters = append(waiters, waiter)
+				continue
+			}
+			select {
+			case waiter.ch <- clock.now:
+			default:
+			}
+			if waiter.period == 0 {
+				continue
+			}
+			// As time.Ticker, drop the ticks if the receiver is too slow
+			for !waiter.deadline.After(clock.now) {
+				waiter.deadline = waiter.deadline.Add(waiter.period)
+			}
+			waiters = append(waiters, waiter)
+		}
+		for idx := len(waiters); idx < len(clock.waiters); idx++ {
+			clock.waiters[idx] = nil
+		}
+		clock.waiters = waiters
+	})
+}
+
+// WaitForWaiters blocks until there are at least `count` active timers
+// and tickers (including the channels returned by After), or until `ctx`
+// is done. It is useful to be sure that the code under test is already
+// waiting before calling Advance.
+func (clock *FakeClock) WaitForWaiters(ctx context.Context, count int) error {
+	for {
+		var changedChan chan struct{}
+		var isEnough bool
+		clock.locker.LockDo(func() {
+			isEnough = len(clock.waiters) >= count
+			changedChan = clock.changedChan
+		})
+		if isEnough {
+			return nil
+		}
+		select {
+		case <-changedChan:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (clock *FakeClock) addWaiter(waiter *fakeClockWaiter) {
+	clock.waiters = append(clock.waiters, waiter)
+	close(clock.changedChan)
+	clock.changedChan = make(chan struct{})
+}
+
+func (clock *FakeClock) removeWaiter(waiter *fakeClockWaiter) (isFound bool) {
+	for idx, item := range clock.waiters {
+		if item != waiter {
+			continue
+		}
+		copy(clock.waiters[idx:], clock.waiters[idx+1:])
+		clock.waiters[len(clock.waiters)-1] = nil
+		clock.waiters = clock.waiters[:len(clock.waiters)-1]
+		return true
+	}
+	return false
+}
+
+type fakeClockTicker struct {
+	*fakeClockWaiter
+}
+
+// Stop implements Ticker.
+func (ticker fakeClockTicker) Stop() {
+	ticker.fakeClockWaiter.Stop()
+}
+
+// C implements Timer and Ticker.
+func (waiter *fakeClockWaiter) C() <-chan time.Time {
+	return waiter.ch
+}
+
+// Stop implements Timer.
+func (waiter *fakeClockWaiter) Stop() (isActive bool) {
+	waiter.clock.locker.LockDo(func() {
+		isActive = waiter.clock.removeWaiter(waiter)
+	})
+	return
+}
+
+// Reset implements Timer.
+func (waiter *fakeClockWaiter) Reset(d time.Duration) (isActive bool) {
+	clock := waiter.clock
+	clock.locker.LockDo(func() {
+		isActive = clock.removeWaiter(waiter)
+		waiter.deadline = clock.now.Add(d)
+		if d <= 0 && waiter.period == 0 {
+			select {
+			case waiter.ch <- clock.now:
+			default:
+			}
+			return
+		}
+		clock.addWaiter(waiter)
+	})
+	return
+}
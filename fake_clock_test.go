@@ -0,0 +1,106 @@
+package secureio_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	xerrors "github.com/xaionaro-go/errors"
+
+	. "github.com/xaionaro-go/secureio"
+)
+
+func TestFakeClock(t *testing.T) {
+	startTime := time.Unix(1500000000, 0)
+	clock := NewFakeClock(startTime)
+	assert.Equal(t, startTime, clock.Now())
+
+	timer := clock.NewTimer(time.Second)
+	ticker := clock.NewTicker(time.Minute)
+	afterChan := clock.After(time.Hour)
+	require.NoError(t, clock.WaitForWaiters(context.Background(), 3))
+
+	isFired := func(ch <-chan time.Time) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	clock.Advance(time.Second - 1)
+	assert.False(t, isFired(timer.C()))
+	clock.Advance(1)
+	assert.Equal(t, startTime.Add(time.Second), clock.Now())
+	assert.True(t, isFired(timer.C()))
+	assert.False(t, timer.Stop())
+
+	assert.False(t, timer.Reset(time.Second))
+	assert.True(t, timer.Stop())
+	clock.Advance(time.Second)
+	assert.False(t, isFired(timer.C()))
+
+	clock.Advance(time.Minute)
+	assert.True(t, isFired(ticker.C()))
+	clock.Advance(time.Minute)
+	assert.True(t, isFired(ticker.C()))
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	assert.False(t, isFired(ticker.C()))
+
+	assert.False(t, isFired(afterChan))
+	clock.Advance(time.Hour)
+	assert.True(t, isFired(afterChan))
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelFunc()
+	assert.Error(t, clock.WaitForWaiters(ctx, 1))
+}
+
+func TestSession_fakeClock(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, _ := testPair(t)
+
+	clock := NewFakeClock(time.Now())
+	randReader := bytes.NewReader(append([]byte{1, 2, 3, 4, 5, 6, 7, 8}, make([]byte, 1024)...))
+	timeoutChan := make(chan struct{})
+	sess := identity0.NewSession(identity1, conn0, wrapErrorHandler(&testLogger{t}, func(sess *Session, err error) bool {
+		if err.(*xerrors.Error).Has(ErrKeyExchangeTimeout{}) {
+			close(timeoutChan)
+		}
+		return false
+	}), &SessionOptions{
+		Clock:      clock,
+		RandReader: randReader,
+		KeyExchangerOptions: KeyExchangerOptions{
+			Timeout:       time.Hour,
+			RetryInterval: time.Hour,
+		},
+	})
+	assert.Equal(t, uint64(clock.Now().UnixNano()), sess.ID().CreatedAt)
+	assert.Equal(t, uint64(0x0807060504030201), sess.ID().Random)
+
+	// The remote side never answers, so the key exchange should time out
+	// as soon as the clock is advanced by KeyExchangerOptions.Timeout.
+	require.NoError(t, sess.Start(ctx))
+	require.NoError(t, clock.WaitForWaiters(ctx, 2)) // the retry ticker and the timeout timer
+	select {
+	case <-timeoutChan:
+		t.Fatal("the timeout happened before the clock was advanced")
+	default:
+	}
+	clock.Advance(time.Hour)
+
+	select {
+	case <-timeoutChan:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no timeout")
+	}
+	waitForClosure(t, sess)
+}
@@ -6,6 +6,9 @@ import (
 	"lukechampine.com/blake3"
 )
 
+// hashSize is the size of the result of function hash.
+const hashSize = 32
+
 // hash hashes the values using blake3 and sha3.
 // For each hashing it adds all the salts.
 func hash(input []byte, salts ...[]byte) []byte {
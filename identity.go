@@ -2,11 +2,12 @@ package secureio
 
 import (
 	"context"
+	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/pem"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -14,9 +15,9 @@ import (
 )
 
 const (
-	//authorizedKeysFileName = `authorized_keys`
-	privateFileName = `id_ed25519`
-	publicFileName  = `id_ed25519.pub`
+	authorizedKeysFileName = `authorized_keys`
+	privateFileName        = `id_ed25519`
+	publicFileName         = `id_ed25519.pub`
 )
 
 // Keys is a key pair used to generate signatures (to be verified on
@@ -42,6 +43,21 @@ type Keys struct {
 type Identity struct {
 	Keys Keys
 
+	// Certificate is an optional certificate of the identity.
+	//
+	// If it is set on a local identity then it is sent to the remote
+	// side on key exchanges. On a remote identity it is set if the remote
+	// side was verified using its certificate (see `CertificateVerifier`).
+	Certificate *Certificate
+
+	// Signer is an optional signer of a local identity. If it is set then
+	// it is used to sign instead of "Private" key, so the private key
+	// could be kept outside of the process memory (for example in
+	// an ssh-agent, see `SSHAgentSigner`).
+	//
+	// See `NewIdentityFromSigner`.
+	Signer crypto.Signer
+
 	cryptoRandReader io.Reader
 }
 
@@ -64,12 +80,32 @@ type Identity struct {
 // does not exist there and creates a new instance of `*Identity`.
 //
 // File names in the directory are `id_ed25519` and `id_ed25519.pub`.
+// The format of existing key files is detected automatically (see
+// `KeyFileFormat`), so keys generated by `ssh-keygen -t ed25519` could
+// be used. New keys are saved in format DefaultKeyFileFormat.
 //
 // The returned identity (if it is not `nil`) could be
 // used as both: local and remote (see `Identity`).
 func NewIdentity(keysDir string) (*Identity, error) {
 	i := &Identity{}
-	return i, i.prepareKeys(keysDir)
+	return i, i.prepareKeys(keysDir, nil)
+}
+
+// NewIdentityWithPassphrase is the same as NewIdentity, but the private
+// key file is protected by a passphrase returned by `passphraseFunc`:
+//
+// * If the private key file exists and it is passphrase-protected then
+// it's decrypted using the passphrase.
+// * If the private key file does not exist then new keys are
+// generated and the private key is saved in format
+// KeyFileFormatEncryptedPEM.
+//
+// `passphraseFunc` is called only if a passphrase is required. Existing
+// plaintext key files are loaded as is, use ChangeKeyFilePassphrase
+// to encrypt them.
+func NewIdentityWithPassphrase(keysDir string, passphraseFunc PassphraseFunc) (*Identity, error) {
+	i := &Identity{}
+	return i, i.prepareKeys(keysDir, passphraseFunc)
 }
 
 // NewIdentityFromPrivateKey is a constructor for `Identity` based
@@ -91,9 +127,33 @@ func NewIdentityFromPrivateKey(privKey ed25519.PrivateKey) (*Identity, error) {
 	return i, nil
 }
 
+// NewIdentityFromSigner is a constructor for `Identity` based
+// on an ED25519 crypto.Signer (see `Identity.Signer`).
+//
+// The returned identity could be used as both: local and remote
+// (see `Identity`).
+func NewIdentityFromSigner(signer crypto.Signer) (*Identity, error) {
+	pubKey, ok := signer.Public().(ed25519.PublicKey)
+	if !ok {
+		return nil, newErrUnsupportedKeyFormat(fmt.Sprintf(`signer with public key of type %T`, signer.Public()))
+	}
+	if len(pubKey) != PublicKeySize {
+		return nil, &ErrWrongKeyLength{
+			ExpectedLength: PublicKeySize,
+			RealLength:     uint(len(pubKey)),
+		}
+	}
+
+	i := &Identity{}
+	i.Keys.Public = pubKey
+	i.Signer = signer
+	return i, nil
+}
+
 // NewRemoteIdentity is a constructor for `Identity` based on the path
-// to the ED25519 public key. It parses the public key from the directory
-// `keysDir`. The file name is `id_ed25519.pub`.
+// to the ED25519 public key. It parses the public key from file `keyPath`
+// (for example `id_ed25519.pub`). The format of the file is detected
+// automatically (see `KeyFileFormat`).
 //
 // The returned identity (if it is not `nil`) could be
 // used only as a remote identity (see `Identity`).
@@ -124,29 +184,59 @@ func NewRemoteIdentityFromPublicKey(pubKey ed25519.PublicKey) (*Identity, error)
 	return i, nil
 }
 
-func (i *Identity) savePublicKey(keysDir string) error {
-	return saveKeyToPemFile(
-		"ED25519 PUBLIC KEY",
-		i.Keys.Public,
-		filepath.Join(keysDir, publicFileName),
-		nil,
-	)
+// SaveKeys saves the keys of the identity to directory `keysDir`
+// (files `id_ed25519` and `id_ed25519.pub`) using the format `format`.
+//
+// The private key is saved only if it is set (see `Identity`).
+func (i *Identity) SaveKeys(keysDir string, format KeyFileFormat) error {
+	return i.saveKeys(keysDir, format, nil)
+}
+
+// SaveKeysWithPassphrase is the same as SaveKeys, but the private key
+// is encrypted using `passphrase` (see KeyFileFormatEncryptedPEM).
+func (i *Identity) SaveKeysWithPassphrase(keysDir string, passphrase []byte) error {
+	return i.saveKeys(keysDir, KeyFileFormatEncryptedPEM, passphrase)
+}
+
+func (i *Identity) saveKeys(keysDir string, format KeyFileFormat, passphrase []byte) error {
+	if i.Keys.Private != nil {
+		if err := i.savePrivateKey(keysDir, format, passphrase); err != nil {
+			return xerrors.Errorf("unable to save the private key: %w", err)
+		}
+	}
+	if err := i.savePublicKey(keysDir, format); err != nil {
+		return xerrors.Errorf("unable to save the public key: %w", err)
+	}
+	return nil
+}
+
+func (i *Identity) savePublicKey(keysDir string, format KeyFileFormat) error {
+	b, err := marshalPublicKey(i.Keys.Public, format)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(filepath.Join(keysDir, publicFileName), b)
 }
 
-func (i *Identity) savePrivateKey(keysDir string) error {
+func (i *Identity) savePrivateKey(keysDir string, format KeyFileFormat, passphrase []byte) error {
+	block, err := marshalPrivateKey(i.Keys.Private, format, passphrase, i.getCryptoRandReader())
+	if err != nil {
+		return err
+	}
 	return saveKeyToPemFile(
-		"ED25519 PRIVATE KEY",
-		i.Keys.Private,
+		block.Type,
+		block.Bytes,
 		filepath.Join(keysDir, privateFileName),
-		nil,
+		block.Headers,
 	)
 }
 
 func saveKeyToPemFile(keyType string, key []byte, filePath string, headers map[string]string) error {
-	keyFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0600)
+	keyFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return xerrors.Errorf("unable to open file: %w", err)
 	}
+	defer func() { _ = keyFile.Close() }()
 
 	keyBlock := pem.Block{
 		Type:    keyType,
@@ -169,15 +259,26 @@ func (i *Identity) getCryptoRandReader() io.Reader {
 	return i.cryptoRandReader
 }
 
-func (i *Identity) generateAndSaveKeys(keysDir string) error {
+func (i *Identity) generateAndSaveKeys(keysDir string, passphraseFunc PassphraseFunc) error {
+	format := DefaultKeyFileFormat
+	var passphrase []byte
+	if passphraseFunc != nil {
+		format = KeyFileFormatEncryptedPEM
+		var err error
+		passphrase, err = passphraseFunc.get()
+		if err != nil {
+			return err
+		}
+	}
+
 	var err error
 	i.Keys.Public, i.Keys.Private, err = ed25519.GenerateKey(i.getCryptoRandReader())
 	if err != nil {
 		return xerrors.Errorf("cannot generate keys: %w", err)
 	}
-	err = i.savePrivateKey(keysDir)
+	err = i.savePrivateKey(keysDir, format, passphrase)
 	if err == nil {
-		err = i.savePublicKey(keysDir)
+		err = i.savePublicKey(keysDir, format)
 	}
 	if err != nil {
 		return xerrors.Errorf("cannot save keys: %w", err)
@@ -185,36 +286,8 @@ func (i *Identity) generateAndSaveKeys(keysDir string) error {
 	return nil
 }
 
-func loadPublicKeyFromFile(keyPtr *ed25519.PublicKey, path string) error {
-	keyBytes, err := ioutil.ReadFile(path) // #nosec
-	if err != nil {
-		return xerrors.Errorf("unable to read key from file '%s': %w", path, err)
-	}
-
-	block, _ := pem.Decode(keyBytes)
-	if len(block.Bytes) != ed25519.PublicKeySize {
-		return newErrWrongKeyLength(ed25519.PublicKeySize, uint(len(block.Bytes)))
-	}
-	*keyPtr = block.Bytes
-	return nil
-}
-
-func loadPrivateKeyFromFile(keyPtr *ed25519.PrivateKey, path string) error {
-	keyBytes, err := ioutil.ReadFile(path) // #nosec
-	if err != nil {
-		return xerrors.Errorf("unable to read file: %w", err)
-	}
-
-	block, _ := pem.Decode(keyBytes)
-	if len(block.Bytes) != ed25519.PrivateKeySize {
-		return newErrWrongKeyLength(ed25519.PrivateKeySize, uint(len(block.Bytes)))
-	}
-	*keyPtr = block.Bytes
-	return nil
-}
-
-func (i *Identity) loadKeys(keysDir string) error {
-	err := loadPrivateKeyFromFile(&i.Keys.Private, filepath.Join(keysDir, privateFileName))
+func (i *Identity) loadKeys(keysDir string, passphraseFunc PassphraseFunc) error {
+	err := loadPrivateKeyFromFile(&i.Keys.Private, filepath.Join(keysDir, privateFileName), passphraseFunc)
 	if err != nil {
 		return xerrors.Errorf("Cannot load the private key: %w", err)
 	}
@@ -222,18 +295,18 @@ func (i *Identity) loadKeys(keysDir string) error {
 	return nil
 }
 
-func (i *Identity) prepareKeys(keysDir string) error {
+func (i *Identity) prepareKeys(keysDir string, passphraseFunc PassphraseFunc) error {
 	err := os.MkdirAll(keysDir, os.FileMode(0700))
 	if err != nil {
 		return xerrors.Errorf(`cannot create the directory "%s": %w`, keysDir, err)
 	}
 	if _, err := os.Stat(filepath.Join(keysDir, privateFileName)); os.IsNotExist(err) {
-		return i.generateAndSaveKeys(keysDir)
+		return i.generateAndSaveKeys(keysDir, passphraseFunc)
 	}
-	err = i.loadKeys(keysDir)
+	err = i.loadKeys(keysDir, passphraseFunc)
 	if err == nil {
 		if _, checkErr := os.Stat(filepath.Join(keysDir, publicFileName)); os.IsNotExist(checkErr) {
-			err = i.savePublicKey(keysDir)
+			err = i.savePublicKey(keysDir, DefaultKeyFileFormat)
 		}
 	}
 	if err != nil {
@@ -259,7 +332,22 @@ func (i *Identity) NewSession(
 	eventHandler EventHandler,
 	opts *SessionOptions,
 ) *Session {
-	return newSession(i, remoteIdentity, backend, eventHandler, opts)
+	return newSession(i, remoteIdentity, nil, backend, eventHandler, opts)
+}
+
+// NewSessionWithTrustStore is the same as NewSession, but instead of
+// a single remote identity it accepts any remote identity trusted
+// by `trustStore` (for example a `RemoteIdentitySet`).
+//
+// Which identity was matched could be retrieved using
+// `(*Session).GetRemoteIdentity` after the session is established.
+func (i *Identity) NewSessionWithTrustStore(
+	trustStore TrustStore,
+	backend io.ReadWriteCloser,
+	eventHandler EventHandler,
+	opts *SessionOptions,
+) *Session {
+	return newSession(i, nil, trustStore, backend, eventHandler, opts)
 }
 
 // MutualConfirmationOfIdentity is a helper which creates a temporary
@@ -294,6 +382,7 @@ func (i *Identity) MutualConfirmationOfIdentity(
 	sess := newSession(
 		i,
 		remoteIdentity,
+		nil,
 		backend,
 		wrapErrorHandler(eventHandler, func(sess *Session, err error) bool {
 			if xerr, ok := err.(*xerrors.Error); ok {
@@ -339,13 +428,25 @@ func (i *Identity) MutualConfirmationOfIdentity(
 		return
 	}
 
-	ephemeralKeys = sess.GetEphemeralKeys()
+	// The keys of the session are destroyed on closing, so copy them
+	for _, key := range sess.GetEphemeralKeys() {
+		ephemeralKeys = append(ephemeralKeys, append([]byte(nil), key...))
+	}
 	if len(ephemeralKeys) != secretIDs {
 		returnError = newErrCanceled()
 	}
 	return
 }
 
+// publicKey returns the public key of the identity, or nil if there
+// is no identity (see NewPSKSession).
+func (i *Identity) publicKey() ed25519.PublicKey {
+	if i == nil {
+		return nil
+	}
+	return i.Keys.Public
+}
+
 // VerifySignature just verifies an ED25519 signature `signature` over `data`.
 func (i *Identity) VerifySignature(signature, data []byte) error {
 	if !ed25519.Verify(i.Keys.Public, data, signature) {
@@ -355,7 +456,24 @@ func (i *Identity) VerifySignature(signature, data []byte) error {
 }
 
 // Sign just fills `signature` with an ED25519 signature of `data`.
-func (i *Identity) Sign(signature, data []byte) {
-	result := ed25519.Sign(i.Keys.Private, data)
+//
+// If `Signer` is set then it is used to sign, otherwise "Private" key is used.
+func (i *Identity) Sign(signature, data []byte) error {
+	if i.Signer == nil {
+		if len(i.Keys.Private) != PrivateKeySize {
+			return newErrLocalPrivateKeyIsNil()
+		}
+		copy(signature, ed25519.Sign(i.Keys.Private, data))
+		return nil
+	}
+
+	result, err := i.Signer.Sign(i.getCryptoRandReader(), data, crypto.Hash(0))
+	if err != nil {
+		return xerrors.Errorf("unable to sign: %w", err)
+	}
+	if len(result) != keySignatureSize {
+		return newErrWrongKeyLength(keySignatureSize, uint(len(result)))
+	}
 	copy(signature, result)
+	return nil
 }
@@ -35,7 +35,7 @@ func TestIdentity_generateAndSaveKeys_negative(t *testing.T) {
 	identity := testIdentity(t)
 
 	// invalid dir
-	assert.Error(t, identity.generateAndSaveKeys(nonExistentDir))
+	assert.Error(t, identity.generateAndSaveKeys(nonExistentDir, nil))
 
 	// invalid reader
 	identity.cryptoRandReader = &bytes.Buffer{}
@@ -44,7 +44,7 @@ func TestIdentity_generateAndSaveKeys_negative(t *testing.T) {
 		return
 	}
 	defer os.RemoveAll(dir)
-	assert.Error(t, identity.generateAndSaveKeys(dir))
+	assert.Error(t, identity.generateAndSaveKeys(dir, nil))
 }
 
 func TestLoadPublicKeyFromFile_negative(t *testing.T) {
@@ -80,12 +80,12 @@ func TestLoadPrivateKeyFromFile_negative(t *testing.T) {
 
 func TestIdentity_loadKeys_negative(t *testing.T) {
 	// invalid path
-	assert.Error(t, (&Identity{}).loadKeys(nonExistentDir))
+	assert.Error(t, (&Identity{}).loadKeys(nonExistentDir, nil))
 }
 
 func TestIdentity_prepareKeys_negative(t *testing.T) {
 	// invalid path
-	assert.Error(t, (&Identity{}).prepareKeys(nonExistentDir))
+	assert.Error(t, (&Identity{}).prepareKeys(nonExistentDir, nil))
 }
 
 func TestIdentity_VerifySignature_negative(t *testing.T) {
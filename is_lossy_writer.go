@@ -7,10 +7,14 @@ import (
 
 // IsLossyWriter returns true if writer `w` is a known type of a writer
 // which can loose traffic (currently it only looks for UDP connections).
+//
+// A Multipath is lossy if any of its paths is lossy.
 func IsLossyWriter(w io.Writer) bool {
 	switch conn := w.(type) {
 	case *net.UDPConn:
 		return true
+	case *Multipath:
+		return conn.isLossy()
 	case interface{ LocalAddr() net.Addr }:
 		remoteAddr := conn.LocalAddr()
 		switch remoteAddr.(type) {
@@ -27,3 +31,32 @@ func IsLossyWriter(w io.Writer) bool {
 		return false
 	}
 }
+
+// IsStreamWriter returns true if writer `w` is considered a byte stream,
+// which may fragment or merge the written packets (like TCP connections
+// or pipes). It is so if `w` is not lossy (see IsLossyWriter) and is not
+// a known type of a datagram connection (currently it only looks for
+// "unixgram" and "unixpacket" sockets).
+//
+// A Multipath is never a byte stream: it frames its stream paths itself.
+func IsStreamWriter(w io.Writer) bool {
+	if _, ok := w.(*Multipath); ok {
+		return false
+	}
+	if IsLossyWriter(w) {
+		return false
+	}
+	conn, ok := w.(interface{ LocalAddr() net.Addr })
+	if !ok {
+		return true
+	}
+	unixAddr, ok := conn.LocalAddr().(*net.UnixAddr)
+	if !ok || unixAddr == nil {
+		return true
+	}
+	switch unixAddr.Net {
+	case "unixgram", "unixpacket":
+		return false
+	}
+	return true
+}
@@ -24,6 +24,23 @@ func (conn *udpConn) LocalAddr() net.Addr {
 	return &net.UDPAddr{}
 }
 
+type tcpConn struct {
+	net.Conn
+}
+
+func (conn *tcpConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+type unixConn struct {
+	net.Conn
+	net string
+}
+
+func (conn *unixConn) LocalAddr() net.Addr {
+	return &net.UnixAddr{Net: conn.net}
+}
+
 func TestIsLossyWriter(t *testing.T) {
 	t.Run("tcp", func(t *testing.T) {
 		require.False(t, IsLossyWriter(&net.TCPConn{}))
@@ -41,3 +58,24 @@ func TestIsLossyWriter(t *testing.T) {
 		require.False(t, IsLossyWriter(&bytes.Buffer{}))
 	})
 }
+
+func TestIsStreamWriter(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		require.True(t, IsStreamWriter(&tcpConn{}))
+	})
+	t.Run("udp", func(t *testing.T) {
+		require.False(t, IsStreamWriter(&udpConn{}))
+	})
+	t.Run("unixpacket", func(t *testing.T) {
+		require.False(t, IsStreamWriter(&unixConn{net: "unixpacket"}))
+	})
+	t.Run("unix", func(t *testing.T) {
+		require.True(t, IsStreamWriter(&unixConn{net: "unix"}))
+	})
+	t.Run("unknown_network_connection", func(t *testing.T) {
+		require.True(t, IsStreamWriter(&unknownConn{}))
+	})
+	t.Run("bytes.Buffer", func(t *testing.T) {
+		require.True(t, IsStreamWriter(&bytes.Buffer{}))
+	})
+}
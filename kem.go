@@ -0,0 +1,49 @@
+// +build go1.24
+
+package secureio
+
+import (
+	"crypto/mlkem"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+const (
+	kemEncapsulationKeySize = mlkem.EncapsulationKeySize768
+	kemCiphertextSize       = mlkem.CiphertextSize768
+)
+
+// kemKey is an ML-KEM-768 decapsulation key used by the hybrid
+// key exchange (see KeyExchangerOptions.EnableHybridKeyExchange).
+type kemKey struct {
+	decapsulationKey *mlkem.DecapsulationKey768
+}
+
+func newKEMKey() (*kemKey, error) {
+	decapsulationKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, xerrors.Errorf("unable to generate an ML-KEM key: %w", err)
+	}
+	return &kemKey{decapsulationKey: decapsulationKey}, nil
+}
+
+func (key *kemKey) EncapsulationKey() []byte {
+	return key.decapsulationKey.EncapsulationKey().Bytes()
+}
+
+func (key *kemKey) Decapsulate(ciphertext []byte) ([]byte, error) {
+	sharedKey, err := key.decapsulationKey.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to decapsulate an ML-KEM shared key: %w", err)
+	}
+	return sharedKey, nil
+}
+
+func kemEncapsulate(encapsulationKey []byte) (sharedKey, ciphertext []byte, err error) {
+	key, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("invalid ML-KEM encapsulation key: %w", err)
+	}
+	sharedKey, ciphertext = key.Encapsulate()
+	return
+}
@@ -0,0 +1,29 @@
+// +build !go1.24
+
+package secureio
+
+const (
+	kemEncapsulationKeySize = 1184
+	kemCiphertextSize       = 1088
+)
+
+// kemKey is a placeholder for an ML-KEM-768 key. ML-KEM is available
+// only since Go 1.24, so the hybrid key exchange is not supported
+// if the application is built by an older version of Go.
+type kemKey struct{}
+
+func newKEMKey() (*kemKey, error) {
+	return nil, newErrHybridKeyExchangeUnsupported(`ML-KEM requires Go 1.24 or newer`)
+}
+
+func (key *kemKey) EncapsulationKey() []byte {
+	return nil
+}
+
+func (key *kemKey) Decapsulate(ciphertext []byte) ([]byte, error) {
+	return nil, newErrHybridKeyExchangeUnsupported(`ML-KEM requires Go 1.24 or newer`)
+}
+
+func kemEncapsulate(encapsulationKey []byte) (sharedKey, ciphertext []byte, err error) {
+	return nil, nil, newErrHybridKeyExchangeUnsupported(`ML-KEM requires Go 1.24 or newer`)
+}
@@ -3,8 +3,10 @@ package secureio
 import (
 	"bytes"
 	"context"
+	"crypto/cipher"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -14,6 +16,7 @@ import (
 
 	"github.com/aead/ecdh"
 	"github.com/xaionaro-go/bytesextra"
+	"golang.org/x/crypto/chacha20poly1305"
 
 	xerrors "github.com/xaionaro-go/errors"
 )
@@ -87,7 +90,7 @@ type keyExchanger struct {
 
 	ctx            context.Context
 	cancelFunc     func()
-	setSecretsFunc func([][]byte)
+	setSecretsFunc func(CipherSuite, [][]byte)
 	doneFunc       func()
 	errFunc        func(error)
 	options        KeyExchangerOptions
@@ -99,24 +102,66 @@ type keyExchanger struct {
 	nextRemotePublicKey *[curve25519PublicKeySize]byte
 	prevLocalPrivateKey *[curve25519PrivateKeySize]byte
 	nextLocalPrivateKey *[curve25519PrivateKeySize]byte
+	prevLocalPublicKey  *[curve25519PublicKeySize]byte
 	nextLocalPublicKey  *[curve25519PublicKeySize]byte
+	prevLocalKEMKey     *localKEMKey
+	nextLocalKEMKey     *localKEMKey
+	prevRemoteKEMKey    *remoteKEMKey
+	nextRemoteKEMKey    *remoteKEMKey
+	cipherSuite         CipherSuite
+	protocolVersion     ProtocolVersion
+	protocolFeatures    ProtocolFeatures
+	isProtocolAgreed    bool
+	isConnected         bool
+	isResumed           bool
+	resumedPayloadSize  uint32
+	isTicketChecked     bool
+	isTicketAccepted    bool
+	psks                []PSK
+	remotePSK           *PSK
 	localIdentity       *Identity
 	remoteIdentity      *Identity
+	trustStore          TrustStore
 	messenger           *Messenger
 	ecdh                ecdh.KeyExchange
 
 	remoteSessionID       *SessionID
 	remoteKeyID           uint64
+	remoteKeyIDSessionID  *SessionID
+	remoteKeyIDPublicKey  [curve25519PublicKeySize]byte
+	hidingRemotePublicKey *[curve25519PublicKeySize]byte
 	localKeyCreatedAt     uint64
 	nextLocalKeyCreatedAt uint64
 	successNotifyChan     chan uint64
 	keyUpdateLocker       lockerMutex
 	skipKeyUpdateUntil    time.Time
+	authString            *AuthenticationString
+	exporterSecret        []byte
 
 	cryptoRandReader io.Reader
 	wg               sync.WaitGroup
 }
 
+// localKEMKey is the local ML-KEM key of the hybrid key exchange, it's
+// generated together with each local key exchange (X25519) key.
+type localKEMKey struct {
+	key              *kemKey
+	encapsulationKey []byte
+
+	// sharedKey is decapsulated from the ciphertext sent by the remote side
+	// (or nil if it was not received, yet).
+	sharedKey []byte
+}
+
+// remoteKEMKey is the shared key encapsulated by the local side for
+// the ML-KEM encapsulation key of the remote side (which corresponds
+// to the remote key exchange key `kxPublicKey`).
+type remoteKEMKey struct {
+	kxPublicKey [curve25519PublicKeySize]byte
+	ciphertext  []byte
+	sharedKey   []byte
+}
+
 // KeyExchangerOptions is used to configure the key exchanging options.
 // It's passed to a session via SessionOptions.
 type KeyExchangerOptions struct {
@@ -130,16 +175,21 @@ type KeyExchangerOptions struct {
 	// If a zero-value then DefaultKeyExchangeInterval is used.
 	KeyUpdateInterval time.Duration
 
-	// maximalTimeDifference enables check of how sane are timestamps
+	// MaximalTimeDifference enables check of how sane are timestamps
 	// are being received from the remote side. If the timestamp
 	// is from far past or from far future it may be considered as
-	// a hack attempt.
+	// a hack attempt (for example a replay of a captured key exchange
+	// message), so the message is ignored and ErrInvalidTimestamp
+	// is reported.
 	//
 	// By default this check is disabled. To enable it set
 	// a non-zero value. The value defines how big could be the
 	// legitimate difference between local clock and remote clock.
 	// The time difference should include possible network delays.
-	maximalTimeDifference time.Duration
+	//
+	// If it is enabled then key exchange messages without a timestamp
+	// (from remote sides of ProtocolVersionLegacy) are ignored as well.
+	MaximalTimeDifference time.Duration
 
 	// RetryInterval defines the maximal delay between sending a key exchange
 	// packet and success key exchange before resending the key exchange
@@ -159,8 +209,25 @@ type KeyExchangerOptions struct {
 	// an additional source for ephemeral key ("cipher key") generation.
 	// So if it is set then to initiate a working session it's required to
 	// satisfy both conditions: valid (and expected) identities and the same PSK.
+	//
+	// It is the same as PSKs with a single PSK with an empty ID. It is
+	// ignored if PSKs is set.
 	PSK []byte
 
+	// PSKs is a set of named Pre-Shared Keys (see PSK). The first one
+	// is used by the local side, and the rest are accepted from the remote
+	// side. The remote side tells which PSK it uses, and the cipher keys
+	// are derived from both the local PSK and the remote one.
+	//
+	// So PSKs could be rotated without restarting all the peers at the same
+	// moment: add the new PSK to the set on all the peers, then move it
+	// to the beginning of the set (and mark the old one as Deprecated),
+	// and then remove the old one.
+	//
+	// If the remote side uses a PSK which is not in the set, then the key
+	// exchange fails with ErrKeyExchangeTimeout (or ErrUnknownPSK).
+	PSKs []PSK
+
 	// AnswersMode set the behavior of key-exchange message acknowledgments.
 	//
 	// When the local side receives a packet from the remote side it _may_
@@ -173,6 +240,82 @@ type KeyExchangerOptions struct {
 	//
 	// See KeyExchangeAnswersMode values.
 	AnswersMode KeyExchangeAnswersMode
+
+	// EnableIdentityHiding enables the mode where the identity public key
+	// (and the signature) is sent only encrypted by a key derived from
+	// an ephemeral X25519 exchange. So a passive observer cannot find out
+	// which identities are used by the session.
+	//
+	// An active attacker still could find out the identity by
+	// introducing its own ephemeral key.
+	//
+	// Both sides should have the same value of this option, otherwise
+	// the key exchange will fail with ErrKeyExchangeTimeout.
+	EnableIdentityHiding bool
+
+	// EnableHybridKeyExchange enables the hybrid post-quantum key exchange:
+	// in addition to X25519 the sides exchange ML-KEM-768 shared keys and
+	// the cipher key is derived from all of them. So the recorded traffic
+	// cannot be decrypted even if X25519 will be broken.
+	//
+	// A key exchange message becomes larger than 2KiB, so make sure
+	// the backend is able to pass such messages (see
+	// SessionOptions.PayloadSizeLimit).
+	//
+	// If the remote side does not support the hybrid key exchange then
+	// ErrHybridKeyExchangeUnsupported is reported and the session is closed.
+	// It requires the application to be built with Go 1.24 or newer.
+	EnableHybridKeyExchange bool
+
+	// CipherSuites is the list of cipher suites allowed to be used
+	// to encrypt the traffic, the most preferred first. Both sides select
+	// the same suite: the one which is closer to the beginning in
+	// both lists.
+	//
+	// If the remote side does not support cipher suites negotiation,
+	// then it is considered to support only CipherSuiteXChaCha20Poly1305.
+	// If there are no common cipher suites then ErrNoCommonCipherSuite
+	// is reported and the session is closed.
+	//
+	// The default value is DefaultCipherSuites.
+	CipherSuites []CipherSuite
+
+	// MinProtocolVersion is the minimal protocol version accepted
+	// from the remote side. Both sides use the highest protocol version
+	// supported by both of them. If there is no such version, then
+	// ErrProtocolVersionMismatch is reported and the session is closed.
+	//
+	// The default value is ProtocolVersionLegacy (any remote side
+	// is accepted). Set ProtocolVersion1 to refuse remote sides
+	// of ProtocolVersionLegacy.
+	MinProtocolVersion ProtocolVersion
+
+	// ResumptionTicketIssuer enables issuing resumption tickets to
+	// the remote side (see ResumptionTicket) and accepting them. A ticket
+	// is issued right after the session is established.
+	//
+	// Tickets are used only in KeyExchangeAnswersModeAnswerAndWait.
+	ResumptionTicketIssuer *ResumptionTicketIssuer
+
+	// LockKeysInMemory enables locking the memory of the keys (the key
+	// exchange private keys and the cipher keys), so they are never
+	// swapped out to a disk (see mlock(2)).
+	//
+	// It is supported only on Linux and requires enough RLIMIT_MEMLOCK
+	// (or CAP_IPC_LOCK). If the memory cannot be locked then
+	// ErrCannotLockMemory is reported, but the session continues to work.
+	//
+	// The keys are overwritten with zeros when they are not needed
+	// anymore regardless of this option.
+	LockKeysInMemory bool
+
+	// ResumptionTicket is a ticket issued by the remote side in
+	// a previous session (see `(*Session).GetResumptionTicket`). It is
+	// presented to the remote side to resume the session.
+	//
+	// If the ticket is not accepted by the remote side (for example,
+	// it is expired), then the session is established as usual.
+	ResumptionTicket *ResumptionTicket
 }
 
 // KeyExchangeAnswersMode is the variable type for KeyExchangeOptions.AnswersMode
@@ -200,8 +343,9 @@ func newKeyExchanger(
 	ctx context.Context,
 	localIdentity *Identity,
 	remoteIdentity *Identity,
+	trustStore TrustStore,
 	messenger *Messenger,
-	setSecretsFunc func([][]byte),
+	setSecretsFunc func(CipherSuite, [][]byte),
 	doneFunc func(),
 	errFunc func(error),
 	opts *KeyExchangerOptions,
@@ -212,11 +356,46 @@ func newKeyExchanger(
 		errFunc:           errFunc,
 		localIdentity:     localIdentity,
 		remoteIdentity:    remoteIdentity,
+		trustStore:        trustStore,
 		messenger:         messenger,
 		ecdh:              ecdh.X25519(),
 		successNotifyChan: make(chan uint64, 1),
 	}
+	kx.setOptions(opts)
+
+	kx.ctx, kx.cancelFunc = context.WithCancel(ctx)
+	go func() {
+		<-kx.ctx.Done()
+		close(kx.successNotifyChan)
+	}()
+	messenger.SetHandler(kx)
+	kx.start()
+	return kx
+}
+
+// newKeyExchangeVerifier returns a key exchanger which is used only to
+// check the first messages of new remote sides (see verifyFirstMessage).
+// It never sends anything, and it has no keys.
+func newKeyExchangeVerifier(
+	localIdentity *Identity,
+	trustStore TrustStore,
+	sess *Session,
+	opts *KeyExchangerOptions,
+) *keyExchanger {
+	kx := &keyExchanger{
+		errFunc:       func(error) {},
+		localIdentity: localIdentity,
+		trustStore:    trustStore,
+		messenger:     &Messenger{sess: sess},
+		ecdh:          ecdh.X25519(),
+	}
+	kx.setOptions(opts)
+	return kx
+}
 
+// setOptions sets the options `opts` replacing the zero-values with
+// the default values.
+func (kx *keyExchanger) setOptions(opts *KeyExchangerOptions) {
 	if opts != nil {
 		kx.options = *opts
 	}
@@ -232,22 +411,28 @@ func newKeyExchanger(
 	if kx.options.AnswersMode == KeyExchangeAnswersModeDefault {
 		kx.options.AnswersMode = KeyExchangeAnswersModeAnswerAndWait
 	}
-
-	kx.ctx, kx.cancelFunc = context.WithCancel(ctx)
-	go func() {
-		<-kx.ctx.Done()
-		close(kx.successNotifyChan)
-	}()
-	messenger.SetHandler(kx)
-	kx.start()
-	return kx
+	if len(kx.options.CipherSuites) == 0 {
+		kx.options.CipherSuites = DefaultCipherSuites
+	}
+	kx.psks = kx.options.getPSKs()
 }
 
 func (kx *keyExchanger) getCryptoRandReader() io.Reader {
-	if kx.cryptoRandReader == nil {
-		return rand.Reader
+	if kx.cryptoRandReader != nil {
+		return kx.cryptoRandReader
 	}
-	return kx.cryptoRandReader
+	if kx.messenger != nil {
+		return kx.messenger.sess.getRandReader()
+	}
+	return rand.Reader
+}
+
+// getClock returns the Clock of the session (see SessionOptions.Clock).
+func (kx *keyExchanger) getClock() Clock {
+	if kx.messenger != nil {
+		return kx.messenger.sess.getClock()
+	}
+	return systemClock{}
 }
 
 func (kx *keyExchanger) LockDo(fn func()) {
@@ -265,30 +450,82 @@ func (kx *keyExchanger) generateSharedKeyBySecretID(
 		}
 		if kx.messenger != nil {
 			kx.messenger.sess.debugf("[kx] generateSharedKeyBySecretID(%v) -> %v, %v",
-				secretID, sharedKey, err)
+				secretID, secretForDebug(sharedKey), err)
 		}
 	}()
 
-	var localPrivateKey *[curve25519PrivateKeySize]byte
-	var remotePublicKey *[curve25519PublicKeySize]byte
+	// The private keys (and the ML-KEM shared keys) are copied, because
+	// the originals are destroyed when they are rotated out
+	// (see destroyLocalKey).
+	var localPrivateKey, localPrivateKeyOrig *[curve25519PrivateKeySize]byte
+	var localPrivateKeyCopy [curve25519PrivateKeySize]byte
+	defer zeroBytes(localPrivateKeyCopy[:])
+	var localPublicKey, remotePublicKey *[curve25519PublicKeySize]byte
+	var localKEM *localKEMKey
+	var remoteKEM *remoteKEMKey
+	var localKEMSharedKey, remoteKEMSharedKey []byte
+	defer func() {
+		zeroBytes(localKEMSharedKey)
+		zeroBytes(remoteKEMSharedKey)
+	}()
 	kx.keyLocker.RLockDo(func() {
 		switch secretID {
 		case secretIDRecentBoth:
-			localPrivateKey = kx.nextLocalPrivateKey
-			remotePublicKey = kx.nextRemotePublicKey
+			localPrivateKeyOrig, localPublicKey, localKEM = kx.nextLocalPrivateKey, kx.nextLocalPublicKey, kx.nextLocalKEMKey
+			remotePublicKey, remoteKEM = kx.nextRemotePublicKey, kx.nextRemoteKEMKey
 		case secretIDRecentLocal:
-			localPrivateKey = kx.nextLocalPrivateKey
-			remotePublicKey = kx.prevRemotePublicKey
+			localPrivateKeyOrig, localPublicKey, localKEM = kx.nextLocalPrivateKey, kx.nextLocalPublicKey, kx.nextLocalKEMKey
+			remotePublicKey, remoteKEM = kx.prevRemotePublicKey, kx.prevRemoteKEMKey
 		case secretIDRecentRemote:
-			localPrivateKey = kx.prevLocalPrivateKey
-			remotePublicKey = kx.nextRemotePublicKey
+			localPrivateKeyOrig, localPublicKey, localKEM = kx.prevLocalPrivateKey, kx.prevLocalPublicKey, kx.prevLocalKEMKey
+			remotePublicKey, remoteKEM = kx.nextRemotePublicKey, kx.nextRemoteKEMKey
 		case secretIDPrevious:
-			localPrivateKey = kx.prevLocalPrivateKey
-			remotePublicKey = kx.prevRemotePublicKey
+			localPrivateKeyOrig, localPublicKey, localKEM = kx.prevLocalPrivateKey, kx.prevLocalPublicKey, kx.prevLocalKEMKey
+			remotePublicKey, remoteKEM = kx.prevRemotePublicKey, kx.prevRemoteKEMKey
+		}
+		if localPrivateKeyOrig != nil {
+			localPrivateKeyCopy = *localPrivateKeyOrig
+			localPrivateKey = &localPrivateKeyCopy
+		}
+		if localKEM != nil {
+			localKEMSharedKey = append([]byte(nil), localKEM.sharedKey...)
+		}
+		if remoteKEM != nil && remotePublicKey != nil && remoteKEM.kxPublicKey == *remotePublicKey {
+			remoteKEMSharedKey = append([]byte(nil), remoteKEM.sharedKey...)
 		}
 	})
 
-	return kx.generateSharedKey(localPrivateKey, remotePublicKey)
+	sharedKey, err = kx.generateSharedKey(localPrivateKey, remotePublicKey)
+	if err != nil || !kx.options.EnableHybridKeyExchange {
+		return
+	}
+	if localKEMSharedKey == nil || remoteKEMSharedKey == nil {
+		return nil, newErrKEMSharedKeyIsNil()
+	}
+
+	// Both sides should mix the ML-KEM shared keys in the same order
+	if bytes.Compare(localPublicKey[:], remotePublicKey[:]) > 0 {
+		localKEMSharedKey, remoteKEMSharedKey = remoteKEMSharedKey, localKEMSharedKey
+	}
+	hybridKey := make([]byte, 0, len(sharedKey)+len(localKEMSharedKey)+len(remoteKEMSharedKey))
+	hybridKey = append(hybridKey, sharedKey...)
+	hybridKey = append(hybridKey, localKEMSharedKey...)
+	hybridKey = append(hybridKey, remoteKEMSharedKey...)
+	defer zeroBytes(hybridKey)
+	zeroBytes(sharedKey)
+	return hash(hybridKey, Salt, []byte("hybridCipherKey")), nil
+}
+
+// isLowOrderPublicKey returns true if `publicKey` is a point of a small
+// order (including zero), so the shared key with it would be zero for
+// any private key.
+func (kx *keyExchanger) isLowOrderPublicKey(publicKey *[curve25519PublicKeySize]byte) bool {
+	// The private keys are clamped to multiples of the cofactor, so any
+	// of them is fine to check the order.
+	var privateKey [curve25519PrivateKeySize]byte
+	secret := kx.ecdh.ComputeSecret(&privateKey, publicKey)
+	var zeroKey [32]byte
+	return bytes.Equal(secret, zeroKey[:])
 }
 
 func (kx *keyExchanger) generateSharedKey(
@@ -305,15 +542,20 @@ func (kx *keyExchanger) generateSharedKey(
 	key := kx.ecdh.ComputeSecret(localPrivateKey, remotePublicKey)
 	var zeroKey [32]byte
 	if bytes.Compare(key, zeroKey[:]) == 0 {
-		panic(fmt.Sprintf("should not happen: %v %v", localPrivateKey, remotePublicKey))
+		// The remote public key is a point of a small order
+		return nil, newErrInvalidPublicKey().(*xerrors.Error)
 	}
 
-	psk := kx.options.PSK
-	if psk != nil {
-		pskXORer := hash(psk, Salt, []byte("cipherKey"))
+	if len(kx.psks) != 0 {
+		var remotePSK *PSK
+		kx.keyLocker.RLockDo(func() {
+			remotePSK = kx.remotePSK
+		})
+		pskXORer := calculatePSKXORer(&kx.psks[0], remotePSK)
 		for i := 0; i < len(pskXORer); i++ {
 			key[i] ^= pskXORer[i]
 		}
+		zeroBytes(pskXORer)
 	}
 
 	return key, nil
@@ -327,84 +569,186 @@ func (kx *keyExchanger) updateSecrets() (err error) {
 		newSecret, genErr := kx.generateSharedKeyBySecretID(secretID(secretIdx))
 		if genErr != nil &&
 			!genErr.Has(errLocalPrivateKeyIsNil{}) &&
-			!genErr.Has(errRemotePublicKeyIsNil{}) {
+			!genErr.Has(errRemotePublicKeyIsNil{}) &&
+			!genErr.Has(errKEMSharedKeyIsNil{}) {
 			return genErr
 		}
 		newSecrets[secretIdx] = newSecret
 	}
 
 	if len(newSecrets[secretIDRecentBoth]) != 0 {
-		kx.messenger.sess.debugf("[kx] set the secrets == %v", newSecrets)
-		kx.setSecretsFunc(newSecrets)
+		var cipherSuite CipherSuite
+		kx.keyLocker.RLockDo(func() {
+			cipherSuite = kx.cipherSuite
+		})
+		kx.messenger.sess.debugf("[kx] set the secrets == %v (%v)", secretsForDebug(newSecrets), cipherSuite)
+		kx.setSecretsFunc(cipherSuite, newSecrets)
+	} else {
+		zeroBytesSlices(newSecrets)
 	}
 	return nil
 }
 
-func (kx *keyExchanger) parseAndCheck(msg *keySeedUpdateMessage, b []byte) (err error) {
+// parseMessage parses the message `b` (without checking its signature)
+// into `msg` and returns its extensions.
+func (kx *keyExchanger) parseMessage(
+	msg *keySeedUpdateMessage,
+	b []byte,
+) (keySeedUpdateMessageExtensions, error) {
 	if len(b) < keySeedUpdateMessageSignedSize {
-		return newErrTooShort(uint(keySeedUpdateMessageSignedSize), uint(len(b)))
+		return nil, newErrTooShort(uint(keySeedUpdateMessageSignedSize), uint(len(b)))
 	}
 
-	signature := b[:keySignatureSize]
 	msgBytes := b[keySignatureSize:keySeedUpdateMessageSignedSize]
-	if len(b) > keySeedUpdateMessageSignedSize {
-		kx.messenger.sess.debugf("[kx] ignored the tail of length %v", keySeedUpdateMessageSignedSize-len(b))
+	if err := binary.Read(bytes.NewBuffer(msgBytes), binaryOrderType, msg); err != nil {
+		return nil, wrapError(err)
 	}
-	if kx.remoteIdentity != nil {
-		if err = kx.remoteIdentity.VerifySignature(signature, msgBytes); err != nil {
-			kx.messenger.sess.debugf("[kx] ignoring the message from %+v due to the wrong signature: %v", kx.remoteIdentity, err)
-			return
+	if msg.SessionID == kx.messenger.sess.id {
+		// For example, somebody sent our own message back to us
+		err := newErrReflectedMessage()
+		kx.messenger.sess.debugf("[kx] ignoring the message: %v", err)
+		return nil, err
+	}
+
+	exts, err := parseKeySeedUpdateMessageExtensions(b[keySeedUpdateMessageSignedSize:])
+	if err != nil {
+		if kx.localIdentity == nil || msg.Flags.HasExtensions() {
+			return nil, xerrors.Errorf("unable to parse extensions: %w", err)
 		}
+		// The tail of a message of ProtocolVersionLegacy is ignored
+		return nil, nil
 	}
+	return exts, nil
+}
 
-	err = binary.Read(bytes.NewBuffer(msgBytes), binaryOrderType, msg)
+// parseAndCheck parses the message `b` and checks if it is signed
+// by a trusted remote identity. The identity is returned as `remoteIdentity`.
+func (kx *keyExchanger) parseAndCheck(
+	msg *keySeedUpdateMessage,
+	b []byte,
+) (remoteIdentity *Identity, exts keySeedUpdateMessageExtensions, err error) {
+	exts, err = kx.parseMessage(msg, b)
 	if err != nil {
-		return wrapError(err)
+		return nil, nil, err
+	}
+
+	remoteIdentity = kx.remoteIdentity
+	switch {
+	case kx.localIdentity == nil:
+		// PSK-only mode: the message is authenticated by a MAC instead of a signature
+		if err = kx.verifyMAC(b[:keySignatureSize], b[keySignatureSize:], exts, msg.SessionID); err != nil {
+			kx.messenger.sess.debugf("[kx] ignoring the message due to the wrong MAC: %v", err)
+			return nil, nil, err
+		}
+	case remoteIdentity != nil:
+		exts, err = verifyKeySeedUpdateMessageSignatures(remoteIdentity.Keys.Public, msg, b, exts)
+		if err != nil {
+			kx.messenger.sess.debugf("[kx] ignoring the message from %+v due to the wrong signature: %v", remoteIdentity, err)
+			return nil, nil, err
+		}
+	default:
+		// The signature wasn't verified yet
+		exts, err = verifyKeySeedUpdateMessageSignatures(msg.IdentityPublicKey[:], msg, b, exts)
+		if err != nil {
+			kx.messenger.sess.debugf("[kx] ignoring the message from %v due to the wrong signature: %v", msg.IdentityPublicKey[:], err)
+			return nil, nil, err
+		}
+
+		remoteIdentity, err = kx.findRemoteIdentity(msg, exts)
+		if err != nil {
+			kx.messenger.sess.debugf("[kx] ignoring the message from %v: %v", msg.IdentityPublicKey[:], err)
+			if xerr, ok := err.(*xerrors.Error); ok && xerr.Has(ErrPeerKeyChanged{}) {
+				kx.errFunc(err)
+			}
+			return nil, nil, err
+		}
+	}
+
+	if remoteIdentity != nil && remoteIdentity.Certificate != nil {
+		if err = remoteIdentity.Certificate.checkValidity(kx.getClock().Now()); err != nil {
+			kx.errFunc(err)
+			return
+		}
 	}
 
 	if msg.AnswersMode != kx.options.AnswersMode {
-		kx.messenger.sess.debugf("[kx] msg == %+v; msgBytes == %v; b == %v", msg, msgBytes, b)
+		kx.messenger.sess.debugf("[kx] msg == %+v; b == %v", msg, b)
 		err = newErrAnswersModeMismatch(kx.options.AnswersMode, msg.AnswersMode)
 		kx.errFunc(err)
 		return
 	}
 
-	var zeroKey [curve25519PublicKeySize]byte
-	if bytes.Compare(msg.KXPublicKey[:], zeroKey[:]) == 0 {
+	if kx.isLowOrderPublicKey(&msg.KXPublicKey) {
 		err = newErrInvalidPublicKey()
 		kx.errFunc(err)
 		return
 	}
 
-	return nil
+	return
 }
 
-func (kx *keyExchanger) setRemoteIdentityFromPublicKey(origMsg, remotePubKey []byte) (isOK bool) {
-	kx.messenger.sess.debugf("[kx] setting the remote identity to %+v", remotePubKey[:])
+// findRemoteIdentity returns the identity of a not-yet-known remote side.
+// The signature of the message is expected to be already verified.
+func (kx *keyExchanger) findRemoteIdentity(
+	msg *keySeedUpdateMessage,
+	exts keySeedUpdateMessageExtensions,
+) (*Identity, error) {
+	if kx.trustStore == nil {
+		// Any remote identity is accepted
+		return NewRemoteIdentityFromPublicKey(msg.IdentityPublicKey[:])
+	}
 
-	// Parse the remote key
-	remoteIdentity, err := NewRemoteIdentityFromPublicKey(remotePubKey[:])
-	if err != nil {
-		kx.errFunc(wrapError(err))
-		return false
+	if certBytes := exts.Get(keySeedUpdateMessageExtensionTypeCertificate); certBytes != nil {
+		if certVerifier, ok := kx.trustStore.(CertificateVerifier); ok {
+			cert, err := ParseCertificate(certBytes)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(cert.SubjectKey, msg.IdentityPublicKey[:]) {
+				return nil, newErrInvalidCertificate(`the subject key does not match the identity key`)
+			}
+			remoteIdentity, err := certVerifier.VerifyCertificate(kx.messenger.sess, cert)
+			if err != nil {
+				return nil, err
+			}
+			if remoteIdentity == nil || !bytes.Equal(remoteIdentity.Keys.Public, msg.IdentityPublicKey[:]) {
+				return nil, newErrUntrustedRemoteIdentity(msg.IdentityPublicKey[:])
+			}
+			return remoteIdentity, nil
+		}
 	}
 
-	// The signature wasn't verified on the stage of kx.parseAndCheck, so we need to verify it at least now
-	if len(origMsg) < keySeedUpdateMessageSignedSize {
-		kx.errFunc(xerrors.Errorf("[kx] too short message: %d < %d", len(origMsg), keySeedUpdateMessageSignedSize))
-		return false
+	if verifier, ok := kx.trustStore.(RemoteIdentityVerifier); ok {
+		remoteIdentity, err := verifier.VerifyRemoteIdentity(kx.messenger.sess, msg.IdentityPublicKey[:])
+		if err != nil {
+			return nil, err
+		}
+		if remoteIdentity == nil || !bytes.Equal(remoteIdentity.Keys.Public, msg.IdentityPublicKey[:]) {
+			return nil, newErrUntrustedRemoteIdentity(msg.IdentityPublicKey[:])
+		}
+		return remoteIdentity, nil
 	}
-	if err = remoteIdentity.VerifySignature(origMsg[:keySignatureSize], origMsg[keySignatureSize:keySeedUpdateMessageSignedSize]); err != nil {
-		kx.messenger.sess.debugf("[kx] ignoring the message from %+v due to the wrong signature: %v", remoteIdentity, err)
-		return false
+
+	remoteIdentity := kx.trustStore.FindRemoteIdentity(msg.IdentityPublicKey[:])
+	if remoteIdentity == nil {
+		return nil, newErrUntrustedRemoteIdentity(msg.IdentityPublicKey[:])
 	}
+	return remoteIdentity, nil
+}
 
-	// Everything is OK, let's remember the new value
+func (kx *keyExchanger) setRemoteIdentity(remoteIdentity *Identity) {
+	kx.messenger.sess.debugf("[kx] setting the remote identity to %+v", remoteIdentity.Keys.Public)
 	kx.remoteIdentity = remoteIdentity
 	kx.messenger.sess.lockDo(func() {
 		kx.messenger.sess.remoteIdentity = kx.remoteIdentity
 	})
-	return true
+}
+
+// remoteSessionRestartHandler is an optional interface of a backend
+// which is notified if a verified key exchange message of a new session
+// of the remote side is received (see Listener).
+type remoteSessionRestartHandler interface {
+	onRemoteSessionRestart(sess *Session, remoteSessionID SessionID)
 }
 
 func (kx *keyExchanger) setRemoteSessionID(sessID *SessionID) {
@@ -433,10 +777,29 @@ func (kx *keyExchanger) setNextRemotePublicKey(kxPublicKey *[32]byte) {
 func (kx *keyExchanger) Handle(b []byte) (err error) {
 	defer func() { err = wrapError(err) }()
 
+	var hiddenHdr *keySeedUpdateMessageHiddenHeaders
+	if kx.options.EnableIdentityHiding {
+		b, hiddenHdr, err = kx.revealMessage(b)
+		if err != nil {
+			kx.messenger.sess.debugf("[kx] ignoring the message: %v", err)
+			return
+		}
+		if b == nil {
+			if hiddenHdr != nil {
+				kx.handleIntroduction(hiddenHdr)
+			}
+			return
+		}
+	}
+
 	var msg keySeedUpdateMessage
-	if err = kx.parseAndCheck(&msg, b); err != nil {
+	remoteIdentity, exts, err := kx.parseAndCheck(&msg, b)
+	if err != nil {
 		return
 	}
+	if hiddenHdr != nil && (msg.KXPublicKey != hiddenHdr.KXPublicKey || msg.SessionID != hiddenHdr.SessionID) {
+		return newErrInvalidPublicKey()
+	}
 	kx.messenger.sess.debugf("[kx] received msg: %+v", msg)
 
 	kx.LockDo(func() {
@@ -452,41 +815,837 @@ func (kx *keyExchanger) Handle(b []byte) (err error) {
 		default:
 		}
 
-		if kx.remoteIdentity == nil {
-			if !kx.setRemoteIdentityFromPublicKey(b, msg.IdentityPublicKey[:]) {
+		if kx.remoteSessionID != nil && msg.SessionID.isOlderThan(kx.remoteSessionID) {
+			// A message of a previous remote session (for example a replay)
+			err = newErrOldRemoteSessionID(msg.SessionID, *kx.remoteSessionID)
+			kx.messenger.sess.debugf("[kx] ignoring the message: %v", err)
+			return
+		}
+
+		if err = kx.checkTimestamps(&msg, exts); err != nil {
+			return
+		}
+
+		if kx.remoteIdentity == nil && remoteIdentity != nil {
+			kx.setRemoteIdentity(remoteIdentity)
+		}
+
+		switch {
+		case kx.remoteSessionID == nil:
+			kx.setRemoteSessionID(&msg.SessionID)
+		case *kx.remoteSessionID != msg.SessionID:
+			// The remote side was restarted
+			kx.messenger.sess.debugf("[kx] the remote session is restarted: %v -> %v", *kx.remoteSessionID, msg.SessionID)
+			backend, _ := kx.messenger.sess.getBackend()
+			if handler, ok := backend.(remoteSessionRestartHandler); ok {
+				handler.onRemoteSessionRestart(kx.messenger.sess, msg.SessionID)
 				return
 			}
+			var isConnected bool
+			kx.keyLocker.RLockDo(func() {
+				isConnected = kx.isConnected
+			})
+			if !isConnected {
+				// Nothing was established with the previous remote
+				// session, so just switch to the new one (it happens
+				// in the identity hiding mode, if an introduction of
+				// a new remote session was answered by the previous one).
+				kx.setRemoteSessionID(&msg.SessionID)
+			}
 		}
 
-		if kx.remoteSessionID == nil {
-			kx.setRemoteSessionID(&msg.SessionID)
+		if err = kx.negotiateProtocol(exts); err != nil {
+			kx.errFunc(wrapError(err))
+			return
+		}
+
+		if err = kx.selectCipherSuite(exts); err != nil {
+			kx.errFunc(wrapError(err))
+			return
+		}
+
+		if err = kx.selectRemotePSK(exts); err != nil {
+			kx.errFunc(wrapError(err))
+			return
+		}
+
+		if hiddenHdr != nil {
+			// The message is verified, so the key exchange key of
+			// the remote side could be used for the identity hiding.
+			kx.keyLocker.LockDo(func() {
+				kx.hidingRemotePublicKey = &hiddenHdr.KXPublicKey
+			})
 		}
 
 		kx.setNextRemotePublicKey(&msg.KXPublicKey)
 
+		if kx.options.EnableHybridKeyExchange {
+			if err = kx.handleKEMExtensions(&msg, exts); err != nil {
+				kx.errFunc(wrapError(err))
+				return
+			}
+		}
+
+		kx.handleResumption(&msg, exts)
+
 		err = kx.updateSecrets()
 		if err != nil {
 			kx.errFunc(wrapError(err))
 			return
 		}
 
-		if msg.Flags.IsAnswer() || kx.options.AnswersMode != KeyExchangeAnswersModeAnswerAndWait {
-			kx.lastExchangeTS = timeNow()
+		isComplete := kx.isKEMComplete()
+		if isComplete && (msg.Flags.IsAnswer() || kx.options.AnswersMode != KeyExchangeAnswersModeAnswerAndWait) {
+			kx.lastExchangeTS = kx.getClock().Now()
+			if kx.authString == nil {
+				kx.setAuthTranscript(kx.makeAuthTranscript())
+			}
+			kx.keyLocker.LockDo(func() {
+				kx.isConnected = true
+			})
 			kx.sendSuccessNotifications()
 		}
 
-		if !msg.Flags.IsAnswer() && kx.options.AnswersMode != KeyExchangeAnswersModeDisable {
-			// Send answer
+		if (!msg.Flags.IsAnswer() || !isComplete) && kx.options.AnswersMode != KeyExchangeAnswersModeDisable {
+			// Send answer.
+			//
+			// If the hybrid key exchange is not complete, yet (the remote side
+			// did not know our ML-KEM encapsulation key), then a non-answer is
+			// sent, so the remote side will answer with the ML-KEM ciphertext.
 			kx.wg.Add(1)
 			go func() {
 				defer kx.wg.Done()
-				kx.mustSendPublicKey(true)
+				kx.mustSendPublicKey(isComplete)
 			}()
 		}
 	})
 	return
 }
 
+// checkTimestamps checks the signed timestamps of a key exchange message
+// (see keySeedUpdateMessageTimestamps). The creation time should not
+// differ from the local time more than
+// KeyExchangerOptions.MaximalTimeDifference (if it is set). And the key
+// creation counter of the remote session should not decrease, and
+// the key exchange key should not change without increasing the counter.
+// The counter is tracked only for the newest remote session, so messages
+// of older remote sessions are rejected (see ErrOldRemoteSessionID).
+//
+// It should be called with kx.locker locked.
+func (kx *keyExchanger) checkTimestamps(msg *keySeedUpdateMessage, exts keySeedUpdateMessageExtensions) error {
+	timestamps, err := kx.checkRemoteTime(exts)
+	if err != nil {
+		return err
+	}
+	if timestamps == nil {
+		return nil
+	}
+
+	if kx.remoteKeyIDSessionID == nil || *kx.remoteKeyIDSessionID != msg.SessionID {
+		if kx.remoteKeyIDSessionID != nil && msg.SessionID.isOlderThan(kx.remoteKeyIDSessionID) {
+			return newErrOldRemoteSessionID(msg.SessionID, *kx.remoteKeyIDSessionID)
+		}
+		// A new remote session
+		sessionID := msg.SessionID
+		kx.remoteKeyIDSessionID = &sessionID
+		kx.remoteKeyID = timestamps.KeyCreatedAt
+		kx.remoteKeyIDPublicKey = msg.KXPublicKey
+		return nil
+	}
+
+	switch {
+	case timestamps.KeyCreatedAt < kx.remoteKeyID:
+		return newErrInvalidKeyCreatedAt(timestamps.KeyCreatedAt, kx.remoteKeyID)
+	case timestamps.KeyCreatedAt == kx.remoteKeyID:
+		if msg.KXPublicKey != kx.remoteKeyIDPublicKey {
+			return newErrInvalidKeyCreatedAt(timestamps.KeyCreatedAt, kx.remoteKeyID)
+		}
+	default:
+		kx.remoteKeyID = timestamps.KeyCreatedAt
+		kx.remoteKeyIDPublicKey = msg.KXPublicKey
+	}
+	return nil
+}
+
+// checkRemoteTime parses the timestamps of a key exchange message (nil
+// if there are no timestamps) and checks the creation time against
+// KeyExchangerOptions.MaximalTimeDifference (see checkTimestamps).
+func (kx *keyExchanger) checkRemoteTime(exts keySeedUpdateMessageExtensions) (*keySeedUpdateMessageTimestamps, error) {
+	var timestamps *keySeedUpdateMessageTimestamps
+	if ext := exts.Get(keySeedUpdateMessageExtensionTypeTimestamps); ext != nil {
+		var err error
+		timestamps, err = parseKeySeedUpdateMessageTimestamps(ext)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to parse the timestamps: %w", err)
+		}
+	}
+
+	if maxDiff := kx.options.MaximalTimeDifference; maxDiff != 0 {
+		var remoteTime time.Time
+		if timestamps != nil {
+			remoteTime = time.Unix(0, int64(timestamps.CreatedAt))
+		}
+		localTime := kx.getClock().Now()
+		diff := localTime.Sub(remoteTime)
+		if diff < 0 {
+			diff = -diff
+		}
+		if timestamps == nil || diff > maxDiff {
+			return nil, newErrInvalidTimestamp(remoteTime, localTime, maxDiff)
+		}
+	}
+	return timestamps, nil
+}
+
+// verifyFirstMessage checks if `b` is a key exchange message which may
+// start a new session, and returns the SessionID of the remote side.
+// It does not change the state of the key exchanger (see
+// newKeyExchangeVerifier).
+//
+// The message should be authentic: signed by a trusted identity (only
+// the signature is checked if the TrustStore needs a session to verify
+// the identity, see RemoteIdentityVerifier and CertificateVerifier) or
+// protected by a MAC in the PSK-only mode. In the identity hiding mode
+// only an introduction is accepted, it has nothing to verify.
+func (kx *keyExchanger) verifyFirstMessage(b []byte) (SessionID, error) {
+	if kx.options.EnableIdentityHiding {
+		_, hiddenHdr, err := kx.revealMessage(b)
+		if err != nil {
+			return SessionID{}, err
+		}
+		var zeroKey [curve25519PublicKeySize]byte
+		if hiddenHdr == nil || hiddenHdr.RecipientKXPublicKey != zeroKey {
+			// The message is encrypted for a key of another session
+			return SessionID{}, newErrCannotDecrypt()
+		}
+		return hiddenHdr.SessionID, nil
+	}
+
+	var msg keySeedUpdateMessage
+	exts, err := kx.parseMessage(&msg, b)
+	if err != nil {
+		return SessionID{}, err
+	}
+	if kx.isLowOrderPublicKey(&msg.KXPublicKey) {
+		return SessionID{}, newErrInvalidPublicKey()
+	}
+
+	switch {
+	case kx.localIdentity == nil:
+		if err = kx.verifyMAC(b[:keySignatureSize], b[keySignatureSize:], exts, msg.SessionID); err != nil {
+			return SessionID{}, err
+		}
+	default:
+		exts, err = verifyKeySeedUpdateMessageSignatures(msg.IdentityPublicKey[:], &msg, b, exts)
+		if err != nil {
+			return SessionID{}, err
+		}
+		switch kx.trustStore.(type) {
+		case nil, RemoteIdentityVerifier, CertificateVerifier:
+		default:
+			if kx.trustStore.FindRemoteIdentity(msg.IdentityPublicKey[:]) == nil {
+				return SessionID{}, newErrUntrustedRemoteIdentity(msg.IdentityPublicKey[:])
+			}
+		}
+	}
+
+	if _, err = kx.checkRemoteTime(exts); err != nil {
+		return SessionID{}, err
+	}
+	return msg.SessionID, nil
+}
+
+// handleResumption accepts the resumption ticket of the remote side
+// (see KeyExchangerOptions.ResumptionTicketIssuer) and checks if
+// the remote side accepted the local ticket (see
+// KeyExchangerOptions.ResumptionTicket). It is done only before
+// the first successful key exchange.
+//
+// The session is resumed if any of the tickets is accepted. The tickets
+// are sent in every message until the first successful key exchange,
+// and an answer is sent only after the received message is handled. So
+// both sides know if the session is resumed when the first key exchange
+// succeeds (in KeyExchangeAnswersModeAnswerAndWait).
+//
+// It should be called with kx.locker locked.
+func (kx *keyExchanger) handleResumption(msg *keySeedUpdateMessage, exts keySeedUpdateMessageExtensions) {
+	if kx.options.AnswersMode != KeyExchangeAnswersModeAnswerAndWait || kx.localIdentity == nil {
+		return
+	}
+	var isConnected, isTicketChecked bool
+	kx.keyLocker.RLockDo(func() {
+		isConnected, isTicketChecked = kx.isConnected, kx.isTicketChecked
+	})
+	if isConnected {
+		return
+	}
+
+	if issuer := kx.options.ResumptionTicketIssuer; issuer != nil && !isTicketChecked {
+		if ticket := exts.Get(keySeedUpdateMessageExtensionTypeResumptionTicket); ticket != nil {
+			data, err := issuer.accept(kx.getClock(), kx.localIdentity, msg.IdentityPublicKey[:], ticket)
+			kx.keyLocker.LockDo(func() {
+				kx.isTicketChecked = true
+				if err != nil {
+					return
+				}
+				kx.isTicketAccepted = true
+				kx.setResumed(data.PayloadSize)
+			})
+			if err != nil {
+				kx.messenger.sess.error(err)
+			} else {
+				kx.messenger.sess.debugf("[kx] accepted the resumption ticket of the remote side")
+			}
+		}
+	}
+
+	if exts.Has(keySeedUpdateMessageExtensionTypeResumptionTicketAccepted) && kx.options.ResumptionTicket != nil {
+		kx.messenger.sess.debugf("[kx] the remote side accepted our resumption ticket")
+		kx.keyLocker.LockDo(func() {
+			kx.setResumed(kx.options.ResumptionTicket.PayloadSize)
+		})
+	}
+}
+
+// setResumed marks the session as resumed. If both tickets are accepted,
+// then the smallest payload size is used.
+//
+// It should be called with kx.keyLocker locked.
+func (kx *keyExchanger) setResumed(payloadSize uint32) {
+	if kx.isResumed && kx.resumedPayloadSize < payloadSize {
+		return
+	}
+	kx.isResumed = true
+	kx.resumedPayloadSize = payloadSize
+}
+
+// getResumptionTicket returns the ticket to be presented to the remote
+// side or nil if there is no such ticket (or it is not usable).
+func (kx *keyExchanger) getResumptionTicket() *ResumptionTicket {
+	ticket := kx.options.ResumptionTicket
+	if ticket == nil || kx.options.AnswersMode != KeyExchangeAnswersModeAnswerAndWait {
+		return nil
+	}
+	if kx.getClock().Now().After(ticket.ExpiresAt) {
+		return nil
+	}
+	if kx.remoteIdentity != nil && !bytes.Equal(kx.remoteIdentity.Keys.Public, ticket.RemotePublicKey) {
+		return nil
+	}
+	return ticket
+}
+
+// getResumedPayloadSize returns the payload size to be used instead of
+// the negotiation if the session is resumed.
+func (kx *keyExchanger) getResumedPayloadSize() (payloadSize uint32, isResumed bool) {
+	kx.keyLocker.RLockDo(func() {
+		payloadSize, isResumed = kx.resumedPayloadSize, kx.isResumed
+	})
+	return
+}
+
+// localProtocolVersionInfo returns the protocol versions and
+// the features supported by the local side.
+func (kx *keyExchanger) localProtocolVersionInfo() protocolVersionInfo {
+	features := ProtocolFeatureCipherSuites | ProtocolFeatureResumptionTickets | ProtocolFeaturePathProbes
+	if kx.options.EnableHybridKeyExchange {
+		features |= ProtocolFeatureHybridKeyExchange
+	}
+	return protocolVersionInfo{
+		MinVersion: kx.options.MinProtocolVersion,
+		MaxVersion: ProtocolVersionCurrent,
+		Features:   features,
+	}
+}
+
+// negotiateProtocol selects the protocol version and the features to be
+// used with the remote side. It is done only once per session.
+func (kx *keyExchanger) negotiateProtocol(exts keySeedUpdateMessageExtensions) error {
+	var isAgreed bool
+	kx.keyLocker.RLockDo(func() {
+		isAgreed = kx.isProtocolAgreed
+	})
+	if isAgreed {
+		return nil
+	}
+
+	remoteInfo := &legacyProtocolVersionInfo
+	if ext := exts.Get(keySeedUpdateMessageExtensionTypeProtocolVersion); ext != nil {
+		var err error
+		remoteInfo, err = parseProtocolVersionInfo(ext)
+		if err != nil {
+			return xerrors.Errorf("unable to parse the protocol version: %w", err)
+		}
+	}
+
+	version, features, err := negotiateProtocolVersion(kx.localProtocolVersionInfo(), *remoteInfo)
+	if err != nil {
+		return err
+	}
+	kx.messenger.sess.debugf("[kx] the protocol version is %v, the features are %v", version, features)
+	kx.keyLocker.LockDo(func() {
+		kx.protocolVersion = version
+		kx.protocolFeatures = features
+		kx.isProtocolAgreed = true
+	})
+	return nil
+}
+
+// getProtocol returns the agreed protocol version and features.
+func (kx *keyExchanger) getProtocol() (version ProtocolVersion, features ProtocolFeatures, isAgreed bool) {
+	kx.keyLocker.RLockDo(func() {
+		version, features, isAgreed = kx.protocolVersion, kx.protocolFeatures, kx.isProtocolAgreed
+	})
+	return
+}
+
+// selectCipherSuite selects the cipher suite (see
+// KeyExchangerOptions.CipherSuites) using the list of cipher suites
+// supported by the remote side. The cipher suite is selected only once
+// per session.
+func (kx *keyExchanger) selectCipherSuite(exts keySeedUpdateMessageExtensions) error {
+	var cipherSuite CipherSuite
+	kx.keyLocker.RLockDo(func() {
+		cipherSuite = kx.cipherSuite
+	})
+	if cipherSuite != CipherSuiteUndefined {
+		return nil
+	}
+
+	remoteCipherSuites := []CipherSuite{CipherSuiteXChaCha20Poly1305}
+	_, features, _ := kx.getProtocol()
+	if ext := exts.Get(keySeedUpdateMessageExtensionTypeCipherSuites); ext != nil &&
+		features.Has(ProtocolFeatureCipherSuites) {
+		remoteCipherSuites = make([]CipherSuite, 0, len(ext))
+		for _, suite := range ext {
+			remoteCipherSuites = append(remoteCipherSuites, CipherSuite(suite))
+		}
+	}
+
+	cipherSuite = selectCipherSuite(kx.options.CipherSuites, remoteCipherSuites)
+	if cipherSuite == CipherSuiteUndefined {
+		return newErrNoCommonCipherSuite(kx.options.CipherSuites, remoteCipherSuites)
+	}
+	kx.messenger.sess.debugf("[kx] selected the cipher suite %v", cipherSuite)
+	kx.keyLocker.LockDo(func() {
+		kx.cipherSuite = cipherSuite
+	})
+	return nil
+}
+
+// findRemotePSK finds the PSK used by the remote side (see
+// KeyExchangerOptions.PSKs). If the remote side does not tell which PSK
+// it uses, then it is supposed to use the PSK with an empty ID (or
+// the same PSK as the local side if there is no such PSK).
+func (kx *keyExchanger) findRemotePSK(exts keySeedUpdateMessageExtensions) (*PSK, error) {
+	if len(kx.psks) == 0 {
+		return nil, nil
+	}
+
+	remotePSKID := string(exts.Get(keySeedUpdateMessageExtensionTypePSKID))
+	remotePSK := findPSK(kx.psks, remotePSKID)
+	if remotePSK == nil {
+		if exts.Has(keySeedUpdateMessageExtensionTypePSKID) {
+			return nil, newErrUnknownPSK(remotePSKID)
+		}
+		remotePSK = &kx.psks[0]
+	}
+	return remotePSK, nil
+}
+
+// verifyMAC checks the MAC of a key exchange message of remote session
+// `senderSessionID` in the PSK-only mode (see NewPSKSession). The MAC is
+// calculated using the PSK of the remote side and the local SessionID
+// (or no SessionID if the remote side does not know it, yet; see
+// calculateKeyExchangeMAC).
+//
+// The MAC without the local SessionID is accepted only until
+// the SessionID of the remote side is accepted (or from another remote
+// session, if the remote side was restarted). Otherwise an old message
+// of the remote session could be replayed into the established session.
+func (kx *keyExchanger) verifyMAC(
+	mac []byte,
+	data []byte,
+	exts keySeedUpdateMessageExtensions,
+	senderSessionID SessionID,
+) error {
+	remotePSK, err := kx.findRemotePSK(exts)
+	if err != nil {
+		return err
+	}
+	if remotePSK == nil {
+		return newErrPSKRequired()
+	}
+	recipientSessionIDs := []*SessionID{&kx.messenger.sess.id, nil}
+	kx.locker.RLock()
+	if kx.remoteSessionID != nil && *kx.remoteSessionID == senderSessionID {
+		recipientSessionIDs = recipientSessionIDs[:1]
+	}
+	kx.locker.RUnlock()
+	for _, recipientSessionID := range recipientSessionIDs {
+		expectedMAC := calculateKeyExchangeMAC(remotePSK, recipientSessionID, data)
+		if subtle.ConstantTimeCompare(mac, expectedMAC[:]) == 1 {
+			return nil
+		}
+	}
+	return newErrInvalidSignature()
+}
+
+// selectRemotePSK remembers the PSK used by the remote side (see
+// findRemotePSK), so it will be used to derive the cipher keys.
+func (kx *keyExchanger) selectRemotePSK(exts keySeedUpdateMessageExtensions) error {
+	remotePSK, err := kx.findRemotePSK(exts)
+	if remotePSK == nil {
+		return err
+	}
+
+	var prevRemotePSK *PSK
+	kx.keyLocker.LockDo(func() {
+		prevRemotePSK = kx.remotePSK
+		kx.remotePSK = remotePSK
+	})
+	if remotePSK == prevRemotePSK {
+		return nil
+	}
+	kx.messenger.sess.debugf("[kx] the remote side uses PSK '%s'", remotePSK.ID)
+
+	if !remotePSK.Deprecated {
+		return nil
+	}
+	sess := kx.messenger.sess
+	if handler, ok := sess.eventHandler.(PSKEventHandler); ok {
+		go handler.OnDeprecatedPSK(sess, remotePSK.ID)
+	}
+	return nil
+}
+
+// handleKEMExtensions encapsulates a shared key for the ML-KEM encapsulation
+// key of the remote side (if it is a new one) and decapsulates the shared
+// key sent by the remote side (if it was not received, yet).
+func (kx *keyExchanger) handleKEMExtensions(
+	msg *keySeedUpdateMessage,
+	exts keySeedUpdateMessageExtensions,
+) error {
+	encapsulationKey := exts.Get(keySeedUpdateMessageExtensionTypeKEMEncapsulationKey)
+	if _, features, _ := kx.getProtocol(); !features.Has(ProtocolFeatureHybridKeyExchange) || encapsulationKey == nil {
+		return newErrHybridKeyExchangeUnsupported(`the remote side has not sent an ML-KEM encapsulation key`)
+	}
+
+	var remoteKEM *remoteKEMKey
+	kx.keyLocker.RLockDo(func() {
+		remoteKEM = kx.nextRemoteKEMKey
+	})
+	if remoteKEM == nil || remoteKEM.kxPublicKey != msg.KXPublicKey {
+		sharedKey, ciphertext, err := kemEncapsulate(encapsulationKey)
+		if err != nil {
+			return err
+		}
+		if err := protectKey(&kx.options, sharedKey); err != nil {
+			kx.messenger.sess.lockMemoryError(err)
+		}
+		kx.keyLocker.LockDo(func() {
+			if kx.prevRemoteKEMKey != nil {
+				destroyKey(&kx.options, kx.prevRemoteKEMKey.sharedKey)
+				kx.prevRemoteKEMKey.sharedKey = nil
+			}
+			kx.prevRemoteKEMKey = kx.nextRemoteKEMKey
+			kx.nextRemoteKEMKey = &remoteKEMKey{
+				kxPublicKey: msg.KXPublicKey,
+				ciphertext:  ciphertext,
+				sharedKey:   sharedKey,
+			}
+		})
+	}
+
+	ciphertextExt := exts.Get(keySeedUpdateMessageExtensionTypeKEMCiphertext)
+	if ciphertextExt == nil {
+		// The remote side does not know our encapsulation key, yet.
+		return nil
+	}
+	if len(ciphertextExt) < curve25519PublicKeySize {
+		return newErrTooShort(curve25519PublicKeySize, uint(len(ciphertextExt)))
+	}
+	var recipientPublicKey [curve25519PublicKeySize]byte
+	copy(recipientPublicKey[:], ciphertextExt)
+
+	var localKEM *localKEMKey
+	var isAlreadyKnown bool
+	kx.keyLocker.RLockDo(func() {
+		switch {
+		case kx.nextLocalPublicKey != nil && *kx.nextLocalPublicKey == recipientPublicKey:
+			localKEM = kx.nextLocalKEMKey
+		case kx.prevLocalPublicKey != nil && *kx.prevLocalPublicKey == recipientPublicKey:
+			localKEM = kx.prevLocalKEMKey
+		}
+		isAlreadyKnown = localKEM != nil && localKEM.sharedKey != nil
+	})
+	if localKEM == nil || isAlreadyKnown {
+		return nil
+	}
+
+	sharedKey, err := localKEM.key.Decapsulate(ciphertextExt[curve25519PublicKeySize:])
+	if err != nil {
+		return err
+	}
+	if err := protectKey(&kx.options, sharedKey); err != nil {
+		kx.messenger.sess.lockMemoryError(err)
+	}
+	kx.keyLocker.LockDo(func() {
+		localKEM.sharedKey = sharedKey
+	})
+	return nil
+}
+
+// isKEMComplete returns true if both ML-KEM shared keys for the recent
+// key exchange keys are known (or if the hybrid key exchange is disabled).
+func (kx *keyExchanger) isKEMComplete() (result bool) {
+	if !kx.options.EnableHybridKeyExchange {
+		return true
+	}
+	kx.keyLocker.RLockDo(func() {
+		result = kx.nextLocalKEMKey != nil && kx.nextLocalKEMKey.sharedKey != nil &&
+			kx.nextRemoteKEMKey != nil && kx.nextRemotePublicKey != nil &&
+			kx.nextRemoteKEMKey.kxPublicKey == *kx.nextRemotePublicKey
+	})
+	return
+}
+
+// makeAuthTranscript returns the data both sides agree on after the first
+// successful key exchange: identity public keys, key exchange public keys
+// and the shared secret. The parts are ordered the same way on both sides.
+//
+// It is used to derive the AuthenticationString and the keying material
+// (see setAuthTranscript).
+func (kx *keyExchanger) makeAuthTranscript() []byte {
+	sharedKey, err := kx.generateSharedKeyBySecretID(secretIDRecentBoth)
+	if err != nil {
+		kx.messenger.sess.debugf("[kx] unable to make the transcript: %v", err)
+		return nil
+	}
+
+	var localPart, remotePart []byte
+	kx.keyLocker.RLockDo(func() {
+		localPart = append(append(localPart, kx.localIdentity.publicKey()...), (*kx.nextLocalPublicKey)[:]...)
+		remotePart = append(append(remotePart, kx.remoteIdentity.publicKey()...), (*kx.nextRemotePublicKey)[:]...)
+	})
+	if bytes.Compare(localPart, remotePart) > 0 {
+		localPart, remotePart = remotePart, localPart
+	}
+
+	transcript := make([]byte, 0, len(localPart)+len(remotePart)+len(sharedKey))
+	transcript = append(transcript, localPart...)
+	transcript = append(transcript, remotePart...)
+	transcript = append(transcript, sharedKey...)
+	zeroBytes(sharedKey)
+	return transcript
+}
+
+// setAuthTranscript derives the AuthenticationString and the secret of
+// ExportKeyingMaterial from the transcript (see makeAuthTranscript) and
+// overwrites the transcript, so the shared secret is not kept
+// for the whole session.
+func (kx *keyExchanger) setAuthTranscript(transcript []byte) {
+	if transcript == nil {
+		return
+	}
+	kx.authString = newAuthenticationString(transcript)
+	kx.exporterSecret = hash(transcript, Salt, []byte("exporterSecret"))
+	zeroBytes(transcript)
+}
+
+// getAuthenticationString returns a copy of the AuthenticationString
+// derived on the first successful key exchange or nil if there was no
+// successful key exchange, yet.
+func (kx *keyExchanger) getAuthenticationString() *AuthenticationString {
+	kx.locker.RLock()
+	defer kx.locker.RUnlock()
+	if kx.authString == nil {
+		return nil
+	}
+	authString := *kx.authString
+	return &authString
+}
+
+// getExporterSecret returns a copy of the secret of ExportKeyingMaterial
+// derived on the first successful key exchange or nil if there was no
+// successful key exchange, yet.
+func (kx *keyExchanger) getExporterSecret() []byte {
+	kx.locker.RLock()
+	defer kx.locker.RUnlock()
+	if kx.exporterSecret == nil {
+		return nil
+	}
+	return append([]byte(nil), kx.exporterSecret...)
+}
+
+// handleIntroduction handles a message of the identity hiding mode
+// which has no encrypted part. It means the remote side does not know
+// our key exchange key, yet. So we send it (and our identity) encrypted
+// with the introduced key.
+//
+// The introduced key is not remembered, because it is not verified:
+// otherwise anybody could break the session (or the key exchange in
+// progress) by introducing a wrong key. The key of the remote side
+// is remembered only after a verified message is received (see Handle).
+//
+// After the remote side is verified, only introductions of a newer
+// remote session are answered (the remote side was restarted).
+func (kx *keyExchanger) handleIntroduction(hdr *keySeedUpdateMessageHiddenHeaders) {
+	kx.messenger.sess.debugf("[kx] received an introduction: %v (%v)", hdr.KXPublicKey[:], hdr.SessionID)
+	kx.locker.RLock()
+	remoteSessionID := kx.remoteSessionID
+	kx.locker.RUnlock()
+	var isVerified, isStarted bool
+	kx.keyLocker.RLockDo(func() {
+		isVerified = kx.hidingRemotePublicKey != nil
+		isStarted = kx.nextLocalPublicKey != nil
+	})
+	if isVerified && remoteSessionID != nil && hdr.SessionID.CreatedAt <= remoteSessionID.CreatedAt {
+		kx.messenger.sess.debugf("[kx] ignoring the introduction: the remote session is already verified")
+		return
+	}
+	if !isStarted {
+		// Our introduction will be sent by kx.loop() soon
+		return
+	}
+	remotePublicKey := hdr.KXPublicKey
+	kx.wg.Add(1)
+	go func() {
+		defer kx.wg.Done()
+		if err := kx.sendPublicKey(false, &remotePublicKey); err != nil {
+			kx.messenger.sess.debugf("[kx] unable to answer the introduction: %v", err)
+		}
+	}()
+}
+
+// getLocalPrivateKey returns a copy of the local key exchange private key
+// which corresponds to public key `pubKey` or nil if there's no such key
+// (anymore). The copy should be overwritten after use.
+func (kx *keyExchanger) getLocalPrivateKey(pubKey *[curve25519PublicKeySize]byte) (result *[curve25519PrivateKeySize]byte) {
+	kx.keyLocker.RLockDo(func() {
+		var privateKey *[curve25519PrivateKeySize]byte
+		switch {
+		case kx.nextLocalPublicKey != nil && *kx.nextLocalPublicKey == *pubKey:
+			privateKey = kx.nextLocalPrivateKey
+		case kx.prevLocalPublicKey != nil && *kx.prevLocalPublicKey == *pubKey:
+			privateKey = kx.prevLocalPrivateKey
+		}
+		if privateKey != nil {
+			privateKeyCopy := *privateKey
+			result = &privateKeyCopy
+		}
+	})
+	return
+}
+
+// newIdentityHidingCipher returns the cipher used to encrypt key exchange
+// messages in the identity hiding mode.
+func (kx *keyExchanger) newIdentityHidingCipher(
+	localPrivateKey *[curve25519PrivateKeySize]byte,
+	remotePublicKey *[curve25519PublicKeySize]byte,
+) (cipher.AEAD, error) {
+	secret := kx.ecdh.ComputeSecret(localPrivateKey, remotePublicKey)
+	defer zeroBytes(secret)
+	var zeroKey [32]byte
+	if bytes.Equal(secret, zeroKey[:]) {
+		return nil, newErrInvalidPublicKey()
+	}
+	key := hash(secret, Salt, []byte("identityHiding"))
+	defer zeroBytes(key)
+	return chacha20poly1305.NewX(key)
+}
+
+// hideMessage encrypts the signed key exchange message `b` for the
+// identity hiding mode. The message is encrypted for `remotePublicKey`,
+// or for the verified key exchange key of the remote side if
+// `remotePublicKey` is nil. If the key of the remote side is not known
+// yet, then only `localPublicKey` is sent.
+func (kx *keyExchanger) hideMessage(
+	localPublicKey *[curve25519PublicKeySize]byte,
+	remotePublicKey *[curve25519PublicKeySize]byte,
+	b []byte,
+) ([]byte, error) {
+	hdr := keySeedUpdateMessageHiddenHeaders{
+		KXPublicKey: *localPublicKey,
+		SessionID:   kx.messenger.sess.id,
+	}
+	if remotePublicKey == nil {
+		kx.keyLocker.RLockDo(func() {
+			remotePublicKey = kx.hidingRemotePublicKey
+		})
+	}
+
+	var aead cipher.AEAD
+	if remotePublicKey != nil {
+		localPrivateKey := kx.getLocalPrivateKey(localPublicKey)
+		if localPrivateKey == nil {
+			return nil, newErrLocalPrivateKeyIsNil()
+		}
+		defer zeroBytes(localPrivateKey[:])
+		var err error
+		aead, err = kx.newIdentityHidingCipher(localPrivateKey, remotePublicKey)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to initialize the cipher: %w", err)
+		}
+		hdr.RecipientKXPublicKey = *remotePublicKey
+		if _, err := io.ReadFull(kx.getCryptoRandReader(), hdr.Nonce[:]); err != nil {
+			return nil, xerrors.Errorf("unable to generate a nonce: %w", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binaryOrderType, &hdr); err != nil {
+		return nil, xerrors.Errorf("unable to encode the headers: %w", err)
+	}
+	if aead == nil {
+		return buf.Bytes(), nil
+	}
+	hdrBytes := buf.Bytes()
+	result := make([]byte, len(hdrBytes), len(hdrBytes)+len(b)+aead.Overhead())
+	copy(result, hdrBytes)
+	return aead.Seal(result, hdr.Nonce[:], b, hdrBytes), nil
+}
+
+// revealMessage decrypts a key exchange message of the identity hiding
+// mode. It returns the signed key exchange message and the (not verified)
+// headers. If the message is just an introduction (see hideMessage) then
+// the returned message is nil. If the message was encrypted for an already
+// rotated out local key then both returned values are nil.
+func (kx *keyExchanger) revealMessage(b []byte) ([]byte, *keySeedUpdateMessageHiddenHeaders, error) {
+	if len(b) < keySeedUpdateMessageHiddenHeadersSize {
+		return nil, nil, newErrTooShort(uint(keySeedUpdateMessageHiddenHeadersSize), uint(len(b)))
+	}
+	hdrBytes := b[:keySeedUpdateMessageHiddenHeadersSize]
+	var hdr keySeedUpdateMessageHiddenHeaders
+	if err := binary.Read(bytes.NewReader(hdrBytes), binaryOrderType, &hdr); err != nil {
+		return nil, nil, wrapError(err)
+	}
+
+	var zeroKey [curve25519PublicKeySize]byte
+	if hdr.KXPublicKey == zeroKey {
+		return nil, nil, newErrInvalidPublicKey()
+	}
+	if hdr.RecipientKXPublicKey == zeroKey {
+		return nil, &hdr, nil
+	}
+
+	localPrivateKey := kx.getLocalPrivateKey(&hdr.RecipientKXPublicKey)
+	if localPrivateKey == nil {
+		kx.messenger.sess.debugf("[kx] the message is encrypted for an unknown key: %v", hdr.RecipientKXPublicKey[:])
+		return nil, nil, nil
+	}
+	defer zeroBytes(localPrivateKey[:])
+	aead, err := kx.newIdentityHidingCipher(localPrivateKey, &hdr.KXPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	msgBytes, err := aead.Open(nil, hdr.Nonce[:], b[keySeedUpdateMessageHiddenHeadersSize:], hdrBytes)
+	if err != nil {
+		return nil, nil, newErrCannotDecrypt()
+	}
+	return msgBytes, &hdr, nil
+}
+
 func (kx *keyExchanger) sendSuccessNotifications() {
 	kx.messenger.sess.debugf("[kx] sendSuccessNotifications()")
 	var localNextKeyID uint64
@@ -544,7 +1703,7 @@ func (kx *keyExchanger) start() {
 func (kx *keyExchanger) loop() {
 	kx.KeyUpdateSendWait()
 
-	keyUpdateTicker := time.NewTicker(kx.options.KeyUpdateInterval)
+	keyUpdateTicker := kx.getClock().NewTicker(kx.options.KeyUpdateInterval)
 	defer keyUpdateTicker.Stop()
 
 	for {
@@ -552,7 +1711,7 @@ func (kx *keyExchanger) loop() {
 		case <-kx.ctx.Done():
 			_ = kx.messenger.Close()
 			return
-		case <-keyUpdateTicker.C:
+		case <-keyUpdateTicker.C():
 			kx.KeyUpdateSendWait()
 		}
 	}
@@ -576,13 +1735,33 @@ func (kx *keyExchanger) updateLocalKey() (result uint64) {
 		kx.errFunc(xerrors.Errorf("[kx] unable to generate ECDH keys: %w", err))
 		return 0
 	}
+	var localKEM *localKEMKey
+	if kx.options.EnableHybridKeyExchange {
+		kemKey, err := newKEMKey()
+		if err != nil {
+			_ = kx.Close()
+			kx.errFunc(xerrors.Errorf("[kx] unable to generate ML-KEM keys: %w", err))
+			return 0
+		}
+		localKEM = &localKEMKey{
+			key:              kemKey,
+			encapsulationKey: kemKey.EncapsulationKey(),
+		}
+	}
 	privKeyCasted := privKey.([curve25519PrivateKeySize]byte)
 	pubKeyCasted := pubKey.([curve25519PublicKeySize]byte)
+	if err := protectKey(&kx.options, privKeyCasted[:]); err != nil {
+		kx.messenger.sess.lockMemoryError(err)
+	}
 	kx.keyLocker.LockDo(func() {
+		kx.destroyLocalKey(kx.prevLocalPrivateKey, kx.prevLocalKEMKey)
 		kx.prevLocalPrivateKey = kx.nextLocalPrivateKey
+		kx.prevLocalPublicKey = kx.nextLocalPublicKey
+		kx.prevLocalKEMKey = kx.nextLocalKEMKey
 		kx.nextLocalPrivateKey = &privKeyCasted
 		kx.nextLocalPublicKey = &pubKeyCasted
-		kx.nextLocalKeyCreatedAt = uint64(timeNow().UnixNano())
+		kx.nextLocalKEMKey = localKEM
+		kx.nextLocalKeyCreatedAt = uint64(kx.getClock().Now().UnixNano())
 		if kx.nextLocalKeyCreatedAt <= kx.localKeyCreatedAt { // could happen due to time re-synchronization
 			kx.nextLocalKeyCreatedAt = kx.localKeyCreatedAt + 1
 		}
@@ -598,6 +1777,41 @@ func (kx *keyExchanger) updateLocalKey() (result uint64) {
 	return
 }
 
+// destroyLocalKey overwrites a local key exchange private key (and
+// the corresponding ML-KEM shared key) which is not needed anymore.
+//
+// It should be called with kx.keyLocker locked.
+func (kx *keyExchanger) destroyLocalKey(privateKey *[curve25519PrivateKeySize]byte, kem *localKEMKey) {
+	if privateKey != nil {
+		destroyKey(&kx.options, privateKey[:])
+	}
+	if kem != nil {
+		destroyKey(&kx.options, kem.sharedKey)
+		kem.sharedKey = nil
+	}
+}
+
+// destroyKeys overwrites all the secret keys of the key exchanger. It is
+// called when the session is closed, after that the key exchanger
+// is not able to calculate the secrets anymore.
+func (kx *keyExchanger) destroyKeys() {
+	kx.keyLocker.LockDo(func() {
+		kx.destroyLocalKey(kx.prevLocalPrivateKey, kx.prevLocalKEMKey)
+		kx.destroyLocalKey(kx.nextLocalPrivateKey, kx.nextLocalKEMKey)
+		kx.prevLocalPrivateKey, kx.nextLocalPrivateKey = nil, nil
+		for _, remoteKEM := range []*remoteKEMKey{kx.prevRemoteKEMKey, kx.nextRemoteKEMKey} {
+			if remoteKEM != nil {
+				destroyKey(&kx.options, remoteKEM.sharedKey)
+				remoteKEM.sharedKey = nil
+			}
+		}
+	})
+	kx.LockDo(func() {
+		zeroBytes(kx.exporterSecret)
+		kx.exporterSecret = nil
+	})
+}
+
 func (kx *keyExchanger) makeSuccessNotifyChanEmpty() (isDone bool) {
 	for {
 		select {
@@ -622,23 +1836,46 @@ func (kx *keyExchanger) getNextKeyCreatedAt() (nextKeyCreatedAt uint64) {
 	return
 }
 
+// requestKeyUpdate starts a key update in background (even if the key
+// was updated recently).
+func (kx *keyExchanger) requestKeyUpdate() {
+	kx.wg.Add(1)
+	go func() {
+		defer kx.wg.Done()
+		_ = kx.keyUpdateSendWait(kx.ctx, false)
+	}()
+}
+
 func (kx *keyExchanger) KeyUpdateSendWait() {
+	_ = kx.keyUpdateSendWait(kx.ctx, true)
+}
+
+// keyUpdateSendWait updates the local key, sends it to the remote side
+// and waits until the remote side confirms it.
+//
+// Returns ErrKeyExchangeTimeout if there was no confirmation within
+// KeyExchangerOptions.Timeout (then the key exchanger is closed) or
+// before the deadline of `ctx` (then the key exchanger is left as is).
+// If `ctx` is cancelled, then the error wraps `ctx.Err()`.
+func (kx *keyExchanger) keyUpdateSendWait(ctx context.Context, skipIfRecentlyUpdated bool) (err error) {
 	kx.messenger.sess.debugf("[kx] KeyUpdateSendWait")
 	kx.keyUpdateLocker.LockDo(func() {
 		// Check if we may update the key right now
-		if timeNow().Before(kx.skipKeyUpdateUntil) {
+		if skipIfRecentlyUpdated && kx.getClock().Now().Before(kx.skipKeyUpdateUntil) {
 			kx.messenger.sess.debugf("[kx] somebody already updated the key, skipping key-update iteration.")
 			return
 		}
 
 		// Empty the chan (to wait for the our event only on retries)
 		if kx.makeSuccessNotifyChanEmpty() {
+			err = newErrAlreadyClosed()
 			return
 		}
 
 		// Update the key (and increase nextKeyCreatedAt)
 		nextKeyCreatedAt := kx.getNextKeyCreatedAt()
 		if nextKeyCreatedAt == 0 {
+			err = xerrors.Errorf("unable to update the local key")
 			return
 		}
 
@@ -646,96 +1883,164 @@ func (kx *keyExchanger) KeyUpdateSendWait() {
 		kx.mustSendPublicKey(false)
 
 		// Send retries:
-		kx.retryUntilSuccessOrTimeout(nextKeyCreatedAt)
+		err = kx.retryUntilSuccessOrTimeout(ctx, nextKeyCreatedAt)
 	})
+	return
 }
 
-func (kx *keyExchanger) retryUntilSuccessOrTimeout(nextKeyCreatedAt uint64) {
+func (kx *keyExchanger) retryUntilSuccessOrTimeout(ctx context.Context, nextKeyCreatedAt uint64) error {
 	checkNewKeyCreatedAt := func(newKeyCreatedAt uint64) bool {
 		kx.messenger.sess.debugf("[kx] checkNewKeyCreatedAt: %v ?= %v", newKeyCreatedAt, nextKeyCreatedAt)
 		return newKeyCreatedAt >= nextKeyCreatedAt
 	}
-	checkSuccessNotifyChan := func() bool {
+	checkSuccessNotifyChan := func() (bool, error) {
 		select {
 		case newKeyCreatedAt, ok := <-kx.successNotifyChan:
 			kx.messenger.sess.debugf("[kx] retryUntilSuccessOrTimeout: late-success (keyCreatedAt == %v)", newKeyCreatedAt)
 			if !ok {
-				return true
+				return true, newErrAlreadyClosed()
 			}
-			return checkNewKeyCreatedAt(newKeyCreatedAt)
+			return checkNewKeyCreatedAt(newKeyCreatedAt), nil
 		default:
-			return false
+			return false, nil
 		}
 	}
-	timeoutTimer := time.NewTimer(kx.options.Timeout)
-	retryTicker := time.NewTicker(kx.options.RetryInterval)
+	timeoutTimer := kx.getClock().NewTimer(kx.options.Timeout)
+	defer timeoutTimer.Stop()
+	retryTicker := kx.getClock().NewTicker(kx.options.RetryInterval)
 	defer retryTicker.Stop()
 	for {
 		select {
 		case <-kx.ctx.Done():
 			kx.messenger.sess.debugf("[kx] retryUntilSuccessOrTimeout: done")
-			return
+			return newErrAlreadyClosed()
+		case <-ctx.Done():
+			kx.messenger.sess.debugf("[kx] retryUntilSuccessOrTimeout: context is done")
+			if kx.ctx.Err() != nil {
+				return newErrAlreadyClosed()
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				return newErrKeyExchangeTimeout()
+			}
+			return xerrors.Errorf("the key exchange is interrupted: %w", ctx.Err())
 		case newKeyCreatedAt, ok := <-kx.successNotifyChan:
 			kx.messenger.sess.debugf("[kx] retryUntilSuccessOrTimeout: success (keyCreatedAt == %v)", newKeyCreatedAt)
 			if !ok {
-				return
+				return newErrAlreadyClosed()
 			}
 			if checkNewKeyCreatedAt(newKeyCreatedAt) {
-				return
+				return nil
 			}
-		case <-retryTicker.C:
+		case <-retryTicker.C():
 			kx.messenger.sess.debugf("[kx] retryUntilSuccessOrTimeout: retry (waiting for keyCreatedAt == %v)", nextKeyCreatedAt)
-			if checkSuccessNotifyChan() { // just in case; TODO: check if it is really useful
-				return
+			if isDone, err := checkSuccessNotifyChan(); isDone { // just in case; TODO: check if it is really useful
+				return err
 			}
 			runtime.Gosched()
 			kx.mustSendPublicKey(false)
-		case <-timeoutTimer.C:
+		case <-timeoutTimer.C():
 			kx.messenger.sess.debugf("[kx] retryUntilSuccessOrTimeout: timeout")
-			if checkSuccessNotifyChan() { // just in case; TODO: check if it is really useful
-				return
+			if isDone, err := checkSuccessNotifyChan(); isDone { // just in case; TODO: check if it is really useful
+				return err
 			}
 			_ = kx.Close()
 			kx.errFunc(newErrKeyExchangeTimeout())
-			return
+			return newErrKeyExchangeTimeout()
 		}
 	}
 }
 
 func (kx *keyExchanger) mustSendPublicKey(isAnswer bool) {
-	err := kx.sendPublicKey(isAnswer)
+	err := kx.sendPublicKey(isAnswer, nil)
 	if err != nil {
 		_ = kx.Close()
 		kx.errFunc(xerrors.Errorf("[kx] unable to send a public key: %w", err))
 	}
 }
 
-func (kx *keyExchanger) sendPublicKey(isAnswer bool) error {
+// sendPublicKey sends the local key exchange key. In the identity hiding
+// mode the message is encrypted for `hidingRemotePublicKey` (see
+// hideMessage).
+func (kx *keyExchanger) sendPublicKey(isAnswer bool, hidingRemotePublicKey *[curve25519PublicKeySize]byte) error {
 	if kx.nextLocalPublicKey == nil && isAnswer {
 		kx.updateLocalKey()
-		kx.skipKeyUpdateUntil = timeNow().Add(kx.options.KeyUpdateInterval)
+		kx.skipKeyUpdateUntil = kx.getClock().Now().Add(kx.options.KeyUpdateInterval)
 	}
 	kx.messenger.sess.debugf("[kx] kx.sendPublicKey(isAnswer: %v)", isAnswer)
 	msg := &keySeedUpdateMessage{}
-	copy(msg.IdentityPublicKey[:], kx.localIdentity.Keys.Public)
+	copy(msg.IdentityPublicKey[:], kx.localIdentity.publicKey())
 	msg.SessionID = kx.messenger.sess.id
+	var localKEM *localKEMKey
+	var remoteKEM *remoteKEMKey
+	var timestamps keySeedUpdateMessageTimestamps
+	var isConnected, isTicketAccepted bool
 	kx.keyLocker.RLockDo(func() {
 		copy(msg.KXPublicKey[:], (*kx.nextLocalPublicKey)[:])
+		timestamps.KeyCreatedAt = kx.nextLocalKeyCreatedAt
+		localKEM = kx.nextLocalKEMKey
+		remoteKEM = kx.nextRemoteKEMKey
+		isConnected, isTicketAccepted = kx.isConnected, kx.isTicketAccepted
 	})
 	msg.Flags.SetIsAnswer(isAnswer)
 	msg.AnswersMode = kx.options.AnswersMode
-	return kx.send(msg)
+
+	var exts keySeedUpdateMessageExtensions
+	if kx.localIdentity != nil && kx.localIdentity.Certificate != nil {
+		certBytes, err := kx.localIdentity.Certificate.MarshalBinary()
+		if err != nil {
+			return xerrors.Errorf("unable to encode the certificate: %w", err)
+		}
+		exts.Add(keySeedUpdateMessageExtensionTypeCertificate, certBytes)
+	}
+	timestamps.CreatedAt = uint64(kx.getClock().Now().UnixNano())
+	exts.Add(keySeedUpdateMessageExtensionTypeTimestamps, timestamps.Bytes())
+	protocolVersionInfo := kx.localProtocolVersionInfo()
+	exts.Add(keySeedUpdateMessageExtensionTypeProtocolVersion, protocolVersionInfo.Bytes())
+	cipherSuitesExt := make([]byte, 0, len(kx.options.CipherSuites))
+	for _, suite := range kx.options.CipherSuites {
+		cipherSuitesExt = append(cipherSuitesExt, uint8(suite))
+	}
+	exts.Add(keySeedUpdateMessageExtensionTypeCipherSuites, cipherSuitesExt)
+	if ticket := kx.getResumptionTicket(); ticket != nil && !isConnected {
+		exts.Add(keySeedUpdateMessageExtensionTypeResumptionTicket, ticket.Ticket)
+	}
+	if isTicketAccepted {
+		exts.Add(keySeedUpdateMessageExtensionTypeResumptionTicketAccepted, []byte{})
+	}
+	if len(kx.psks) != 0 && kx.psks[0].ID != "" {
+		exts.Add(keySeedUpdateMessageExtensionTypePSKID, []byte(kx.psks[0].ID))
+	}
+	if kx.options.EnableHybridKeyExchange {
+		if localKEM == nil {
+			return newErrLocalPrivateKeyIsNil()
+		}
+		exts.Add(keySeedUpdateMessageExtensionTypeKEMEncapsulationKey, localKEM.encapsulationKey)
+		if remoteKEM != nil {
+			ciphertextExt := make([]byte, 0, len(remoteKEM.kxPublicKey)+len(remoteKEM.ciphertext))
+			ciphertextExt = append(ciphertextExt, remoteKEM.kxPublicKey[:]...)
+			ciphertextExt = append(ciphertextExt, remoteKEM.ciphertext...)
+			exts.Add(keySeedUpdateMessageExtensionTypeKEMCiphertext, ciphertextExt)
+		}
+	}
+	return kx.send(msg, exts, hidingRemotePublicKey)
 }
 
-func (kx *keyExchanger) send(msg *keySeedUpdateMessage) error {
-	buf := bytesextra.NewWriter(make([]byte, keySeedUpdateMessageSignedSize))
-	buf.CurrentPosition = keySignatureSize
-	err := binary.Write(buf, binaryOrderType, msg)
+func (kx *keyExchanger) send(
+	msg *keySeedUpdateMessage,
+	exts keySeedUpdateMessageExtensions,
+	hidingRemotePublicKey *[curve25519PublicKeySize]byte,
+) error {
+	bufBytes, err := kx.encode(msg, exts)
 	if err != nil {
-		return fmt.Errorf("unable to encode keySeedUpdateMessage: %w", err)
+		return err
+	}
+
+	if kx.options.EnableIdentityHiding {
+		bufBytes, err = kx.hideMessage(&msg.KXPublicKey, hidingRemotePublicKey, bufBytes)
+		if err != nil {
+			return xerrors.Errorf("unable to encrypt keySeedUpdateMessage: %w", err)
+		}
 	}
-	bufBytes := buf.Storage
-	kx.localIdentity.Sign(bufBytes[:keySignatureSize], bufBytes[keySignatureSize:])
 
 	n, err := kx.messenger.Write(bufBytes)
 	if err != nil {
@@ -748,6 +2053,52 @@ func (kx *keyExchanger) send(msg *keySeedUpdateMessage) error {
 	return nil
 }
 
+// encode returns the signed (or MAC-ed in the PSK-only mode) message
+// with the extensions.
+func (kx *keyExchanger) encode(
+	msg *keySeedUpdateMessage,
+	exts keySeedUpdateMessageExtensions,
+) ([]byte, error) {
+	if kx.localIdentity != nil && len(exts) != 0 {
+		// The signature of the extensions, see sign
+		msg.Flags.SetHasExtensions(true)
+		exts.Add(keySeedUpdateMessageExtensionTypeExtensionsSignature, make([]byte, keySignatureSize))
+	}
+	buf := bytesextra.NewWriter(make([]byte, keySeedUpdateMessageSignedSize+exts.Size()))
+	buf.CurrentPosition = keySignatureSize
+	err := binary.Write(buf, binaryOrderType, msg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode keySeedUpdateMessage: %w", err)
+	}
+	bufBytes := buf.Storage
+	exts.WriteTo(bufBytes[keySeedUpdateMessageSignedSize:])
+	if kx.localIdentity == nil {
+		kx.locker.RLock()
+		recipientSessionID := kx.remoteSessionID
+		kx.locker.RUnlock()
+		mac := calculateKeyExchangeMAC(&kx.psks[0], recipientSessionID, bufBytes[keySignatureSize:])
+		copy(bufBytes[:keySignatureSize], mac[:])
+	} else if err := kx.sign(bufBytes, exts); err != nil {
+		return nil, xerrors.Errorf("unable to sign keySeedUpdateMessage: %w", err)
+	}
+	return bufBytes, nil
+}
+
+// sign fills the signature of the encoded message `b` and the signature
+// of its extensions `exts` (the last extension is the placeholder for
+// the signature of the extensions, see
+// keySeedUpdateMessageExtensionTypeExtensionsSignature).
+func (kx *keyExchanger) sign(b []byte, exts keySeedUpdateMessageExtensions) error {
+	if err := kx.localIdentity.Sign(b[:keySignatureSize], b[keySignatureSize:keySeedUpdateMessageSignedSize]); err != nil {
+		return err
+	}
+	if len(exts) == 0 {
+		return nil
+	}
+	signature := b[len(b)-keySignatureSize:]
+	return kx.localIdentity.Sign(signature, keySeedUpdateMessageExtensionsSignedData(b[:len(b)-keySeedUpdateMessageExtensionHeadersSize-keySignatureSize]))
+}
+
 // WaitForClosure waits until the keyExchanger will be closed and will finish
 // everything.
 func (kx *keyExchanger) WaitForClosure() {
@@ -3,8 +3,10 @@ package secureio
 import (
 	"bytes"
 	"context"
-	"fmt"
-	"strings"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"testing"
 	"time"
 
@@ -25,10 +27,10 @@ func testKeyExchanger(t *testing.T, errFunc func(error)) *keyExchanger {
 		errFunc:    errFunc,
 		ecdh:       ecdh.X25519(),
 		messenger: &Messenger{sess: &Session{
+			id:                           globalSessionIDGetter.Get(),
 			ctx:                          ctx,
 			backend:                      newErroneousConn(),
 			state:                        newSessionStateStorage(),
-			cipherKeys:                   &[][][]byte{nil}[0],
 			messageHeadersPool:           newMessageHeadersPool(),
 			messageFragmentHeadersPool:   newMessageFragmentHeadersPool(),
 			messagesContainerHeadersPool: newMessagesContainerHeadersPool(),
@@ -46,6 +48,7 @@ func testKeyExchanger(t *testing.T, errFunc func(error)) *keyExchanger {
 	}
 	sess := kx.messenger.sess
 	sess.sendInfoPool = newSendInfoPool(sess)
+	sess.cipherKeys = sess.newCipherKeys(nil, nil)
 	sess.setSecrets([][]byte{make([]byte, 32), make([]byte, 32), make([]byte, 32), make([]byte, 32)})
 	return kx
 }
@@ -56,13 +59,13 @@ func TestKeyExchanger_generateSharedKey_negative(t *testing.T) {
 		errCount++
 	})
 
-	func() {
-		defer func() {
-			assert.True(t, strings.Index(fmt.Sprintf("%v", recover()), `should not happen`) != -1)
-		}()
-		var a [32]byte
-		_, _ = kx.generateSharedKey(&a, &a)
-	}()
+	var a [32]byte
+	_, err := kx.generateSharedKey(&a, &a)
+	assert.True(t, err.Has(errInvalidPublicKey{}), err)
+	lowOrderKey := [32]byte{1} // a point of order 4
+	assert.True(t, kx.isLowOrderPublicKey(&lowOrderKey))
+	_, err = kx.generateSharedKey(&a, &lowOrderKey)
+	assert.True(t, err.Has(errInvalidPublicKey{}), err)
 
 	assert.True(t, kx.Handle(nil).(*xerrors.Error).Has(ErrTooShort{}))
 	assert.True(t, kx.Handle(make([]byte, 65536)).(*xerrors.Error).Has(ErrInvalidSignature{}))
@@ -87,3 +90,215 @@ func TestKeyExchanger_KeyUpdateSendWait_timeout(t *testing.T) {
 	kx.KeyUpdateSendWait()
 	assert.Equal(t, 1, errCount)
 }
+
+func TestKeyExchanger_keyUpdateSendWait_contextTimeout(t *testing.T) {
+	kx := testKeyExchanger(t, func(err error) {
+		t.Error(err)
+	})
+	kx.options.Timeout = time.Hour
+	kx.options.RetryInterval = time.Hour
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelFunc()
+	err := kx.keyUpdateSendWait(ctx, false)
+	assert.True(t, err.(*xerrors.Error).Has(ErrKeyExchangeTimeout{}), err)
+	assert.NoError(t, kx.ctx.Err())
+}
+
+func TestKeyExchanger_keyUpdateSendWait_contextCancel(t *testing.T) {
+	kx := testKeyExchanger(t, func(err error) {
+		t.Error(err)
+	})
+	kx.options.Timeout = time.Hour
+	kx.options.RetryInterval = time.Hour
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+	err := kx.keyUpdateSendWait(ctx, false)
+	assert.False(t, err.(*xerrors.Error).Has(ErrKeyExchangeTimeout{}), err)
+	assert.True(t, errors.Is(err, context.Canceled), err)
+	assert.NoError(t, kx.ctx.Err())
+}
+
+func TestKeyExchanger_checkTimestamps(t *testing.T) {
+	kx := testKeyExchanger(t, func(err error) {
+		t.Error(err)
+	})
+	kx.options.MaximalTimeDifference = time.Minute
+
+	msg := &keySeedUpdateMessage{SessionID: SessionID{CreatedAt: 1, Random: 2}}
+	msg.KXPublicKey[0] = 1
+	check := func(createdAt time.Time, keyCreatedAt uint64) error {
+		var exts keySeedUpdateMessageExtensions
+		timestamps := keySeedUpdateMessageTimestamps{
+			CreatedAt:    uint64(createdAt.UnixNano()),
+			KeyCreatedAt: keyCreatedAt,
+		}
+		exts.Add(keySeedUpdateMessageExtensionTypeTimestamps, timestamps.Bytes())
+		return kx.checkTimestamps(msg, exts)
+	}
+
+	assert.NoError(t, check(timeNow(), 10))
+	assert.NoError(t, check(timeNow(), 10)) // a retry or an answer
+	assert.True(t, check(timeNow().Add(-time.Hour), 10).(*xerrors.Error).Has(ErrInvalidTimestamp{}))
+	assert.True(t, check(timeNow().Add(time.Hour), 10).(*xerrors.Error).Has(ErrInvalidTimestamp{}))
+	assert.True(t, kx.checkTimestamps(msg, nil).(*xerrors.Error).Has(ErrInvalidTimestamp{}))
+
+	msg.KXPublicKey[0] = 2
+	assert.True(t, check(timeNow(), 10).(*xerrors.Error).Has(ErrInvalidKeyCreatedAt{}))
+	assert.NoError(t, check(timeNow(), 11))
+	msg.KXPublicKey[0] = 1
+	assert.True(t, check(timeNow(), 10).(*xerrors.Error).Has(ErrInvalidKeyCreatedAt{}))
+
+	// a new remote session
+	msg.SessionID.CreatedAt++
+	assert.NoError(t, check(timeNow(), 1))
+
+	// an old remote session does not reset the counter
+	msg.SessionID.CreatedAt--
+	assert.True(t, check(timeNow(), 100).(*xerrors.Error).Has(ErrOldRemoteSessionID{}))
+	msg.SessionID.CreatedAt++
+	assert.True(t, check(timeNow(), 0).(*xerrors.Error).Has(ErrInvalidKeyCreatedAt{}))
+
+	kx.options.MaximalTimeDifference = 0
+	assert.NoError(t, kx.checkTimestamps(msg, nil))
+}
+
+func TestKeyExchanger_encode_signatures(t *testing.T) {
+	kx := testKeyExchanger(t, func(err error) {
+		t.Error(err)
+	})
+	pubKey := kx.localIdentity.Keys.Public
+
+	verify := func(b []byte) (keySeedUpdateMessageExtensions, error) {
+		var msg keySeedUpdateMessage
+		assert.NoError(t, binary.Read(bytes.NewReader(b[keySignatureSize:keySeedUpdateMessageSignedSize]), binaryOrderType, &msg))
+		exts, _ := parseKeySeedUpdateMessageExtensions(b[keySeedUpdateMessageSignedSize:])
+		return verifyKeySeedUpdateMessageSignatures(pubKey, &msg, b, exts)
+	}
+
+	var exts keySeedUpdateMessageExtensions
+	exts.Add(keySeedUpdateMessageExtensionTypeCipherSuites, []byte{uint8(CipherSuiteAES256GCM)})
+	b, err := kx.encode(&keySeedUpdateMessage{}, exts)
+	assert.NoError(t, err)
+	verifiedExts, err := verify(b)
+	assert.NoError(t, err)
+	assert.Equal(t, exts, verifiedExts)
+
+	// The signature of keySeedUpdateMessage does not cover the extensions,
+	// so remote sides of ProtocolVersionLegacy could verify it.
+	assert.True(t, ed25519.Verify(pubKey, b[keySignatureSize:keySeedUpdateMessageSignedSize], b[:keySignatureSize]))
+
+	// The extensions could not be cut off or modified
+	_, err = verify(b[:keySeedUpdateMessageSignedSize])
+	assert.True(t, err.(*xerrors.Error).Has(ErrInvalidSignature{}))
+	b[keySeedUpdateMessageSignedSize+keySeedUpdateMessageExtensionHeadersSize]++
+	_, err = verify(b)
+	assert.True(t, err.(*xerrors.Error).Has(ErrInvalidSignature{}))
+
+	// A message of ProtocolVersionLegacy, its tail is ignored
+	b, err = kx.encode(&keySeedUpdateMessage{}, nil)
+	assert.NoError(t, err)
+	verifiedExts, err = verify(append(b, 1, 2, 3))
+	assert.NoError(t, err)
+	assert.Nil(t, verifiedExts)
+}
+
+func TestKeyExchanger_Handle_oldRemoteSession(t *testing.T) {
+	kx := testKeyExchanger(t, func(err error) {})
+	kx.options.AnswersMode = KeyExchangeAnswersModeDisable
+	kx.options.CipherSuites = DefaultCipherSuites
+	kx.setSecretsFunc = func(CipherSuite, [][]byte) {}
+	kx.doneFunc = func() {}
+	kx.updateLocalKey()
+
+	remoteKX := testKeyExchanger(t, func(err error) {})
+	remoteKX.localIdentity = kx.remoteIdentity
+	message := func(sessionID SessionID, keyCreatedAt uint64) []byte {
+		msg := &keySeedUpdateMessage{
+			SessionID:   sessionID,
+			AnswersMode: KeyExchangeAnswersModeDisable,
+		}
+		copy(msg.IdentityPublicKey[:], remoteKX.localIdentity.Keys.Public)
+		_, kxPublicKey, err := remoteKX.ecdh.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		msg.KXPublicKey = kxPublicKey.([curve25519PublicKeySize]byte)
+		var exts keySeedUpdateMessageExtensions
+		timestamps := keySeedUpdateMessageTimestamps{
+			CreatedAt:    uint64(timeNow().UnixNano()),
+			KeyCreatedAt: keyCreatedAt,
+		}
+		exts.Add(keySeedUpdateMessageExtensionTypeTimestamps, timestamps.Bytes())
+		b, err := remoteKX.encode(msg, exts)
+		assert.NoError(t, err)
+		return b
+	}
+
+	oldSessionID := SessionID{CreatedAt: 1, Random: 1}
+	oldMessage := message(oldSessionID, 10) // captured by an attacker
+
+	newSessionID := SessionID{CreatedAt: 2, Random: 2}
+	assert.NoError(t, kx.Handle(message(newSessionID, 1)))
+	assert.Equal(t, newSessionID, *kx.remoteSessionID)
+
+	// A replay of the message of the previous remote session is ignored
+	// and does not reset the key creation counter of the current one.
+	err := kx.Handle(oldMessage)
+	assert.True(t, err.(*xerrors.Error).Has(ErrOldRemoteSessionID{}), err)
+	assert.Equal(t, newSessionID, *kx.remoteSessionID)
+	assert.Equal(t, newSessionID, *kx.remoteKeyIDSessionID)
+	assert.Equal(t, uint64(1), kx.remoteKeyID)
+	assert.NoError(t, kx.Handle(message(newSessionID, 2)))
+}
+
+func TestKeyExchanger_Handle_unboundMACReplay(t *testing.T) {
+	psks := []PSK{{Key: []byte(`unit-test`)}}
+	kx := testKeyExchanger(t, func(err error) {})
+	kx.localIdentity = nil
+	kx.psks = psks
+	kx.options.AnswersMode = KeyExchangeAnswersModeDisable
+	kx.options.CipherSuites = DefaultCipherSuites
+	kx.setSecretsFunc = func(CipherSuite, [][]byte) {}
+	kx.doneFunc = func() {}
+	kx.updateLocalKey()
+
+	remoteKX := testKeyExchanger(t, func(err error) {})
+	remoteKX.localIdentity = nil
+	remoteKX.psks = psks
+	message := func(sessionID SessionID, keyCreatedAt uint64, recipientSessionID *SessionID) []byte {
+		remoteKX.remoteSessionID = recipientSessionID
+		msg := &keySeedUpdateMessage{
+			SessionID:   sessionID,
+			AnswersMode: KeyExchangeAnswersModeDisable,
+		}
+		_, kxPublicKey, err := remoteKX.ecdh.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		msg.KXPublicKey = kxPublicKey.([curve25519PublicKeySize]byte)
+		var exts keySeedUpdateMessageExtensions
+		timestamps := keySeedUpdateMessageTimestamps{
+			CreatedAt:    uint64(timeNow().UnixNano()),
+			KeyCreatedAt: keyCreatedAt,
+		}
+		exts.Add(keySeedUpdateMessageExtensionTypeTimestamps, timestamps.Bytes())
+		b, err := remoteKX.encode(msg, exts)
+		assert.NoError(t, err)
+		return b
+	}
+
+	// The remote side does not know the local SessionID, yet
+	remoteSessionID := SessionID{CreatedAt: 2, Random: 2}
+	assert.NoError(t, kx.Handle(message(remoteSessionID, 1, nil)))
+	assert.Equal(t, remoteSessionID, *kx.remoteSessionID)
+
+	// A message of the accepted remote session should be bound to
+	// the local SessionID, so a replay of an unbound message is rejected
+	unboundMessage := message(remoteSessionID, 2, nil)
+	err := kx.Handle(unboundMessage)
+	assert.True(t, err.(*xerrors.Error).Has(ErrInvalidSignature{}), err)
+	assert.Equal(t, uint64(1), kx.remoteKeyID)
+	assert.NoError(t, kx.Handle(message(remoteSessionID, 2, &kx.messenger.sess.id)))
+
+	// The restarted remote side does not know the local SessionID
+	restartedSessionID := SessionID{CreatedAt: 3, Random: 3}
+	assert.NoError(t, kx.Handle(message(restartedSessionID, 1, nil)))
+}
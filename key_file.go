@@ -0,0 +1,367 @@
+package secureio
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+const (
+	pemTypeOpenSSHPrivateKey = `OPENSSH PRIVATE KEY`
+	pemTypePKCS8PrivateKey   = `PRIVATE KEY`
+	pemTypePKIXPublicKey     = `PUBLIC KEY`
+	pemTypeLegacyPrivateKey  = `ED25519 PRIVATE KEY`
+	pemTypeLegacyPublicKey   = `ED25519 PUBLIC KEY`
+
+	openSSHKeyMagic = "openssh-key-v1\x00"
+)
+
+// KeyFileFormat defines how ED25519 keys are serialized into files.
+type KeyFileFormat uint8
+
+const (
+	// KeyFileFormatUndefined means the format is not defined (or was
+	// not recognized).
+	KeyFileFormatUndefined = KeyFileFormat(iota)
+
+	// KeyFileFormatOpenSSH is the format used by OpenSSH (`ssh-keygen`):
+	// "OPENSSH PRIVATE KEY" PEM block for the private key and
+	// the one-line authorized_keys format ("ssh-ed25519 AAAA... comment")
+	// for the public key.
+	KeyFileFormatOpenSSH
+
+	// KeyFileFormatPKCS8 is the format used by OpenSSL and most of
+	// the X.509 tooling: a PKCS#8 "PRIVATE KEY" PEM block for the private
+	// key and a PKIX "PUBLIC KEY" PEM block for the public key.
+	KeyFileFormatPKCS8
+
+	// KeyFileFormatLegacyPEM is the format used by previous versions
+	// of this package: "ED25519 PRIVATE KEY" and "ED25519 PUBLIC KEY" PEM
+	// blocks with raw keys inside.
+	KeyFileFormatLegacyPEM
+
+	// KeyFileFormatEncryptedPEM is the format of passphrase-protected
+	// private keys: a "SECUREIO ENCRYPTED PRIVATE KEY" PEM block with
+	// the key encrypted by XChaCha20-Poly1305 using a key derived
+	// from the passphrase by Argon2id. The public key is saved in
+	// the format KeyFileFormatOpenSSH.
+	//
+	// See `NewIdentityWithPassphrase`.
+	KeyFileFormatEncryptedPEM
+)
+
+// DefaultKeyFileFormat is the format used to save newly generated keys.
+const DefaultKeyFileFormat = KeyFileFormatOpenSSH
+
+func (format KeyFileFormat) String() string {
+	switch format {
+	case KeyFileFormatUndefined:
+		return `undefined`
+	case KeyFileFormatOpenSSH:
+		return `openssh`
+	case KeyFileFormatPKCS8:
+		return `pkcs8`
+	case KeyFileFormatLegacyPEM:
+		return `legacy_pem`
+	case KeyFileFormatEncryptedPEM:
+		return `encrypted_pem`
+	}
+	return fmt.Sprintf(`unknown_%d`, uint8(format))
+}
+
+// parsePrivateKey detects the format of a private key file content
+// and parses it. `passphraseFunc` is used only if the key is
+// passphrase-protected, it could be nil.
+func parsePrivateKey(b []byte, passphraseFunc PassphraseFunc) (key ed25519.PrivateKey, format KeyFileFormat, err error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, KeyFileFormatUndefined, newErrUnsupportedKeyFormat(`not a PEM-encoded key`)
+	}
+
+	switch block.Type {
+	case pemTypeOpenSSHPrivateKey:
+		format = KeyFileFormatOpenSSH
+		var rawKey interface{}
+		rawKey, err = ssh.ParseRawPrivateKey(b)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			var passphrase []byte
+			passphrase, err = passphraseFunc.get()
+			if err != nil {
+				return nil, format, err
+			}
+			rawKey, err = ssh.ParseRawPrivateKeyWithPassphrase(b, passphrase)
+			if err == x509.IncorrectPasswordError {
+				return nil, format, newErrWrongPassphrase()
+			}
+		}
+		if err != nil {
+			break
+		}
+		switch rawKey := rawKey.(type) {
+		case *ed25519.PrivateKey:
+			key = *rawKey
+		case ed25519.PrivateKey:
+			key = rawKey
+		default:
+			return nil, format, newErrUnsupportedKeyFormat(fmt.Sprintf(`OpenSSH private key of type %T`, rawKey))
+		}
+	case pemTypePKCS8PrivateKey:
+		format = KeyFileFormatPKCS8
+		var rawKey interface{}
+		rawKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			break
+		}
+		var ok bool
+		key, ok = rawKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, format, newErrUnsupportedKeyFormat(fmt.Sprintf(`PKCS#8 private key of type %T`, rawKey))
+		}
+	case pemTypeLegacyPrivateKey:
+		format = KeyFileFormatLegacyPEM
+		if len(block.Bytes) != ed25519.PrivateKeySize {
+			err = newErrWrongKeyLength(ed25519.PrivateKeySize, uint(len(block.Bytes)))
+			break
+		}
+		key = block.Bytes
+	case pemTypeEncryptedPrivateKey:
+		format = KeyFileFormatEncryptedPEM
+		key, err = decryptPrivateKey(block, passphraseFunc)
+		if err != nil {
+			return nil, format, err
+		}
+	default:
+		return nil, KeyFileFormatUndefined, newErrUnsupportedKeyFormat(fmt.Sprintf(`PEM block "%s"`, block.Type))
+	}
+	if err != nil {
+		return nil, format, xerrors.Errorf("unable to parse a private key of format %v: %w", format, err)
+	}
+
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, format, newErrWrongKeyLength(ed25519.PrivateKeySize, uint(len(key)))
+	}
+	return
+}
+
+// parsePublicKey detects the format of a public key file content
+// and parses it.
+func parsePublicKey(b []byte) (key ed25519.PublicKey, format KeyFileFormat, err error) {
+	trimmed := bytes.TrimSpace(b)
+	if !bytes.HasPrefix(trimmed, []byte("-----BEGIN ")) {
+		format = KeyFileFormatOpenSSH
+		key, err = parseAuthorizedKey(trimmed)
+		return
+	}
+
+	block, _ := pem.Decode(trimmed)
+	if block == nil {
+		return nil, KeyFileFormatUndefined, newErrUnsupportedKeyFormat(`malformed PEM block`)
+	}
+
+	switch block.Type {
+	case pemTypePKIXPublicKey:
+		format = KeyFileFormatPKCS8
+		var rawKey interface{}
+		rawKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, format, xerrors.Errorf("unable to parse a public key of format %v: %w", format, err)
+		}
+		var ok bool
+		key, ok = rawKey.(ed25519.PublicKey)
+		if !ok {
+			return nil, format, newErrUnsupportedKeyFormat(fmt.Sprintf(`PKIX public key of type %T`, rawKey))
+		}
+	case pemTypeLegacyPublicKey:
+		format = KeyFileFormatLegacyPEM
+		key = block.Bytes
+	default:
+		return nil, KeyFileFormatUndefined, newErrUnsupportedKeyFormat(fmt.Sprintf(`PEM block "%s"`, block.Type))
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, format, newErrWrongKeyLength(ed25519.PublicKeySize, uint(len(key)))
+	}
+	return
+}
+
+// parseAuthorizedKey parses a public key in the one-line authorized_keys
+// format ("ssh-ed25519 AAAA... comment").
+func parseAuthorizedKey(line []byte) (ed25519.PublicKey, error) {
+	sshPubKey, _, _, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to parse a public key of format %v: %w", KeyFileFormatOpenSSH, err)
+	}
+	return sshPublicKeyToED25519(sshPubKey)
+}
+
+func sshPublicKeyToED25519(sshPubKey ssh.PublicKey) (ed25519.PublicKey, error) {
+	if sshPubKey.Type() != ssh.KeyAlgoED25519 {
+		return nil, newErrUnsupportedKeyFormat(fmt.Sprintf(`OpenSSH public key of type "%s"`, sshPubKey.Type()))
+	}
+	cryptoPubKey, ok := sshPubKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, newErrUnsupportedKeyFormat(fmt.Sprintf(`OpenSSH public key of type %T`, sshPubKey))
+	}
+	key, ok := cryptoPubKey.CryptoPublicKey().(ed25519.PublicKey)
+	if !ok {
+		return nil, newErrUnsupportedKeyFormat(fmt.Sprintf(`OpenSSH public key of type %T`, cryptoPubKey.CryptoPublicKey()))
+	}
+	return key, nil
+}
+
+// marshalPrivateKey serializes the private key into a PEM block
+// of the format `format`. `passphrase` is used only for
+// format KeyFileFormatEncryptedPEM.
+func marshalPrivateKey(key ed25519.PrivateKey, format KeyFileFormat, passphrase []byte, randReader io.Reader) (*pem.Block, error) {
+	switch format {
+	case KeyFileFormatOpenSSH:
+		b, err := marshalOpenSSHPrivateKey(key, ``, randReader)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: pemTypeOpenSSHPrivateKey, Bytes: b}, nil
+	case KeyFileFormatPKCS8:
+		b, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to marshal a PKCS#8 private key: %w", err)
+		}
+		return &pem.Block{Type: pemTypePKCS8PrivateKey, Bytes: b}, nil
+	case KeyFileFormatLegacyPEM:
+		return &pem.Block{Type: pemTypeLegacyPrivateKey, Bytes: key}, nil
+	case KeyFileFormatEncryptedPEM:
+		return encryptPrivateKey(key, passphrase, randReader)
+	}
+	return nil, newErrUnsupportedKeyFormat(format.String())
+}
+
+// marshalPublicKey serializes the public key into the format `format`.
+func marshalPublicKey(key ed25519.PublicKey, format KeyFileFormat) ([]byte, error) {
+	switch format {
+	case KeyFileFormatOpenSSH, KeyFileFormatEncryptedPEM:
+		sshPubKey, err := ssh.NewPublicKey(key)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to convert the public key: %w", err)
+		}
+		return ssh.MarshalAuthorizedKey(sshPubKey), nil
+	case KeyFileFormatPKCS8:
+		b, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to marshal a PKIX public key: %w", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: pemTypePKIXPublicKey, Bytes: b}), nil
+	case KeyFileFormatLegacyPEM:
+		return pem.EncodeToMemory(&pem.Block{Type: pemTypeLegacyPublicKey, Bytes: key}), nil
+	}
+	return nil, newErrUnsupportedKeyFormat(format.String())
+}
+
+// marshalOpenSSHPrivateKey serializes an unencrypted ED25519 private key
+// into the OpenSSH format, see
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+func marshalOpenSSHPrivateKey(key ed25519.PrivateKey, comment string, randReader io.Reader) ([]byte, error) {
+	if randReader == nil {
+		randReader = rand.Reader
+	}
+	var checkBytes [4]byte
+	if _, err := io.ReadFull(randReader, checkBytes[:]); err != nil {
+		return nil, xerrors.Errorf("unable to generate a check value: %w", err)
+	}
+	check := binary.BigEndian.Uint32(checkBytes[:])
+
+	pubKey := key.Public().(ed25519.PublicKey)
+	pubKeyBlob := ssh.Marshal(struct {
+		KeyType string
+		PubKey  []byte
+	}{ssh.KeyAlgoED25519, pubKey})
+
+	privKeyBlock := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		PubKey  []byte
+		PrivKey []byte
+		Comment string
+	}{check, check, ssh.KeyAlgoED25519, pubKey, key, comment})
+
+	// Padding to the block size of cipher "none" (which is 8)
+	for i := 0; len(privKeyBlock)%8 != 0; i++ {
+		privKeyBlock = append(privKeyBlock, byte(i+1))
+	}
+
+	return append([]byte(openSSHKeyMagic), ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, pubKeyBlob, privKeyBlock})...), nil
+}
+
+func writeKeyFile(filePath string, b []byte) error {
+	keyFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return xerrors.Errorf("unable to open file: %w", err)
+	}
+	defer func() { _ = keyFile.Close() }()
+
+	_, err = keyFile.Write(b)
+	if err != nil {
+		return xerrors.Errorf("unable to write to file '%s': %w", filePath, err)
+	}
+
+	return nil
+}
+
+// replaceKeyFile is the same as writeKeyFile, but the file is
+// replaced atomically (so the old content is not lost on failure).
+func replaceKeyFile(filePath string, b []byte) error {
+	tmpPath := filePath + `.new`
+	if err := writeKeyFile(tmpPath, b); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		_ = os.Remove(tmpPath)
+		return xerrors.Errorf("unable to replace file '%s': %w", filePath, err)
+	}
+	return nil
+}
+
+func loadPublicKeyFromFile(keyPtr *ed25519.PublicKey, path string) error {
+	keyBytes, err := ioutil.ReadFile(path) // #nosec
+	if err != nil {
+		return xerrors.Errorf("unable to read key from file '%s': %w", path, err)
+	}
+
+	key, _, err := parsePublicKey(keyBytes)
+	if err != nil {
+		return xerrors.Errorf("unable to parse key from file '%s': %w", path, err)
+	}
+	*keyPtr = key
+	return nil
+}
+
+func loadPrivateKeyFromFile(keyPtr *ed25519.PrivateKey, path string, passphraseFunc PassphraseFunc) error {
+	keyBytes, err := ioutil.ReadFile(path) // #nosec
+	if err != nil {
+		return xerrors.Errorf("unable to read file: %w", err)
+	}
+
+	key, _, err := parsePrivateKey(keyBytes, passphraseFunc)
+	if err != nil {
+		return xerrors.Errorf("unable to parse key from file '%s': %w", path, err)
+	}
+	*keyPtr = key
+	return nil
+}
@@ -0,0 +1,201 @@
+package secureio
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+const (
+	pemTypeEncryptedPrivateKey = `SECUREIO ENCRYPTED PRIVATE KEY`
+
+	pemHeaderKDF       = `KDF`
+	pemHeaderKDFParams = `KDF-Params`
+	pemHeaderSalt      = `Salt`
+	pemHeaderCipher    = `Cipher`
+	pemHeaderNonce     = `Nonce`
+
+	keyFileKDFArgon2id             = `argon2id`
+	keyFileCipherXChaCha20Poly1305 = `xchacha20-poly1305`
+
+	keyFileSaltSize = 32
+
+	// keyFileMinSaltSize is the minimal size of the salt of a key file
+	// to be accepted.
+	keyFileMinSaltSize = 16
+
+	// keyFileKDFMaxMemory, keyFileKDFMaxTime and keyFileKDFMaxThreads are
+	// the limits of the KDF parameters (memory is in KiB) of a key file to
+	// be accepted. They are required to prevent exhausting the memory
+	// or the CPU due to a malformed file.
+	keyFileKDFMaxMemory  = 4 * 1024 * 1024
+	keyFileKDFMaxTime    = 64
+	keyFileKDFMaxThreads = 64
+)
+
+var (
+	// See argon2.IDKey(). These values are stored in the key file, so
+	// they could be changed without breaking existing files.
+	keyFileKDFTime    = uint32(3)
+	keyFileKDFMemory  = uint32(64 * 1024)
+	keyFileKDFThreads = uint8(4)
+)
+
+// PassphraseFunc returns a passphrase to encrypt or decrypt a private key
+// file. It is called only if a passphrase is actually required.
+type PassphraseFunc func() ([]byte, error)
+
+func (fn PassphraseFunc) get() ([]byte, error) {
+	if fn == nil {
+		return nil, newErrPassphraseRequired()
+	}
+	passphrase, err := fn()
+	if err != nil {
+		return nil, xerrors.Errorf("unable to get the passphrase: %w", err)
+	}
+	if len(passphrase) == 0 {
+		return nil, newErrPassphraseRequired()
+	}
+	return passphrase, nil
+}
+
+func keyFileKDFParamsString(kdfTime, kdfMemory uint32, kdfThreads uint8) string {
+	return fmt.Sprintf("t=%d,m=%d,p=%d", kdfTime, kdfMemory, kdfThreads)
+}
+
+// keyFileAAD returns the additional authenticated data for the AEAD, so
+// it's not possible to tamper the parameters of an encrypted key file.
+func keyFileAAD(headers map[string]string) []byte {
+	return []byte(headers[pemHeaderKDF] + "|" + headers[pemHeaderKDFParams] + "|" +
+		headers[pemHeaderSalt] + "|" + headers[pemHeaderCipher])
+}
+
+// encryptPrivateKey encrypts the private key with a key derived from
+// the passphrase using Argon2id. The key is encrypted by XChaCha20-Poly1305.
+func encryptPrivateKey(key ed25519.PrivateKey, passphrase []byte, randReader io.Reader) (*pem.Block, error) {
+	if len(passphrase) == 0 {
+		return nil, newErrPassphraseRequired()
+	}
+	if randReader == nil {
+		randReader = rand.Reader
+	}
+
+	salt := make([]byte, keyFileSaltSize)
+	if _, err := io.ReadFull(randReader, salt); err != nil {
+		return nil, xerrors.Errorf("unable to generate a salt: %w", err)
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := io.ReadFull(randReader, nonce); err != nil {
+		return nil, xerrors.Errorf("unable to generate a nonce: %w", err)
+	}
+
+	block := &pem.Block{
+		Type: pemTypeEncryptedPrivateKey,
+		Headers: map[string]string{
+			pemHeaderKDF:       keyFileKDFArgon2id,
+			pemHeaderKDFParams: keyFileKDFParamsString(keyFileKDFTime, keyFileKDFMemory, keyFileKDFThreads),
+			pemHeaderSalt:      hex.EncodeToString(salt),
+			pemHeaderCipher:    keyFileCipherXChaCha20Poly1305,
+			pemHeaderNonce:     hex.EncodeToString(nonce),
+		},
+	}
+
+	derivedKey := argon2.IDKey(passphrase, salt, keyFileKDFTime, keyFileKDFMemory, keyFileKDFThreads, chacha20poly1305.KeySize)
+	defer zeroBytes(derivedKey)
+	aead, err := chacha20poly1305.NewX(derivedKey)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to initialize the cipher: %w", err)
+	}
+	block.Bytes = aead.Seal(nil, nonce, key, keyFileAAD(block.Headers))
+	return block, nil
+}
+
+// decryptPrivateKey is the reverse function for encryptPrivateKey.
+func decryptPrivateKey(block *pem.Block, passphraseFunc PassphraseFunc) (ed25519.PrivateKey, error) {
+	if block.Headers[pemHeaderKDF] != keyFileKDFArgon2id {
+		return nil, newErrUnsupportedKeyFormat(fmt.Sprintf(`encrypted private key with KDF "%s"`, block.Headers[pemHeaderKDF]))
+	}
+	if block.Headers[pemHeaderCipher] != keyFileCipherXChaCha20Poly1305 {
+		return nil, newErrUnsupportedKeyFormat(fmt.Sprintf(`encrypted private key with cipher "%s"`, block.Headers[pemHeaderCipher]))
+	}
+
+	var (
+		kdfTime, kdfMemory uint32
+		kdfThreads         uint8
+	)
+	kdfParams := block.Headers[pemHeaderKDFParams]
+	_, err := fmt.Sscanf(kdfParams, "t=%d,m=%d,p=%d", &kdfTime, &kdfMemory, &kdfThreads)
+	if err != nil ||
+		kdfParams != keyFileKDFParamsString(kdfTime, kdfMemory, kdfThreads) ||
+		kdfTime == 0 || kdfTime > keyFileKDFMaxTime ||
+		kdfThreads == 0 || kdfThreads > keyFileKDFMaxThreads ||
+		kdfMemory > keyFileKDFMaxMemory {
+		return nil, newErrUnsupportedKeyFormat(fmt.Sprintf(`encrypted private key with KDF params "%s"`, kdfParams))
+	}
+	salt, err := hex.DecodeString(block.Headers[pemHeaderSalt])
+	if err != nil {
+		return nil, xerrors.Errorf("unable to parse the salt: %w", err)
+	}
+	if len(salt) < keyFileMinSaltSize {
+		return nil, newErrUnsupportedKeyFormat(fmt.Sprintf(`encrypted private key with a %d-byte salt`, len(salt)))
+	}
+	nonce, err := hex.DecodeString(block.Headers[pemHeaderNonce])
+	if err != nil {
+		return nil, xerrors.Errorf("unable to parse the nonce: %w", err)
+	}
+	if len(nonce) != chacha20poly1305.NonceSizeX {
+		return nil, newErrWrongKeyLength(chacha20poly1305.NonceSizeX, uint(len(nonce)))
+	}
+
+	passphrase, err := passphraseFunc.get()
+	if err != nil {
+		return nil, err
+	}
+
+	derivedKey := argon2.IDKey(passphrase, salt, kdfTime, kdfMemory, kdfThreads, chacha20poly1305.KeySize)
+	defer zeroBytes(derivedKey)
+	aead, err := chacha20poly1305.NewX(derivedKey)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to initialize the cipher: %w", err)
+	}
+	key, err := aead.Open(nil, nonce, block.Bytes, keyFileAAD(block.Headers))
+	if err != nil {
+		return nil, newErrWrongPassphrase()
+	}
+	return key, nil
+}
+
+// ChangeKeyFilePassphrase re-encrypts the private key file in directory
+// `keysDir` (see `NewIdentity`) with passphrase `newPassphrase`.
+//
+// `oldPassphraseFunc` is used to decrypt the existing file, it could be nil
+// if the file is not encrypted (so the function could be used to encrypt
+// an existing plaintext key).
+//
+// The file is replaced atomically, so the key is not lost if the function
+// fails.
+func ChangeKeyFilePassphrase(keysDir string, oldPassphraseFunc PassphraseFunc, newPassphrase []byte) error {
+	keyPath := filepath.Join(keysDir, privateFileName)
+
+	var key ed25519.PrivateKey
+	if err := loadPrivateKeyFromFile(&key, keyPath, oldPassphraseFunc); err != nil {
+		return xerrors.Errorf("unable to load the private key: %w", err)
+	}
+	defer zeroBytes(key)
+
+	block, err := encryptPrivateKey(key, newPassphrase, nil)
+	if err != nil {
+		return xerrors.Errorf("unable to encrypt the private key: %w", err)
+	}
+
+	return replaceKeyFile(keyPath, pem.EncodeToMemory(block))
+}
@@ -0,0 +1,20 @@
+package secureio
+
+// protectKey locks the memory of `key` if
+// KeyExchangerOptions.LockKeysInMemory is enabled. The key should be
+// destroyed by destroyKey when it is not needed anymore.
+func protectKey(opts *KeyExchangerOptions, key []byte) error {
+	if !opts.LockKeysInMemory {
+		return nil
+	}
+	return lockMemory(key)
+}
+
+// destroyKey overwrites `key` with zeros (and unlocks its memory
+// if it was locked by protectKey).
+func destroyKey(opts *KeyExchangerOptions, key []byte) {
+	if opts.LockKeysInMemory {
+		unlockMemory(key)
+	}
+	zeroBytes(key)
+}
@@ -1,12 +1,16 @@
 package secureio
 
 import (
+	"crypto/ed25519"
 	"encoding/binary"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 var (
-	keySeedUpdateMessageContainerSize = binary.Size(keySeedUpdateMessageContainer{})
-	keySeedUpdateMessageSignedSize    = binary.Size(keySeedUpdateMessageSigned{})
+	keySeedUpdateMessageContainerSize     = binary.Size(keySeedUpdateMessageContainer{})
+	keySeedUpdateMessageSignedSize        = binary.Size(keySeedUpdateMessageSigned{})
+	keySeedUpdateMessageHiddenHeadersSize = binary.Size(keySeedUpdateMessageHiddenHeaders{})
 )
 
 type keySeedUpdateMessageContainer struct {
@@ -27,10 +31,34 @@ type keySeedUpdateMessage struct {
 	Flags             keySeedUpdateMessageFlags
 }
 
+// keySeedUpdateMessageHiddenHeaders are the headers of a key exchange
+// message in the identity hiding mode
+// (see KeyExchangerOptions.EnableIdentityHiding). They are followed
+// by the encrypted keySeedUpdateMessageSigned (and its extensions).
+//
+// If RecipientKXPublicKey is zero, then the encrypted part is absent:
+// the sender does not know the key exchange key of the recipient, yet,
+// and just introduces its own key (and its SessionID, so a restart
+// of the sender could be detected).
+type keySeedUpdateMessageHiddenHeaders struct {
+	KXPublicKey          [curve25519PublicKeySize]byte
+	SessionID            SessionID
+	RecipientKXPublicKey [curve25519PublicKeySize]byte
+	Nonce                [chacha20poly1305.NonceSizeX]byte
+}
+
 type keySeedUpdateMessageFlags uint8
 
 const (
 	keySeedUpdateMessageFlagsIsAnswer = keySeedUpdateMessageFlags(1 << iota)
+
+	// keySeedUpdateMessageFlagsHasExtensions means the message is followed
+	// by extensions, and the last of them is
+	// keySeedUpdateMessageExtensionTypeExtensionsSignature. The flag is
+	// covered by the signature of the message, so the extensions could
+	// not be cut off to make the message look like a message of
+	// a remote side of ProtocolVersionLegacy.
+	keySeedUpdateMessageFlagsHasExtensions
 )
 
 func (flags keySeedUpdateMessageFlags) IsAnswer() bool {
@@ -44,3 +72,238 @@ func (flags *keySeedUpdateMessageFlags) SetIsAnswer(v bool) {
 		*flags &= ^keySeedUpdateMessageFlagsIsAnswer
 	}
 }
+
+func (flags keySeedUpdateMessageFlags) HasExtensions() bool {
+	return flags&keySeedUpdateMessageFlagsHasExtensions != 0
+}
+
+func (flags *keySeedUpdateMessageFlags) SetHasExtensions(v bool) {
+	if v {
+		*flags |= keySeedUpdateMessageFlagsHasExtensions
+	} else {
+		*flags &= ^keySeedUpdateMessageFlagsHasExtensions
+	}
+}
+
+// keySeedUpdateMessageTimestamps are the timestamps of a key exchange
+// message, they are used to detect replays of old messages
+// (see KeyExchangerOptions.MaximalTimeDifference).
+type keySeedUpdateMessageTimestamps struct {
+	// CreatedAt is the time (in unix nanoseconds) when the message
+	// was sent.
+	CreatedAt uint64
+
+	// KeyCreatedAt is the counter of the key exchange key of the sender
+	// (it's the time when the key was generated, but it is guaranteed to
+	// increase with each key even if the clock was moved back).
+	KeyCreatedAt uint64
+}
+
+const keySeedUpdateMessageTimestampsSize = 16
+
+func (timestamps *keySeedUpdateMessageTimestamps) Bytes() []byte {
+	b := make([]byte, keySeedUpdateMessageTimestampsSize)
+	binaryOrderType.PutUint64(b[0:], timestamps.CreatedAt)
+	binaryOrderType.PutUint64(b[8:], timestamps.KeyCreatedAt)
+	return b
+}
+
+func parseKeySeedUpdateMessageTimestamps(b []byte) (*keySeedUpdateMessageTimestamps, error) {
+	if len(b) < keySeedUpdateMessageTimestampsSize {
+		return nil, newErrTooShort(keySeedUpdateMessageTimestampsSize, uint(len(b)))
+	}
+	return &keySeedUpdateMessageTimestamps{
+		CreatedAt:    binaryOrderType.Uint64(b[0:]),
+		KeyCreatedAt: binaryOrderType.Uint64(b[8:]),
+	}, nil
+}
+
+// keySeedUpdateMessageExtensions is the optional area of a key exchange
+// message which follows right after keySeedUpdateMessage.
+//
+// The signature of keySeedUpdateMessageSigned covers only
+// keySeedUpdateMessage (so remote sides of ProtocolVersionLegacy,
+// which ignore the extensions, are still able to verify it). The extensions
+// are covered by the separate signature in the last extension
+// (see keySeedUpdateMessageExtensionTypeExtensionsSignature). In
+// the PSK-only mode the MAC covers the whole message instead.
+//
+// Each extension is encoded as: type (uint8), length of the value
+// (uint16) and the value. Extensions of unknown types are ignored.
+type keySeedUpdateMessageExtensions []keySeedUpdateMessageExtension
+
+type keySeedUpdateMessageExtension struct {
+	Type  keySeedUpdateMessageExtensionType
+	Value []byte
+}
+
+type keySeedUpdateMessageExtensionType uint8
+
+const (
+	keySeedUpdateMessageExtensionTypeUndefined = keySeedUpdateMessageExtensionType(iota)
+
+	// keySeedUpdateMessageExtensionTypeCertificate contains the Certificate
+	// of the sender's identity.
+	keySeedUpdateMessageExtensionTypeCertificate
+
+	// keySeedUpdateMessageExtensionTypeKEMEncapsulationKey contains the ML-KEM
+	// encapsulation key of the sender, see
+	// KeyExchangerOptions.EnableHybridKeyExchange.
+	keySeedUpdateMessageExtensionTypeKEMEncapsulationKey
+
+	// keySeedUpdateMessageExtensionTypeKEMCiphertext contains the key exchange
+	// public key of the recipient (which identifies the ML-KEM encapsulation
+	// key used) followed by the ML-KEM ciphertext.
+	keySeedUpdateMessageExtensionTypeKEMCiphertext
+
+	// keySeedUpdateMessageExtensionTypeCipherSuites contains the list of
+	// cipher suites supported by the sender (one byte per CipherSuite,
+	// the most preferred first).
+	keySeedUpdateMessageExtensionTypeCipherSuites
+
+	// keySeedUpdateMessageExtensionTypeProtocolVersion contains the range of
+	// protocol versions and the features supported by the sender
+	// (see protocolVersionInfo).
+	keySeedUpdateMessageExtensionTypeProtocolVersion
+
+	// keySeedUpdateMessageExtensionTypeTimestamps contains
+	// keySeedUpdateMessageTimestamps.
+	keySeedUpdateMessageExtensionTypeTimestamps
+
+	// keySeedUpdateMessageExtensionTypeResumptionTicket contains the
+	// encrypted resumption ticket presented by the sender
+	// (see KeyExchangerOptions.ResumptionTicket).
+	keySeedUpdateMessageExtensionTypeResumptionTicket
+
+	// keySeedUpdateMessageExtensionTypeResumptionTicketAccepted means
+	// the resumption ticket of the recipient is accepted by the sender.
+	// It has no value.
+	keySeedUpdateMessageExtensionTypeResumptionTicketAccepted
+
+	// keySeedUpdateMessageExtensionTypePSKID contains the ID of the PSK
+	// used by the sender (see KeyExchangerOptions.PSKs).
+	keySeedUpdateMessageExtensionTypePSKID
+
+	// keySeedUpdateMessageExtensionTypeExtensionsSignature contains
+	// the signature of the message with all the previous extensions
+	// (see keySeedUpdateMessageExtensionsSignedData). It is always
+	// the last extension.
+	keySeedUpdateMessageExtensionTypeExtensionsSignature
+)
+
+const keySeedUpdateMessageExtensionHeadersSize = 3
+
+var keySeedUpdateMessageExtensionsSignaturePrefix = []byte("xaionaro-go/secureio.keySeedUpdateMessageExtensions\x00")
+
+func (exts keySeedUpdateMessageExtensions) Get(extType keySeedUpdateMessageExtensionType) []byte {
+	for _, ext := range exts {
+		if ext.Type == extType {
+			return ext.Value
+		}
+	}
+	return nil
+}
+
+// Has returns true if there is an extension of type `extType` (even
+// if its value is empty).
+func (exts keySeedUpdateMessageExtensions) Has(extType keySeedUpdateMessageExtensionType) bool {
+	for _, ext := range exts {
+		if ext.Type == extType {
+			return true
+		}
+	}
+	return false
+}
+
+func (exts *keySeedUpdateMessageExtensions) Add(extType keySeedUpdateMessageExtensionType, value []byte) {
+	*exts = append(*exts, keySeedUpdateMessageExtension{Type: extType, Value: value})
+}
+
+func (exts keySeedUpdateMessageExtensions) Size() (result int) {
+	for _, ext := range exts {
+		result += keySeedUpdateMessageExtensionHeadersSize + len(ext.Value)
+	}
+	return
+}
+
+func (exts keySeedUpdateMessageExtensions) WriteTo(b []byte) {
+	for _, ext := range exts {
+		b[0] = uint8(ext.Type)
+		binaryOrderType.PutUint16(b[1:], uint16(len(ext.Value)))
+		copy(b[keySeedUpdateMessageExtensionHeadersSize:], ext.Value)
+		b = b[keySeedUpdateMessageExtensionHeadersSize+len(ext.Value):]
+	}
+}
+
+func parseKeySeedUpdateMessageExtensions(b []byte) (result keySeedUpdateMessageExtensions, err error) {
+	for len(b) > 0 {
+		if len(b) < keySeedUpdateMessageExtensionHeadersSize {
+			return nil, newErrTooShort(uint(keySeedUpdateMessageExtensionHeadersSize), uint(len(b)))
+		}
+		ext := keySeedUpdateMessageExtension{
+			Type: keySeedUpdateMessageExtensionType(b[0]),
+		}
+		length := int(binaryOrderType.Uint16(b[1:]))
+		b = b[keySeedUpdateMessageExtensionHeadersSize:]
+		if len(b) < length {
+			return nil, newErrTooShort(uint(length), uint(len(b)))
+		}
+		for _, prevExt := range result {
+			if prevExt.Type == ext.Type {
+				return nil, newErrDuplicateExtension(uint8(ext.Type))
+			}
+		}
+		ext.Value = b[:length:length]
+		b = b[length:]
+		result = append(result, ext)
+	}
+	return
+}
+
+// keySeedUpdateMessageExtensionsSignedData returns the data signed by
+// the signature of the extensions, where `b` is the message
+// (keySeedUpdateMessageSigned) followed by the extensions preceding
+// keySeedUpdateMessageExtensionTypeExtensionsSignature.
+func keySeedUpdateMessageExtensionsSignedData(b []byte) []byte {
+	signedBytes := b[keySignatureSize:]
+	result := make([]byte, 0, len(keySeedUpdateMessageExtensionsSignaturePrefix)+len(signedBytes))
+	result = append(result, keySeedUpdateMessageExtensionsSignaturePrefix...)
+	return append(result, signedBytes...)
+}
+
+// verifyKeySeedUpdateMessageSignatures checks the signature of the message
+// `b` (see keySeedUpdateMessageSigned) and the signature of its
+// extensions `exts` using the public key `pubKey`.
+//
+// It returns the extensions without
+// keySeedUpdateMessageExtensionTypeExtensionsSignature. A message without
+// keySeedUpdateMessageFlagsHasExtensions is a message of a remote side
+// of ProtocolVersionLegacy, so its tail is ignored and no extensions
+// are returned.
+func verifyKeySeedUpdateMessageSignatures(
+	pubKey ed25519.PublicKey,
+	msg *keySeedUpdateMessage,
+	b []byte,
+	exts keySeedUpdateMessageExtensions,
+) (keySeedUpdateMessageExtensions, error) {
+	if !ed25519.Verify(pubKey, b[keySignatureSize:keySeedUpdateMessageSignedSize], b[:keySignatureSize]) {
+		return nil, newErrInvalidSignature()
+	}
+	if !msg.Flags.HasExtensions() {
+		return nil, nil
+	}
+
+	if len(exts) == 0 {
+		return nil, newErrInvalidSignature()
+	}
+	signatureExt := exts[len(exts)-1]
+	if signatureExt.Type != keySeedUpdateMessageExtensionTypeExtensionsSignature ||
+		len(signatureExt.Value) != keySignatureSize {
+		return nil, newErrInvalidSignature()
+	}
+	signedBytes := b[:len(b)-keySeedUpdateMessageExtensionHeadersSize-keySignatureSize]
+	if !ed25519.Verify(pubKey, keySeedUpdateMessageExtensionsSignedData(signedBytes), signatureExt.Value) {
+		return nil, newErrInvalidSignature()
+	}
+	return exts[:len(exts)-1], nil
+}
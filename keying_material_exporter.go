@@ -0,0 +1,70 @@
+package secureio
+
+import (
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// MaxExportedKeyingMaterialLength is the maximal length of the keying
+	// material which could be exported by
+	// `(*Session).ExportKeyingMaterial`.
+	MaxExportedKeyingMaterialLength = 255 * 32
+)
+
+// ExportKeyingMaterial derives `length` bytes of keying material for
+// an external protocol (similar to RFC 5705 for TLS).
+//
+// The result depends on the identities of both sides, the first key
+// exchange of the session, `label` and `context`. So both sides get
+// the same result for the same `label` and `context`, and it does not
+// change on key re-exchanges. The result is independent from the cipher
+// keys of the session (and from the results with other labels or
+// contexts), so revealing it does not compromise the traffic.
+//
+// A nil `context` is different from an empty one.
+//
+// Returns ErrKeyExchangeNotCompleted if there was no successful
+// key exchange, yet.
+func (sess *Session) ExportKeyingMaterial(label string, context []byte, length uint) ([]byte, error) {
+	if length > MaxExportedKeyingMaterialLength {
+		return nil, newErrKeyingMaterialTooLong(length, MaxExportedKeyingMaterialLength)
+	}
+	if sess.keyExchanger == nil {
+		return nil, newErrKeyExchangeNotCompleted()
+	}
+	exporterSecret := sess.keyExchanger.getExporterSecret()
+	if exporterSecret == nil {
+		return nil, newErrKeyExchangeNotCompleted()
+	}
+	defer zeroBytes(exporterSecret)
+
+	result := make([]byte, length)
+	kdf := hkdf.Expand(sha3.New256, exporterSecret, exporterInfo(label, context))
+	if _, err := io.ReadFull(kdf, result); err != nil {
+		return nil, wrapError(err)
+	}
+	return result, nil
+}
+
+// exporterInfo returns an unambiguous encoding of `label` and `context`
+// to be used as the "info" of HKDF.
+func exporterInfo(label string, context []byte) []byte {
+	info := make([]byte, 0, 4+len(label)+1+4+len(context))
+	info = appendUint32(info, uint32(len(label)))
+	info = append(info, label...)
+	if context == nil {
+		return append(info, 0)
+	}
+	info = append(info, 1)
+	info = appendUint32(info, uint32(len(context)))
+	return append(info, context...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binaryOrderType.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
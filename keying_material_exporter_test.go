@@ -0,0 +1,75 @@
+package secureio_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	xerrors "github.com/xaionaro-go/errors"
+
+	. "github.com/xaionaro-go/secureio"
+)
+
+func TestSession_ExportKeyingMaterial(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	opts := &SessionOptions{
+		KeyExchangerOptions: KeyExchangerOptions{
+			KeyUpdateInterval: time.Hour,
+		},
+	}
+
+	sess0 := identity0.NewSession(identity1, conn0, &testLogger{t}, opts)
+	_, err := sess0.ExportKeyingMaterial(`unit-test`, nil, 32)
+	assert.True(t, err.(*xerrors.Error).Has(ErrKeyExchangeNotCompleted{}), err)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, opts)
+	require.NoError(t, sess1.Start(ctx))
+
+	assert.Equal(t, SessionStateEstablished, sess0.WaitForState(ctx, SessionStateEstablished))
+	assert.Equal(t, SessionStateEstablished, sess1.WaitForState(ctx, SessionStateEstablished))
+
+	key0, err := sess0.ExportKeyingMaterial(`unit-test`, []byte(`context`), 64)
+	require.NoError(t, err)
+	key1, err := sess1.ExportKeyingMaterial(`unit-test`, []byte(`context`), 64)
+	require.NoError(t, err)
+	assert.Len(t, key0, 64)
+	assert.Equal(t, key0, key1)
+
+	for _, cipherKey := range sess0.GetCipherKeys() {
+		assert.NotEqual(t, cipherKey, key0[:len(cipherKey)])
+	}
+
+	otherLabel, err := sess0.ExportKeyingMaterial(`unit-test2`, []byte(`context`), 64)
+	require.NoError(t, err)
+	assert.NotEqual(t, key0, otherLabel)
+
+	emptyContext, err := sess0.ExportKeyingMaterial(`unit-test`, []byte{}, 64)
+	require.NoError(t, err)
+	noContext, err := sess0.ExportKeyingMaterial(`unit-test`, nil, 64)
+	require.NoError(t, err)
+	assert.NotEqual(t, key0, emptyContext)
+	assert.NotEqual(t, emptyContext, noContext)
+
+	shortKey, err := sess0.ExportKeyingMaterial(`unit-test`, []byte(`context`), 16)
+	require.NoError(t, err)
+	assert.Equal(t, key0[:16], shortKey)
+
+	_, err = sess0.ExportKeyingMaterial(`unit-test`, nil, MaxExportedKeyingMaterialLength+1)
+	assert.True(t, err.(*xerrors.Error).Has(ErrKeyingMaterialTooLong{}), err)
+
+	require.NoError(t, sess1.Rekey(ctx))
+	key1, err = sess1.ExportKeyingMaterial(`unit-test`, []byte(`context`), 64)
+	require.NoError(t, err)
+	assert.Equal(t, key0, key1)
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
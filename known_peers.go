@@ -0,0 +1,336 @@
+package secureio
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+// KnownPeers is a storage of public keys of remote sides keyed by
+// application-chosen peer names. It's used for the trust-on-first-use
+// (TOFU) mode, similar to OpenSSH's known_hosts: the first key seen for
+// a peer name is recorded and any later session presenting a different
+// key for the same name is rejected with ErrPeerKeyChanged.
+//
+// The file format is one peer per line:
+//
+//	<peer name> ssh-ed25519 AAAA...
+//
+// Keys rejected by the user (see `(*Session).RejectAuthenticationString`)
+// are stored as:
+//
+//	@revoked ssh-ed25519 AAAA...
+//
+// Empty lines and lines starting with "#" are ignored.
+//
+// See `(*KnownPeers).TrustStore` and `KnownPeersEventHandler`.
+type KnownPeers struct {
+	locker   lockerRWMutex
+	filePath string
+	peers    map[string]ed25519.PublicKey
+	revoked  map[[PublicKeySize]byte]struct{}
+}
+
+// NewKnownPeers is a constructor for `KnownPeers` stored in file
+// `filePath`. If the file does not exist then it will be created
+// on the first change.
+//
+// If `filePath` is empty then the known peers are stored in memory only.
+func NewKnownPeers(filePath string) (*KnownPeers, error) {
+	knownPeers := &KnownPeers{
+		filePath: filePath,
+		peers:    map[string]ed25519.PublicKey{},
+		revoked:  map[[PublicKeySize]byte]struct{}{},
+	}
+	if filePath == `` {
+		return knownPeers, nil
+	}
+
+	b, err := ioutil.ReadFile(filePath) // #nosec
+	if os.IsNotExist(err) {
+		return knownPeers, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("unable to read file '%s': %w", filePath, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		fields := strings.SplitN(line, ` `, 2)
+		if len(fields) != 2 {
+			return nil, xerrors.Errorf("invalid line %d in file '%s': %w", lineNum, filePath,
+				newErrUnsupportedKeyFormat(`a line without a key`))
+		}
+		pubKey, err := parseAuthorizedKey([]byte(fields[1]))
+		if err != nil {
+			return nil, xerrors.Errorf("invalid line %d in file '%s': %w", lineNum, filePath, err)
+		}
+		if fields[0] == revokedMarker {
+			knownPeers.revoked[publicKeyToArray(pubKey)] = struct{}{}
+			continue
+		}
+		knownPeers.peers[fields[0]] = pubKey
+	}
+	return knownPeers, nil
+}
+
+const revokedMarker = `@revoked`
+
+func publicKeyToArray(pubKey ed25519.PublicKey) (result [PublicKeySize]byte) {
+	copy(result[:], pubKey)
+	return
+}
+
+func checkPeerName(peerName string) error {
+	if peerName == `` || strings.HasPrefix(peerName, `#`) || strings.HasPrefix(peerName, `@`) ||
+		strings.IndexFunc(peerName, func(r rune) bool { return r <= ' ' }) != -1 {
+		return newErrInvalidPeerName(peerName)
+	}
+	return nil
+}
+
+// Get returns the known public key of the peer `peerName` or nil if the
+// peer is not known yet.
+func (knownPeers *KnownPeers) Get(peerName string) (result ed25519.PublicKey) {
+	knownPeers.locker.RLockDo(func() {
+		result = knownPeers.peers[peerName]
+	})
+	return
+}
+
+// Set records public key `pubKey` as the key of the peer `peerName`
+// (replacing the previous one if any) and saves the file.
+func (knownPeers *KnownPeers) Set(peerName string, pubKey ed25519.PublicKey) (err error) {
+	if err := checkPeerName(peerName); err != nil {
+		return err
+	}
+	if len(pubKey) != PublicKeySize {
+		return newErrWrongKeyLength(PublicKeySize, uint(len(pubKey)))
+	}
+	knownPeers.locker.LockDo(func() {
+		knownPeers.peers[peerName] = pubKey
+		err = knownPeers.save()
+	})
+	return
+}
+
+// SetIfAbsent records public key `pubKey` as the key of the peer
+// `peerName` and saves the file, but only if the peer has no key
+// recorded yet. Otherwise it returns the recorded key and false.
+func (knownPeers *KnownPeers) SetIfAbsent(
+	peerName string,
+	pubKey ed25519.PublicKey,
+) (ed25519.PublicKey, bool, error) {
+	return knownPeers.CompareAndSet(peerName, nil, pubKey)
+}
+
+// CompareAndSet records public key `newKey` as the key of the peer
+// `peerName` and saves the file, but only if the recorded key of
+// the peer is `oldKey` (nil means the peer has no key recorded).
+// Otherwise it returns the recorded key and false.
+func (knownPeers *KnownPeers) CompareAndSet(
+	peerName string,
+	oldKey, newKey ed25519.PublicKey,
+) (existingKey ed25519.PublicKey, isSet bool, err error) {
+	if err := checkPeerName(peerName); err != nil {
+		return nil, false, err
+	}
+	if len(newKey) != PublicKeySize {
+		return nil, false, newErrWrongKeyLength(PublicKeySize, uint(len(newKey)))
+	}
+	knownPeers.locker.LockDo(func() {
+		existingKey = knownPeers.peers[peerName]
+		if !bytes.Equal(existingKey, oldKey) || (existingKey == nil) != (oldKey == nil) {
+			return
+		}
+		knownPeers.peers[peerName] = newKey
+		isSet = true
+		err = knownPeers.save()
+	})
+	return
+}
+
+// Remove forgets the key of the peer `peerName` and saves the file.
+func (knownPeers *KnownPeers) Remove(peerName string) (err error) {
+	knownPeers.locker.LockDo(func() {
+		delete(knownPeers.peers, peerName)
+		err = knownPeers.save()
+	})
+	return
+}
+
+// Revoke marks public key `pubKey` as untrusted, forgets the peers
+// which have this key and saves the file. A revoked key is never
+// trusted again (even if approved by KnownPeersEventHandler).
+func (knownPeers *KnownPeers) Revoke(pubKey ed25519.PublicKey) (err error) {
+	if len(pubKey) != PublicKeySize {
+		return newErrWrongKeyLength(PublicKeySize, uint(len(pubKey)))
+	}
+	knownPeers.locker.LockDo(func() {
+		for peerName, peerKey := range knownPeers.peers {
+			if bytes.Equal(peerKey, pubKey) {
+				delete(knownPeers.peers, peerName)
+			}
+		}
+		knownPeers.revoked[publicKeyToArray(pubKey)] = struct{}{}
+		err = knownPeers.save()
+	})
+	return
+}
+
+// IsRevoked returns true if public key `pubKey` was revoked
+// (see `Revoke`).
+func (knownPeers *KnownPeers) IsRevoked(pubKey ed25519.PublicKey) (result bool) {
+	knownPeers.locker.RLockDo(func() {
+		_, result = knownPeers.revoked[publicKeyToArray(pubKey)]
+	})
+	return
+}
+
+func (knownPeers *KnownPeers) save() error {
+	if knownPeers.filePath == `` {
+		return nil
+	}
+
+	peerNames := make([]string, 0, len(knownPeers.peers))
+	for peerName := range knownPeers.peers {
+		peerNames = append(peerNames, peerName)
+	}
+	sort.Strings(peerNames)
+
+	var buf bytes.Buffer
+	for _, peerName := range peerNames {
+		line, err := marshalPublicKey(knownPeers.peers[peerName], KeyFileFormatOpenSSH)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(peerName)
+		buf.WriteByte(' ')
+		buf.Write(line)
+	}
+
+	revokedKeys := make([]string, 0, len(knownPeers.revoked))
+	for pubKey := range knownPeers.revoked {
+		line, err := marshalPublicKey(pubKey[:], KeyFileFormatOpenSSH)
+		if err != nil {
+			return err
+		}
+		revokedKeys = append(revokedKeys, string(line))
+	}
+	sort.Strings(revokedKeys)
+	for _, line := range revokedKeys {
+		buf.WriteString(revokedMarker)
+		buf.WriteByte(' ')
+		buf.WriteString(line)
+	}
+
+	return replaceKeyFile(knownPeers.filePath, buf.Bytes())
+}
+
+// TrustStore returns a TrustStore which trusts the known key of peer
+// `peerName` or records the key seen on the first use.
+//
+// If the EventHandler of the session implements KnownPeersEventHandler
+// then it is asked to approve new and changed keys.
+func (knownPeers *KnownPeers) TrustStore(peerName string) TrustStore {
+	return &knownPeerTrustStore{
+		knownPeers: knownPeers,
+		peerName:   peerName,
+	}
+}
+
+// KnownPeersEventHandler is an optional interface of an EventHandler.
+// If it is implemented then the application is asked to approve
+// keys not recorded in KnownPeers yet.
+//
+// The callbacks are called from the reading routine of the session, so
+// the session does not process incoming messages until they return.
+type KnownPeersEventHandler interface {
+	// OnNewPeerKey is called when peer `peerName` has no recorded key yet.
+	// If it returns true then `pubKey` is trusted and recorded.
+	OnNewPeerKey(sess *Session, peerName string, pubKey ed25519.PublicKey) bool
+
+	// OnChangedPeerKey is called when peer `peerName` presented a key
+	// different from the recorded one. If it returns true then `newKey`
+	// is trusted and recorded instead of `knownKey`.
+	OnChangedPeerKey(sess *Session, peerName string, knownKey, newKey ed25519.PublicKey) bool
+}
+
+type knownPeerTrustStore struct {
+	knownPeers *KnownPeers
+	peerName   string
+}
+
+var (
+	_ RemoteIdentityVerifier = (*knownPeerTrustStore)(nil)
+	_ RemoteIdentityRejecter = (*knownPeerTrustStore)(nil)
+)
+
+func (trustStore *knownPeerTrustStore) FindRemoteIdentity(pubKey ed25519.PublicKey) *Identity {
+	if trustStore.knownPeers.IsRevoked(pubKey) ||
+		!bytes.Equal(trustStore.knownPeers.Get(trustStore.peerName), pubKey) {
+		return nil
+	}
+	identity, _ := NewRemoteIdentityFromPublicKey(pubKey)
+	return identity
+}
+
+func (trustStore *knownPeerTrustStore) VerifyRemoteIdentity(sess *Session, pubKey ed25519.PublicKey) (*Identity, error) {
+	peerName := trustStore.peerName
+	if err := checkPeerName(peerName); err != nil {
+		return nil, err
+	}
+
+	if trustStore.knownPeers.IsRevoked(pubKey) {
+		return nil, newErrUntrustedRemoteIdentity(pubKey)
+	}
+
+	// The handler is called without the lock of KnownPeers (it may wait
+	// for the user), so the key is recorded only if the recorded key
+	// is still the same as the one the handler was asked about.
+	handler, _ := sess.eventHandler.(KnownPeersEventHandler)
+	knownKey := trustStore.knownPeers.Get(peerName)
+	switch {
+	case knownKey == nil:
+		if handler != nil && !handler.OnNewPeerKey(sess, peerName, pubKey) {
+			return nil, newErrUntrustedRemoteIdentity(pubKey)
+		}
+	case bytes.Equal(knownKey, pubKey):
+		return NewRemoteIdentityFromPublicKey(pubKey)
+	default:
+		if handler == nil || !handler.OnChangedPeerKey(sess, peerName, knownKey, pubKey) {
+			return nil, newErrPeerKeyChanged(peerName, knownKey, pubKey)
+		}
+	}
+
+	existingKey, isSet, err := trustStore.knownPeers.CompareAndSet(peerName, knownKey, pubKey)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to record the key of peer '%s': %w", peerName, err)
+	}
+	if !isSet && !bytes.Equal(existingKey, pubKey) {
+		// Another session recorded another key meanwhile
+		return nil, newErrPeerKeyChanged(peerName, existingKey, pubKey)
+	}
+	return NewRemoteIdentityFromPublicKey(pubKey)
+}
+
+func (trustStore *knownPeerTrustStore) RejectRemoteIdentity(sess *Session, pubKey ed25519.PublicKey) error {
+	return trustStore.knownPeers.Revoke(pubKey)
+}
+
+func (trustStore *knownPeerTrustStore) String() string {
+	return fmt.Sprintf("known peer '%s'", trustStore.peerName)
+}
@@ -0,0 +1,195 @@
+package secureio_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	xerrors "github.com/xaionaro-go/errors"
+
+	. "github.com/xaionaro-go/secureio"
+)
+
+func TestKnownPeers_firstUse(t *testing.T) {
+	ctx := context.Background()
+
+	dirPath, err := ioutil.TempDir(os.TempDir(), `secureio-test`)
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dirPath) }()
+	filePath := path.Join(dirPath, `known_peers`)
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	knownPeers, err := NewKnownPeers(filePath)
+	require.NoError(t, err)
+	assert.Nil(t, knownPeers.Get(`peer1`))
+
+	sess0 := identity0.NewSessionWithTrustStore(knownPeers.TrustStore(`peer1`), conn0, &testLogger{t}, nil)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, nil)
+	require.NoError(t, sess1.Start(ctx))
+
+	_, err = sess1.Write([]byte(`unit-test`))
+	require.NoError(t, err)
+	readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+	n, err := sess0.Read(readBuf)
+	require.NoError(t, err)
+	assert.Equal(t, `unit-test`, string(readBuf[:n]))
+
+	assert.Equal(t, identity1.Keys.Public, sess0.GetRemoteIdentity().Keys.Public)
+	assert.Equal(t, identity1.Keys.Public, knownPeers.Get(`peer1`))
+
+	reloadedKnownPeers, err := NewKnownPeers(filePath)
+	require.NoError(t, err)
+	assert.Equal(t, identity1.Keys.Public, reloadedKnownPeers.Get(`peer1`))
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestKnownPeers_keyChanged(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	otherPubKey, _, err := ed25519.GenerateKey(rand.New(rand.NewSource(1)))
+	require.NoError(t, err)
+	knownPeers, err := NewKnownPeers(``)
+	require.NoError(t, err)
+	require.NoError(t, knownPeers.Set(`peer1`, otherPubKey))
+
+	keyChangedChan := make(chan struct{}, 1)
+	sess0 := identity0.NewSessionWithTrustStore(knownPeers.TrustStore(`peer1`), conn0, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		if err.(*xerrors.Error).Has(ErrPeerKeyChanged{}) {
+			select {
+			case keyChangedChan <- struct{}{}:
+			default:
+			}
+		}
+		return false
+	}), nil)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		return false
+	}), nil)
+	require.NoError(t, sess1.Start(ctx))
+
+	<-keyChangedChan
+	assert.Nil(t, sess0.GetRemoteIdentity())
+	assert.Equal(t, otherPubKey, knownPeers.Get(`peer1`))
+
+	_ = sess0.Close()
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestKnownPeers_invalidPeerName(t *testing.T) {
+	knownPeers, err := NewKnownPeers(``)
+	require.NoError(t, err)
+
+	pubKey, _, err := ed25519.GenerateKey(rand.New(rand.NewSource(1)))
+	require.NoError(t, err)
+	for _, peerName := range []string{``, `#comment`, `with space`} {
+		err := knownPeers.Set(peerName, pubKey)
+		require.Error(t, err)
+		assert.True(t, err.(*xerrors.Error).Has(ErrInvalidPeerName{}), peerName)
+	}
+}
+
+func TestKnownPeers_compareAndSet(t *testing.T) {
+	knownPeers, err := NewKnownPeers(``)
+	require.NoError(t, err)
+	pubKey0, _, err := ed25519.GenerateKey(rand.New(rand.NewSource(1)))
+	require.NoError(t, err)
+	pubKey1, _, err := ed25519.GenerateKey(rand.New(rand.NewSource(2)))
+	require.NoError(t, err)
+
+	existingKey, isSet, err := knownPeers.SetIfAbsent(`peer1`, pubKey0)
+	require.NoError(t, err)
+	assert.True(t, isSet)
+	assert.Nil(t, existingKey)
+
+	existingKey, isSet, err = knownPeers.SetIfAbsent(`peer1`, pubKey1)
+	require.NoError(t, err)
+	assert.False(t, isSet)
+	assert.Equal(t, pubKey0, existingKey)
+
+	_, isSet, err = knownPeers.CompareAndSet(`peer1`, pubKey1, pubKey1)
+	require.NoError(t, err)
+	assert.False(t, isSet)
+	_, isSet, err = knownPeers.CompareAndSet(`peer1`, pubKey0, pubKey1)
+	require.NoError(t, err)
+	assert.True(t, isSet)
+	assert.Equal(t, pubKey1, knownPeers.Get(`peer1`))
+}
+
+// barrierKnownPeersEventHandler approves any key, but only after all
+// the expected sessions asked to approve a key.
+type barrierKnownPeersEventHandler struct {
+	*testLogger
+	waitGroup *sync.WaitGroup
+}
+
+func (handler *barrierKnownPeersEventHandler) OnNewPeerKey(*Session, string, ed25519.PublicKey) bool {
+	handler.waitGroup.Done()
+	handler.waitGroup.Wait()
+	return true
+}
+
+func (handler *barrierKnownPeersEventHandler) OnChangedPeerKey(*Session, string, ed25519.PublicKey, ed25519.PublicKey) bool {
+	return true
+}
+
+func TestKnownPeers_concurrentFirstUse(t *testing.T) {
+	knownPeers, err := NewKnownPeers(``)
+	require.NoError(t, err)
+	trustStore := knownPeers.TrustStore(`peer1`).(RemoteIdentityVerifier)
+
+	var approvalsWG sync.WaitGroup
+	approvalsWG.Add(2)
+	identity0, _, conn0, conn1 := testPair(t)
+	handler := &barrierKnownPeersEventHandler{testLogger: &testLogger{t}, waitGroup: &approvalsWG}
+	sessions := []*Session{
+		identity0.NewSession(nil, conn0, handler, nil),
+		identity0.NewSession(nil, conn1, handler, nil),
+	}
+
+	// Two remote sides present different keys for the same peer name
+	// at the same time, only one of them could be trusted.
+	pubKeys := make([]ed25519.PublicKey, len(sessions))
+	errs := make([]error, len(sessions))
+	var wg sync.WaitGroup
+	for idx, sess := range sessions {
+		pubKeys[idx], _, err = ed25519.GenerateKey(rand.New(rand.NewSource(int64(idx + 1))))
+		require.NoError(t, err)
+		wg.Add(1)
+		go func(idx int, sess *Session) {
+			defer wg.Done()
+			_, errs[idx] = trustStore.VerifyRemoteIdentity(sess, pubKeys[idx])
+		}(idx, sess)
+	}
+	wg.Wait()
+
+	var trustedKey ed25519.PublicKey
+	for idx, err := range errs {
+		if err == nil {
+			assert.Nil(t, trustedKey, "only one key should be trusted")
+			trustedKey = pubKeys[idx]
+			continue
+		}
+		assert.True(t, err.(*xerrors.Error).Has(ErrPeerKeyChanged{}), err)
+	}
+	assert.NotNil(t, trustedKey)
+	assert.Equal(t, trustedKey, knownPeers.Get(`peer1`))
+}
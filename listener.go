@@ -0,0 +1,857 @@
+package secureio
+
+import (
+	"context"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultListenerIdleTimeout is the default value for
+	// ListenerOptions.IdleTimeout.
+	DefaultListenerIdleTimeout = 5 * time.Minute
+
+	// DefaultListenerMaxHalfOpenSessions is the default value for
+	// ListenerOptions.MaxHalfOpenSessions.
+	DefaultListenerMaxHalfOpenSessions = 256
+
+	// DefaultListenerMaxIntroducedSessions is the default value for
+	// ListenerOptions.MaxIntroducedSessions.
+	DefaultListenerMaxIntroducedSessions = 256
+
+	// DefaultListenerAcceptQueueLength is the default value for
+	// ListenerOptions.AcceptQueueLength.
+	DefaultListenerAcceptQueueLength = 64
+
+	// DefaultListenerRoamingChecksPerSecond is the default value for
+	// ListenerOptions.RoamingChecksPerSecond.
+	DefaultListenerRoamingChecksPerSecond = 10000
+)
+
+const (
+	// listenerAmplificationFactor limits the amount of bytes sent to
+	// an address which is not validated, yet (see listenerConn.Write),
+	// relatively to the amount of bytes received from it. It is the same
+	// limit as QUIC uses (see RFC 9000, section 8).
+	listenerAmplificationFactor = 3
+)
+
+// ListenerOptions is a set of optional parameters of a Listener.
+type ListenerOptions struct {
+	// SessionOptions are the options of each Session created by
+	// the Listener.
+	SessionOptions SessionOptions
+
+	// EventHandler is the handler of the events of each Session
+	// created by the Listener.
+	EventHandler EventHandler
+
+	// IdleTimeout is the duration after which a Session is closed if
+	// nothing was received from the remote side. It is measured using
+	// SessionOptions.Clock.
+	//
+	// The default value is DefaultListenerIdleTimeout.
+	IdleTimeout time.Duration
+
+	// MaxHalfOpenSessions is the maximal amount of sessions with
+	// an incomplete key exchange. Datagrams from new peers are ignored
+	// while the limit is reached.
+	//
+	// Without the identity hiding mode a session is created only for
+	// an authentic key exchange message (see `Listener`), so the limit
+	// could be exhausted only by the trusted remote sides (or by anybody
+	// if any remote identity is trusted). The sessions created for
+	// introductions of the identity hiding mode are limited by
+	// MaxIntroducedSessions instead.
+	//
+	// The default value is DefaultListenerMaxHalfOpenSessions.
+	MaxHalfOpenSessions uint
+
+	// MaxIntroducedSessions is the maximal amount of sessions with
+	// an incomplete key exchange, which were created for introductions
+	// of the identity hiding mode (see
+	// KeyExchangerOptions.EnableIdentityHiding). An introduction is not
+	// authenticated (the remote side does not know the key to encrypt
+	// its identity for, yet), so anybody could send them. Therefore if
+	// the limit is reached, then the oldest of these sessions is closed
+	// to create a new one: a spoofer cannot hold the sessions, it could
+	// only outrun the remote sides.
+	//
+	// The default value is DefaultListenerMaxIntroducedSessions.
+	MaxIntroducedSessions uint
+
+	// AcceptQueueLength is the maximal amount of established sessions
+	// waiting for Accept. If the queue is full then new sessions are
+	// closed right after the key exchange.
+	//
+	// The default value is DefaultListenerAcceptQueueLength.
+	AcceptQueueLength uint
+
+	// RoamingChecksPerSecond is the maximal amount of trial decryptions
+	// per second of datagrams from unknown addresses, performed to find
+	// an established Session which roamed to the address (see
+	// `Listener`). The Sessions with the same IP address as the datagram
+	// are checked first. If the limit is reached, then the datagram is
+	// checked only as a key exchange message of a new remote side (and
+	// the roaming is delayed until the next datagram of the remote side).
+	//
+	// The default value is DefaultListenerRoamingChecksPerSecond.
+	RoamingChecksPerSecond uint
+}
+
+// Listener demultiplexes the datagrams of many peers received on a single
+// socket (for example an UDP socket) into separate Sessions. A Session
+// is created for each new remote address, and it is returned by Accept
+// after the key exchange is complete.
+//
+// If the remote side is restarted (and so starts a new session from
+// the same address) then the old Session is closed and a new one is
+// created.
+//
+// If the remote side of an established Session changes its address (for
+// example, see `(*Session).ReplaceBackend`) then the Session roams to
+// the new address as soon as an authentic packet is received from it.
+//
+// The source addresses of datagrams could be spoofed, so a Session is
+// created only for a datagram with an authentic key exchange message
+// (signed by a trusted identity, or protected by a PSK in the PSK-only
+// mode). A replay of such datagram from other addresses does not create
+// more sessions. The exception is the identity hiding mode: the first
+// message of the remote side is an introduction, which could not be
+// authenticated, so these sessions are limited separately (see
+// ListenerOptions.MaxIntroducedSessions). And until a packet encrypted with the negotiated keys
+// is received from the address (which proves the remote side receives
+// the datagrams sent to it), a Session sends to its address at most
+// listenerAmplificationFactor times more bytes than it received from it.
+//
+// All the sessions of the Listener use the same socket, so they are
+// closed when the Listener is closed.
+type Listener struct {
+	locker        lockerMutex
+	packetConn    net.PacketConn
+	identity      *Identity
+	trustStore    TrustStore
+	options       ListenerOptions
+	clock         Clock
+	ctx           context.Context
+	cancelFunc    context.CancelFunc
+	conns         map[string]*listenerConn
+	halfOpenCount uint
+
+	// introducedConns are the half-open connections created for
+	// introductions of the identity hiding mode, from the oldest to
+	// the newest (see ListenerOptions.MaxIntroducedSessions).
+	introducedConns []*listenerConn
+
+	// remoteSessions are the connections by the SessionID of their
+	// first key exchange message, so a replay of the message from
+	// another address does not create a new connection.
+	remoteSessions map[SessionID]*listenerConn
+
+	roamingChecksBudget     uint
+	roamingChecksRefilledAt time.Time
+
+	verifier   *keyExchanger
+	acceptChan chan *Session
+	err        error
+	waitGroup  sync.WaitGroup
+}
+
+// Listen starts accepting sessions on `packetConn`. The sessions use
+// local identity `identity`, and the remote identities are verified by
+// `trustStore` (see `(*Identity).NewSessionWithTrustStore`).
+//
+// If `identity` is nil then PSK-only sessions are created (see
+// NewPSKSession).
+//
+// The Listener owns `packetConn`, it is closed on `(*Listener).Close`.
+func Listen(
+	packetConn net.PacketConn,
+	identity *Identity,
+	trustStore TrustStore,
+	opts *ListenerOptions,
+) (*Listener, error) {
+	l := &Listener{
+		packetConn:     packetConn,
+		identity:       identity,
+		trustStore:     trustStore,
+		conns:          map[string]*listenerConn{},
+		remoteSessions: map[SessionID]*listenerConn{},
+	}
+	if opts != nil {
+		l.options = *opts
+	}
+	if identity == nil && len(l.options.SessionOptions.KeyExchangerOptions.getPSKs()) == 0 {
+		return nil, newErrPSKRequired()
+	}
+	// The session is never started, it is used only to decrypt and
+	// to check the first datagrams of new remote sides.
+	verifierSession := newSession(identity, nil, trustStore, nil, l.options.EventHandler, &l.options.SessionOptions)
+	l.verifier = newKeyExchangeVerifier(identity, trustStore, verifierSession, &verifierSession.options.KeyExchangerOptions)
+	if l.options.IdleTimeout == 0 {
+		l.options.IdleTimeout = DefaultListenerIdleTimeout
+	}
+	if l.options.MaxHalfOpenSessions == 0 {
+		l.options.MaxHalfOpenSessions = DefaultListenerMaxHalfOpenSessions
+	}
+	if l.options.MaxIntroducedSessions == 0 {
+		l.options.MaxIntroducedSessions = DefaultListenerMaxIntroducedSessions
+	}
+	if l.options.AcceptQueueLength == 0 {
+		l.options.AcceptQueueLength = DefaultListenerAcceptQueueLength
+	}
+	if l.options.RoamingChecksPerSecond == 0 {
+		l.options.RoamingChecksPerSecond = DefaultListenerRoamingChecksPerSecond
+	}
+	l.clock = l.options.SessionOptions.Clock
+	if l.clock == nil {
+		l.clock = systemClock{}
+	}
+	l.roamingChecksBudget = l.options.RoamingChecksPerSecond
+	l.roamingChecksRefilledAt = l.clock.Now()
+	l.acceptChan = make(chan *Session, l.options.AcceptQueueLength)
+	l.ctx, l.cancelFunc = context.WithCancel(context.Background())
+
+	l.waitGroup.Add(2)
+	go func() {
+		defer l.waitGroup.Done()
+		l.readLoop()
+	}()
+	go func() {
+		defer l.waitGroup.Done()
+		l.expireLoop()
+	}()
+	return l, nil
+}
+
+// Accept waits for a new established Session.
+//
+// It returns ErrAlreadyClosed if the Listener is closed (or the error
+// which caused the closing).
+func (l *Listener) Accept(ctx context.Context) (*Session, error) {
+	select {
+	case sess := <-l.acceptChan:
+		return sess, nil
+	case <-ctx.Done():
+		return nil, wrapError(ctx.Err())
+	case <-l.ctx.Done():
+		var err error
+		l.locker.LockDo(func() {
+			err = l.err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, newErrAlreadyClosed()
+	}
+}
+
+// Addr returns the local address of the Listener.
+func (l *Listener) Addr() net.Addr {
+	return l.packetConn.LocalAddr()
+}
+
+// Close closes the socket of the Listener and all its sessions and waits
+// until everything is finished.
+func (l *Listener) Close() error {
+	if l.ctx.Err() != nil {
+		return newErrAlreadyClosed()
+	}
+	l.close(nil)
+	l.waitGroup.Wait()
+	return nil
+}
+
+func (l *Listener) close(err error) {
+	l.locker.LockDo(func() {
+		if l.ctx.Err() != nil {
+			return
+		}
+		l.err = err
+		l.cancelFunc()
+		_ = l.packetConn.Close()
+		for _, conn := range l.conns {
+			_ = conn.session.Close()
+		}
+	})
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, maxPossiblePacketSize)
+	for {
+		n, addr, err := l.packetConn.ReadFrom(buf)
+		if err != nil {
+			if l.ctx.Err() == nil {
+				l.close(wrapError(err))
+			}
+			return
+		}
+
+		datagram := listenerDatagram{
+			data: append([]byte(nil), buf[:n]...),
+			addr: addr,
+		}
+		conn := l.routeDatagram(datagram)
+		if conn == nil {
+			// Not a key exchange datagram, too many half-open sessions
+			// (or the Listener is closed)
+			continue
+		}
+
+		select {
+		case conn.readChan <- datagram:
+		default:
+			// The session does not keep up, drop the datagram (as the
+			// OS would do with a full socket buffer).
+		}
+	}
+}
+
+// routeDatagram finds the connection the datagram belongs to. If there
+// is no connection with the source address of the datagram, but
+// the datagram is authentic for an established connection with another
+// address, then the datagram is routed to that connection (and
+// the connection roams to the new address, see onAuthenticPacket).
+// Otherwise a new connection is created if the datagram contains
+// an authentic key exchange message (see verifyFirstDatagram).
+func (l *Listener) routeDatagram(datagram listenerDatagram) (conn *listenerConn) {
+	key := datagram.addr.String()
+	var candidates []*listenerConn
+	l.locker.LockDo(func() {
+		conn = l.conns[key]
+		if conn != nil {
+			conn.lastActivity = l.clock.Now()
+			conn.addReceivedBytes(uint64(len(datagram.data)))
+			return
+		}
+		for _, candidate := range l.conns {
+			if candidate.isEstablished() {
+				candidates = append(candidates, candidate)
+			}
+		}
+		candidates = l.limitRoamingCandidates(datagram.addr, candidates)
+	})
+	if conn != nil {
+		return
+	}
+
+	// The trial decryption is performed without the lock.
+	var roamingConn *listenerConn
+	for idx, candidate := range candidates {
+		if candidate.session.isAuthenticPacket(datagram.data) {
+			roamingConn = candidate
+			l.locker.LockDo(func() {
+				// The rest of the candidates are not checked
+				l.roamingChecksBudget += uint(len(candidates) - idx - 1)
+			})
+			break
+		}
+	}
+
+	var remoteSessionID SessionID
+	if roamingConn == nil {
+		var err error
+		remoteSessionID, err = l.verifyFirstDatagram(datagram.data)
+		if err != nil {
+			return nil
+		}
+	}
+
+	l.locker.LockDo(func() {
+		if roamingConn != nil {
+			conn = roamingConn
+		} else if conn = l.conns[key]; conn == nil {
+			// In the identity hiding mode verifyFirstDatagram accepts
+			// only (not authenticated) introductions.
+			isIntroduction := l.verifier.options.EnableIdentityHiding
+			conn = l.newConn(datagram.addr, remoteSessionID, uint64(len(datagram.data)), false, isIntroduction)
+		}
+		if conn != nil {
+			conn.lastActivity = l.clock.Now()
+		}
+	})
+	return
+}
+
+// limitRoamingCandidates returns the connections of `candidates` which
+// should be checked if they roamed to address `addr`: the ones with
+// the same IP address go first (for example, a NAT changed the port),
+// and the amount is limited by ListenerOptions.RoamingChecksPerSecond.
+//
+// It should be called with l.locker locked.
+func (l *Listener) limitRoamingCandidates(addr net.Addr, candidates []*listenerConn) []*listenerConn {
+	now := l.clock.Now()
+	rate := l.options.RoamingChecksPerSecond
+	if refill := uint(now.Sub(l.roamingChecksRefilledAt).Seconds() * float64(rate)); refill > 0 {
+		l.roamingChecksBudget += refill
+		if l.roamingChecksBudget > rate {
+			l.roamingChecksBudget = rate
+		}
+		l.roamingChecksRefilledAt = now
+	}
+
+	host := addrHost(addr)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return addrHost(candidates[i].getRemoteAddr()) == host &&
+			addrHost(candidates[j].getRemoteAddr()) != host
+	})
+	if uint(len(candidates)) > l.roamingChecksBudget {
+		candidates = candidates[:l.roamingChecksBudget]
+	}
+	l.roamingChecksBudget -= uint(len(candidates))
+	return candidates
+}
+
+// addrHost returns the host part of address `addr` (or the whole
+// address if it has no port).
+func addrHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// verifyFirstDatagram checks if the datagram of a new remote side
+// contains an authentic key exchange message (see
+// `(*keyExchanger).verifyFirstMessage`), and returns the SessionID
+// of the remote side.
+//
+// It is called only from the readLoop.
+func (l *Listener) verifyFirstDatagram(data []byte) (SessionID, error) {
+	msg := l.verifier.messenger.sess.keyExchangeMessage(data)
+	if msg == nil {
+		return SessionID{}, newErrCannotDecrypt()
+	}
+	return l.verifier.verifyFirstMessage(msg)
+}
+
+// roam moves `conn` to the new remote address `addr`. A half-open
+// connection from the new address is closed, but an established one is
+// kept (and then `conn` is not moved).
+func (l *Listener) roam(conn *listenerConn, addr net.Addr) {
+	var replacedConn *listenerConn
+	l.locker.LockDo(func() {
+		oldKey := conn.getRemoteAddr().String()
+		if l.conns[oldKey] != conn {
+			// The connection is already removed
+			return
+		}
+		newKey := addr.String()
+		if otherConn := l.conns[newKey]; otherConn != nil {
+			if otherConn.isEstablished() {
+				return
+			}
+			replacedConn = otherConn
+		}
+		delete(l.conns, oldKey)
+		l.conns[newKey] = conn
+		conn.locker.LockDo(func() {
+			conn.remoteAddr = addr
+		})
+	})
+	if replacedConn != nil {
+		go func() { _ = replacedConn.session.Close() }()
+	}
+}
+
+// restartConn replaces `conn` with a new connection for the same remote
+// address, because the remote side started a new session
+// `remoteSessionID`. The message of the new remote session is already
+// authenticated by the session of `conn` (and it may be encrypted
+// for the key of that session in the identity hiding mode, so it cannot
+// be checked by verifyFirstDatagram), and the address is validated.
+func (l *Listener) restartConn(conn *listenerConn, remoteSessionID SessionID) {
+	l.locker.LockDo(func() {
+		addr := conn.getRemoteAddr()
+		key := addr.String()
+		if l.conns[key] != conn {
+			// The connection is already removed
+			return
+		}
+		delete(l.conns, key)
+		if newConn := l.newConn(addr, remoteSessionID, 0, true, false); newConn != nil {
+			newConn.lastActivity = l.clock.Now()
+		}
+	})
+}
+
+// newConn creates a new Session for remote address `addr` and remote
+// session `remoteSessionID`. `receivedBytes` is the amount of bytes
+// already received from the address, and `isAddressValidated` is true
+// if the address is known to be not spoofed (see listenerConn.Write).
+// `isIntroduction` is true if the session is created for an introduction
+// of the identity hiding mode (see ListenerOptions.MaxIntroducedSessions).
+//
+// It should be called with l.locker locked.
+func (l *Listener) newConn(
+	addr net.Addr,
+	remoteSessionID SessionID,
+	receivedBytes uint64,
+	isAddressValidated bool,
+	isIntroduction bool,
+) *listenerConn {
+	if l.ctx.Err() != nil {
+		return nil
+	}
+	if !isIntroduction && l.halfOpenCount >= l.options.MaxHalfOpenSessions {
+		return nil
+	}
+	if l.remoteSessions[remoteSessionID] != nil {
+		// The same key exchange message from another address (for
+		// example a replay with a spoofed address)
+		return nil
+	}
+	if isIntroduction && uint(len(l.introducedConns)) >= l.options.MaxIntroducedSessions {
+		oldestConn := l.introducedConns[0]
+		l.removeIntroducedConn(oldestConn)
+		go func() { _ = oldestConn.session.Close() }()
+	}
+
+	conn := &listenerConn{
+		listener:            l,
+		remoteAddr:          addr,
+		readChan:            make(chan listenerDatagram, messageQueueLength),
+		closedChan:          make(chan struct{}),
+		deadlineChangedChan: make(chan struct{}),
+		receivedBytes:       receivedBytes,
+		isAddressValidated:  isAddressValidated,
+		isIntroduction:      isIntroduction,
+	}
+	conn.session = newSession(l.identity, nil, l.trustStore, conn, l.options.EventHandler, &l.options.SessionOptions)
+	if err := conn.session.Start(l.ctx); err != nil {
+		return nil
+	}
+	l.conns[addr.String()] = conn
+	if isIntroduction {
+		l.introducedConns = append(l.introducedConns, conn)
+	} else {
+		l.halfOpenCount++
+	}
+	l.remoteSessions[remoteSessionID] = conn
+	conn.remoteSessionID = remoteSessionID
+
+	l.waitGroup.Add(1)
+	go func() {
+		defer l.waitGroup.Done()
+		l.watchConn(conn)
+	}()
+	return conn
+}
+
+// watchConn passes the session of `conn` to Accept after the key
+// exchange and removes `conn` after the session is closed.
+func (l *Listener) watchConn(conn *listenerConn) {
+	sess := conn.session
+	state := sess.WaitForState(l.ctx, SessionStateEstablished, SessionStateClosing, SessionStateClosed)
+	l.locker.LockDo(func() {
+		if conn.isIntroduction {
+			l.removeIntroducedConn(conn)
+		} else {
+			l.halfOpenCount--
+		}
+	})
+	if state == SessionStateEstablished {
+		select {
+		case l.acceptChan <- sess:
+		default:
+			_ = sess.Close()
+		}
+	}
+
+	sess.WaitForClosure()
+	l.removeConn(conn)
+	l.locker.LockDo(func() {
+		if l.remoteSessions[conn.remoteSessionID] == conn {
+			delete(l.remoteSessions, conn.remoteSessionID)
+		}
+	})
+	conn.close()
+}
+
+// removeIntroducedConn removes `conn` from l.introducedConns (if it is
+// still there).
+//
+// It should be called with l.locker locked.
+func (l *Listener) removeIntroducedConn(conn *listenerConn) {
+	for idx, introducedConn := range l.introducedConns {
+		if introducedConn == conn {
+			l.introducedConns = append(l.introducedConns[:idx], l.introducedConns[idx+1:]...)
+			return
+		}
+	}
+}
+
+func (l *Listener) removeConn(conn *listenerConn) {
+	l.locker.LockDo(func() {
+		key := conn.getRemoteAddr().String()
+		if l.conns[key] == conn {
+			delete(l.conns, key)
+		}
+	})
+}
+
+// expireLoop closes the sessions which received nothing for longer than
+// ListenerOptions.IdleTimeout.
+func (l *Listener) expireLoop() {
+	ticker := l.clock.NewTicker(l.options.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		now := l.clock.Now()
+		var expired []*listenerConn
+		l.locker.LockDo(func() {
+			for key, conn := range l.conns {
+				if now.Sub(conn.lastActivity) < l.options.IdleTimeout {
+					continue
+				}
+				delete(l.conns, key)
+				expired = append(expired, conn)
+			}
+		})
+		for _, conn := range expired {
+			_ = conn.session.Close()
+		}
+	}
+}
+
+// listenerConn is the backend of a Session created by a Listener. It
+// receives the datagrams routed by the Listener and sends datagrams to
+// the remote address via the socket of the Listener.
+type listenerConn struct {
+	listener     *Listener
+	session      *Session
+	readChan     chan listenerDatagram
+	closedChan   chan struct{}
+	lastActivity time.Time
+
+	// remoteSessionID is the SessionID of the first key exchange
+	// message (see Listener.remoteSessions).
+	remoteSessionID SessionID
+
+	// isIntroduction is true if the connection was created for
+	// an introduction of the identity hiding mode (see
+	// Listener.introducedConns).
+	isIntroduction bool
+
+	locker              lockerMutex
+	remoteAddr          net.Addr
+	lastReadAddr        net.Addr
+	isClosed            bool
+	readDeadline        time.Time
+	deadlineChangedChan chan struct{}
+
+	// receivedBytes and sentBytes are used to limit the amount of
+	// bytes sent to the remote address until it is validated (see Write
+	// and validateAddress).
+	isAddressValidated bool
+	receivedBytes      uint64
+	sentBytes          uint64
+}
+
+// listenerDatagram is a datagram routed to a listenerConn, `addr`
+// is its source address.
+type listenerDatagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// Read implements io.Reader. Each call returns one datagram.
+func (conn *listenerConn) Read(b []byte) (int, error) {
+	for {
+		var deadline time.Time
+		var deadlineChangedChan chan struct{}
+		conn.locker.LockDo(func() {
+			deadline = conn.readDeadline
+			deadlineChangedChan = conn.deadlineChangedChan
+		})
+
+		// The deadlines are always in real time (see SessionOptions.Clock)
+		var timer *time.Timer
+		var timeoutChan <-chan time.Time
+		if !deadline.IsZero() {
+			timeout := deadline.Sub(timeNow())
+			if timeout <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(timeout)
+			timeoutChan = timer.C
+		}
+
+		n, err, isDone := conn.waitForDatagram(b, timeoutChan, deadlineChangedChan)
+		if timer != nil {
+			timer.Stop()
+		}
+		if isDone {
+			return n, err
+		}
+	}
+}
+
+func (conn *listenerConn) waitForDatagram(
+	b []byte,
+	timeoutChan <-chan time.Time,
+	deadlineChangedChan chan struct{},
+) (n int, err error, isDone bool) {
+	select {
+	case datagram := <-conn.readChan:
+		conn.locker.LockDo(func() {
+			conn.lastReadAddr = datagram.addr
+		})
+		return copy(b, datagram.data), nil, true
+	case <-conn.closedChan:
+		return 0, net.ErrClosed, true
+	case <-timeoutChan:
+		return 0, os.ErrDeadlineExceeded, true
+	case <-deadlineChangedChan:
+		return 0, nil, false
+	}
+}
+
+// Write implements io.Writer. Each call sends one datagram.
+//
+// The source address of the first datagram could be spoofed, so until
+// the address is validated (see validateAddress) at most
+// listenerAmplificationFactor times more bytes than received are sent
+// to the address (otherwise the Listener could be used to amplify
+// traffic to a victim). The datagrams over the limit are dropped (as if
+// they were lost).
+func (conn *listenerConn) Write(b []byte) (int, error) {
+	if !conn.reserveBytes(uint64(len(b))) {
+		return len(b), nil
+	}
+	return conn.listener.packetConn.WriteTo(b, conn.getRemoteAddr())
+}
+
+// reserveBytes returns true if `size` more bytes could be sent to
+// the remote address (see Write).
+func (conn *listenerConn) reserveBytes(size uint64) (result bool) {
+	conn.locker.LockDo(func() {
+		if conn.isAddressValidated {
+			result = true
+			return
+		}
+		if conn.sentBytes+size > conn.receivedBytes*listenerAmplificationFactor {
+			return
+		}
+		conn.sentBytes += size
+		result = true
+	})
+	return
+}
+
+// validateAddress removes the limit of Write. It is called when
+// a datagram encrypted with the negotiated keys is received from
+// the remote address: the keys depend on the key exchange message
+// sent to the address, so the remote side receives the datagrams
+// sent to it.
+func (conn *listenerConn) validateAddress() {
+	conn.locker.LockDo(func() {
+		conn.isAddressValidated = true
+	})
+}
+
+// addReceivedBytes is called when a datagram of size `size` is received
+// from the remote address.
+func (conn *listenerConn) addReceivedBytes(size uint64) {
+	conn.locker.LockDo(func() {
+		conn.receivedBytes += size
+	})
+}
+
+// Close implements io.Closer. It does not close the socket of
+// the Listener.
+func (conn *listenerConn) Close() error {
+	conn.listener.removeConn(conn)
+	conn.close()
+	return nil
+}
+
+func (conn *listenerConn) close() {
+	conn.locker.LockDo(func() {
+		if conn.isClosed {
+			return
+		}
+		conn.isClosed = true
+		close(conn.closedChan)
+	})
+}
+
+// LocalAddr returns the local address of the Listener.
+func (conn *listenerConn) LocalAddr() net.Addr {
+	return conn.listener.packetConn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the remote side.
+func (conn *listenerConn) RemoteAddr() net.Addr {
+	return conn.getRemoteAddr()
+}
+
+func (conn *listenerConn) getRemoteAddr() (addr net.Addr) {
+	conn.locker.LockDo(func() {
+		addr = conn.remoteAddr
+	})
+	return
+}
+
+// isEstablished returns true if the key exchange of the session
+// is complete, so its packets could be authenticated
+// (see `(*Session).isAuthenticPacket`).
+func (conn *listenerConn) isEstablished() bool {
+	switch conn.session.GetState() {
+	case SessionStateEstablished, SessionStatePaused:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetReadDeadline sets the deadline for Read calls (including the one
+// which is currently blocked).
+func (conn *listenerConn) SetReadDeadline(t time.Time) error {
+	conn.locker.LockDo(func() {
+		conn.readDeadline = t
+		close(conn.deadlineChangedChan)
+		conn.deadlineChangedChan = make(chan struct{})
+	})
+	return nil
+}
+
+// SetDeadline is the same as SetReadDeadline, the writes are never
+// blocked.
+func (conn *listenerConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+// onAuthenticPacket implements authenticPacketHandler. If the last read
+// datagram came from another address then the connection roams to it.
+// Otherwise, if the datagram is encrypted with the negotiated keys, then
+// the address is validated (see validateAddress).
+func (conn *listenerConn) onAuthenticPacket(isEncryptedWithCipherKey bool) {
+	var addr, remoteAddr net.Addr
+	conn.locker.LockDo(func() {
+		addr = conn.lastReadAddr
+		remoteAddr = conn.remoteAddr
+	})
+	if addr == nil || addr.String() == remoteAddr.String() {
+		if isEncryptedWithCipherKey {
+			conn.validateAddress()
+		}
+		return
+	}
+	conn.listener.roam(conn, addr)
+}
+
+// onRemoteSessionRestart implements remoteSessionRestartHandler.
+func (conn *listenerConn) onRemoteSessionRestart(sess *Session, remoteSessionID SessionID) {
+	conn.listener.restartConn(conn, remoteSessionID)
+	go func() { _ = sess.Close() }()
+}
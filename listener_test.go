@@ -0,0 +1,322 @@
+package secureio_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/xaionaro-go/secureio"
+)
+
+func testListener(t *testing.T, opts *ListenerOptions) (*Listener, *Identity) {
+	identity, _, _, _ := testPair(t)
+	packetConn, err := net.ListenPacket(`udp`, `127.0.0.1:0`)
+	require.NoError(t, err)
+	listener, err := Listen(packetConn, identity, nil, opts)
+	require.NoError(t, err)
+	return listener, identity
+}
+
+func testListenerClient(
+	t *testing.T,
+	listener *Listener,
+	serverIdentity *Identity,
+	opts *SessionOptions,
+) (*Session, *Identity, *net.UDPConn) {
+	_, privKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	identity, err := NewIdentityFromPrivateKey(privKey)
+	require.NoError(t, err)
+
+	conn, err := net.DialUDP(`udp`, nil, listener.Addr().(*net.UDPAddr))
+	require.NoError(t, err)
+
+	sess := identity.NewSession(serverIdentity, conn, &testLogger{t}, opts)
+	require.NoError(t, sess.Start(context.Background()))
+	return sess, identity, conn
+}
+
+func testListenerOptions(t *testing.T) *SessionOptions {
+	return &SessionOptions{
+		PayloadSizeLimit: 1024,
+		KeyExchangerOptions: KeyExchangerOptions{
+			RetryInterval: 50 * time.Millisecond,
+		},
+	}
+}
+
+func TestListener(t *testing.T) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+
+	listener, serverIdentity := testListener(t, &ListenerOptions{
+		SessionOptions: *testListenerOptions(t),
+		EventHandler:   &testLogger{t},
+	})
+
+	clients := map[string]*Session{}
+	for i := 0; i < 2; i++ {
+		sess, identity, _ := testListenerClient(t, listener, serverIdentity, testListenerOptions(t))
+		clients[string(identity.Keys.Public)] = sess
+		defer func() { _ = sess.Close() }()
+	}
+
+	for i := 0; i < 2; i++ {
+		serverSess, err := listener.Accept(ctx)
+		require.NoError(t, err)
+		clientSess := clients[string(serverSess.GetRemoteIdentity().Keys.Public)]
+		require.NotNil(t, clientSess)
+
+		_, err = clientSess.Write([]byte(`ping`))
+		require.NoError(t, err)
+		buf := make([]byte, serverSess.GetPayloadSizeLimit())
+		n, err := serverSess.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, `ping`, string(buf[:n]))
+
+		_, err = serverSess.Write([]byte(`pong`))
+		require.NoError(t, err)
+		n, err = clientSess.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, `pong`, string(buf[:n]))
+	}
+
+	require.NoError(t, listener.Close())
+	_, err := listener.Accept(ctx)
+	assert.Error(t, err)
+}
+
+func TestListener_remoteRestart(t *testing.T) {
+	for _, enableIdentityHiding := range []bool{false, true} {
+		enableIdentityHiding := enableIdentityHiding
+		t.Run(fmt.Sprintf("identityHiding-%v", enableIdentityHiding), func(t *testing.T) {
+			testListenerRemoteRestart(t, enableIdentityHiding)
+		})
+	}
+}
+
+func testListenerRemoteRestart(t *testing.T, enableIdentityHiding bool) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+
+	sessOpts := func() *SessionOptions {
+		opts := testListenerOptions(t)
+		opts.KeyExchangerOptions.EnableIdentityHiding = enableIdentityHiding
+		return opts
+	}
+
+	listener, serverIdentity := testListener(t, &ListenerOptions{
+		SessionOptions: *sessOpts(),
+		EventHandler:   &testLogger{t},
+	})
+	defer func() { _ = listener.Close() }()
+
+	clientSess0, clientIdentity, conn := testListenerClient(t, listener, serverIdentity, sessOpts())
+	serverSess0, err := listener.Accept(ctx)
+	require.NoError(t, err)
+	require.NoError(t, clientSess0.Close())
+	clientSess0.WaitForClosure()
+
+	// A new session from the same address
+	clientSess1 := clientIdentity.NewSession(serverIdentity, conn, &testLogger{t}, sessOpts())
+	require.NoError(t, clientSess1.Start(ctx))
+	defer func() { _ = clientSess1.Close() }()
+
+	serverSess1, err := listener.Accept(ctx)
+	require.NoError(t, err)
+	assert.NotEqual(t, serverSess0, serverSess1)
+	assert.Equal(t, SessionStateClosed, serverSess0.WaitForState(ctx, SessionStateClosed))
+
+	_, err = clientSess1.Write([]byte(`unit-test`))
+	require.NoError(t, err)
+	buf := make([]byte, serverSess1.GetPayloadSizeLimit())
+	n, err := serverSess1.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, `unit-test`, string(buf[:n]))
+}
+
+func TestListener_roaming(t *testing.T) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+
+	listener, serverIdentity := testListener(t, &ListenerOptions{
+		SessionOptions: *testListenerOptions(t),
+		EventHandler:   &testLogger{t},
+	})
+	defer func() { _ = listener.Close() }()
+
+	clientSess, _, _ := testListenerClient(t, listener, serverIdentity, testListenerOptions(t))
+	defer func() { _ = clientSess.Close() }()
+	serverSess, err := listener.Accept(ctx)
+	require.NoError(t, err)
+
+	// The client changes its address
+	newConn, err := net.DialUDP(`udp`, nil, listener.Addr().(*net.UDPAddr))
+	require.NoError(t, err)
+	require.NoError(t, clientSess.ReplaceBackend(newConn))
+
+	_, err = clientSess.Write([]byte(`ping`))
+	require.NoError(t, err)
+	buf := make([]byte, serverSess.GetPayloadSizeLimit())
+	n, err := serverSess.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, `ping`, string(buf[:n]))
+	assert.Equal(t, newConn.LocalAddr().String(), serverSess.RemoteAddr().String())
+
+	// The reply is sent to the new address
+	_, err = serverSess.Write([]byte(`pong`))
+	require.NoError(t, err)
+	n, err = clientSess.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, `pong`, string(buf[:n]))
+
+	shortCtx, shortCancelFunc := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer shortCancelFunc()
+	_, err = listener.Accept(shortCtx)
+	assert.Error(t, err, "no new session is created for the new address")
+}
+
+func TestListener_limits(t *testing.T) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+
+	// The negotiation needs the time to move, so it is disabled with
+	// the fake clock.
+	clock := NewFakeClock(time.Now())
+	sessOpts := testListenerOptions(t)
+	sessOpts.Clock = clock
+	sessOpts.KeyExchangerOptions.Timeout = time.Minute
+	sessOpts.NegotiatorOptions.Enable = NegotiatorEnableFalse
+	clientOpts := testListenerOptions(t)
+	clientOpts.NegotiatorOptions.Enable = NegotiatorEnableFalse
+	listener, serverIdentity := testListener(t, &ListenerOptions{
+		SessionOptions:      *sessOpts,
+		EventHandler:        wrapErrorHandler(nil, func(sess *Session, err error) bool { return false }),
+		IdleTimeout:         time.Hour,
+		MaxHalfOpenSessions: 1,
+	})
+	defer func() { _ = listener.Close() }()
+
+	// A peer which never completes the key exchange (it expects another
+	// identity of the server)
+	_, wrongServerIdentity, _, _ := testPair(t)
+	junkSess, _, _ := testListenerClient(t, listener, wrongServerIdentity, clientOpts)
+	require.NoError(t, clock.WaitForWaiters(ctx, 3)) // the idle ticker, the key exchange timeout timer and the retry ticker
+
+	clientSess, _, _ := testListenerClient(t, listener, serverIdentity, clientOpts)
+	defer func() { _ = clientSess.Close() }()
+
+	shortCtx, shortCancelFunc := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer shortCancelFunc()
+	_, err := listener.Accept(shortCtx)
+	require.Error(t, err, "the half-open sessions limit is exceeded")
+
+	// The key exchange with the junk peer times out, so there's a free
+	// slot for the client. The datagrams of the junk peer which are
+	// already sent may start a new key exchange, so the clock is
+	// advanced until the client is accepted.
+	require.NoError(t, junkSess.Close())
+	junkSess.WaitForClosure()
+	var serverSess *Session
+	for serverSess == nil {
+		require.NoError(t, ctx.Err(), "the client is not accepted")
+		clock.Advance(time.Minute)
+		shortCtx, shortCancelFunc := context.WithTimeout(ctx, 100*time.Millisecond)
+		serverSess, _ = listener.Accept(shortCtx)
+		shortCancelFunc()
+	}
+
+	// The session is closed if nothing is received for IdleTimeout
+	clock.Advance(time.Hour)
+	for serverSess.GetState() != SessionStateClosed {
+		select {
+		case <-ctx.Done():
+			t.Fatal("the idle session is not closed")
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(time.Hour)
+		}
+	}
+}
+
+// firstWriteRecorder records the first datagram written to the wrapped
+// connection.
+type firstWriteRecorder struct {
+	net.Conn
+	firstWrite chan []byte
+}
+
+func (conn *firstWriteRecorder) Write(b []byte) (int, error) {
+	select {
+	case conn.firstWrite <- append([]byte(nil), b...):
+	default:
+	}
+	return conn.Conn.Write(b)
+}
+
+func TestListener_spoofedDatagrams(t *testing.T) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+
+	listener, serverIdentity := testListener(t, &ListenerOptions{
+		SessionOptions:      *testListenerOptions(t),
+		EventHandler:        &testLogger{t},
+		MaxHalfOpenSessions: 1,
+	})
+	defer func() { _ = listener.Close() }()
+
+	spoofer, err := net.DialUDP(`udp`, nil, listener.Addr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer func() { _ = spoofer.Close() }()
+	assertNoReply := func() {
+		buf := make([]byte, 65536)
+		require.NoError(t, spoofer.SetReadDeadline(time.Now().Add(300*time.Millisecond)))
+		_, err := spoofer.Read(buf)
+		assert.Error(t, err, "a reply to a spoofed datagram")
+	}
+	accept := func(backend net.Conn) *Session {
+		_, privKey, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		identity, err := NewIdentityFromPrivateKey(privKey)
+		require.NoError(t, err)
+		clientSess := identity.NewSession(serverIdentity, backend, &testLogger{t}, testListenerOptions(t))
+		require.NoError(t, clientSess.Start(ctx))
+		_, err = listener.Accept(ctx)
+		require.NoError(t, err)
+		return clientSess
+	}
+
+	// Junk does not create sessions (and does not take the only
+	// half-open session slot)
+	junk := make([]byte, 256)
+	for i := 0; i < 3; i++ {
+		_, err = rand.Read(junk)
+		require.NoError(t, err)
+		_, err = spoofer.Write(junk)
+		require.NoError(t, err)
+	}
+	assertNoReply()
+
+	conn, err := net.DialUDP(`udp`, nil, listener.Addr().(*net.UDPAddr))
+	require.NoError(t, err)
+	recorder := &firstWriteRecorder{Conn: conn, firstWrite: make(chan []byte, 1)}
+	clientSess := accept(recorder)
+	defer func() { _ = clientSess.Close() }()
+
+	// A replay of an authentic key exchange message from another
+	// address does not create a session either
+	_, err = spoofer.Write(<-recorder.firstWrite)
+	require.NoError(t, err)
+	assertNoReply()
+
+	conn, err = net.DialUDP(`udp`, nil, listener.Addr().(*net.UDPAddr))
+	require.NoError(t, err)
+	otherClientSess := accept(conn)
+	defer func() { _ = otherClientSess.Close() }()
+}
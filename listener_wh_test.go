@@ -0,0 +1,207 @@
+package secureio
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+func TestListener_limitRoamingCandidates(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	l := &Listener{
+		options:                 ListenerOptions{RoamingChecksPerSecond: 2},
+		clock:                   clock,
+		roamingChecksBudget:     2,
+		roamingChecksRefilledAt: clock.Now(),
+	}
+	conn := func(addr string) *listenerConn {
+		udpAddr, err := net.ResolveUDPAddr(`udp`, addr)
+		assert.NoError(t, err)
+		return &listenerConn{remoteAddr: udpAddr}
+	}
+	candidates := func() []*listenerConn {
+		return []*listenerConn{
+			conn(`192.0.2.1:1000`),
+			conn(`192.0.2.2:1000`),
+			conn(`192.0.2.3:1000`),
+		}
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP(`192.0.2.3`), Port: 2000}
+
+	// The connection with the same IP address goes first
+	result := l.limitRoamingCandidates(addr, candidates())
+	if assert.Len(t, result, 2) {
+		assert.Equal(t, `192.0.2.3:1000`, result[0].getRemoteAddr().String())
+	}
+
+	// The limit is reached
+	assert.Empty(t, l.limitRoamingCandidates(addr, candidates()))
+	clock.Advance(time.Second / 2)
+	assert.Len(t, l.limitRoamingCandidates(addr, candidates()), 1)
+	clock.Advance(time.Hour)
+	assert.Len(t, l.limitRoamingCandidates(addr, candidates()), 2)
+}
+
+// packetRecorder is a backend which records the written packets.
+type packetRecorder struct {
+	*erroneousConn
+	packets chan []byte
+}
+
+func (conn *packetRecorder) Write(b []byte) (int, error) {
+	conn.packets <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestListener_lowOrderPublicKey(t *testing.T) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+
+	newIdentity := func() *Identity {
+		_, privKey, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		identity, err := NewIdentityFromPrivateKey(privKey)
+		require.NoError(t, err)
+		return identity
+	}
+	serverIdentity := newIdentity()
+	packetConn, err := net.ListenPacket(`udp`, `127.0.0.1:0`)
+	require.NoError(t, err)
+	l, err := Listen(packetConn, serverIdentity, nil, nil)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	// A properly signed message with a low-order key exchange key (the
+	// shared key with it would be zero)
+	attackerKX := testKeyExchanger(t, func(err error) {})
+	recorder := &packetRecorder{erroneousConn: newErroneousConn(), packets: make(chan []byte, 1)}
+	attackerKX.messenger.sess.backend = recorder
+	msg := &keySeedUpdateMessage{
+		SessionID:   SessionID{CreatedAt: uint64(time.Now().UnixNano()), Random: 1},
+		AnswersMode: l.verifier.options.AnswersMode,
+		KXPublicKey: [curve25519PublicKeySize]byte{1},
+	}
+	copy(msg.IdentityPublicKey[:], attackerKX.localIdentity.Keys.Public)
+	var exts keySeedUpdateMessageExtensions
+	timestamps := keySeedUpdateMessageTimestamps{
+		CreatedAt:    uint64(time.Now().UnixNano()),
+		KeyCreatedAt: 1,
+	}
+	exts.Add(keySeedUpdateMessageExtensionTypeTimestamps, timestamps.Bytes())
+	b, err := attackerKX.encode(msg, exts)
+	require.NoError(t, err)
+	_, err = attackerKX.messenger.sess.WriteMessageSingle(messageTypeKeyExchange, b)
+	require.NoError(t, err)
+	packet := <-recorder.packets
+
+	_, err = l.verifyFirstDatagram(packet)
+	assert.True(t, err.(*xerrors.Error).Has(errInvalidPublicKey{}), err)
+
+	attackerConn, err := net.DialUDP(`udp`, nil, l.Addr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer func() { _ = attackerConn.Close() }()
+	_, err = attackerConn.Write(packet)
+	require.NoError(t, err)
+
+	// The server keeps serving
+	clientConn, err := net.DialUDP(`udp`, nil, l.Addr().(*net.UDPAddr))
+	require.NoError(t, err)
+	clientSess := newIdentity().NewSession(serverIdentity, clientConn, nil, nil)
+	require.NoError(t, clientSess.Start(ctx))
+	defer func() { _ = clientSess.Close() }()
+	serverSess, err := l.Accept(ctx)
+	require.NoError(t, err)
+	_, err = clientSess.Write([]byte(`ping`))
+	require.NoError(t, err)
+	buf := make([]byte, serverSess.GetPayloadSizeLimit())
+	n, err := serverSess.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, `ping`, string(buf[:n]))
+}
+
+func TestListener_spoofedIntroductions(t *testing.T) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+
+	newIdentity := func() *Identity {
+		_, privKey, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		identity, err := NewIdentityFromPrivateKey(privKey)
+		require.NoError(t, err)
+		return identity
+	}
+	sessOpts := func() *SessionOptions {
+		opts := &SessionOptions{}
+		opts.KeyExchangerOptions.RetryInterval = 50 * time.Millisecond
+		opts.KeyExchangerOptions.EnableIdentityHiding = true
+		return opts
+	}
+	serverIdentity := newIdentity()
+	packetConn, err := net.ListenPacket(`udp`, `127.0.0.1:0`)
+	require.NoError(t, err)
+	l, err := Listen(packetConn, serverIdentity, nil, &ListenerOptions{
+		SessionOptions:        *sessOpts(),
+		MaxHalfOpenSessions:   1,
+		MaxIntroducedSessions: 4,
+	})
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	// Introductions (which anybody could send) from many addresses
+	for i := 0; i < 8; i++ {
+		spooferKX := testKeyExchanger(t, func(err error) {})
+		recorder := &packetRecorder{erroneousConn: newErroneousConn(), packets: make(chan []byte, 1)}
+		spooferKX.messenger.sess.backend = recorder
+		hdr := keySeedUpdateMessageHiddenHeaders{
+			SessionID: SessionID{CreatedAt: uint64(time.Now().UnixNano()), Random: uint64(i + 1)},
+		}
+		_, err := rand.Read(hdr.KXPublicKey[:])
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, binary.Write(&buf, binaryOrderType, &hdr))
+		_, err = spooferKX.messenger.sess.WriteMessageSingle(messageTypeKeyExchange, buf.Bytes())
+		require.NoError(t, err)
+
+		spooferConn, err := net.DialUDP(`udp`, nil, l.Addr().(*net.UDPAddr))
+		require.NoError(t, err)
+		defer func() { _ = spooferConn.Close() }()
+		_, err = spooferConn.Write(<-recorder.packets)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() (isDone bool) {
+		l.locker.LockDo(func() {
+			count := len(l.introducedConns)
+			isDone = count != 0 && l.introducedConns[count-1].remoteSessionID.Random == 8
+		})
+		return
+	}, 10*time.Second, time.Millisecond)
+	l.locker.LockDo(func() {
+		assert.Len(t, l.introducedConns, 4)
+		assert.Zero(t, l.halfOpenCount)
+	})
+
+	// A legitimate client is still accepted
+	clientConn, err := net.DialUDP(`udp`, nil, l.Addr().(*net.UDPAddr))
+	require.NoError(t, err)
+	clientSess := newIdentity().NewSession(serverIdentity, clientConn, nil, sessOpts())
+	require.NoError(t, clientSess.Start(ctx))
+	defer func() { _ = clientSess.Close() }()
+	serverSess, err := l.Accept(ctx)
+	require.NoError(t, err)
+	_, err = clientSess.Write([]byte(`ping`))
+	require.NoError(t, err)
+	buf := make([]byte, serverSess.GetPayloadSizeLimit())
+	n, err := serverSess.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, `ping`, string(buf[:n]))
+}
@@ -65,8 +65,15 @@ const (
 	// the in-band data. It used by default for (*Session).Read and
 	// (*Session).Write.
 	MessageTypeReadWrite
-	messageTypeReserved0
-	messageTypeReserved1
+
+	// messageTypeResumptionTicket is used to send resumption tickets
+	// (see ResumptionTicket).
+	messageTypeResumptionTicket
+
+	// messageTypePathProbe is used to probe the paths of a multipath
+	// session (see Multipath).
+	messageTypePathProbe
+
 	messageTypeReserved2
 	messageTypeReserved3
 	messageTypeReserved4
@@ -197,6 +204,10 @@ type messagesContainerHeadersData struct {
 type messagesContainerHeaders struct {
 	messagesContainerHeadersData
 
+	// isEncryptedWithCipherKey is set by `(*Session).decrypt`, it is
+	// false if the packet is protected only by an aux cipher key.
+	isEncryptedWithCipherKey bool
+
 	pool   *messagesContainerHeadersPool
 	isBusy bool
 }
@@ -287,9 +298,9 @@ func (containerHdr *messagesContainerHeadersData) SetNextPacketID(sess *Session)
 	containerHdr.PacketID.SetNextPacketID(sess)
 }
 
-func (containerHdr *messagesContainerHeadersData) calculatePoly1305Key(cipherKey []byte) (result [32]byte) {
-	copy(result[:len(containerHdr.PacketID)], containerHdr.PacketID[:])
-	copy(result[len(containerHdr.PacketID):], cipherKey)
+func calculatePoly1305Key(packetIDBytes []byte, cipherKey []byte) (result [32]byte) {
+	copy(result[:len(packetIDBytes)], packetIDBytes)
+	copy(result[len(packetIDBytes):], cipherKey)
 	for idx := range result {
 		result[idx] ^= poly1305KeyXORer[idx]
 	}
@@ -297,21 +308,34 @@ func (containerHdr *messagesContainerHeadersData) calculatePoly1305Key(cipherKey
 	return result
 }
 
-func (containerHdr *messagesContainerHeadersData) CalculateHeadersChecksumTo(cipherKey []byte, dst *[poly1305.TagSize]byte) {
-	key := containerHdr.calculatePoly1305Key(cipherKey)
-	poly1305.Sum(
+func (containerHdr *messagesContainerHeadersData) CalculateHeadersChecksumTo(
+	suite streamCipherSuiteImplementation,
+	cipherKey []byte,
+	iv []byte,
+	dst *[poly1305.TagSize]byte,
+) {
+	suite.Sum(
 		dst,
+		cipherKey,
+		iv,
+		checksumTypeHeaders,
 		unsafetools.BytesOf(containerHdr)[len(containerHdr.PacketID)+poly1305.TagSize*2:],
-		&key,
 	)
 }
 
-func (containerHdr *messagesContainerHeadersData) CalculateMessagesChecksumTo(cipherKey []byte, dst *[poly1305.TagSize]byte, messagesBytes []byte) {
-	key := containerHdr.calculatePoly1305Key(cipherKey)
-	poly1305.Sum(
+func (containerHdr *messagesContainerHeadersData) CalculateMessagesChecksumTo(
+	suite streamCipherSuiteImplementation,
+	cipherKey []byte,
+	iv []byte,
+	dst *[poly1305.TagSize]byte,
+	messagesBytes []byte,
+) {
+	suite.Sum(
 		dst,
+		cipherKey,
+		iv,
+		checksumTypeMessages,
 		messagesBytes,
-		&key,
 	)
 }
 
@@ -421,10 +445,21 @@ func (pool *messagesContainerHeadersPool) Put(containerHdr *messagesContainerHea
 	pool.storage.Put(containerHdr)
 }
 
-func (containerHdr *messagesContainerHeadersData) Set(cipherKey []byte, messagesBytes []byte) error {
+func (containerHdr *messagesContainerHeadersData) Set(
+	suite cipherSuiteImplementation,
+	cipherKey []byte,
+	iv []byte,
+	messagesBytes []byte,
+) error {
 	containerHdr.Length = messageLength(len(messagesBytes))
-	containerHdr.CalculateHeadersChecksumTo(cipherKey, &containerHdr.ContainerHeadersChecksum)
-	containerHdr.CalculateMessagesChecksumTo(cipherKey, &containerHdr.MessagesChecksum, messagesBytes)
+	streamSuite, ok := suite.(streamCipherSuiteImplementation)
+	if !ok {
+		// The packet is authenticated by the AEAD, see
+		// aeadCipherSuiteImplementation.
+		return nil
+	}
+	containerHdr.CalculateHeadersChecksumTo(streamSuite, cipherKey, iv, &containerHdr.ContainerHeadersChecksum)
+	containerHdr.CalculateMessagesChecksumTo(streamSuite, cipherKey, iv, &containerHdr.MessagesChecksum, messagesBytes)
 	return nil
 }
 
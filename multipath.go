@@ -0,0 +1,571 @@
+package secureio
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMultipathProbeInterval is the default value for
+	// MultipathOptions.ProbeInterval.
+	DefaultMultipathProbeInterval = time.Second
+
+	// DefaultMultipathProbeTimeout is the default value for
+	// MultipathOptions.ProbeTimeout.
+	DefaultMultipathProbeTimeout = 5 * time.Second
+)
+
+// PathID is the identifier of a path of a Multipath.
+type PathID uint32
+
+// MultipathPolicy defines which path is used to send a packet
+// (see MultipathOptions.Policy).
+type MultipathPolicy uint8
+
+const (
+	// MultipathPolicyFailover sends all the packets via the first
+	// healthy path (in order of adding). The rest paths are the backups.
+	MultipathPolicyFailover = MultipathPolicy(iota)
+
+	// MultipathPolicyRoundRobin stripes the packets across all
+	// the healthy paths.
+	MultipathPolicyRoundRobin
+
+	// MultipathPolicyLowestRTT sends all the packets via the healthy
+	// path with the lowest round-trip time (measured by probes).
+	MultipathPolicyLowestRTT
+)
+
+// MultipathOptions is a set of optional parameters of a Multipath.
+type MultipathOptions struct {
+	// Policy defines which path is used to send a packet.
+	//
+	// The default value is MultipathPolicyFailover.
+	Policy MultipathPolicy
+
+	// ProbeInterval is the interval between probes sent via each path
+	// by the Session to measure the round-trip time and to detect if
+	// the path is healthy.
+	//
+	// The default value is DefaultMultipathProbeInterval.
+	ProbeInterval time.Duration
+
+	// ProbeTimeout is the duration after which a path is considered
+	// unhealthy if nothing authentic was received via it (including
+	// replies to the probes).
+	//
+	// The default value is DefaultMultipathProbeTimeout.
+	ProbeTimeout time.Duration
+
+	// Clock is the source of time for the health checks and the probes.
+	//
+	// The default value is the system clock.
+	Clock Clock
+}
+
+// PathStatistics is the statistics of a path of a Multipath
+// (see `(*Session).GetPathStatistics`).
+type PathStatistics struct {
+	ID PathID
+
+	// IsUp is true if the path is considered healthy.
+	IsUp bool
+
+	// RTT is the smoothed round-trip time measured by probes (or zero
+	// if it is not measured yet).
+	RTT time.Duration
+
+	// LastAliveAt is the time when an authentic packet (or a reply to
+	// a probe) was received via the path last time.
+	LastAliveAt time.Time
+
+	SentPackets     uint64
+	SentBytes       uint64
+	ReceivedPackets uint64
+	ReceivedBytes   uint64
+	SendErrors      uint64
+	ReceiveErrors   uint64
+
+	// LastError is the last error of a read or a write on the path.
+	LastError error
+}
+
+// Multipath is a backend of a Session which sends and receives packets
+// via multiple paths (other backends, for example one UDP connection per
+// network interface).
+//
+// Each packet is sent via a single path chosen by MultipathOptions.Policy,
+// and the packets received via any path are passed to the Session (which
+// detects replays using a single PacketID window). The health of the paths
+// is detected by probes sent by the Session, see
+// `(*Session).GetPathStatistics`.
+//
+// The paths with byte stream backends are framed (see IsStreamWriter).
+//
+// The Multipath owns its paths: they are closed on RemovePath and Close.
+type Multipath struct {
+	locker              lockerMutex
+	options             MultipathOptions
+	paths               []*multipathPath
+	nextPathID          PathID
+	roundRobinIdx       uint
+	lastReadPath        *multipathPath
+	readChan            chan multipathPacket
+	closedChan          chan struct{}
+	isClosed            bool
+	readDeadline        time.Time
+	deadlineChangedChan chan struct{}
+	waitGroup           sync.WaitGroup
+}
+
+// multipathPath is a path of a Multipath. The mutable fields are
+// guarded by Multipath.locker.
+type multipathPath struct {
+	id       PathID
+	backend  io.ReadWriteCloser
+	isStream bool
+	stopChan chan struct{}
+
+	isFailed    bool
+	lastAliveAt time.Time
+	rtt         time.Duration
+	statistics  PathStatistics
+}
+
+// multipathPacket is a packet received via path `path`.
+type multipathPacket struct {
+	data []byte
+	path *multipathPath
+}
+
+// NewMultipath returns a new Multipath with paths `backends`. More paths
+// could be added later by AddPath.
+func NewMultipath(opts *MultipathOptions, backends ...io.ReadWriteCloser) *Multipath {
+	mp := &Multipath{
+		readChan:            make(chan multipathPacket, messageQueueLength),
+		closedChan:          make(chan struct{}),
+		deadlineChangedChan: make(chan struct{}),
+	}
+	if opts != nil {
+		mp.options = *opts
+	}
+	if mp.options.ProbeInterval == 0 {
+		mp.options.ProbeInterval = DefaultMultipathProbeInterval
+	}
+	if mp.options.ProbeTimeout == 0 {
+		mp.options.ProbeTimeout = DefaultMultipathProbeTimeout
+	}
+	if mp.options.Clock == nil {
+		mp.options.Clock = systemClock{}
+	}
+	for _, backend := range backends {
+		_, _ = mp.AddPath(backend)
+	}
+	return mp
+}
+
+// AddPath adds a new path. It returns ErrAlreadyClosed if the Multipath
+// is closed.
+func (mp *Multipath) AddPath(backend io.ReadWriteCloser) (pathID PathID, err error) {
+	path := &multipathPath{
+		backend:     backend,
+		isStream:    IsStreamWriter(backend),
+		stopChan:    make(chan struct{}),
+		lastAliveAt: mp.options.Clock.Now(),
+	}
+	mp.locker.LockDo(func() {
+		if mp.isClosed {
+			err = newErrAlreadyClosed()
+			return
+		}
+		path.id = mp.nextPathID
+		path.statistics.ID = path.id
+		mp.nextPathID++
+		mp.paths = append(mp.paths, path)
+		mp.waitGroup.Add(1)
+	})
+	if err != nil {
+		return
+	}
+
+	go func() {
+		defer mp.waitGroup.Done()
+		mp.readLoop(path)
+	}()
+	return path.id, nil
+}
+
+// RemovePath removes the path and closes its backend.
+func (mp *Multipath) RemovePath(pathID PathID) error {
+	var path *multipathPath
+	mp.locker.LockDo(func() {
+		for idx, candidate := range mp.paths {
+			if candidate.id != pathID {
+				continue
+			}
+			path = candidate
+			mp.paths = append(mp.paths[:idx], mp.paths[idx+1:]...)
+			close(path.stopChan)
+			break
+		}
+	})
+	if path == nil {
+		return newErrUnknownPath(pathID)
+	}
+	return path.backend.Close()
+}
+
+// GetStatistics returns the statistics of all the paths.
+func (mp *Multipath) GetStatistics() []PathStatistics {
+	now := mp.options.Clock.Now()
+	var result []PathStatistics
+	mp.locker.LockDo(func() {
+		for _, path := range mp.paths {
+			statistics := path.statistics
+			statistics.IsUp = mp.isPathUp(path, now)
+			statistics.RTT = path.rtt
+			statistics.LastAliveAt = path.lastAliveAt
+			result = append(result, statistics)
+		}
+	})
+	return result
+}
+
+func (mp *Multipath) getPathIDs() (result []PathID) {
+	mp.locker.LockDo(func() {
+		for _, path := range mp.paths {
+			result = append(result, path.id)
+		}
+	})
+	return
+}
+
+// isPathUp returns true if the path is considered healthy.
+//
+// It should be called with mp.locker locked.
+func (mp *Multipath) isPathUp(path *multipathPath, now time.Time) bool {
+	return !path.isFailed && now.Sub(path.lastAliveAt) < mp.options.ProbeTimeout
+}
+
+func (mp *Multipath) isLossy() (result bool) {
+	mp.locker.LockDo(func() {
+		for _, path := range mp.paths {
+			if IsLossyWriter(path.backend) {
+				result = true
+				return
+			}
+		}
+	})
+	return
+}
+
+func (mp *Multipath) readLoop(path *multipathPath) {
+	buf := make([]byte, maxPossiblePacketSize)
+	var frameReader *frameReader
+	if path.isStream {
+		frameReader = newFrameReader(path.backend, len(buf))
+	}
+
+	for {
+		var n int
+		var err error
+		if frameReader == nil {
+			n, err = path.backend.Read(buf)
+		} else {
+			n, err = frameReader.ReadFrame(buf)
+		}
+		if err != nil {
+			select {
+			case <-path.stopChan:
+				return
+			case <-mp.closedChan:
+				return
+			default:
+			}
+			mp.locker.LockDo(func() {
+				path.isFailed = true
+				path.statistics.ReceiveErrors++
+				path.statistics.LastError = err
+			})
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || frameReader.IsBroken() {
+				return
+			}
+			// Do not spin on a persistent error.
+			select {
+			case <-mp.options.Clock.After(mp.options.ProbeInterval):
+			case <-path.stopChan:
+				return
+			case <-mp.closedChan:
+				return
+			}
+			continue
+		}
+
+		mp.locker.LockDo(func() {
+			path.statistics.ReceivedPackets++
+			path.statistics.ReceivedBytes += uint64(n)
+		})
+		select {
+		case mp.readChan <- multipathPacket{
+			data: append([]byte(nil), buf[:n]...),
+			path: path,
+		}:
+		case <-path.stopChan:
+			return
+		case <-mp.closedChan:
+			return
+		}
+	}
+}
+
+// Read implements io.Reader. Each call returns one packet received via
+// any of the paths.
+func (mp *Multipath) Read(b []byte) (int, error) {
+	for {
+		var deadline time.Time
+		var deadlineChangedChan chan struct{}
+		mp.locker.LockDo(func() {
+			deadline = mp.readDeadline
+			deadlineChangedChan = mp.deadlineChangedChan
+		})
+
+		// The deadlines are always in real time (see SessionOptions.Clock)
+		var timer *time.Timer
+		var timeoutChan <-chan time.Time
+		if !deadline.IsZero() {
+			timeout := deadline.Sub(timeNow())
+			if timeout <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(timeout)
+			timeoutChan = timer.C
+		}
+
+		n, err, isDone := mp.waitForPacket(b, timeoutChan, deadlineChangedChan)
+		if timer != nil {
+			timer.Stop()
+		}
+		if isDone {
+			return n, err
+		}
+	}
+}
+
+func (mp *Multipath) waitForPacket(
+	b []byte,
+	timeoutChan <-chan time.Time,
+	deadlineChangedChan chan struct{},
+) (n int, err error, isDone bool) {
+	select {
+	case packet := <-mp.readChan:
+		mp.locker.LockDo(func() {
+			mp.lastReadPath = packet.path
+		})
+		return copy(b, packet.data), nil, true
+	case <-mp.closedChan:
+		return 0, net.ErrClosed, true
+	case <-timeoutChan:
+		return 0, os.ErrDeadlineExceeded, true
+	case <-deadlineChangedChan:
+		return 0, nil, false
+	}
+}
+
+// Write implements io.Writer. The packet is sent via a path chosen by
+// MultipathOptions.Policy. If the write fails then the next path is tried.
+func (mp *Multipath) Write(b []byte) (n int, err error) {
+	paths := mp.choosePaths()
+	if len(paths) == 0 {
+		return 0, newErrNoPaths()
+	}
+
+	for _, path := range paths {
+		n, err = mp.writeToPath(path, b)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// writeToPathID writes the packet via path `pathID` (regardless
+// of MultipathOptions.Policy).
+func (mp *Multipath) writeToPathID(pathID PathID, b []byte) (int, error) {
+	var path *multipathPath
+	mp.locker.LockDo(func() {
+		for _, candidate := range mp.paths {
+			if candidate.id == pathID {
+				path = candidate
+				break
+			}
+		}
+	})
+	if path == nil {
+		return 0, newErrUnknownPath(pathID)
+	}
+	return mp.writeToPath(path, b)
+}
+
+// choosePaths returns the paths to try to write to, in order of
+// preference. The unhealthy paths are tried after the healthy ones.
+func (mp *Multipath) choosePaths() (result []*multipathPath) {
+	now := mp.options.Clock.Now()
+	mp.locker.LockDo(func() {
+		var upPaths, downPaths []*multipathPath
+		for _, path := range mp.paths {
+			if mp.isPathUp(path, now) {
+				upPaths = append(upPaths, path)
+			} else {
+				downPaths = append(downPaths, path)
+			}
+		}
+
+		switch mp.options.Policy {
+		case MultipathPolicyRoundRobin:
+			if len(upPaths) > 0 {
+				offset := mp.roundRobinIdx % uint(len(upPaths))
+				mp.roundRobinIdx++
+				upPaths = append(upPaths[offset:], upPaths[:offset]...)
+			}
+		case MultipathPolicyLowestRTT:
+			sort.SliceStable(upPaths, func(i, j int) bool {
+				// An unmeasured RTT is considered the highest one.
+				rttI, rttJ := upPaths[i].rtt, upPaths[j].rtt
+				if rttI == 0 || rttJ == 0 {
+					return rttJ == 0 && rttI != 0
+				}
+				return rttI < rttJ
+			})
+		}
+
+		result = append(upPaths, downPaths...)
+	})
+	return
+}
+
+// writeToPath writes the packet via path `path` and updates
+// the statistics of the path.
+func (mp *Multipath) writeToPath(path *multipathPath, b []byte) (n int, err error) {
+	defer func() {
+		mp.locker.LockDo(func() {
+			if err != nil {
+				path.isFailed = true
+				path.statistics.SendErrors++
+				path.statistics.LastError = err
+				return
+			}
+			path.statistics.SentPackets++
+			path.statistics.SentBytes += uint64(n)
+		})
+	}()
+
+	if !path.isStream {
+		return path.backend.Write(b)
+	}
+
+	// The header and the packet are written by a single Write to do not
+	// interleave with the packets written concurrently.
+	frame := make([]byte, frameHeaderSize+len(b))
+	putFrameHeader(frame, len(b))
+	copy(frame[frameHeaderSize:], b)
+	n, err = path.backend.Write(frame)
+	n -= frameHeaderSize
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// getLastReadPathID returns the path of the last packet returned by Read.
+func (mp *Multipath) getLastReadPathID() (pathID PathID, ok bool) {
+	mp.locker.LockDo(func() {
+		if mp.lastReadPath == nil {
+			return
+		}
+		pathID, ok = mp.lastReadPath.id, true
+	})
+	return
+}
+
+// onAuthenticPacket implements authenticPacketHandler. The path of
+// the last read packet is considered healthy.
+func (mp *Multipath) onAuthenticPacket(bool) {
+	now := mp.options.Clock.Now()
+	mp.locker.LockDo(func() {
+		if mp.lastReadPath == nil {
+			return
+		}
+		mp.lastReadPath.isFailed = false
+		mp.lastReadPath.lastAliveAt = now
+	})
+}
+
+// onProbeReply updates the round-trip time of the path and considers
+// the path healthy.
+func (mp *Multipath) onProbeReply(pathID PathID, rtt time.Duration) {
+	now := mp.options.Clock.Now()
+	mp.locker.LockDo(func() {
+		for _, path := range mp.paths {
+			if path.id != pathID {
+				continue
+			}
+			path.isFailed = false
+			path.lastAliveAt = now
+			if path.rtt == 0 {
+				path.rtt = rtt
+			} else {
+				// The same smoothing as in TCP (RFC 6298)
+				path.rtt = (path.rtt*7 + rtt) / 8
+			}
+			return
+		}
+	})
+}
+
+// Close implements io.Closer. It closes all the paths.
+func (mp *Multipath) Close() error {
+	var paths []*multipathPath
+	mp.locker.LockDo(func() {
+		if mp.isClosed {
+			return
+		}
+		mp.isClosed = true
+		close(mp.closedChan)
+		paths = mp.paths
+		mp.paths = nil
+	})
+	if paths == nil {
+		return nil
+	}
+
+	var result error
+	for _, path := range paths {
+		if err := path.backend.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	mp.waitGroup.Wait()
+	return result
+}
+
+// SetReadDeadline sets the deadline for Read calls (including the one
+// which is currently blocked).
+func (mp *Multipath) SetReadDeadline(t time.Time) error {
+	mp.locker.LockDo(func() {
+		mp.readDeadline = t
+		close(mp.deadlineChangedChan)
+		mp.deadlineChangedChan = make(chan struct{})
+	})
+	return nil
+}
+
+// SetDeadline is the same as SetReadDeadline, the writes are not
+// interrupted.
+func (mp *Multipath) SetDeadline(t time.Time) error {
+	return mp.SetReadDeadline(t)
+}
@@ -0,0 +1,110 @@
+package secureio_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/xaionaro-go/secureio"
+)
+
+func testTCPPair(t *testing.T) (conn0, conn1 net.Conn) {
+	listener, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	conn0, err = net.Dial(`tcp`, listener.Addr().String())
+	require.NoError(t, err)
+	conn1, err = listener.Accept()
+	require.NoError(t, err)
+	return
+}
+
+func waitForPathStatistics(
+	ctx context.Context,
+	t *testing.T,
+	sess *Session,
+	condition func(statistics []PathStatistics) bool,
+) []PathStatistics {
+	for {
+		statistics := sess.GetPathStatistics()
+		if condition(statistics) {
+			return statistics
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("the condition is not met, the statistics: %+v", statistics)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestMultipath(t *testing.T) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+
+	// A datagram path and a stream path
+	identity0, identity1, unixConn0, unixConn1 := testPair(t)
+	tcpConn0, tcpConn1 := testTCPPair(t)
+
+	mpOpts := &MultipathOptions{
+		Policy:        MultipathPolicyRoundRobin,
+		ProbeInterval: 20 * time.Millisecond,
+		ProbeTimeout:  200 * time.Millisecond,
+	}
+	mp0 := NewMultipath(mpOpts, unixConn0, tcpConn0)
+	mp1 := NewMultipath(mpOpts, unixConn1, tcpConn1)
+	require.False(t, IsStreamWriter(mp0))
+
+	sess0 := identity0.NewSession(identity1, mp0, &testLogger{t}, nil)
+	sess1 := identity1.NewSession(identity0, mp1, &testLogger{t}, nil)
+	require.NoError(t, sess0.Start(ctx))
+	require.NoError(t, sess1.Start(ctx))
+	defer func() {
+		assert.NoError(t, sess0.Close())
+		assert.NoError(t, sess1.Close())
+		waitForClosure(t, sess0, sess1)
+	}()
+
+	readBuf := make([]byte, sess1.GetPayloadSizeLimit())
+	pingPong := func() {
+		_, err := sess0.Write([]byte(`ping`))
+		require.NoError(t, err)
+		n, err := sess1.Read(readBuf)
+		require.NoError(t, err)
+		assert.Equal(t, `ping`, string(readBuf[:n]))
+
+		_, err = sess1.Write([]byte(`pong`))
+		require.NoError(t, err)
+		n, err = sess0.Read(readBuf)
+		require.NoError(t, err)
+		assert.Equal(t, `pong`, string(readBuf[:n]))
+	}
+	for i := 0; i < 10; i++ {
+		pingPong()
+	}
+
+	// The probes measure RTT of both paths, and the packets are striped
+	statistics := waitForPathStatistics(ctx, t, sess0, func(statistics []PathStatistics) bool {
+		return len(statistics) == 2 && statistics[0].RTT > 0 && statistics[1].RTT > 0
+	})
+	for _, pathStatistics := range statistics {
+		assert.True(t, pathStatistics.IsUp, pathStatistics)
+		assert.NotZero(t, pathStatistics.SentPackets, pathStatistics)
+		assert.NotZero(t, pathStatistics.ReceivedPackets, pathStatistics)
+	}
+
+	// The TCP path is broken, the traffic fails over to the other path
+	require.NoError(t, tcpConn1.Close())
+	statistics = waitForPathStatistics(ctx, t, sess0, func(statistics []PathStatistics) bool {
+		return statistics[0].IsUp && !statistics[1].IsUp
+	})
+	for i := 0; i < 10; i++ {
+		pingPong()
+	}
+	assert.Equal(t, SessionStateEstablished, sess0.GetState())
+	assert.Nil(t, (&Session{}).GetPathStatistics())
+}
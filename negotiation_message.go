@@ -10,6 +10,7 @@ type negotiationMessageFlags uint8
 
 const (
 	negotiationMessageFlagIsNegotiationEnd = negotiationMessageFlags(1 << iota)
+	negotiationMessageFlagIsRenegotiation
 )
 
 func (flags *negotiationMessageFlags) SetIsNegotiationEnd(isNegotiationEnd bool) {
@@ -24,6 +25,18 @@ func (flags negotiationMessageFlags) IsNegotiationEnd() bool {
 	return flags&negotiationMessageFlagIsNegotiationEnd != 0
 }
 
+func (flags *negotiationMessageFlags) SetIsRenegotiation(isRenegotiation bool) {
+	if isRenegotiation {
+		*flags |= negotiationMessageFlagIsRenegotiation
+	} else {
+		*flags &= ^negotiationMessageFlagIsRenegotiation
+	}
+}
+
+func (flags negotiationMessageFlags) IsRenegotiation() bool {
+	return flags&negotiationMessageFlagIsRenegotiation != 0
+}
+
 type negotiationPingPongMessage struct {
 	MessageSubType uint8 // should be always "1" for "ping" and "2" for "pong"
 
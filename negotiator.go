@@ -39,6 +39,7 @@ const (
 
 type negotiator struct {
 	locker           lockerMutex
+	parentCtx        context.Context
 	ctx              context.Context
 	cancelFn         context.CancelFunc
 	messenger        *Messenger
@@ -48,9 +49,10 @@ type negotiator struct {
 	localLargestRTT  uint32
 	remoteLargestRTT uint32
 	recvChan         chan negotiatorRecvItem
-	wgTasks          sync.WaitGroup
+	wgTasks          *sync.WaitGroup
 	stageChan        chan struct{}
 	remoteEndOnce    sync.Once
+	isRenegotiation  bool
 }
 
 type negotiatorRecvItem struct {
@@ -108,6 +110,16 @@ type NegotiatorOptions struct {
 	//
 	// The default value is DefaultNegotiatorMaxIterations
 	MaxIterations uint32
+
+	// RenegotiateOnReplaceBackend defines if the payload size should be
+	// negotiated again after the backend is replaced
+	// (see `(*Session).ReplaceBackend`).
+	//
+	// The renegotiation is performed in background and the session
+	// remains established meanwhile. The remote side applies the result
+	// when it receives the end of the renegotiation. If the renegotiation
+	// fails then the previous payload size is kept.
+	RenegotiateOnReplaceBackend bool
 }
 
 func newNegotiator(
@@ -132,13 +144,17 @@ func newNegotiator(
 	}
 
 	n := &negotiator{
+		parentCtx: ctx,
 		ctx:       ctx,
 		messenger: messenger,
 		options:   options,
 		okFunc:    okFunc,
 		errFunc:   errFunc,
 		recvChan:  make(chan negotiatorRecvItem, 32),
-		stageChan: make(chan struct{}),
+		// The end of the remote side could be received even before
+		// the negotiation is started locally, so the channel is buffered
+		// to never block the readerLoop.
+		stageChan: make(chan struct{}, 2),
 	}
 
 	n.messenger.SetHandler(n)
@@ -148,7 +164,8 @@ func newNegotiator(
 func (n *negotiator) isEnabled() bool {
 	switch n.options.Enable {
 	case NegotiatorEnableAuto:
-		return IsLossyWriter(n.messenger.sess.backend)
+		backend, _ := n.messenger.sess.getBackend()
+		return IsLossyWriter(backend)
 	case NegotiatorEnableTrue:
 		return true
 	case NegotiatorEnableFalse:
@@ -160,19 +177,7 @@ func (n *negotiator) isEnabled() bool {
 }
 
 func (n *negotiator) Start() (err error) {
-	n.lockDo(func() {
-		if n.cancelFn != nil {
-			err = newErrAlreadyStarted()
-			return
-		}
-
-		if n.options.TotalTimeout > 0 {
-			n.ctx, n.cancelFn = context.WithTimeout(n.ctx, n.options.TotalTimeout)
-		} else {
-			n.ctx, n.cancelFn = context.WithCancel(n.ctx)
-		}
-	})
-	if err != nil {
+	if err = n.initContext(); err != nil {
 		return
 	}
 
@@ -195,22 +200,133 @@ func (n *negotiator) Start() (err error) {
 		defer n.wgTasks.Done()
 		n.pingSenderLoop()
 		n.debugf("the local side has ended")
-		n.stageChan <- struct{}{}
+		select {
+		case n.stageChan <- struct{}{}:
+		case <-n.ctx.Done():
+		}
 	}()
 	return
 }
 
+// Skip finishes the negotiation without probing: the payload size
+// established in a previous session is used instead
+// (see ResumptionTicket).
+func (n *negotiator) Skip(payloadSize uint32) (err error) {
+	if err = n.initContext(); err != nil {
+		return
+	}
+
+	if limit := n.messenger.sess.GetPayloadSizeLimit(); payloadSize > limit {
+		payloadSize = limit
+	}
+	n.debugf("skip: payloadSizeLimit == %d", payloadSize)
+	n.messenger.sess.setEstablishedPayloadSize(payloadSize)
+	n.okFunc()
+	_ = n.Close()
+	return
+}
+
+// Renegotiate probes the payload size again (for example on a new
+// backend, see `(*Session).ReplaceBackend`). Unlike Start it does not
+// wait for the remote side to probe, and it does not call okFunc: the
+// session is already established.
+func (n *negotiator) Renegotiate() (err error) {
+	// Finishing the previous negotiation (if it is still running)
+	_ = n.Close()
+	var wgTasks *sync.WaitGroup
+	n.lockDo(func() {
+		wgTasks = n.wgTasks
+	})
+	if wgTasks != nil {
+		wgTasks.Wait()
+	}
+
+	if !n.isEnabled() {
+		n.debugf("renegotiation: skip")
+		return
+	}
+
+	n.lockDo(func() {
+		n.isRenegotiation = true
+		n.localLargestRTT = 0
+	})
+	for len(n.recvChan) > 0 {
+		<-n.recvChan
+	}
+	for len(n.stageChan) > 0 {
+		<-n.stageChan
+	}
+
+	if err = n.initContext(); err != nil {
+		return
+	}
+	n.debugf("renegotiation: run")
+
+	n.wgTasks.Add(1)
+	go func() {
+		defer n.wgTasks.Done()
+		n.finalizer()
+	}()
+
+	n.wgTasks.Add(1)
+	go func() {
+		defer n.wgTasks.Done()
+		n.pingSenderLoop()
+		n.debugf("the local side has ended")
+		select {
+		case n.stageChan <- struct{}{}:
+		case <-n.ctx.Done():
+		}
+	}()
+	return
+}
+
+func (n *negotiator) initContext() (err error) {
+	n.lockDo(func() {
+		if n.cancelFn != nil {
+			err = newErrAlreadyStarted()
+			return
+		}
+
+		n.ctx, n.cancelFn = context.WithCancel(n.parentCtx)
+		// A new WaitGroup is used for each run, so a renegotiation
+		// never reuses the WaitGroup awaited by Close of the previous run.
+		n.wgTasks = &sync.WaitGroup{}
+		if n.options.TotalTimeout > 0 {
+			// The timeout is measured by SessionOptions.Clock, so
+			// context.WithTimeout is not used here.
+			timer := n.messenger.sess.getClock().NewTimer(n.options.TotalTimeout)
+			go func(ctx context.Context, cancelFn context.CancelFunc) {
+				defer timer.Stop()
+				select {
+				case <-timer.C():
+					cancelFn()
+				case <-ctx.Done():
+				}
+			}(n.ctx, n.cancelFn)
+		}
+	})
+	return
+}
+
 func (n *negotiator) finalizer() {
 	n.debugf("finalizer(): waiting for a signal...")
 	defer n.debugf("/finalizer()")
 
+	// The local and the remote ends are awaited, but the renegotiation
+	// is one-sided (the remote side does not probe).
+	stagesCount := 2
+	if n.getIsRenegotiation() {
+		stagesCount = 1
+	}
+
 	stageID := 0
 	for {
 		select {
 		case <-n.stageChan:
 			stageID++
 			n.debugf("finalizer: stageID == %d", stageID)
-			if stageID == 2 {
+			if stageID == stagesCount {
 				n.finalize()
 				return
 			}
@@ -221,6 +337,19 @@ func (n *negotiator) finalizer() {
 }
 
 func (n *negotiator) finalize() {
+	if n.getIsRenegotiation() {
+		var maxPayloadSize uint32
+		n.lockDo(func() {
+			maxPayloadSize = n.localLargestRTT
+		})
+		n.debugf("finalize renegotiation: payloadSizeLimit == %d", maxPayloadSize)
+		if maxPayloadSize > 0 {
+			n.messenger.sess.setEstablishedPayloadSize(maxPayloadSize)
+		}
+		go n.Close()
+		return
+	}
+
 	maxPayloadSize := u32min(n.localLargestRTT, n.remoteLargestRTT)
 	n.debugf("finalize: payloadSizeLimit == %d", maxPayloadSize)
 	n.messenger.sess.setEstablishedPayloadSize(maxPayloadSize)
@@ -228,6 +357,31 @@ func (n *negotiator) finalize() {
 	go n.Close()
 }
 
+func (n *negotiator) getIsRenegotiation() (result bool) {
+	n.lockDo(func() {
+		result = n.isRenegotiation
+	})
+	return
+}
+
+func (n *negotiator) getContext() (ctx context.Context) {
+	n.lockDo(func() {
+		ctx = n.ctx
+	})
+	return
+}
+
+// fail reports an error of the negotiation. A failed renegotiation does
+// not close the session, the previously negotiated settings are kept.
+func (n *negotiator) fail(err error) {
+	if !n.getIsRenegotiation() {
+		n.errFunc(err)
+		return
+	}
+	n.messenger.sess.error(err)
+	go n.Close()
+}
+
 func (n *negotiator) isCtxDone() bool {
 	select {
 	case <-n.ctx.Done():
@@ -306,7 +460,7 @@ pingSenderEnd:
 					if err.(*xerrors.Error).Has(ErrAlreadyClosed{}) {
 						go n.Close()
 					} else {
-						n.errFunc(err)
+						n.fail(err)
 					}
 				}
 			}
@@ -317,8 +471,9 @@ pingSenderEnd:
 		}
 		n.debugf("pingSenderLoop: steps:%d step:%f", steps, step)
 
+		clock := n.messenger.sess.getClock()
 		var firstReceived time.Duration
-		startTime := time.Now()
+		startTime := clock.Now()
 		var nextMin, nextMax uint32
 
 	negotiatorPingSenderLoopCollectFor:
@@ -330,7 +485,7 @@ pingSenderEnd:
 				collectUntil = startTime.Add(infinite)
 			}
 			n.debugf("pingSenderLoop: startTime:%v firstReceived:%v collectDuration:%v",
-				startTime, firstReceived, time.Until(collectUntil))
+				startTime, firstReceived, collectUntil.Sub(clock.Now()))
 			select {
 			case recvItem := <-n.recvChan:
 				if recvItem.MessageSize > nextMin {
@@ -338,14 +493,20 @@ pingSenderEnd:
 					nextMax = nextMin + uint32(step+1) // we need to round the "step" up
 				}
 				if firstReceived == 0 && recvItem.IterationID == curIterationID {
-					firstReceived = time.Since(startTime)
+					firstReceived = clock.Now().Sub(startTime)
 				}
-			case <-time.After(time.Until(collectUntil)):
+			case <-clock.After(collectUntil.Sub(clock.Now())):
 				break negotiatorPingSenderLoopCollectFor
-			case <-time.After(readTimeout):
-				n.errFunc(newErrNegotiationTimeout("read collectUntil"))
+			case <-clock.After(readTimeout):
+				n.fail(newErrNegotiationTimeout("read collectUntil"))
 				return
 			case <-n.ctx.Done():
+				if n.getIsRenegotiation() {
+					// The session is closed or the backend is replaced
+					// again, the current settings are kept.
+					n.debugf("the renegotiation is cancelled")
+					return
+				}
 				n.errFunc(newErrNegotiationCancelled("ctx is done"))
 				return
 			}
@@ -394,15 +555,16 @@ func (n *negotiator) sendControl(isNegotiationEnd bool) {
 		msg.LargestRTT = n.localLargestRTT
 	})
 	msg.Flags.SetIsNegotiationEnd(isNegotiationEnd)
+	msg.Flags.SetIsRenegotiation(n.getIsRenegotiation())
 	var buf bytes.Buffer
 	err := binary.Write(&buf, binaryOrderType, msg)
 	if err != nil {
-		n.errFunc(wrapError(err))
+		n.fail(wrapError(err))
 		return
 	}
 	_, err = n.messenger.WriteSingle(buf.Bytes())
 	if err != nil {
-		n.errFunc(wrapError(err))
+		n.fail(wrapError(err))
 		return
 	}
 }
@@ -434,15 +596,38 @@ func (n *negotiator) handleControlMessage(b []byte) (err error) {
 		n.debugf("n.remoteLargestRTT == %d", n.remoteLargestRTT)
 	})
 
+	if msg.Flags.IsRenegotiation() {
+		if msg.Flags.IsNegotiationEnd() {
+			n.applyRemoteRenegotiation(msg.LargestRTT)
+		}
+		return
+	}
+
 	if msg.Flags.IsNegotiationEnd() {
 		n.remoteEndOnce.Do(func() {
 			n.debugf("the remote side has ended")
-			n.stageChan <- struct{}{}
+			select {
+			case n.stageChan <- struct{}{}:
+			case <-n.getContext().Done():
+			}
 		})
 	}
 	return
 }
 
+// applyRemoteRenegotiation applies the payload size found by
+// the renegotiation initiated by the remote side.
+func (n *negotiator) applyRemoteRenegotiation(largestRTT uint32) {
+	if largestRTT == 0 {
+		return
+	}
+	if limit := n.messenger.sess.GetPayloadSizeLimit(); largestRTT > limit {
+		largestRTT = limit
+	}
+	n.debugf("the remote side has ended the renegotiation: payloadSizeLimit == %d", largestRTT)
+	n.messenger.sess.setEstablishedPayloadSize(largestRTT)
+}
+
 func (n *negotiator) debugf(fmt string, args ...interface{}) {
 	n.messenger.sess.debugf("[negotiator] "+fmt, args...)
 }
@@ -475,9 +660,14 @@ func (n *negotiator) handlePingPongMessage(b []byte, isPing bool) (err error) {
 			n.localLargestRTT = uint32(len(b))
 		}
 	})
-	n.recvChan <- negotiatorRecvItem{
+	select {
+	case n.recvChan <- negotiatorRecvItem{
 		MessageSize: uint32(len(b)),
 		IterationID: msg.IterationID,
+	}:
+	case <-n.getContext().Done():
+		// A late pong after the negotiation is finished (or skipped).
+		return nil
 	}
 	n.sendControl(false)
 	return nil
@@ -513,6 +703,7 @@ func (n *negotiator) Close() (err error) {
 	defer func() { n.debugf("/Close(): err:%v", err) }()
 
 	shouldSkip := false
+	var wgTasks *sync.WaitGroup
 	n.lockDo(func() {
 		if n.cancelFn == nil {
 			shouldSkip = true
@@ -520,17 +711,15 @@ func (n *negotiator) Close() (err error) {
 		}
 		n.cancelFn()
 		n.cancelFn = nil
+		wgTasks = n.wgTasks
 	})
 	if shouldSkip {
 		return
 	}
 
+	// n.recvChan is not closed, because late pongs still could be
+	// received (they are dropped, see handlePingPongMessage).
 	err = n.messenger.Close()
-	n.wgTasks.Wait()
-	if n.recvChan == nil {
-		return
-	}
-	close(n.recvChan)
-	n.recvChan = nil
+	wgTasks.Wait()
 	return
 }
@@ -13,7 +13,7 @@ import (
 
 func dummySession(t *testing.T, errFunc func(error)) *Session {
 	sess := &Session{}
-	sess.init(&Identity{}, &Identity{}, iotools.NewReadWriteCloser(func(bytes []byte) (int, error) {
+	sess.init(&Identity{}, &Identity{}, nil, iotools.NewReadWriteCloser(func(bytes []byte) (int, error) {
 		t.Fatal("read", bytes)
 		return len(bytes), nil
 	}, func(bytes []byte) (int, error) {
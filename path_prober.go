@@ -0,0 +1,200 @@
+package secureio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pathProbeMessageSubTypeProbe = uint8(iota)
+	pathProbeMessageSubTypeReply
+)
+
+type pathProbeMessage struct {
+	MessageSubType uint8 // pathProbeMessageSubTypeProbe or pathProbeMessageSubTypeReply
+	ProbeID        uint64
+}
+
+type pendingPathProbe struct {
+	PathID PathID
+	SentAt time.Time
+}
+
+// pathProber sends probes via each path of a Multipath backend to detect
+// if the paths are healthy and to measure their round-trip times. It also
+// answers the probes of the remote side (even if the local backend is not
+// a Multipath).
+type pathProber struct {
+	sess        *Session
+	messenger   *Messenger
+	locker      lockerMutex
+	nextProbeID uint64
+	pending     map[uint64]pendingPathProbe
+	isStarted   uint32
+}
+
+func newPathProber(sess *Session, messenger *Messenger) *pathProber {
+	prober := &pathProber{
+		sess:      sess,
+		messenger: messenger,
+		pending:   map[uint64]pendingPathProbe{},
+	}
+	messenger.SetHandler(prober)
+	return prober
+}
+
+func (prober *pathProber) getMultipath() *Multipath {
+	backend, _ := prober.sess.getBackend()
+	mp, _ := backend.(*Multipath)
+	return mp
+}
+
+// Start starts sending probes if the backend is a Multipath. It does
+// nothing if the probes are already being sent.
+func (prober *pathProber) Start() {
+	if prober == nil {
+		return
+	}
+	mp := prober.getMultipath()
+	if mp == nil {
+		return
+	}
+	if _, features, _ := prober.sess.keyExchanger.getProtocol(); !features.Has(ProtocolFeaturePathProbes) {
+		prober.sess.debugf("[path_prober] the remote side does not support path probes")
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&prober.isStarted, 0, 1) {
+		return
+	}
+
+	go prober.loop(mp.options.Clock, mp.options.ProbeInterval)
+}
+
+func (prober *pathProber) loop(clock Clock, interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-prober.sess.ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		mp := prober.getMultipath()
+		if mp == nil {
+			continue
+		}
+
+		// The probes which are not replied in time are forgotten.
+		now := mp.options.Clock.Now()
+		prober.locker.LockDo(func() {
+			for probeID, probe := range prober.pending {
+				if now.Sub(probe.SentAt) >= mp.options.ProbeTimeout {
+					delete(prober.pending, probeID)
+				}
+			}
+		})
+
+		for _, pathID := range mp.getPathIDs() {
+			if err := prober.sendProbe(mp, pathID); err != nil {
+				prober.sess.debugf("[path_prober] unable to probe path %d: %v", pathID, err)
+			}
+		}
+	}
+}
+
+func (prober *pathProber) sendProbe(mp *Multipath, pathID PathID) error {
+	msg := &pathProbeMessage{
+		MessageSubType: pathProbeMessageSubTypeProbe,
+	}
+	prober.locker.LockDo(func() {
+		msg.ProbeID = prober.nextProbeID
+		prober.nextProbeID++
+		prober.pending[msg.ProbeID] = pendingPathProbe{
+			PathID: pathID,
+			SentAt: mp.options.Clock.Now(),
+		}
+	})
+	return prober.write(mp, pathID, msg)
+}
+
+// write sends the message via path `pathID` of `mp` (the other packets
+// are sent concurrently via the paths chosen by MultipathOptions.Policy).
+// If `mp` is nil then the message is sent as any other message.
+func (prober *pathProber) write(mp *Multipath, pathID PathID, msg *pathProbeMessage) (err error) {
+	defer func() { err = wrapError(err) }()
+
+	var buf bytes.Buffer
+	err = binary.Write(&buf, binaryOrderType, msg)
+	if err != nil {
+		return
+	}
+	if mp == nil {
+		_, err = prober.messenger.WriteSingle(buf.Bytes())
+		return
+	}
+	_, err = prober.sess.writeMessageSingleToPath(mp, pathID, messageTypePathProbe, buf.Bytes())
+	return
+}
+
+// Handle implements Handler.
+func (prober *pathProber) Handle(b []byte) (err error) {
+	defer func() { err = wrapError(err) }()
+
+	msg := &pathProbeMessage{}
+	if len(b) < binary.Size(msg) {
+		return newErrTooShort(uint(binary.Size(msg)), uint(len(b)))
+	}
+	err = binary.Read(bytes.NewReader(b), binaryOrderType, msg)
+	if err != nil {
+		return
+	}
+
+	switch msg.MessageSubType {
+	case pathProbeMessageSubTypeProbe:
+		return prober.reply(msg)
+	case pathProbeMessageSubTypeReply:
+		prober.handleReply(msg)
+		return nil
+	default:
+		return newErrUnknownSubType(msg.MessageSubType)
+	}
+}
+
+// reply answers the probe via the same path it was received from (Handle
+// is called by the readerLoop right after reading the packet).
+func (prober *pathProber) reply(msg *pathProbeMessage) error {
+	msg.MessageSubType = pathProbeMessageSubTypeReply
+	mp := prober.getMultipath()
+	if mp == nil {
+		return prober.write(nil, 0, msg)
+	}
+	pathID, ok := mp.getLastReadPathID()
+	if !ok {
+		return prober.write(nil, 0, msg)
+	}
+	return prober.write(mp, pathID, msg)
+}
+
+func (prober *pathProber) handleReply(msg *pathProbeMessage) {
+	var probe pendingPathProbe
+	var ok bool
+	prober.locker.LockDo(func() {
+		probe, ok = prober.pending[msg.ProbeID]
+		delete(prober.pending, msg.ProbeID)
+	})
+	if !ok {
+		prober.sess.debugf("[path_prober] a late or unknown probe reply: %d", msg.ProbeID)
+		return
+	}
+
+	mp := prober.getMultipath()
+	if mp == nil {
+		return
+	}
+	rtt := mp.options.Clock.Now().Sub(probe.SentAt)
+	prober.sess.debugf("[path_prober] path %d: rtt == %v", probe.PathID, rtt)
+	mp.onProbeReply(probe.PathID, rtt)
+}
@@ -0,0 +1,146 @@
+package secureio
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProtocolVersion is the version of the wire protocol of the key exchange
+// and the session. Both sides agree on the highest version supported
+// by both of them, see KeyExchangerOptions.MinProtocolVersion.
+type ProtocolVersion uint16
+
+const (
+	// ProtocolVersionLegacy is the version of the remote sides which
+	// do not announce their protocol version (the versions of this package
+	// before the protocol version negotiation). Such remote sides ignore
+	// the extensions of the key exchange messages, so only the cipher suite
+	// CipherSuiteXChaCha20Poly1305 and no optional features are used
+	// with them. If the backend is a byte stream, then the stream framing
+	// should be disabled for them as well (see StreamFramingEnableFalse).
+	ProtocolVersionLegacy = ProtocolVersion(iota)
+
+	// ProtocolVersion1 is the first version with the protocol version
+	// and features negotiation.
+	ProtocolVersion1
+
+	// ProtocolVersionCurrent is the newest protocol version supported
+	// by this package.
+	ProtocolVersionCurrent = ProtocolVersion1
+)
+
+func (version ProtocolVersion) String() string {
+	if version == ProtocolVersionLegacy {
+		return `legacy`
+	}
+	return fmt.Sprintf(`v%d`, uint16(version))
+}
+
+// ProtocolFeatures is a set of optional features of the protocol. Only
+// the features supported (and enabled) on both sides are used.
+type ProtocolFeatures uint32
+
+const (
+	// ProtocolFeatureCipherSuites is the cipher suites negotiation
+	// (see KeyExchangerOptions.CipherSuites).
+	ProtocolFeatureCipherSuites = ProtocolFeatures(1 << iota)
+
+	// ProtocolFeatureHybridKeyExchange is the hybrid post-quantum key
+	// exchange (see KeyExchangerOptions.EnableHybridKeyExchange).
+	ProtocolFeatureHybridKeyExchange
+
+	// ProtocolFeatureResumptionTickets is the support of session
+	// resumption tickets (see ResumptionTicket).
+	ProtocolFeatureResumptionTickets
+
+	// ProtocolFeaturePathProbes is the support of probes of the paths
+	// of a multipath session (see Multipath).
+	ProtocolFeaturePathProbes
+
+	protocolFeaturesEndOfRange
+)
+
+// Has returns true if all the features of `features` are in the set.
+func (set ProtocolFeatures) Has(features ProtocolFeatures) bool {
+	return set&features == features
+}
+
+func (set ProtocolFeatures) String() string {
+	var names []string
+	for feature := ProtocolFeatures(1); feature < protocolFeaturesEndOfRange; feature <<= 1 {
+		if !set.Has(feature) {
+			continue
+		}
+		switch feature {
+		case ProtocolFeatureCipherSuites:
+			names = append(names, `cipher_suites`)
+		case ProtocolFeatureHybridKeyExchange:
+			names = append(names, `hybrid_key_exchange`)
+		case ProtocolFeatureResumptionTickets:
+			names = append(names, `resumption_tickets`)
+		case ProtocolFeaturePathProbes:
+			names = append(names, `path_probes`)
+		}
+	}
+	if unknown := set &^ (protocolFeaturesEndOfRange - 1); unknown != 0 {
+		names = append(names, fmt.Sprintf(`unknown_0x%x`, uint32(unknown)))
+	}
+	return strings.Join(names, `|`)
+}
+
+// protocolVersionInfo is the value of extension
+// keySeedUpdateMessageExtensionTypeProtocolVersion.
+type protocolVersionInfo struct {
+	MinVersion ProtocolVersion
+	MaxVersion ProtocolVersion
+	Features   ProtocolFeatures
+}
+
+const protocolVersionInfoSize = 8
+
+// legacyProtocolVersionInfo is the assumed protocolVersionInfo of
+// the remote sides which does not send it.
+var legacyProtocolVersionInfo = protocolVersionInfo{
+	MinVersion: ProtocolVersionLegacy,
+	MaxVersion: ProtocolVersionLegacy,
+}
+
+func (info *protocolVersionInfo) Bytes() []byte {
+	b := make([]byte, protocolVersionInfoSize)
+	binaryOrderType.PutUint16(b[0:], uint16(info.MinVersion))
+	binaryOrderType.PutUint16(b[2:], uint16(info.MaxVersion))
+	binaryOrderType.PutUint32(b[4:], uint32(info.Features))
+	return b
+}
+
+func parseProtocolVersionInfo(b []byte) (*protocolVersionInfo, error) {
+	if len(b) < protocolVersionInfoSize {
+		return nil, newErrTooShort(protocolVersionInfoSize, uint(len(b)))
+	}
+	// Extra bytes are reserved for future extensions of the structure.
+	return &protocolVersionInfo{
+		MinVersion: ProtocolVersion(binaryOrderType.Uint16(b[0:])),
+		MaxVersion: ProtocolVersion(binaryOrderType.Uint16(b[2:])),
+		Features:   ProtocolFeatures(binaryOrderType.Uint32(b[4:])),
+	}, nil
+}
+
+// negotiateProtocolVersion returns the highest protocol version supported
+// by both sides and the common features.
+func negotiateProtocolVersion(local, remote protocolVersionInfo) (ProtocolVersion, ProtocolFeatures, error) {
+	minVersion := local.MinVersion
+	if remote.MinVersion > minVersion {
+		minVersion = remote.MinVersion
+	}
+	maxVersion := local.MaxVersion
+	if remote.MaxVersion < maxVersion {
+		maxVersion = remote.MaxVersion
+	}
+	if minVersion > maxVersion {
+		return ProtocolVersionLegacy, 0, newErrProtocolVersionMismatch(
+			local.MinVersion, local.MaxVersion,
+			remote.MinVersion, remote.MaxVersion,
+		)
+	}
+	return maxVersion, local.Features & remote.Features, nil
+}
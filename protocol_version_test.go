@@ -0,0 +1,50 @@
+package secureio
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+func TestProtocolVersionInfo(t *testing.T) {
+	info := protocolVersionInfo{
+		MinVersion: ProtocolVersionLegacy,
+		MaxVersion: ProtocolVersionCurrent,
+		Features:   ProtocolFeatureCipherSuites | ProtocolFeatureHybridKeyExchange,
+	}
+	parsedInfo, err := parseProtocolVersionInfo(info.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, info, *parsedInfo)
+
+	_, err = parseProtocolVersionInfo(info.Bytes()[:protocolVersionInfoSize-1])
+	assert.True(t, err.(*xerrors.Error).Has(ErrTooShort{}))
+}
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	local := protocolVersionInfo{
+		MinVersion: ProtocolVersionLegacy,
+		MaxVersion: ProtocolVersion(3),
+		Features:   ProtocolFeatureCipherSuites | ProtocolFeatureHybridKeyExchange,
+	}
+	remote := protocolVersionInfo{
+		MinVersion: ProtocolVersion1,
+		MaxVersion: ProtocolVersion(2),
+		Features:   ProtocolFeatureCipherSuites | ProtocolFeatures(1<<31),
+	}
+	version, features, err := negotiateProtocolVersion(local, remote)
+	require.NoError(t, err)
+	assert.Equal(t, ProtocolVersion(2), version)
+	assert.Equal(t, ProtocolFeatureCipherSuites, features)
+
+	version, features, err = negotiateProtocolVersion(local, legacyProtocolVersionInfo)
+	require.NoError(t, err)
+	assert.Equal(t, ProtocolVersionLegacy, version)
+	assert.Equal(t, ProtocolFeatures(0), features)
+
+	_, _, err = negotiateProtocolVersion(remote, legacyProtocolVersionInfo)
+	require.Error(t, err)
+	assert.True(t, err.(*xerrors.Error).Has(ErrProtocolVersionMismatch{}))
+}
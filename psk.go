@@ -0,0 +1,118 @@
+package secureio
+
+import (
+	"bytes"
+	"io"
+
+	"lukechampine.com/blake3"
+)
+
+// PSK is a named Pre-Shared Key, see KeyExchangerOptions.PSKs.
+type PSK struct {
+	// ID is the identifier of the key. It is sent to the remote side
+	// (in the key exchange messages, which are encrypted by a key derived
+	// from the PSK), so the remote side knows which key is used.
+	ID string
+
+	// Key is the secret value of the key.
+	Key []byte
+
+	// Deprecated marks a key which is still accepted from the remote
+	// sides, but is going to be removed. If the remote side uses it,
+	// then PSKEventHandler.OnDeprecatedPSK is called.
+	Deprecated bool
+}
+
+// PSKEventHandler is an optional interface of an EventHandler.
+// If it is implemented then the application is notified about remote
+// sides which use a deprecated PSK (see PSK.Deprecated).
+type PSKEventHandler interface {
+	// OnDeprecatedPSK is called when the remote side of session `sess`
+	// uses the deprecated PSK with ID `pskID`.
+	OnDeprecatedPSK(sess *Session, pskID string)
+}
+
+// getPSKs returns the set of PSKs configured by KeyExchangerOptions.PSKs
+// or KeyExchangerOptions.PSK. The first one is the PSK of the local side.
+func (opts *KeyExchangerOptions) getPSKs() []PSK {
+	if len(opts.PSKs) != 0 {
+		return opts.PSKs
+	}
+	if opts.PSK != nil {
+		return []PSK{{Key: opts.PSK}}
+	}
+	return nil
+}
+
+func findPSK(psks []PSK, id string) *PSK {
+	for idx := range psks {
+		if psks[idx].ID == id {
+			return &psks[idx]
+		}
+	}
+	return nil
+}
+
+// calculatePSKXORer returns the value to be XOR-ed into the shared keys if
+// the local side uses `localPSK` and the remote side uses `remotePSK`.
+// The result does not depend on which side calls the function.
+func calculatePSKXORer(localPSK, remotePSK *PSK) []byte {
+	if remotePSK == nil || localPSK.ID == remotePSK.ID {
+		return hash(localPSK.Key, Salt, []byte("cipherKey"))
+	}
+
+	// Both sides should mix the PSKs in the same order
+	if bytes.Compare([]byte(localPSK.ID), []byte(remotePSK.ID)) > 0 {
+		localPSK, remotePSK = remotePSK, localPSK
+	}
+	return hash(localPSK.Key, remotePSK.Key, Salt, []byte("cipherKey"))
+}
+
+// calculateKeyExchangeMAC returns the MAC of a key exchange message,
+// which is used instead of the signature in the PSK-only mode
+// (see NewPSKSession).
+//
+// Both sides use the same PSK, so the MAC also covers the SessionID of
+// the recipient (nil if it is not known to the sender, yet). Thus a message
+// could not be sent back to its sender once the sender knows the remote
+// side (the SessionID of the sender is covered by `data`).
+func calculateKeyExchangeMAC(
+	psk *PSK,
+	recipientSessionID *SessionID,
+	data []byte,
+) (result [keySignatureSize]byte) {
+	var recipientSessionIDBytes [16]byte
+	if recipientSessionID != nil {
+		recipientSessionIDBytes = recipientSessionID.Bytes()
+	}
+	h := blake3.New(keySignatureSize, hash(psk.Key, Salt, []byte("keyExchangeMAC")))
+	_, _ = h.Write(recipientSessionIDBytes[:])
+	_, _ = h.Write(data)
+	h.Sum(result[:0])
+	return
+}
+
+// NewPSKSession creates a secure session over (unsecure) `backend`
+// without ED25519 identities: the key exchange messages are
+// authenticated by a MAC derived from the PSK (instead of a signature),
+// so the remote side is verified only by the knowledge of the PSK.
+//
+// A PSK should be set in `opts` (see KeyExchangerOptions.PSK and
+// KeyExchangerOptions.PSKs), otherwise Start returns ErrPSKRequired.
+// The remote side should use NewPSKSession as well.
+//
+// Anybody who knows the PSK is able to impersonate any side, so use
+// a separate PSK for each pair of peers if it matters.
+// `(*Session).GetRemoteIdentity` always returns nil for such sessions
+// and resumption tickets are not supported.
+//
+// The session will not work until method Start() will be called.
+//
+// See `Session`.
+func NewPSKSession(
+	backend io.ReadWriteCloser,
+	eventHandler EventHandler,
+	opts *SessionOptions,
+) *Session {
+	return newSession(nil, nil, nil, backend, eventHandler, opts)
+}
@@ -0,0 +1,317 @@
+package secureio
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+const (
+	// DefaultResumptionTicketLifetime is the default value of
+	// ResumptionTicketIssuerOptions.Lifetime.
+	DefaultResumptionTicketLifetime = time.Hour * 24
+)
+
+const (
+	resumptionTicketIDSize        = 16
+	resumptionTicketPlainSize     = 8 + 4 + resumptionTicketIDSize + PublicKeySize
+	resumptionTicketSize          = chacha20poly1305.NonceSizeX + resumptionTicketPlainSize + poly1305.TagSize
+	resumptionTicketMessageHeader = 8 + 4
+)
+
+// ResumptionTicket is a ticket issued by the remote side of a session
+// (see KeyExchangerOptions.ResumptionTicketIssuer). It could be presented
+// to the same remote side in a new session (see
+// KeyExchangerOptions.ResumptionTicket) to resume the session: the sides
+// still exchange signed ephemeral keys (so the new session has fresh
+// cipher keys), but the negotiation of the payload size is skipped and
+// the payload size of the previous session is reused. So the new session
+// is established in one round trip.
+//
+// The ticket is sent in cleartext during the key exchange (unless
+// KeyExchangerOptions.EnableIdentityHiding is enabled), so
+// a passive observer could link the sessions which use tickets of
+// the same issuer session.
+//
+// See `(*Session).GetResumptionTicket`.
+type ResumptionTicket struct {
+	// RemotePublicKey is the identity public key of the issuer.
+	RemotePublicKey ed25519.PublicKey
+
+	// PayloadSize is the payload size established in the session where
+	// the ticket was issued (see `(*Session).GetEstablishedPayloadSize`).
+	PayloadSize uint32
+
+	// ExpiresAt is the time after which the ticket is not accepted
+	// by the issuer.
+	ExpiresAt time.Time
+
+	// Ticket is the encrypted ticket. Only the issuer is able to read it.
+	Ticket []byte
+}
+
+// ResumptionTicketIssuerOptions is used to configure a
+// ResumptionTicketIssuer.
+type ResumptionTicketIssuerOptions struct {
+	// Lifetime defines how long an issued ticket is valid.
+	//
+	// If a zero-value then DefaultResumptionTicketLifetime is used.
+	Lifetime time.Duration
+
+	// SingleUse makes each ticket to be accepted only once, so a ticket
+	// cannot be replayed. A new ticket is issued in each session anyway.
+	//
+	// The used tickets are remembered in memory until they expire, so
+	// a ticket could be accepted again by a ResumptionTicketIssuer
+	// created after a restart (with the same key).
+	SingleUse bool
+
+	// RandReader is the source of cryptographically secure random
+	// values for the key of NewResumptionTicketIssuer (if it is not
+	// passed). The tickets are generated using SessionOptions.RandReader
+	// of the issuing session.
+	//
+	// If it is set to a nil-value then crypto/rand.Reader is used.
+	RandReader io.Reader
+}
+
+// ResumptionTicketIssuer issues resumption tickets (see ResumptionTicket)
+// and checks them. It is supposed to be shared by all the sessions
+// of the local side (see KeyExchangerOptions.ResumptionTicketIssuer).
+type ResumptionTicketIssuer struct {
+	locker        lockerMutex
+	aead          cipher.AEAD
+	options       ResumptionTicketIssuerOptions
+	usedTickets   map[[resumptionTicketIDSize]byte]time.Time
+	nextCleanupAt time.Time
+}
+
+// resumptionTicketData is the decrypted content of a ResumptionTicket.
+type resumptionTicketData struct {
+	ExpiresAt       time.Time
+	PayloadSize     uint32
+	ID              [resumptionTicketIDSize]byte
+	HolderPublicKey [PublicKeySize]byte
+}
+
+// NewResumptionTicketIssuer is a constructor of ResumptionTicketIssuer.
+// The tickets are encrypted with a key derived from `key`. If the tickets
+// should be accepted after a restart, then the same `key` should be used
+// again. If `key` is nil then a random key is used.
+func NewResumptionTicketIssuer(key []byte, opts *ResumptionTicketIssuerOptions) (*ResumptionTicketIssuer, error) {
+	if key == nil {
+		var randReader io.Reader = rand.Reader
+		if opts != nil && opts.RandReader != nil {
+			randReader = opts.RandReader
+		}
+		key = make([]byte, chacha20poly1305.KeySize)
+		if _, err := io.ReadFull(randReader, key); err != nil {
+			return nil, xerrors.Errorf("unable to generate a key: %w", err)
+		}
+	}
+
+	aead, err := chacha20poly1305.NewX(hash(key, Salt, []byte("resumptionTicket"))[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	issuer := &ResumptionTicketIssuer{
+		aead:        aead,
+		usedTickets: map[[resumptionTicketIDSize]byte]time.Time{},
+	}
+	if opts != nil {
+		issuer.options = *opts
+	}
+	if issuer.options.Lifetime == 0 {
+		issuer.options.Lifetime = DefaultResumptionTicketLifetime
+	}
+	return issuer, nil
+}
+
+// issue returns a new ticket for the holder with identity public key
+// `holderPublicKey`. The ticket ID and the nonce are read from
+// `randReader`, and the expiration time is calculated using `clock`.
+func (issuer *ResumptionTicketIssuer) issue(
+	clock Clock,
+	randReader io.Reader,
+	localIdentity *Identity,
+	holderPublicKey ed25519.PublicKey,
+	payloadSize uint32,
+) (*ResumptionTicket, error) {
+	data := resumptionTicketData{
+		ExpiresAt:   clock.Now().Add(issuer.options.Lifetime),
+		PayloadSize: payloadSize,
+	}
+	if _, err := io.ReadFull(randReader, data.ID[:]); err != nil {
+		return nil, xerrors.Errorf("unable to generate a ticket ID: %w", err)
+	}
+	copy(data.HolderPublicKey[:], holderPublicKey)
+
+	plain := make([]byte, resumptionTicketPlainSize)
+	binaryOrderType.PutUint64(plain[0:], uint64(data.ExpiresAt.UnixNano()))
+	binaryOrderType.PutUint32(plain[8:], data.PayloadSize)
+	copy(plain[12:], data.ID[:])
+	copy(plain[12+resumptionTicketIDSize:], data.HolderPublicKey[:])
+
+	ticket := make([]byte, chacha20poly1305.NonceSizeX, resumptionTicketSize)
+	if _, err := io.ReadFull(randReader, ticket); err != nil {
+		return nil, xerrors.Errorf("unable to generate a nonce: %w", err)
+	}
+	ticket = issuer.aead.Seal(ticket, ticket, plain, localIdentity.Keys.Public)
+
+	return &ResumptionTicket{
+		RemotePublicKey: localIdentity.Keys.Public,
+		PayloadSize:     data.PayloadSize,
+		ExpiresAt:       data.ExpiresAt,
+		Ticket:          ticket,
+	}, nil
+}
+
+// accept decrypts and checks the ticket presented by the holder
+// with identity public key `holderPublicKey`. The expiration is checked
+// using `clock`.
+func (issuer *ResumptionTicketIssuer) accept(
+	clock Clock,
+	localIdentity *Identity,
+	holderPublicKey []byte,
+	ticket []byte,
+) (*resumptionTicketData, error) {
+	if len(ticket) != resumptionTicketSize {
+		return nil, newErrInvalidResumptionTicket(`invalid size`)
+	}
+	nonce := ticket[:chacha20poly1305.NonceSizeX]
+	plain, err := issuer.aead.Open(nil, nonce, ticket[len(nonce):], localIdentity.Keys.Public)
+	if err != nil {
+		return nil, newErrInvalidResumptionTicket(`unable to decrypt`)
+	}
+
+	data := &resumptionTicketData{
+		ExpiresAt:   time.Unix(0, int64(binaryOrderType.Uint64(plain[0:]))),
+		PayloadSize: binaryOrderType.Uint32(plain[8:]),
+	}
+	copy(data.ID[:], plain[12:])
+	copy(data.HolderPublicKey[:], plain[12+resumptionTicketIDSize:])
+
+	if string(data.HolderPublicKey[:]) != string(holderPublicKey) {
+		return nil, newErrInvalidResumptionTicket(`issued for another identity`)
+	}
+	now := clock.Now()
+	if now.After(data.ExpiresAt) {
+		return nil, newErrInvalidResumptionTicket(`expired`)
+	}
+	if !issuer.options.SingleUse {
+		return data, nil
+	}
+
+	issuer.locker.LockDo(func() {
+		if _, isUsed := issuer.usedTickets[data.ID]; isUsed {
+			err = newErrInvalidResumptionTicket(`already used`)
+			return
+		}
+		if now.After(issuer.nextCleanupAt) {
+			for ticketID, expiresAt := range issuer.usedTickets {
+				if now.After(expiresAt) {
+					delete(issuer.usedTickets, ticketID)
+				}
+			}
+			issuer.nextCleanupAt = now.Add(issuer.options.Lifetime)
+		}
+		issuer.usedTickets[data.ID] = data.ExpiresAt
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (ticket *ResumptionTicket) messageBytes() []byte {
+	b := make([]byte, resumptionTicketMessageHeader+len(ticket.Ticket))
+	binaryOrderType.PutUint64(b[0:], uint64(ticket.ExpiresAt.UnixNano()))
+	binaryOrderType.PutUint32(b[8:], ticket.PayloadSize)
+	copy(b[resumptionTicketMessageHeader:], ticket.Ticket)
+	return b
+}
+
+func parseResumptionTicketMessage(b []byte, remotePublicKey ed25519.PublicKey) (*ResumptionTicket, error) {
+	if len(b) < resumptionTicketMessageHeader {
+		return nil, newErrTooShort(resumptionTicketMessageHeader, uint(len(b)))
+	}
+	return &ResumptionTicket{
+		RemotePublicKey: remotePublicKey,
+		ExpiresAt:       time.Unix(0, int64(binaryOrderType.Uint64(b[0:]))),
+		PayloadSize:     binaryOrderType.Uint32(b[8:]),
+		Ticket:          append([]byte{}, b[resumptionTicketMessageHeader:]...),
+	}, nil
+}
+
+// resumptionTicketHandler receives the tickets issued by the remote side.
+type resumptionTicketHandler struct {
+	sess *Session
+}
+
+func (h *resumptionTicketHandler) Handle(b []byte) error {
+	remoteIdentity := h.sess.GetRemoteIdentity()
+	if remoteIdentity == nil {
+		return newErrKeyExchangeNotCompleted()
+	}
+	ticket, err := parseResumptionTicketMessage(b, remoteIdentity.Keys.Public)
+	if err != nil {
+		return err
+	}
+	h.sess.debugf("received a resumption ticket, expires at %v", ticket.ExpiresAt)
+	atomic.StorePointer((*unsafe.Pointer)((unsafe.Pointer)(&h.sess.resumptionTicket)), (unsafe.Pointer)(ticket))
+	return nil
+}
+
+// sendResumptionTicket issues a ticket for the remote side (if
+// KeyExchangerOptions.ResumptionTicketIssuer is set and the remote side
+// supports it) and sends it.
+func (sess *Session) sendResumptionTicket() {
+	issuer := sess.options.KeyExchangerOptions.ResumptionTicketIssuer
+	if issuer == nil || sess.keyExchanger == nil {
+		return
+	}
+	if _, features, _ := sess.keyExchanger.getProtocol(); !features.Has(ProtocolFeatureResumptionTickets) {
+		return
+	}
+	remoteIdentity := sess.GetRemoteIdentity()
+	if remoteIdentity == nil {
+		return
+	}
+
+	ticket, err := issuer.issue(sess.getClock(), sess.getRandReader(), sess.identity, remoteIdentity.Keys.Public, sess.GetEstablishedPayloadSize())
+	if err != nil {
+		sess.error(xerrors.Errorf("unable to issue a resumption ticket: %w", err))
+		return
+	}
+	if _, err := sess.WriteMessage(messageTypeResumptionTicket, ticket.messageBytes()); err != nil {
+		sess.error(xerrors.Errorf("unable to send a resumption ticket: %w", err))
+	}
+}
+
+// GetResumptionTicket returns the latest resumption ticket issued
+// by the remote side in this session (or nil if there is no ticket).
+// It could be used in KeyExchangerOptions.ResumptionTicket of a new
+// session with the same remote side.
+func (sess *Session) GetResumptionTicket() *ResumptionTicket {
+	return (*ResumptionTicket)(atomic.LoadPointer((*unsafe.Pointer)((unsafe.Pointer)(&sess.resumptionTicket))))
+}
+
+// IsResumed returns true if the session was resumed using
+// a ResumptionTicket (so the negotiation was skipped).
+func (sess *Session) IsResumed() bool {
+	if sess.keyExchanger == nil {
+		return false
+	}
+	_, isResumed := sess.keyExchanger.getResumedPayloadSize()
+	return isResumed
+}
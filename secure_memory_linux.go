@@ -0,0 +1,67 @@
+// +build linux
+
+package secureio
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var lockedPages = struct {
+	lockerMutex
+	refCount map[uintptr]uint
+}{
+	refCount: map[uintptr]uint{},
+}
+
+// memoryPages calls `fn` for each memory page which contains `b`.
+func memoryPages(b []byte, fn func(page, pageSize uintptr)) {
+	if len(b) == 0 {
+		return
+	}
+	pageSize := uintptr(os.Getpagesize())
+	firstPage := uintptr(unsafe.Pointer(&b[0])) &^ (pageSize - 1)
+	lastPage := uintptr(unsafe.Pointer(&b[len(b)-1])) &^ (pageSize - 1)
+	for page := firstPage; page <= lastPage; page += pageSize {
+		fn(page, pageSize)
+	}
+}
+
+// lockMemory locks the memory pages of `b` (see mlock(2)), so they
+// are never swapped out. The pages are unlocked by unlockMemory
+// (it should be called even if lockMemory returned an error).
+//
+// The pages could be shared by different keys, so the pages are
+// reference counted.
+func lockMemory(b []byte) (err error) {
+	lockedPages.LockDo(func() {
+		memoryPages(b, func(page, pageSize uintptr) {
+			lockedPages.refCount[page]++
+			if lockedPages.refCount[page] != 1 {
+				return
+			}
+			if _, _, errno := syscall.Syscall(syscall.SYS_MLOCK, page, pageSize, 0); errno != 0 {
+				err = newErrCannotLockMemory(errno)
+			}
+		})
+	})
+	return
+}
+
+// unlockMemory unlocks the memory pages locked by lockMemory.
+func unlockMemory(b []byte) {
+	lockedPages.LockDo(func() {
+		memoryPages(b, func(page, pageSize uintptr) {
+			switch lockedPages.refCount[page] {
+			case 0:
+				return
+			case 1:
+				delete(lockedPages.refCount, page)
+				_, _, _ = syscall.Syscall(syscall.SYS_MUNLOCK, page, pageSize, 0)
+			default:
+				lockedPages.refCount[page]--
+			}
+		})
+	})
+}
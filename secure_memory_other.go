@@ -0,0 +1,14 @@
+// +build !linux
+
+package secureio
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func lockMemory(b []byte) error {
+	return newErrCannotLockMemory(fmt.Errorf("not supported on %s", runtime.GOOS))
+}
+
+func unlockMemory(b []byte) {}
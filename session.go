@@ -58,12 +58,24 @@ const (
 	// DefaultMaxFragmentedMessageSize is the default value for
 	// SessionOptions.MaxFragmentedMessageSize.
 	DefaultMaxFragmentedMessageSize = 1 << 16
+
+	// DefaultKeyUpdateEveryNBytes is the default value for
+	// SessionOptions.KeyUpdateEveryNBytes.
+	DefaultKeyUpdateEveryNBytes = 1 << 34
+
+	// DefaultKeyUpdateEveryNPackets is the default value for
+	// SessionOptions.KeyUpdateEveryNPackets.
+	DefaultKeyUpdateEveryNPackets = 1 << 24
 )
 
 const (
-	updateKeyEveryNBytes = 1000000
-	messageQueueLength   = 1024
-	cipherBlockSize      = 1 // TODO: remove this obsolete constant
+	messageQueueLength = 1024
+	cipherBlockSize    = 1 // TODO: remove this obsolete constant
+
+	// keyUpdateHardLimitMultiplier defines the hard limit of traffic sent
+	// with the same cipher key relatively to SessionOptions.KeyUpdateEveryNBytes
+	// and SessionOptions.KeyUpdateEveryNPackets.
+	keyUpdateHardLimitMultiplier = 2
 )
 
 var (
@@ -90,6 +102,12 @@ func (sessID *SessionID) Bytes() (result [16]byte) {
 	return
 }
 
+// isOlderThan returns true if `sessID` is another session which was
+// created not later than `other`.
+func (sessID *SessionID) isOlderThan(other *SessionID) bool {
+	return *sessID != *other && sessID.CreatedAt <= other.CreatedAt
+}
+
 // FillFromBytes fills SessionID using bytes slice.
 // A bytes slice could be received via method Bytes()
 func (sessID *SessionID) FillFromBytes(b []byte) {
@@ -114,19 +132,24 @@ type Session struct {
 	state                  *sessionStateStorage
 	identity               *Identity
 	remoteIdentity         *Identity
+	trustStore             TrustStore
 	options                SessionOptions
 	packetSizeLimit        uint32
 	establishedPayloadSize uint32
 
 	keyExchanger         *keyExchanger
 	negotiator           *negotiator
-	backend              io.ReadWriteCloser
+	pathProber           *pathProber
 	messenger            map[MessageType]*Messenger
 	readChan             map[MessageType]chan *readItem
 	currentSecrets       [][]byte
-	cipherKeys           *[][]byte
-	auxCipherKey         []byte
+	cipherKeys           *cipherKeys
+	cipherSuite          *sessionCipherSuite
+	auxCipherKeys        [][]byte
+	auxCipherKeyIdx      uint32
+	isLockMemoryReported uint32
 	waitForCipherKeyChan chan struct{}
+	cipherKeyUpdatedChan chan struct{}
 	eventHandler         EventHandler
 	stopWaitGroup        sync.WaitGroup
 	isEstablished        chan struct{}
@@ -141,7 +164,7 @@ type Session struct {
 	delayedSendInfo          *SendInfo
 	delayedWriteBuf          *buffer
 	delayedWriteBufLocker    spinlock.Locker
-	delayedSenderTimer       *time.Timer
+	delayedSenderTimer       Timer
 	delayedSenderTimerLocker spinlock.Locker
 	sendDelayedNowChan       chan *SendInfo
 	sendDelayedCond          *sync.Cond
@@ -154,8 +177,12 @@ type Session struct {
 	receivedMessagesCount       uint64
 	sequentialDecryptFailsCount uint64
 	unexpectedPacketIDCount     uint64
+	sentBytesWithCipherKey      uint64
+	sentPacketsWithCipherKey    uint64
 
-	delayedSenderLoopCount uint32
+	delayedSenderLoopCount     uint32
+	authenticationStringStatus uint32
+	isKeyUpdateRequested       uint32
 
 	infoOutputChan  chan DebugOutputEntry
 	debugOutputChan chan DebugOutputEntry
@@ -176,7 +203,23 @@ type Session struct {
 	readInterruptsRequested uint64
 	readInterruptsHappened  uint64
 
-	remoteSessionID *SessionID
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	// readSemaphore serializes Read calls. The rest of the message
+	// which did not fit into the buffer of Read is kept
+	// in readPendingData.
+	readSemaphore   chan struct{}
+	readPendingItem *readItem
+	readPendingData []byte
+
+	remoteSessionID  *SessionID
+	resumptionTicket *ResumptionTicket
+
+	backendLocker     lockerRWMutex
+	backend           io.ReadWriteCloser
+	backendGeneration uint64
+	isStreamFraming   bool
 }
 
 // DebugOutputEntry is a structure of data which is being passed to a debugger
@@ -313,6 +356,74 @@ type SessionOptions struct {
 	// (after assembling from all its fragments). The more this value is
 	// the larder messages are allowed, but more memory is consumed.
 	MaxFragmentedMessageSize uint64
+
+	// KeyUpdateEveryNBytes is an amount of bytes sent with the same
+	// cipher key after which the key update is started (without waiting
+	// for KeyExchangerOptions.KeyUpdateInterval).
+	//
+	// If the key was not updated until twice of this amount is sent, then
+	// sending is blocked until the key update completes.
+	//
+	// If it is set to a nil-value then DefaultKeyUpdateEveryNBytes
+	// will be used instead. If it is set to zero then the limit is disabled.
+	KeyUpdateEveryNBytes *uint64
+
+	// KeyUpdateEveryNPackets is the same as KeyUpdateEveryNBytes, but
+	// it limits the amount of packets instead of bytes.
+	//
+	// If it is set to a nil-value then DefaultKeyUpdateEveryNPackets
+	// will be used instead. If it is set to zero then the limit is disabled.
+	KeyUpdateEveryNPackets *uint64
+
+	// Clock is the source of time for the key exchanger, the negotiator,
+	// the delayed sender, the SessionID, the checks of certificates and
+	// the resumption tickets. It could be replaced to test timeouts
+	// deterministically (see FakeClock).
+	//
+	// The deadlines of the backend are always set using the real time.
+	//
+	// If it is set to a nil-value then the system clock is used.
+	Clock Clock
+
+	// RandReader is the source of cryptographically secure random
+	// values for the key exchanger, the SessionID and the issued
+	// resumption tickets. If it fails to generate a SessionID then
+	// the default source is used instead.
+	//
+	// The ML-KEM keys (see KeyExchangerOptions.EnableHybridKeyExchange)
+	// are always generated using crypto/rand.
+	//
+	// If it is set to a nil-value then crypto/rand.Reader is used.
+	RandReader io.Reader
+
+	// StreamFraming controls if each packet should be prefixed by its
+	// length while being written to the backend. It is required for byte
+	// streams (like TCP connections or pipes), which may fragment or merge
+	// the packets. Only the length of a packet is sent unencrypted.
+	//
+	// It should be the same on the both sides of one communication.
+	//
+	// By default it is enabled only if IsStreamWriter returns true
+	// for the backend.
+	StreamFraming StreamFramingEnable
+}
+
+// getClock returns the Clock set by SessionOptions.Clock or the system
+// clock by default.
+func (sess *Session) getClock() Clock {
+	if sess.options.Clock == nil {
+		return systemClock{}
+	}
+	return sess.options.Clock
+}
+
+// getRandReader returns the source of randomness set by
+// SessionOptions.RandReader or crypto/rand.Reader by default.
+func (sess *Session) getRandReader() io.Reader {
+	if sess.options.RandReader == nil {
+		return rand.Reader
+	}
+	return sess.options.RandReader
 }
 
 // GetUnexpectedPacketIDCount returns the amount of packets which were
@@ -359,12 +470,24 @@ type sessionIDGetterType struct {
 }
 
 func (sessionIDGetter *sessionIDGetterType) Get() (result SessionID) {
+	return sessionIDGetter.get(nil, nil)
+}
+
+// get returns a new SessionID using `clock` and `randReader` as the sources
+// of time and randomness (nil-values mean the defaults).
+func (sessionIDGetter *sessionIDGetterType) get(clock Clock, randReader io.Reader) (result SessionID) {
 	sessionIDGetter.LockDo(func() {
-		for {
-			result.CreatedAt = uint64(timeNow().UnixNano())
-			if result.CreatedAt != sessionIDGetter.prevTime {
-				break
+		if clock == nil {
+			for {
+				result.CreatedAt = uint64(timeNow().UnixNano())
+				if result.CreatedAt != sessionIDGetter.prevTime {
+					break
+				}
 			}
+		} else {
+			// A custom clock (like FakeClock) may stand still, so do not wait
+			// for a change here.
+			result.CreatedAt = uint64(clock.Now().UnixNano())
 		}
 		if result.CreatedAt <= sessionIDGetter.prevTime {
 			result.CreatedAt = sessionIDGetter.prevTime + 1 // could happen due to a time-resynchronization
@@ -372,6 +495,13 @@ func (sessionIDGetter *sessionIDGetterType) Get() (result SessionID) {
 		sessionIDGetter.prevTime = result.CreatedAt
 	})
 
+	if randReader != nil {
+		var randomBytes [8]byte
+		if _, err := io.ReadFull(randReader, randomBytes[:]); err == nil {
+			result.Random = binaryOrderType.Uint64(randomBytes[:])
+			return
+		}
+	}
 	result.Random = sessionIDGetter.rand.Uint64()
 	return
 }
@@ -396,6 +526,7 @@ func init() {
 
 func newSession(
 	identity, remoteIdentity *Identity,
+	trustStore TrustStore,
 	backend io.ReadWriteCloser,
 	eventHandler EventHandler,
 	opts *SessionOptions,
@@ -404,6 +535,7 @@ func newSession(
 
 	sess.init(
 		identity, remoteIdentity,
+		trustStore,
 		backend,
 		eventHandler,
 		opts,
@@ -414,6 +546,7 @@ func newSession(
 
 func (sess *Session) init(
 	identity, remoteIdentity *Identity,
+	trustStore TrustStore,
 	backend io.ReadWriteCloser,
 	eventHandler EventHandler,
 	opts *SessionOptions,
@@ -423,23 +556,28 @@ func (sess *Session) init(
 	}
 
 	*sess = Session{
-		id:                   globalSessionIDGetter.Get(),
 		identity:             identity,
 		remoteIdentity:       remoteIdentity,
+		trustStore:           trustStore,
 		state:                newSessionStateStorage(),
 		backend:              backend,
 		eventHandler:         eventHandler,
 		waitForCipherKeyChan: make(chan struct{}),
 		sendDelayedNowChan:   make(chan *SendInfo),
-		cipherKeys:           &[][][]byte{nil}[0],
 		messenger:            make(map[MessageType]*Messenger),
 		readChan:             make(map[MessageType]chan *readItem),
 		isEstablished:        make(chan struct{}),
+		cipherKeyUpdatedChan: make(chan struct{}),
 	}
 
 	if opts != nil {
 		sess.options = *opts
 	}
+	sess.id = globalSessionIDGetter.get(sess.options.Clock, sess.options.RandReader)
+
+	sess.readDeadline = newDeadline(sess.getClock())
+	sess.writeDeadline = newDeadline(sess.getClock())
+	sess.readSemaphore = make(chan struct{}, 1)
 
 	sess.debugOutputChan = make(chan DebugOutputEntry, 1024)
 	sess.infoOutputChan = make(chan DebugOutputEntry, 1024)
@@ -471,7 +609,7 @@ func (sess *Session) init(
 	}
 
 	if sess.options.PayloadSizeLimit == 0 {
-		if IsLossyWriter(sess.backend) {
+		if IsLossyWriter(backend) {
 			sess.options.PayloadSizeLimit = atomic.LoadUint32(&payloadLossySizeLimit)
 		} else {
 			sess.options.PayloadSizeLimit = atomic.LoadUint32(&payloadSizeLimit)
@@ -484,6 +622,12 @@ func (sess *Session) init(
 	if sess.options.MaxFragmentedMessageSize == 0 {
 		sess.options.MaxFragmentedMessageSize = DefaultMaxFragmentedMessageSize
 	}
+	if sess.options.KeyUpdateEveryNBytes == nil {
+		sess.options.KeyUpdateEveryNBytes = &[]uint64{DefaultKeyUpdateEveryNBytes}[0]
+	}
+	if sess.options.KeyUpdateEveryNPackets == nil {
+		sess.options.KeyUpdateEveryNPackets = &[]uint64{DefaultKeyUpdateEveryNPackets}[0]
+	}
 
 	sess.updatePacketSizeLimit()
 	sess.bufferPool = newBufferPool(uint(sess.GetPacketSizeLimit()))
@@ -499,7 +643,7 @@ func (sess *Session) init(
 	sess.messagesContainerHeadersPool = newMessagesContainerHeadersPool()
 
 	if sess.options.SendDelay != nil {
-		sess.delayedSenderTimer = time.NewTimer(*sess.options.SendDelay)
+		sess.delayedSenderTimer = sess.getClock().NewTimer(*sess.options.SendDelay)
 		sess.delayedSenderTimer.Stop()
 	}
 
@@ -507,19 +651,23 @@ func (sess *Session) init(
 
 	sess.readChan[MessageTypeReadWrite] = make(chan *readItem, messageQueueLength)
 
-	psk := sess.options.KeyExchangerOptions.PSK
-	if psk != nil {
-		sess.auxCipherKey = hash(psk, Salt, []byte("auxCipherKey"))[:chacha.KeySize]
+	// The local side uses the aux cipher key of its own PSK, while
+	// the remote side could use any of the PSKs (see
+	// KeyExchangerOptions.PSKs).
+	for _, psk := range sess.options.KeyExchangerOptions.getPSKs() {
+		sess.auxCipherKeys = append(sess.auxCipherKeys, hash(psk.Key, Salt, []byte("auxCipherKey"))[:chacha.KeySize])
 	}
+	sess.cipherKeys = sess.newCipherKeys(nil, sess.auxCipherKeys)
 
 	sess.pendingChains = make([]pendingChain, sess.options.MaxChainIDDiff)
 
-	sess.setupBackend()
+	sess.setupBackend(backend)
+	sess.isStreamFraming = sess.shouldUseStreamFraming(backend)
 }
 
-func (sess *Session) setupBackend() {
+func (sess *Session) setupBackend(backend io.ReadWriteCloser) {
 	var err error
-	switch backend := sess.backend.(type) {
+	switch backend := backend.(type) {
 	case *net.UDPConn:
 		err = wrapError(udpnofrag.UDPSetNoFragment(backend))
 	}
@@ -528,6 +676,34 @@ func (sess *Session) setupBackend() {
 	}
 }
 
+func (sess *Session) shouldUseStreamFraming(backend io.ReadWriteCloser) bool {
+	switch sess.options.StreamFraming {
+	case StreamFramingEnableAuto:
+		return IsStreamWriter(backend)
+	case StreamFramingEnableTrue:
+		return true
+	default:
+		return false
+	}
+}
+
+// getBackend returns the current backend and its generation (which
+// is increased on each ReplaceBackend).
+func (sess *Session) getBackend() (backend io.ReadWriteCloser, generation uint64) {
+	sess.backendLocker.RLockDo(func() {
+		backend = sess.backend
+		generation = sess.backendGeneration
+	})
+	return
+}
+
+func (sess *Session) getBackendGeneration() (generation uint64) {
+	sess.backendLocker.RLockDo(func() {
+		generation = sess.backendGeneration
+	})
+	return
+}
+
 func (sess *Session) getNextPacketID() uint64 {
 	result := atomic.AddUint64(&sess.nextPacketID, 1)
 	sess.debugf("next packet ID is %v", result)
@@ -607,6 +783,10 @@ func (sess *Session) ID() SessionID {
 // Start runs all the goroutines to make the session work. The session
 // will not work until Start will be called.
 func (sess *Session) Start(ctx context.Context) error {
+	if sess.identity == nil && len(sess.options.KeyExchangerOptions.getPSKs()) == 0 {
+		return newErrPSKRequired()
+	}
+
 	var err error
 	sess.lockDo(func() {
 		if sess.ctx != nil {
@@ -621,6 +801,8 @@ func (sess *Session) Start(ctx context.Context) error {
 
 	sess.delayedSendInfo = sess.sendInfoPool.AcquireSendInfo(sess.ctx)
 	sess.initNegotiator()
+	sess.NewMessenger(messageTypeResumptionTicket).SetHandler(&resumptionTicketHandler{sess: sess})
+	sess.pathProber = newPathProber(sess, sess.NewMessenger(messageTypePathProbe))
 	sess.startKeyExchange()
 	sess.startReader()
 	sess.startBackendCloser()
@@ -671,7 +853,8 @@ func (sess *Session) startBackendCloser() {
 
 		if err := sess.interruptRead(); err != nil {
 			sess.infof("unable to interrupt the Read(), closing the backend ReadWriteCloser")
-			closeErr := sess.backend.Close()
+			backend, _ := sess.getBackend()
+			closeErr := backend.Close()
 			sess.debugf("sess.backend.Close() -> %v: %v ?= %v; %v ?= %v",
 				closeErr, recvMsgCount, sess.options.DetachOnMessagesCount,
 				seqDecryptFailsCount, sess.options.DetachOnSequentialDecryptFailsCount)
@@ -759,6 +942,69 @@ func (sess *Session) SetPause(newValue bool) (err error) {
 	return
 }
 
+// ReplaceBackend swaps the underlying io.ReadWriteCloser of
+// an established session (for example if the IP address of the host has
+// changed or a TCP connection was dropped). The identities, the keys,
+// PacketIDs and pending asynchronous sends are preserved, so no new
+// key exchange is required. The old backend is closed.
+//
+// ReplaceBackend could be used only from states SessionStateEstablished
+// and SessionStatePaused.
+//
+// If NegotiatorOptions.RenegotiateOnReplaceBackend is true then
+// the payload size is re-negotiated (in background) for the new backend.
+func (sess *Session) ReplaceBackend(newBackend io.ReadWriteCloser) (err error) {
+	sess.debugf("ReplaceBackend(%T)", newBackend)
+	defer func() { sess.debugf("ReplaceBackend(%T) -> %v", newBackend, err) }()
+
+	switch state := sess.GetState(); state {
+	case SessionStateEstablished, SessionStatePaused:
+	default:
+		return newErrCannotReplaceBackendFromThisState(state)
+	}
+
+	sess.setupBackend(newBackend)
+	isStreamFraming := sess.shouldUseStreamFraming(newBackend)
+
+	var oldBackend io.ReadWriteCloser
+	sess.backendLocker.LockDo(func() {
+		oldBackend = sess.backend
+		sess.backend = newBackend
+		sess.backendGeneration++
+		sess.isStreamFraming = isStreamFraming
+	})
+
+	// The Read() on the old backend is interrupted, so readerLoop
+	// switches to the new backend.
+	_ = setReadDeadline(oldBackend, timeNow())
+	_ = oldBackend.Close()
+
+	if sess.isDone() {
+		// The session could be closed concurrently, and the closer could
+		// already close the old backend.
+		_ = newBackend.Close()
+		return newErrAlreadyClosed()
+	}
+
+	sess.pathProber.Start()
+
+	if sess.options.NegotiatorOptions.RenegotiateOnReplaceBackend {
+		return sess.negotiator.Renegotiate()
+	}
+	return nil
+}
+
+// GetPathStatistics returns the statistics of the paths if the backend
+// is a Multipath. Otherwise it returns nil.
+func (sess *Session) GetPathStatistics() []PathStatistics {
+	backend, _ := sess.getBackend()
+	mp, ok := backend.(*Multipath)
+	if !ok {
+		return nil
+	}
+	return mp.GetStatistics()
+}
+
 func (sess *Session) waitForUnpause() {
 	if sess.GetState() != SessionStatePaused {
 		return
@@ -837,6 +1083,7 @@ func (sess *Session) readerLoopCleanup() {
 		close(ch)
 	}
 
+	sess.destroySecrets()
 	sess.setState(SessionStateClosed)
 	sess.debugf("secureio session closed")
 	close(sess.debugOutputChan)
@@ -890,7 +1137,8 @@ func (sess *Session) readerLoopDecryptError(err error) (shouldContinue bool) {
 		}
 	}
 
-	if sequentialDecryptFailsCount >= sess.options.DetachOnSequentialDecryptFailsCount {
+	if sess.options.DetachOnSequentialDecryptFailsCount != 0 &&
+		sequentialDecryptFailsCount >= sess.options.DetachOnSequentialDecryptFailsCount {
 		sess.debugf(`reached limit "DetachOnSequentialDecryptFailsCount"`)
 		return false
 	}
@@ -898,25 +1146,83 @@ func (sess *Session) readerLoopDecryptError(err error) (shouldContinue bool) {
 	return true
 }
 
+// authenticPacketHandler is an optional interface of a backend which is
+// notified if a packet is received, decrypted and passed the PacketID
+// check (so it is not a replay). See Listener.
+//
+// `isEncryptedWithCipherKey` is false if the packet is protected only
+// by an aux cipher key (for example a key exchange packet).
+type authenticPacketHandler interface {
+	onAuthenticPacket(isEncryptedWithCipherKey bool)
+}
+
 func (sess *Session) readerLoop() {
 	defer sess.readerLoopCleanup()
 
-	var inputBuffer = make([]byte, sess.GetPacketSizeLimit())
 	var decryptedBuffer buffer
 	decryptedBuffer.Grow(uint(sess.GetPacketSizeLimit()))
 
+	for !sess.isDone() {
+		var backend io.ReadWriteCloser
+		var generation uint64
+		var isStreamFraming bool
+		sess.backendLocker.RLockDo(func() {
+			backend = sess.backend
+			generation = sess.backendGeneration
+			isStreamFraming = sess.isStreamFraming
+		})
+		if !sess.readFromBackend(backend, generation, isStreamFraming, &decryptedBuffer) {
+			return
+		}
+		sess.debugf(`readerLoop(): the backend was replaced, switching to the new one`)
+	}
+	sess.debugf(`readerLoop(): loop finished`)
+}
+
+// readFromBackend reads and handles the incoming packets from the backend
+// until the session is finished (then it returns false) or the backend
+// is replaced (then it returns true, see ReplaceBackend).
+func (sess *Session) readFromBackend(
+	backend io.ReadWriteCloser,
+	generation uint64,
+	isStreamFraming bool,
+	decryptedBuffer *buffer,
+) (isReplaced bool) {
+	var inputBuffer = make([]byte, sess.GetPacketSizeLimit())
+
+	var frameReader *frameReader
+	if isStreamFraming {
+		// The encrypted packets are padded up to cipherBlockSize.
+		inputBuffer = make([]byte, roundSize(sess.GetPacketSizeLimit(), cipherBlockSize))
+		frameReader = newFrameReader(backend, len(inputBuffer))
+	}
+
 	for !sess.isDone() {
 		sess.setIsReading(true)
 		sess.waitForUnpause()
+		if sess.getBackendGeneration() != generation {
+			sess.setIsReading(false)
+			return true
+		}
 		sess.ifDebug(func() { sess.debugf("readerLoop: n, err := sess.backend.Read(inputBuffer)") })
-		n, err := sess.backend.Read(inputBuffer)
+		var n int
+		var err error
+		if frameReader == nil {
+			n, err = backend.Read(inputBuffer)
+		} else {
+			n, err = frameReader.ReadFrame(inputBuffer)
+		}
 		sess.setIsReading(false)
 		sess.ifDebug(func() {
 			sess.debugf("readerLoop: /n, err := sess.backend.Read(inputBuffer): %v | %T:%v | %v", n, err, err, sess.state.Load())
 		})
 		if err != nil {
-			if !sess.readerLoopReadError(err) {
-				return
+			if sess.getBackendGeneration() != generation {
+				// The old backend was interrupted by ReplaceBackend.
+				return true
+			}
+			if !sess.readerLoopReadError(err) || frameReader.IsBroken() {
+				return false
 			}
 			continue
 		}
@@ -924,10 +1230,10 @@ func (sess *Session) readerLoop() {
 			continue
 		}
 
-		containerHdr, messagesBytes, err := sess.decrypt(&decryptedBuffer, inputBuffer[:n])
+		containerHdr, messagesBytes, err := sess.decrypt(decryptedBuffer, inputBuffer[:n])
 		if err != nil {
 			if !sess.readerLoopDecryptError(err) {
-				return
+				return false
 			}
 			continue
 		}
@@ -942,11 +1248,14 @@ func (sess *Session) readerLoop() {
 			continue
 		}
 		atomic.StoreUint64(&sess.sequentialDecryptFailsCount, 0)
+		if handler, ok := backend.(authenticPacketHandler); ok {
+			handler.onAuthenticPacket(containerHdr.isEncryptedWithCipherKey)
+		}
 
 		sess.processIncomingMessages(containerHdr, messagesBytes)
 		containerHdr.Release()
 	}
-	sess.debugf(`readerLoop(): loop finished`)
+	return false
 }
 
 func (sess *Session) processIncomingMessages(
@@ -981,7 +1290,7 @@ func (sess *Session) processIncomingMessages(
 		}
 
 		var receivedMessagesCount uint64
-		if sess.options.DetachOnMessagesCount > 0 && hdr.Type != messageTypeKeyExchange && hdr.Type != messageTypeNegotiation {
+		if sess.options.DetachOnMessagesCount > 0 && hdr.Type != messageTypeKeyExchange && hdr.Type != messageTypeNegotiation && hdr.Type != messageTypePathProbe {
 			receivedMessagesCount = atomic.AddUint64(&sess.receivedMessagesCount, 1)
 		}
 
@@ -1104,6 +1413,7 @@ func (sess *Session) tryDecrypt(
 	decrypted *buffer,
 	containerHdr *messagesContainerHeaders,
 	encrypted []byte,
+	suite cipherSuiteImplementation,
 	cipherKey []byte,
 	iv []byte,
 ) (bool, error) {
@@ -1111,16 +1421,32 @@ func (sess *Session) tryDecrypt(
 	decrypted.Reset()
 	decrypted.Grow(uint(len(encrypted)))
 
-	if cipherKey != nil {
-		decrypt(cipherKey, iv, decrypted.Bytes[decrypted.Offset:], encrypted)
+	streamSuite, isStreamSuite := suite.(streamCipherSuiteImplementation)
+	switch {
+	case !isStreamSuite:
+		// See aeadCipherSuiteImplementation: the authentication tag
+		// takes the place of the headers checksum.
+		if cipherKey == nil || len(encrypted) < poly1305.TagSize {
+			return false, nil
+		}
+		plainBytes := decrypted.Bytes[decrypted.Offset : decrypted.Offset+uint(len(encrypted))]
+		zeroBytes(plainBytes[:poly1305.TagSize])
+		_, err := suite.(aeadCipherSuiteImplementation).Open(cipherKey, iv, plainBytes[poly1305.TagSize:poly1305.TagSize], encrypted)
+		if err != nil {
+			sess.debugf("tryDecrypt: decrypting: unable to open the packet (cipherKey == %v): %v",
+				secretForDebug(cipherKey), err)
+			return false, nil
+		}
+	case cipherKey != nil:
+		streamSuite.XORKeyStream(cipherKey, iv, decrypted.Bytes[decrypted.Offset:], encrypted)
 
 		if len(encrypted) < 200 {
 			sess.ifDebug(func() {
 				sess.debugf("tryDecrypt: decrypted: iv:%v dec:%v enc:%v dec_len:%v cipher_key:%v",
-					iv, decrypted.Bytes[decrypted.Offset:], encrypted, decrypted.Len(), cipherKey)
+					iv, decrypted.Bytes[decrypted.Offset:], encrypted, decrypted.Len(), secretForDebug(cipherKey))
 			})
 		}
-	} else {
+	default:
 		copy(decrypted.Bytes[decrypted.Offset:], encrypted)
 	}
 
@@ -1135,18 +1461,22 @@ func (sess *Session) tryDecrypt(
 	if err != nil {
 		return false, xerrors.Errorf("unable to read a decrypted header: %w", err)
 	}
+	if !isStreamSuite {
+		// Already authenticated by the AEAD
+		return true, nil
+	}
 
-	err = sess.checkHeadersChecksum(cipherKey, containerHdr)
+	err = sess.checkHeadersChecksum(streamSuite, cipherKey, iv, containerHdr)
 	if err != nil {
 		sess.debugf("tryDecrypt: decrypting: headers checksum did not match (cipherKey == %v): %v",
-			cipherKey, err)
+			secretForDebug(cipherKey), err)
 		return false, nil
 	}
 	messagesBytes := decrypted.Bytes[decrypted.Offset:]
-	err = sess.checkMessagesChecksum(cipherKey, containerHdr, messagesBytes)
+	err = sess.checkMessagesChecksum(streamSuite, cipherKey, iv, containerHdr, messagesBytes)
 	if err != nil {
 		sess.debugf("tryDecrypt: decrypting: messages checksum did not match (cipherKey == %v): %v",
-			cipherKey, err)
+			secretForDebug(cipherKey), err)
 		return false, wrapError(err)
 	}
 	return true, nil
@@ -1168,17 +1498,17 @@ func (sess *Session) fillWithRemoteIV(
 	sess.debugf("decrypt(): iv: %v:%v", ivLen, ivBuf.Bytes[:ivLen])
 }
 
-func (sess *Session) decryptPacketIDBytes(decrypted *buffer, encrypted []byte) (packetIDBytes []byte) {
-	if sess.auxCipherKey == nil {
+func (sess *Session) decryptPacketIDBytes(decrypted *buffer, auxCipherKey, encrypted []byte) (packetIDBytes []byte) {
+	if auxCipherKey == nil {
 		packetIDBytes = encrypted
 		return
 	}
 
 	packetIDBytes = decrypted.Bytes[:len(encrypted)]
-	decrypt(sess.auxCipherKey, emptyIV, packetIDBytes, encrypted)
+	decrypt(auxCipherKey, emptyIV, packetIDBytes, encrypted)
 	decrypted.Offset += uint(len(encrypted))
 	sess.debugf("decrypted the PacketID from %v to %v using key %v",
-		encrypted, packetIDBytes, sess.auxCipherKey)
+		encrypted, packetIDBytes, secretForDebug(auxCipherKey))
 	return
 }
 
@@ -1221,52 +1551,177 @@ func (sess *Session) decrypt(
 
 	containerHdr = sess.messagesContainerHeadersPool.AcquireMessagesContainerHeaders(sess)
 
+	ivBuf := sess.bufferPool.AcquireBuffer()
+	defer ivBuf.Release()
+
+	defer func() {
+		if err == nil {
+			messagesBytes = decrypted.Bytes[decrypted.Offset:]
+		}
+	}()
+
+	cipherKeys := sess.acquireCipherKeys()
+	defer cipherKeys.release()
+	if cipherKeys.isClosed {
+		err = newErrAlreadyClosed()
+		return
+	}
+
+	// The remote side may use any of the PSKs, so all of the aux cipher
+	// keys are tried (starting from the one which worked last time).
+	auxCipherKeys := cipherKeys.auxKeys
+	if len(auxCipherKeys) == 0 {
+		auxCipherKeys = [][]byte{nil}
+	}
+	firstIdx := atomic.LoadUint32(&sess.auxCipherKeyIdx)
+	for idx := range auxCipherKeys {
+		auxCipherKeyIdx := (firstIdx + uint32(idx)) % uint32(len(auxCipherKeys))
+		var done bool
+		done, err = sess.tryDecryptWithAuxCipherKey(decrypted, containerHdr, encrypted,
+			cipherKeys.keys, auxCipherKeys[auxCipherKeyIdx], ivBuf)
+		if err != nil {
+			return
+		}
+		if done {
+			if auxCipherKeyIdx != firstIdx {
+				atomic.StoreUint32(&sess.auxCipherKeyIdx, auxCipherKeyIdx)
+			}
+			return
+		}
+	}
+
+	err = newErrCannotDecrypt()
+	return
+}
+
+// keyExchangeMessage returns the payload of the key exchange message of
+// packet `packet` or nil if there is no such message (or the packet
+// cannot be decrypted). Before the first successful key exchange only
+// the aux cipher keys are used, so it could be used to check packets
+// of new remote sides (see Listener).
+func (sess *Session) keyExchangeMessage(packet []byte) []byte {
+	decrypted := sess.bufferPool.AcquireBuffer()
+	defer decrypted.Release()
+	containerHdr, messagesBytes, err := sess.decrypt(decrypted, packet)
+	if err != nil {
+		return nil
+	}
+	defer containerHdr.Release()
+
+	var hdr messageHeadersData
+	l := umin(uint(len(messagesBytes)), uint(containerHdr.Length))
+	for i := uint(0); l-i >= messageHeadersSize; {
+		if _, err := hdr.Read(messagesBytes[i : i+messageHeadersSize]); err != nil {
+			return nil
+		}
+		end := i + messageHeadersSize + uint(hdr.Length)
+		if end > l {
+			return nil
+		}
+		if hdr.Type == messageTypeKeyExchange && !hdr.IsFragmented() {
+			return append([]byte(nil), messagesBytes[i+messageHeadersSize:end]...)
+		}
+		i = end
+	}
+	return nil
+}
+
+// isAuthenticPacket returns true if the packet is encrypted with one of
+// the current cipher keys of the session. Unlike decrypt it does not
+// accept packets protected only by an aux cipher key (for example
+// key-exchange packets).
+//
+// It is safe to be called concurrently with the readerLoop.
+func (sess *Session) isAuthenticPacket(packet []byte) bool {
+	if uint(len(packet)) < messagesContainerHeadersSize {
+		return false
+	}
+
+	containerHdr := sess.messagesContainerHeadersPool.AcquireMessagesContainerHeaders(sess)
+	defer containerHdr.Release()
+	decrypted := sess.bufferPool.AcquireBuffer()
+	defer decrypted.Release()
+	ivBuf := sess.bufferPool.AcquireBuffer()
+	defer ivBuf.Release()
+
+	cipherKeys := sess.acquireCipherKeys()
+	defer cipherKeys.release()
+
+	auxCipherKeys := cipherKeys.auxKeys
+	if len(auxCipherKeys) == 0 {
+		auxCipherKeys = [][]byte{nil}
+	}
+	encrypted := packet[len(containerHdr.PacketID):]
+	suite := sess.getCipherSuiteImplementation()
+	for _, auxCipherKey := range auxCipherKeys {
+		decrypted.Reset()
+		decrypted.Grow(uint(len(packet)))
+		packetIDBytes := sess.decryptPacketIDBytes(decrypted, auxCipherKey, packet[:len(containerHdr.PacketID)])
+		if _, err := containerHdr.PacketID.Read(packetIDBytes); err != nil {
+			return false
+		}
+		sess.fillWithRemoteIV(ivBuf, containerHdr)
+		for _, cipherKey := range cipherKeys.keys {
+			if cipherKey == nil {
+				continue
+			}
+			if done, _ := sess.tryDecrypt(decrypted, containerHdr, encrypted,
+				suite, cipherKey, ivBuf.Bytes); done {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (sess *Session) tryDecryptWithAuxCipherKey(
+	decrypted *buffer,
+	containerHdr *messagesContainerHeaders,
+	encrypted []byte,
+	cipherKeys [][]byte,
+	auxCipherKey []byte,
+	ivBuf *buffer,
+) (done bool, err error) {
+
 	// Getting PacketID
 
-	packetIDBytes := sess.decryptPacketIDBytes(decrypted, encrypted[:len(containerHdr.PacketID)])
+	packetIDBytes := sess.decryptPacketIDBytes(decrypted, auxCipherKey, encrypted[:len(containerHdr.PacketID)])
 
 	_, err = containerHdr.PacketID.Read(packetIDBytes)
 	if err != nil {
-		err = wrapError(err)
-		return
+		return false, wrapError(err)
 	}
 
 	// decrypting the rest:
 	encrypted = encrypted[len(containerHdr.PacketID):]
 
-	ivBuf := sess.bufferPool.AcquireBuffer()
-	defer ivBuf.Release()
 	sess.fillWithRemoteIV(ivBuf, containerHdr)
 
-	defer func() {
-		if err == nil {
-			messagesBytes = decrypted.Bytes[decrypted.Offset:]
-		}
-	}()
-
-	var done bool
-	for _, cipherKey := range sess.GetCipherKeys() {
+	suite := sess.getCipherSuiteImplementation()
+	for _, cipherKey := range cipherKeys {
 		if cipherKey == nil {
 			continue
 		}
 		if done, err = sess.tryDecrypt(decrypted, containerHdr, encrypted,
-			cipherKey, ivBuf.Bytes); done || err != nil {
+			suite, cipherKey, ivBuf.Bytes); done || err != nil {
+			containerHdr.isEncryptedWithCipherKey = done
 			return
 		}
 	}
 
-	if done, err = sess.tryDecrypt(decrypted, containerHdr, encrypted,
-		sess.auxCipherKey, containerHdr.PacketID[:]); done || err != nil {
-		return
-	}
-
-	err = newErrCannotDecrypt()
-	return
+	containerHdr.isEncryptedWithCipherKey = false
+	return sess.tryDecrypt(decrypted, containerHdr, encrypted,
+		xchacha20Poly1305CipherSuite{}, auxCipherKey, containerHdr.PacketID[:])
 }
 
-func (sess *Session) checkHeadersChecksum(cipherKey []byte, containerHdr *messagesContainerHeaders) error {
+func (sess *Session) checkHeadersChecksum(
+	suite streamCipherSuiteImplementation,
+	cipherKey []byte,
+	iv []byte,
+	containerHdr *messagesContainerHeaders,
+) error {
 	var calculatedChecksum [poly1305.TagSize]byte
-	containerHdr.CalculateHeadersChecksumTo(cipherKey, &calculatedChecksum)
+	containerHdr.CalculateHeadersChecksumTo(suite, cipherKey, iv, &calculatedChecksum)
 
 	if bytes.Compare(calculatedChecksum[:], containerHdr.ContainerHeadersChecksum[:]) != 0 {
 		return xerrors.Errorf(
@@ -1279,9 +1734,15 @@ func (sess *Session) checkHeadersChecksum(cipherKey []byte, containerHdr *messag
 	return nil
 }
 
-func (sess *Session) checkMessagesChecksum(cipherKey []byte, containerHdr *messagesContainerHeaders, messagesBytes []byte) error {
+func (sess *Session) checkMessagesChecksum(
+	suite streamCipherSuiteImplementation,
+	cipherKey []byte,
+	iv []byte,
+	containerHdr *messagesContainerHeaders,
+	messagesBytes []byte,
+) error {
 	var calculatedChecksum [poly1305.TagSize]byte
-	containerHdr.CalculateMessagesChecksumTo(cipherKey, &calculatedChecksum, messagesBytes)
+	containerHdr.CalculateMessagesChecksumTo(suite, cipherKey, iv, &calculatedChecksum, messagesBytes)
 
 	if bytes.Compare(calculatedChecksum[:], containerHdr.MessagesChecksum[:]) != 0 {
 		return xerrors.Errorf(
@@ -1358,13 +1819,51 @@ func (sess *Session) SetHandlerFuncs(
 }
 
 // WriteMessage synchronously sends a message of MessageType `msgType`.
+//
+// It returns ErrDeadlineExceeded if the deadline set by SetWriteDeadline
+// (or SetDeadline) is exceeded before the message is queued for sending
+// (then the message is not sent). If the deadline is exceeded after
+// that, then the message is reported as written (it will be sent
+// anyway, like data written to the buffer of a socket).
 func (sess *Session) WriteMessage(
 	msgType MessageType,
 	payload []byte,
 ) (int, error) {
+	deadlineExceeded := sess.writeDeadline.Exceeded()
+	select {
+	case <-deadlineExceeded:
+		return 0, newErrDeadlineExceeded()
+	default:
+	}
+
+	if !msgType.isInternal() {
+		if err := sess.checkPayloadSize(payload); err != nil {
+			return 0, err
+		}
+		cipherKeys, err := sess.acquireCipherKeysWait(deadlineExceeded)
+		if err != nil {
+			return 0, err
+		}
+		if cipherKeys == nil {
+			return 0, newErrAlreadyClosed()
+		}
+		cipherKeys.release()
+	}
+
 	sendInfo := sess.WriteMessageAsync(msgType, payload)
 
-	sendInfo.Wait()
+	select {
+	case <-sendInfo.Done():
+	case <-sendInfo.ctx.Done():
+	case <-deadlineExceeded:
+		select {
+		case <-sendInfo.Done():
+		default:
+			// The message is already queued. sendInfo is not
+			// released, because it is still in use.
+			return len(payload), nil
+		}
+	}
 	err := sendInfo.Err
 	sendInfo.Release()
 
@@ -1390,39 +1889,168 @@ func (sess *Session) WriteMessageSingle(
 	return sess.writeMessageSingle(hdr, payload)
 }
 
-// GetCipherKeys returns the currently active cipher keys.
-// Do not modify it, it's not a copy.
+// writeMessageSingleToPath is the same as WriteMessageSingle, but
+// the packet is sent via path `pathID` of Multipath `mp` (regardless
+// of MultipathOptions.Policy). It is used to send path probes.
+func (sess *Session) writeMessageSingleToPath(
+	mp *Multipath,
+	pathID PathID,
+	msgType MessageType,
+	payload []byte,
+) (int, error) {
+	hdr := sess.messageHeadersPool.AcquireMessageHeaders()
+	hdr.Set(msgType, payload)
+	defer hdr.Release()
+
+	hdr.SetIsConfidential(msgType != messageTypeKeyExchange)
+
+	return sess.writeMessageSingleVia(hdr, payload, func(packet []byte) (int, error) {
+		return mp.writeToPathID(pathID, packet)
+	})
+}
+
+// GetCipherKeys returns a copy of the currently active cipher keys.
+//
+// To derive keys for an external protocol use ExportKeyingMaterial instead.
 //
 // It returns nil if there was no successful key exchange, yet.
 func (sess *Session) GetCipherKeys() [][]byte {
-	return *(*[][]byte)(
+	cipherKeys := sess.acquireCipherKeys()
+	defer cipherKeys.release()
+	return cipherKeys.copy()
+}
+
+// sessionCipherSuite is the cipher suite selected for a session
+// (and its implementation).
+type sessionCipherSuite struct {
+	suite          CipherSuite
+	implementation cipherSuiteImplementation
+}
+
+func (sess *Session) loadCipherSuite() *sessionCipherSuite {
+	return (*sessionCipherSuite)(
 		atomic.LoadPointer(
 			(*unsafe.Pointer)((unsafe.Pointer)(
-				&sess.cipherKeys,
+				&sess.cipherSuite,
 			)),
 		),
 	)
 }
 
+// GetCipherSuite returns the cipher suite used to encrypt the traffic
+// (see KeyExchangerOptions.CipherSuites).
+//
+// It returns CipherSuiteUndefined if there was no successful key exchange, yet.
+func (sess *Session) GetCipherSuite() CipherSuite {
+	cipherSuite := sess.loadCipherSuite()
+	if cipherSuite == nil {
+		return CipherSuiteUndefined
+	}
+	return cipherSuite.suite
+}
+
+// GetProtocolVersion returns the protocol version agreed with the remote
+// side (see KeyExchangerOptions.MinProtocolVersion) and the set of
+// the features enabled on both sides.
+//
+// It returns ProtocolVersionLegacy and no features if there was no
+// successful key exchange, yet.
+func (sess *Session) GetProtocolVersion() (ProtocolVersion, ProtocolFeatures) {
+	if sess.keyExchanger == nil {
+		return ProtocolVersionLegacy, 0
+	}
+	version, features, _ := sess.keyExchanger.getProtocol()
+	return version, features
+}
+
+// getCipherSuiteImplementation returns the implementation of the cipher
+// suite to be used with the cipher keys (see GetCipherKeys).
+func (sess *Session) getCipherSuiteImplementation() cipherSuiteImplementation {
+	cipherSuite := sess.loadCipherSuite()
+	if cipherSuite == nil {
+		return xchacha20Poly1305CipherSuite{}
+	}
+	return cipherSuite.implementation
+}
+
+// setCipherSuite sets the cipher suite selected by the key exchanger. It
+// should be called before the cipher keys are set.
+func (sess *Session) setCipherSuite(suite CipherSuite) {
+	if cipherSuite := sess.loadCipherSuite(); cipherSuite != nil && cipherSuite.suite == suite {
+		return
+	}
+	sess.debugf("the cipher suite is %v", suite)
+	atomic.StorePointer(
+		(*unsafe.Pointer)((unsafe.Pointer)(&sess.cipherSuite)),
+		(unsafe.Pointer)(&sessionCipherSuite{
+			suite:          suite,
+			implementation: suite.newImplementation(),
+		}),
+	)
+}
+
 // GetCipherKeysWait waits until the first successful key exchange and
-// returns the latest cipher key.
-// Do not modify it, it's not a copy.
+// returns a copy of the latest cipher keys.
 func (sess *Session) GetCipherKeysWait() [][]byte {
-	cipherKeys := sess.GetCipherKeys()
-	if len(cipherKeys) == secretIDs && cipherKeys[secretIDRecentBoth] != nil {
-		return cipherKeys
+	cipherKeys, _ := sess.acquireCipherKeysWait(nil)
+	if cipherKeys == nil {
+		return nil
+	}
+	defer cipherKeys.release()
+	return cipherKeys.copy()
+}
+
+// acquireCipherKeysWait is the same as GetCipherKeysWait, but returns
+// the acquired keys (see acquireCipherKeys) instead of a copy, and also
+// returns ErrDeadlineExceeded if `deadlineExceeded` is closed before
+// the keys are received.
+//
+// It returns nil if the session is closed.
+func (sess *Session) acquireCipherKeysWait(deadlineExceeded <-chan struct{}) (*cipherKeys, error) {
+	cipherKeys := sess.acquireCipherKeys()
+	if len(cipherKeys.keys) == secretIDs && cipherKeys.keys[secretIDRecentBoth] != nil {
+		return cipherKeys, nil
+	}
+	cipherKeys.release()
+	if cipherKeys.isClosed {
+		return nil, nil
 	}
 
 	select {
 	case <-sess.waitForCipherKeyChan:
 	case <-sess.ctx.Done():
-		return nil
+		return nil, nil
+	case <-deadlineExceeded:
+		return nil, newErrDeadlineExceeded()
 	}
-	cipherKeys = sess.GetCipherKeys()
-	if cipherKeys == nil {
+	cipherKeys = sess.acquireCipherKeys()
+	if cipherKeys.isClosed {
+		cipherKeys.release()
+		return nil, nil
+	}
+	if cipherKeys.keys == nil {
 		panic(`should not happened`)
 	}
-	return cipherKeys
+	return cipherKeys, nil
+}
+
+// Rekey updates the cipher key right away (without waiting for
+// KeyExchangerOptions.KeyUpdateInterval) and waits until the remote side
+// confirms the new key.
+//
+// It returns ErrKeyExchangeTimeout if the new key was not confirmed
+// within KeyExchangerOptions.Timeout (then the session is closed,
+// as on any other key exchange timeout) or before the deadline of `ctx`
+// (then the session is left as is). If `ctx` is cancelled, then
+// the error wraps `ctx.Err()` (and the session is left as is as well).
+func (sess *Session) Rekey(ctx context.Context) error {
+	if sess.isDone() {
+		return newErrAlreadyClosed()
+	}
+	if sess.keyExchanger == nil {
+		return newErrKeyExchangeNotCompleted()
+	}
+	return sess.keyExchanger.keyUpdateSendWait(ctx, false)
 }
 
 // WriteMessageAsync asynchronously writes a message of MessageType `msgType`.
@@ -1437,11 +2065,10 @@ func (sess *Session) WriteMessageAsync(
 
 	// if msgType == messageType_keyExchange or SendDelay is zero then
 	//
-	maxPayloadSize := atomic.LoadUint32(&sess.establishedPayloadSize)
-	if uint32(len(payload)) > maxPayloadSize && !msgType.isInternal() {
-		if !sess.options.EnableFragmentation {
+	if uint32(len(payload)) > atomic.LoadUint32(&sess.establishedPayloadSize) && !msgType.isInternal() {
+		if err := sess.checkPayloadSize(payload); err != nil {
 			sendInfo = sess.sendInfoPool.AcquireSendInfo(sess.ctx)
-			sendInfo.Err = newErrPayloadTooBig(uint(maxPayloadSize), uint(len(payload)))
+			sendInfo.Err = err
 			close(sendInfo.c)
 			return
 		}
@@ -1466,6 +2093,17 @@ func (sess *Session) WriteMessageAsync(
 	return sess.writeMessageAsync(hdr, payload)
 }
 
+// checkPayloadSize returns ErrPayloadTooBig if the payload of a not
+// internal message does not fit into a packet and the fragmentation
+// is disabled.
+func (sess *Session) checkPayloadSize(payload []byte) error {
+	maxPayloadSize := atomic.LoadUint32(&sess.establishedPayloadSize)
+	if uint32(len(payload)) > maxPayloadSize && !sess.options.EnableFragmentation {
+		return newErrPayloadTooBig(uint(maxPayloadSize), uint(len(payload)))
+	}
+	return nil
+}
+
 func (sess *Session) writeMessageAsyncAsFragmented(
 	msgType MessageType,
 	payload []byte,
@@ -1546,6 +2184,16 @@ func (sess *Session) writeMessageFragment(
 func (sess *Session) writeMessageSingle(
 	hdr *messageHeaders,
 	payload []byte,
+) (n int, err error) {
+	return sess.writeMessageSingleVia(hdr, payload, sess.writeToBackend)
+}
+
+// writeMessageSingleVia is the same as writeMessageSingle, but the packet
+// is written by `write` instead of writing to the backend.
+func (sess *Session) writeMessageSingleVia(
+	hdr *messageHeaders,
+	payload []byte,
+	write func(packet []byte) (int, error),
 ) (n int, err error) {
 	defer func() {
 		if err == nil {
@@ -1568,6 +2216,7 @@ func (sess *Session) writeMessageSingle(
 		hdr.IsConfidential(),
 		hdr.Type.isInternal(),
 		buf.Bytes,
+		write,
 	)
 }
 
@@ -1598,6 +2247,11 @@ func (sess *Session) writeMessageAsync(
 			sendInfo.Err = newErrAlreadyClosed()
 			close(sendInfo.c)
 			return
+		case <-sess.writeDeadline.Exceeded():
+			sendInfo = sess.sendInfoPool.AcquireSendInfo(sess.ctx)
+			sendInfo.Err = newErrDeadlineExceeded()
+			close(sendInfo.c)
+			return
 		case <-sess.isEstablished:
 		}
 	}
@@ -1658,6 +2312,8 @@ func (sess *Session) waitForSend(sendInfo *SendInfo) {
 		return
 	}
 
+	// Real time is used here intentionally: it is a safety net, which
+	// should work even if SessionOptions.Clock is stopped.
 	ticker := time.NewTicker(DefaultSendDelay * 2)
 	defer ticker.Stop()
 	for {
@@ -1722,7 +2378,7 @@ func (sess *Session) appendToDelayedWriteBuffer(
 	sess.delayedSenderTimerLocker.LockDo(func() {
 		if !sess.delayedSenderTimer.Stop() {
 			select {
-			case _, _ = <-sess.delayedSenderTimer.C:
+			case _, _ = <-sess.delayedSenderTimer.C():
 			default:
 			}
 		}
@@ -1780,6 +2436,7 @@ func (sess *Session) sendDelayedNowSyncFromBuffer(buf *buffer) (int, error) {
 		true,
 		false,
 		messagesBytes,
+		sess.writeToBackend,
 	)
 	if err != nil {
 		return -1, wrapError(err)
@@ -1826,7 +2483,7 @@ func (sess *Session) delayedSenderLoop() {
 		case <-sess.ctx.Done():
 			sess.debugf("delayedSenderLoop(): <-sess.ctx.Done()")
 			return false
-		case <-sess.delayedSenderTimer.C:
+		case <-sess.delayedSenderTimer.C():
 			sess.debugf("delayedSenderLoop(): <-sess.delayedSenderTimer.c")
 		}
 
@@ -1835,7 +2492,7 @@ func (sess *Session) delayedSenderLoop() {
 			sess.delayedSenderTimerLocker.LockDo(func() {
 				if !sess.delayedSenderTimer.Stop() {
 					select {
-					case _, _ = <-sess.delayedSenderTimer.C:
+					case _, _ = <-sess.delayedSenderTimer.C():
 					default:
 					}
 				}
@@ -1854,29 +2511,60 @@ func (sess *Session) sendMessages(
 	isConfidential bool,
 	isInternalMessage bool,
 	messagesBytes []byte,
+	write func(packet []byte) (int, error),
 ) (int, error) {
 
 	// cipherKey
 
+	var cipherKeys *cipherKeys
 	var cipherKey []byte
+	var suite cipherSuiteImplementation
 	if isConfidential {
-		cipherKeys := sess.GetCipherKeysWait()
+		if err := sess.waitForKeyUpdateIfRequired(); err != nil {
+			return 0, err
+		}
+		cipherKeys, _ = sess.acquireCipherKeysWait(nil)
 		if cipherKeys == nil {
 			return 0, newErrCanceled()
 		}
-		cipherKey = cipherKeys[secretIDRecentBoth]
+		cipherKey = cipherKeys.keys[secretIDRecentBoth]
+		suite = sess.getCipherSuiteImplementation()
 	} else {
-		cipherKey = sess.auxCipherKey
+		cipherKeys = sess.acquireCipherKeys()
+		if cipherKeys.isClosed {
+			cipherKeys.release()
+			return 0, newErrAlreadyClosed()
+		}
+		cipherKey = cipherKeys.auxKey()
+		suite = xchacha20Poly1305CipherSuite{}
 	}
+	defer cipherKeys.release()
+	auxCipherKey := cipherKeys.auxKey()
 
 	// containerHdr
 
 	containerHdr := sess.messagesContainerHeadersPool.AcquireMessagesContainerHeaders(sess)
-	err := containerHdr.Set(cipherKey, messagesBytes)
+	defer containerHdr.Release()
+
+	// iv
+
+	ivBuf := sess.bufferPool.AcquireBuffer()
+	defer ivBuf.Release()
+
+	if isConfidential {
+		sessionIDBytes := sess.id.Bytes()
+		ivBuf.Grow(uint(len(sessionIDBytes) + len(containerHdr.PacketID)))
+		copy(ivBuf.Bytes, sessionIDBytes[:])
+		copy(ivBuf.Bytes[len(sessionIDBytes):], containerHdr.PacketID[:])
+	} else {
+		ivBuf.Grow(uint(len(containerHdr.PacketID)))
+		copy(ivBuf.Bytes, containerHdr.PacketID[:])
+	}
+
+	err := containerHdr.Set(suite, cipherKey, ivBuf.Bytes, messagesBytes)
 	if err != nil {
 		return -1, wrapError(err)
 	}
-	defer containerHdr.Release()
 
 	// plaintext buffer
 
@@ -1912,7 +2600,7 @@ func (sess *Session) sendMessages(
 
 	sess.ifDebug(func() {
 		sess.debugf("containerHdr == %+v; cipherKey == %v",
-			&containerHdr.messagesContainerHeadersData, cipherKey)
+			&containerHdr.messagesContainerHeadersData, secretForDebug(cipherKey))
 	})
 
 	// encrypt
@@ -1930,32 +2618,27 @@ func (sess *Session) sendMessages(
 
 		plainBytes := buf.Bytes[:size]
 
-		ivBuf := sess.bufferPool.AcquireBuffer()
-		defer ivBuf.Release()
-
-		if isConfidential {
-			sessionIDBytes := sess.id.Bytes()
-			ivBuf.Grow(uint(len(sessionIDBytes) + len(containerHdr.PacketID)))
-			copy(ivBuf.Bytes, sessionIDBytes[:])
-			copy(ivBuf.Bytes[len(sessionIDBytes):], containerHdr.PacketID[:])
-		} else {
-			ivBuf.Grow(uint(len(containerHdr.PacketID)))
-			copy(ivBuf.Bytes, containerHdr.PacketID[:])
-		}
-
 		encryptedBytes := encrypted.Bytes[:size]
-		encrypt(cipherKey, ivBuf.Bytes, encryptedBytes[len(containerHdr.PacketID):], plainBytes[len(containerHdr.PacketID):])
-		if sess.auxCipherKey == nil {
+		switch suite := suite.(type) {
+		case aeadCipherSuiteImplementation:
+			// The authentication tag takes the place of the headers
+			// checksum (see aeadCipherSuiteImplementation).
+			packetIDSize := len(containerHdr.PacketID)
+			suite.Seal(cipherKey, ivBuf.Bytes, encryptedBytes[packetIDSize:packetIDSize], plainBytes[packetIDSize+poly1305.TagSize:])
+		case streamCipherSuiteImplementation:
+			suite.XORKeyStream(cipherKey, ivBuf.Bytes, encryptedBytes[len(containerHdr.PacketID):], plainBytes[len(containerHdr.PacketID):])
+		}
+		if auxCipherKey == nil {
 			copy(encryptedBytes[:len(containerHdr.PacketID)], containerHdr.PacketID[:]) // copying the plain IV
 		} else {
-			encrypt(sess.auxCipherKey, emptyIV, encryptedBytes[:len(containerHdr.PacketID)], containerHdr.PacketID[:])
+			encrypt(auxCipherKey, emptyIV, encryptedBytes[:len(containerHdr.PacketID)], containerHdr.PacketID[:])
 		}
 		sess.ifDebug(func() {
 			if len(encryptedBytes) >= 200 {
 				return
 			}
 			sess.debugf("iv == %v; encrypted == %v; plain == %v, cipherKey == %+v",
-				containerHdr.PacketID[:], encryptedBytes[len(containerHdr.PacketID):], plainBytes[len(containerHdr.PacketID):], cipherKey)
+				containerHdr.PacketID[:], encryptedBytes[len(containerHdr.PacketID):], plainBytes[len(containerHdr.PacketID):], secretForDebug(cipherKey))
 		})
 		outBytes = encryptedBytes
 	}
@@ -1966,7 +2649,10 @@ func (sess *Session) sendMessages(
 		return 0, newErrAlreadyClosed()
 	}
 
-	n, err = sess.backend.Write(outBytes)
+	n, err = write(outBytes)
+	if isConfidential && err == nil {
+		sess.countSentWithCipherKey(uint64(len(outBytes)))
+	}
 	sess.ifDebug(func() {
 		outBytesPrint := interface{}("<too long>")
 		if len(outBytes) < 200 {
@@ -1986,6 +2672,54 @@ func (sess *Session) sendMessages(
 	return n, wrapError(err)
 }
 
+// writeToBackend writes a packet to the backend, prefixed by its length
+// if the stream framing is enabled (see SessionOptions.StreamFraming).
+//
+// If the write fails because the backend was replaced concurrently
+// (see ReplaceBackend) then the packet is written to the new backend.
+func (sess *Session) writeToBackend(packet []byte) (n int, err error) {
+	for {
+		var backend io.ReadWriteCloser
+		var generation uint64
+		var isStreamFraming bool
+		sess.backendLocker.RLockDo(func() {
+			backend = sess.backend
+			generation = sess.backendGeneration
+			isStreamFraming = sess.isStreamFraming
+		})
+		n, err = sess.writeToBackendFramed(backend, isStreamFraming, packet)
+		if err == nil || sess.getBackendGeneration() == generation {
+			return
+		}
+		sess.debugf("the backend was replaced during the write, retrying: %v", err)
+	}
+}
+
+func (sess *Session) writeToBackendFramed(
+	backend io.ReadWriteCloser,
+	isStreamFraming bool,
+	packet []byte,
+) (int, error) {
+	if !isStreamFraming {
+		return backend.Write(packet)
+	}
+
+	// The header and the packet are written by a single Write to do not
+	// interleave with the packets written concurrently.
+	frame := sess.bufferPool.AcquireBuffer()
+	defer frame.Release()
+	frame.Grow(frameHeaderSize + uint(len(packet)))
+	putFrameHeader(frame.Bytes, len(packet))
+	copy(frame.Bytes[frameHeaderSize:], packet)
+
+	n, err := backend.Write(frame.Bytes)
+	n -= frameHeaderSize
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
 func (sess *Session) ifInfo(fn func()) {
 	if !sess.options.EnableDebug {
 		return
@@ -2010,6 +2744,10 @@ func (sess *Session) error(err error) {
 
 // GetRemoteIdentity returns the remote identity.
 // It's not a copy, don't modify the content.
+//
+// If the session was created with a TrustStore then the returned
+// value is the identity (returned by the TrustStore) which matched
+// the remote side, or nil if the remote side is not verified yet.
 func (sess *Session) GetRemoteIdentity() (result *Identity) {
 	sess.rLockDo(func() {
 		result = sess.remoteIdentity
@@ -2039,6 +2777,9 @@ func (sess *Session) onConnect() {
 	if sess.options.SendDelay != nil {
 		sess.startDelayedSender()
 	}
+
+	go sess.sendResumptionTicket()
+	sess.pathProber.Start()
 }
 
 func (sess *Session) initNegotiator() {
@@ -2064,20 +2805,27 @@ func (sess *Session) onKeyExchangeSuccess() {
 		SessionStateClosed, SessionStateClosing,
 		SessionStateNew, SessionStateEstablished, SessionStateNegotiating)
 
-	err := sess.negotiator.Start()
+	var err error
+	if payloadSize, isResumed := sess.keyExchanger.getResumedPayloadSize(); isResumed {
+		sess.debugf("the session is resumed, skipping the negotiation")
+		err = sess.negotiator.Skip(payloadSize)
+	} else {
+		err = sess.negotiator.Start()
+	}
 	if err != nil {
 		sess.error(err)
 	}
 }
 
-func (sess *Session) onReceiveSecrets(secrets [][]byte) {
+func (sess *Session) onReceiveSecrets(cipherSuite CipherSuite, secrets [][]byte) {
+	sess.setCipherSuite(cipherSuite)
 	if !sess.setSecrets(secrets) {
 		// The same key as it was. Nothing to do.
-		sess.debugf("got keys: the same as they were: %v", secrets)
+		sess.debugf("got keys: the same as they were: %v", secretsForDebug(secrets))
 		return
 	}
 
-	sess.debugf("got keys: new keys: %v", secrets)
+	sess.debugf("got keys: new keys: %v", secretsForDebug(secrets))
 }
 
 func (sess *Session) startKeyExchange() {
@@ -2092,6 +2840,7 @@ func (sess *Session) startKeyExchange() {
 		sess.ctx,
 		sess.identity,
 		sess.remoteIdentity,
+		sess.trustStore,
 		sess.NewMessenger(messageTypeKeyExchange),
 		sess.onReceiveSecrets,
 		sess.onKeyExchangeSuccess,
@@ -2124,28 +2873,39 @@ func (sess *Session) setMessenger(msgType MessageType, messenger *Messenger) {
 
 func (sess *Session) setSecrets(newSecrets [][]byte) (result bool) {
 	sess.lockDo(func() {
+		oldCipherKeys := sess.loadCipherKeys()
+		if oldCipherKeys.isClosed {
+			// the session is already closed
+			zeroBytesSlices(newSecrets)
+			return
+		}
+		oldSecrets := sess.currentSecrets
+		newSecrets = sess.reuseSecrets(oldSecrets, newSecrets)
 		sess.currentSecrets = newSecrets
-		oldCipherKeys := sess.GetCipherKeys()
-		newCipherKeys := make([][]byte, 0, len(newSecrets))
+		defer sess.destroyRotatedOutSecrets(oldSecrets, newSecrets)
+		newCipherKeys := sess.newCipherKeys(newSecrets, sess.auxCipherKeys)
 		changedCount := 0
-		for idx, newSecret := range newSecrets {
-			var newCipherKey []byte
-			if newSecret != nil {
-				newCipherKey = newSecret[:chacha.KeySize]
-			}
-			newCipherKeys = append(newCipherKeys, newCipherKey)
-			if idx < len(oldCipherKeys) && bytes.Compare(newCipherKey, oldCipherKeys[idx]) == 0 {
+		for idx, newCipherKey := range newCipherKeys.keys {
+			if idx < len(oldCipherKeys.keys) && bytes.Compare(newCipherKey, oldCipherKeys.keys[idx]) == 0 {
 				continue
 			}
 			changedCount++
 		}
 		if changedCount == 0 {
+			newCipherKeys.destroy()
 			return
 		}
 
-		atomic.StorePointer((*unsafe.Pointer)((unsafe.Pointer)(&sess.cipherKeys)), (unsafe.Pointer)(&newCipherKeys))
+		sess.replaceCipherKeys(newCipherKeys)
+		sess.getCipherSuiteImplementation().resetCache()
 
-		if len(newCipherKeys) == secretIDs {
+		if len(newCipherKeys.keys) > int(secretIDRecentBoth) &&
+			(len(oldCipherKeys.keys) <= int(secretIDRecentBoth) ||
+				bytes.Compare(newCipherKeys.keys[secretIDRecentBoth], oldCipherKeys.keys[secretIDRecentBoth]) != 0) {
+			sess.resetSentWithCipherKey()
+		}
+
+		if len(newCipherKeys.keys) == secretIDs {
 			// check if sess.waitForCipherKeyChan is already closed
 			select {
 			case _, ok := <-sess.waitForCipherKeyChan:
@@ -2164,22 +2924,190 @@ func (sess *Session) setSecrets(newSecrets [][]byte) (result bool) {
 	return
 }
 
+// reuseSecrets replaces the secrets of `newSecrets` which are equal to
+// the secrets of `oldSecrets` with the old ones (and overwrites
+// the new copies). So the cipher keys which are already in use stay
+// valid, and only the secrets which are not used anymore are destroyed
+// by destroyRotatedOutSecrets.
+func (sess *Session) reuseSecrets(oldSecrets, newSecrets [][]byte) [][]byte {
+	opts := &sess.options.KeyExchangerOptions
+	for idx, newSecret := range newSecrets {
+		if newSecret == nil {
+			continue
+		}
+		isReused := false
+		for _, oldSecret := range oldSecrets {
+			if oldSecret != nil && bytes.Equal(oldSecret, newSecret) {
+				zeroBytes(newSecret)
+				newSecrets[idx] = oldSecret
+				isReused = true
+				break
+			}
+		}
+		if isReused {
+			continue
+		}
+		if err := protectKey(opts, newSecret); err != nil {
+			sess.lockMemoryError(err)
+		}
+	}
+	return newSecrets
+}
+
+// destroyRotatedOutSecrets overwrites the secrets of `oldSecrets` which
+// are not in `newSecrets`.
+//
+// The secret of secretIDRecentBoth is rotated out only after at least
+// two key exchanges, so it is not used for encryption anymore.
+func (sess *Session) destroyRotatedOutSecrets(oldSecrets, newSecrets [][]byte) {
+	opts := &sess.options.KeyExchangerOptions
+	for idx, oldSecret := range oldSecrets {
+		if oldSecret == nil ||
+			containsSlice(newSecrets, oldSecret) ||
+			containsSlice(oldSecrets[:idx], oldSecret) {
+			continue
+		}
+		destroyKey(opts, oldSecret)
+	}
+}
+
+// destroySecrets overwrites all the secrets and keys of the session.
+// It is called when the session is closed.
+func (sess *Session) destroySecrets() {
+	sess.lockDo(func() {
+		sess.replaceCipherKeys(&cipherKeys{
+			isClosed: true,
+			options:  &sess.options.KeyExchangerOptions,
+		})
+		sess.getCipherSuiteImplementation().resetCache()
+		sess.destroyRotatedOutSecrets(sess.currentSecrets, nil)
+		sess.currentSecrets = nil
+		zeroBytesSlices(sess.auxCipherKeys)
+		sess.auxCipherKeys = nil
+	})
+	if sess.keyExchanger != nil {
+		sess.keyExchanger.destroyKeys()
+	}
+}
+
+// lockMemoryError reports an error of locking the keys in memory (see
+// KeyExchangerOptions.LockKeysInMemory). Only the first error of
+// the session is reported to avoid flooding the EventHandler on each
+// key exchange.
+func (sess *Session) lockMemoryError(err error) {
+	if !atomic.CompareAndSwapUint32(&sess.isLockMemoryReported, 0, 1) {
+		return
+	}
+	sess.error(err)
+}
+
+// countSentWithCipherKey accounts a packet sent with the current cipher key
+// and starts a key update if a limit is exceeded (see
+// SessionOptions.KeyUpdateEveryNBytes and
+// SessionOptions.KeyUpdateEveryNPackets).
+func (sess *Session) countSentWithCipherKey(packetSize uint64) {
+	sentBytes := atomic.AddUint64(&sess.sentBytesWithCipherKey, packetSize)
+	sentPackets := atomic.AddUint64(&sess.sentPacketsWithCipherKey, 1)
+	if !sess.isKeyUpdateLimitExceeded(sentBytes, sentPackets, 1) {
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&sess.isKeyUpdateRequested, 0, 1) {
+		return
+	}
+	sess.debugf("the cipher key is used too much (%d bytes, %d packets), updating the key",
+		sentBytes, sentPackets)
+	if sess.keyExchanger != nil {
+		sess.keyExchanger.requestKeyUpdate()
+	}
+}
+
+func (sess *Session) isKeyUpdateLimitExceeded(sentBytes, sentPackets, multiplier uint64) bool {
+	if limit := sess.options.KeyUpdateEveryNBytes; limit != nil && *limit != 0 && sentBytes >= *limit*multiplier {
+		return true
+	}
+	if limit := sess.options.KeyUpdateEveryNPackets; limit != nil && *limit != 0 && sentPackets >= *limit*multiplier {
+		return true
+	}
+	return false
+}
+
+// resetSentWithCipherKey resets the counters of traffic sent with
+// the cipher key. It should be called with sess.locker locked when
+// the cipher key is changed.
+func (sess *Session) resetSentWithCipherKey() {
+	atomic.StoreUint64(&sess.sentBytesWithCipherKey, 0)
+	atomic.StoreUint64(&sess.sentPacketsWithCipherKey, 0)
+	atomic.StoreUint32(&sess.isKeyUpdateRequested, 0)
+	if sess.cipherKeyUpdatedChan != nil {
+		close(sess.cipherKeyUpdatedChan)
+	}
+	sess.cipherKeyUpdatedChan = make(chan struct{})
+}
+
+// waitForKeyUpdateIfRequired blocks while the hard limit of traffic sent
+// with the current cipher key is exceeded (see
+// SessionOptions.KeyUpdateEveryNBytes).
+func (sess *Session) waitForKeyUpdateIfRequired() error {
+	for {
+		var cipherKeyUpdatedChan chan struct{}
+		sess.rLockDo(func() {
+			cipherKeyUpdatedChan = sess.cipherKeyUpdatedChan
+		})
+		if !sess.isKeyUpdateLimitExceeded(
+			atomic.LoadUint64(&sess.sentBytesWithCipherKey),
+			atomic.LoadUint64(&sess.sentPacketsWithCipherKey),
+			keyUpdateHardLimitMultiplier,
+		) {
+			return nil
+		}
+		sess.debugf("the hard limit of the cipher key usage is exceeded, waiting for the key update")
+		select {
+		case <-sess.ctx.Done():
+			return newErrAlreadyClosed()
+		case <-cipherKeyUpdatedChan:
+		}
+	}
+}
+
 func (sess *Session) read(p []byte) (int, error) {
-	ch := sess.readChan[MessageTypeReadWrite]
-	item := <-ch
-	if item == nil {
-		return -1, newErrAlreadyClosed()
+	deadlineExceeded := sess.readDeadline.Exceeded()
+	select {
+	case sess.readSemaphore <- struct{}{}:
+	case <-deadlineExceeded:
+		return 0, newErrDeadlineExceeded()
 	}
-	if len(p) < len(item.Data) {
-		return -1, newErrPayloadTooBig(uint(len(p)), uint(len(item.Data)))
+	defer func() { <-sess.readSemaphore }()
+
+	if sess.readPendingItem == nil {
+		var item *readItem
+		select {
+		case item = <-sess.readChan[MessageTypeReadWrite]:
+		case <-deadlineExceeded:
+			return 0, newErrDeadlineExceeded()
+		}
+		if item == nil {
+			return 0, newErrAlreadyClosed()
+		}
+		sess.readPendingItem = item
+		sess.readPendingData = item.Data
+	}
+
+	n := copy(p, sess.readPendingData)
+	sess.readPendingData = sess.readPendingData[n:]
+	if len(sess.readPendingData) == 0 {
+		sess.readPendingItem.Release()
+		sess.readPendingItem = nil
+		sess.readPendingData = nil
 	}
-	copy(p, item.Data)
-	n := len(item.Data)
-	item.Release()
 	return n, nil
 }
 
-// Read implements io.Reader
+// Read implements io.Reader. Each call returns data of one message
+// (see Write). If `p` is shorter than the message, then the rest
+// of the message is returned by the next calls.
+//
+// It returns ErrAlreadyClosed (which matches net.ErrClosed, see errors.Is)
+// if the session is closed.
 func (sess *Session) Read(p []byte) (int, error) {
 	return sess.read(p)
 }
@@ -2193,10 +3121,67 @@ func (sess *Session) Write(p []byte) (int, error) {
 	return sess.write(p)
 }
 
-func (sess *Session) setBackendReadDeadline(deadline time.Time) (err error) {
+// SetDeadline implements net.Conn. It is the same as calling both
+// SetReadDeadline and SetWriteDeadline.
+func (sess *Session) SetDeadline(t time.Time) error {
+	sess.readDeadline.Set(t)
+	sess.writeDeadline.Set(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn. After the deadline `t` method
+// Read (including the one which is currently blocked) returns
+// ErrDeadlineExceeded. A zero value of `t` means Read will not time out.
+//
+// The deadline is measured using SessionOptions.Clock. It does not
+// affect the backend, the Session continues to receive messages.
+func (sess *Session) SetReadDeadline(t time.Time) error {
+	sess.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn. After the deadline `t` methods
+// Write and WriteMessage (including the ones which are currently blocked)
+// return ErrDeadlineExceeded, unless the message is already queued for
+// sending (see WriteMessage). A zero value of `t` means Write will
+// not time out.
+//
+// The deadline is measured using SessionOptions.Clock. A blocked write
+// to the backend itself is not interrupted.
+func (sess *Session) SetWriteDeadline(t time.Time) error {
+	sess.writeDeadline.Set(t)
+	return nil
+}
+
+// LocalAddr implements net.Conn. It returns the local address of
+// the backend, or nil if the backend has no method LocalAddr.
+func (sess *Session) LocalAddr() net.Addr {
+	backend, _ := sess.getBackend()
+	if addrGetter, ok := backend.(interface{ LocalAddr() net.Addr }); ok {
+		return addrGetter.LocalAddr()
+	}
+	return nil
+}
+
+// RemoteAddr implements net.Conn. It returns the remote address of
+// the backend, or nil if the backend has no method RemoteAddr.
+func (sess *Session) RemoteAddr() net.Addr {
+	backend, _ := sess.getBackend()
+	if addrGetter, ok := backend.(interface{ RemoteAddr() net.Addr }); ok {
+		return addrGetter.RemoteAddr()
+	}
+	return nil
+}
+
+func (sess *Session) setBackendReadDeadline(deadline time.Time) error {
+	backend, _ := sess.getBackend()
+	return setReadDeadline(backend, deadline)
+}
+
+func setReadDeadline(backend io.ReadWriteCloser, deadline time.Time) (err error) {
 	defer func() { err = wrapError(err) }()
 
-	if setReadDeadliner, ok := sess.backend.(interface{ SetReadDeadline(time.Time) error }); ok {
+	if setReadDeadliner, ok := backend.(interface{ SetReadDeadline(time.Time) error }); ok {
 		err = setReadDeadliner.SetReadDeadline(deadline)
 		if err != nil {
 			return
@@ -2204,7 +3189,7 @@ func (sess *Session) setBackendReadDeadline(deadline time.Time) (err error) {
 		return
 	}
 
-	if setDeadliner, ok := sess.backend.(interface{ SetDeadline(time.Time) error }); ok {
+	if setDeadliner, ok := backend.(interface{ SetDeadline(time.Time) error }); ok {
 		err = setDeadliner.SetDeadline(deadline)
 		if err != nil {
 			return
@@ -2212,7 +3197,7 @@ func (sess *Session) setBackendReadDeadline(deadline time.Time) (err error) {
 		return
 	}
 
-	return newErrCannotSetReadDeadline(sess.backend)
+	return newErrCannotSetReadDeadline(backend)
 }
 
 func (sess *Session) interruptRead() (err error) {
@@ -2233,7 +3218,7 @@ func (sess *Session) startClosing() {
 
 	go func() {
 		select {
-		case <-time.After(sess.keyExchanger.options.Timeout):
+		case <-sess.getClock().After(sess.keyExchanger.options.Timeout):
 			sess.cancelFunc()
 		case <-sess.ctx.Done():
 		}
@@ -2277,12 +3262,24 @@ func (sess *Session) WaitForClosure() {
 
 // GetEphemeralKeys just returns the last generated shared keys
 //
-// It's not a copy, don't modify.
+// It's not a copy, don't modify. The keys are overwritten with zeros
+// when they are rotated out and when the session is closed, so copy
+// them if they are needed for longer.
+//
+// To derive keys for an external protocol use ExportKeyingMaterial instead.
 func (sess *Session) GetEphemeralKeys() [][]byte {
 	return sess.currentSecrets
 }
 
+// setRemoteSessionID sets the SessionID of the remote side. If it is
+// changed, then the PacketIDs received from the previous remote session
+// are forgotten.
+//
+// It should be called from the readerLoop (see keyExchanger.Handle).
 func (sess *Session) setRemoteSessionID(remoteSessionID *SessionID) {
 	sess.debugf("setRemoteSessionID(%v)", remoteSessionID)
+	if sess.remoteSessionID != nil && sess.receivedPacketIDs != nil {
+		sess.receivedPacketIDs = newPacketIDStorage(uint(len(sess.receivedPacketIDs.table)) * 64)
+	}
 	sess.remoteSessionID = remoteSessionID
 }
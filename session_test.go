@@ -711,13 +711,14 @@ func TestSessionKeyRenew(t *testing.T) {
 		runtime.Gosched()
 	}
 
+	// The keys are overwritten on closing, so they are copied before it
+	keys0 := sess0.GetCipherKeys()
+	keys1 := sess1.GetCipherKeys()
+
 	sess0.CloseAndWait()
 	sess1.CloseAndWait()
 	runtime.Gosched()
 
-	keys0 := sess0.GetCipherKeys()
-	keys1 := sess1.GetCipherKeys()
-
 	for i := 0; i < len(keys0); i++ {
 		key0 := keys0[i]
 		assert.NotNil(t, key0)
@@ -820,3 +821,970 @@ func TestSession_Fragmentation(t *testing.T) {
 
 	waitForClosure(t, sess0, sess1)
 }
+
+type recordingConn struct {
+	*net.UnixConn
+	locker  sync.Mutex
+	written []byte
+}
+
+func (conn *recordingConn) Write(b []byte) (int, error) {
+	conn.locker.Lock()
+	conn.written = append(conn.written, b...)
+	conn.locker.Unlock()
+	return conn.UnixConn.Write(b)
+}
+
+func TestSession_identityHiding(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+	recConn0 := &recordingConn{UnixConn: conn0}
+	recConn1 := &recordingConn{UnixConn: conn1}
+
+	opts := &SessionOptions{
+		EnableDebug: true,
+		KeyExchangerOptions: KeyExchangerOptions{
+			KeyUpdateInterval:    100 * time.Millisecond,
+			EnableIdentityHiding: true,
+		},
+	}
+
+	trustStore, err := NewRemoteIdentitySetFromPublicKeys(identity1.Keys.Public)
+	require.NoError(t, err)
+	sess0 := identity0.NewSessionWithTrustStore(trustStore, recConn0, &testLogger{t}, opts)
+	printLogsOfSession(t, true, sess0)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, recConn1, &testLogger{t}, opts)
+	printLogsOfSession(t, true, sess1)
+	require.NoError(t, sess1.Start(ctx))
+
+	for i := 0; i < 3; i++ {
+		_, err = sess1.Write([]byte(`unit-test`))
+		require.NoError(t, err)
+		readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+		n, err := sess0.Read(readBuf)
+		require.NoError(t, err)
+		assert.Equal(t, `unit-test`, string(readBuf[:n]))
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, identity1.Keys.Public, sess0.GetRemoteIdentity().Keys.Public)
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+
+	for _, recConn := range []*recordingConn{recConn0, recConn1} {
+		assert.NotEmpty(t, recConn.written)
+		assert.False(t, bytes.Contains(recConn.written, identity0.Keys.Public))
+		assert.False(t, bytes.Contains(recConn.written, identity1.Keys.Public))
+	}
+}
+
+func TestSession_hybridKeyExchange(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	opts := &SessionOptions{
+		EnableDebug: true,
+		KeyExchangerOptions: KeyExchangerOptions{
+			KeyUpdateInterval:       100 * time.Millisecond,
+			EnableHybridKeyExchange: true,
+		},
+	}
+
+	sess0 := identity0.NewSession(identity1, conn0, &testLogger{t}, opts)
+	printLogsOfSession(t, true, sess0)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, opts)
+	printLogsOfSession(t, true, sess1)
+	require.NoError(t, sess1.Start(ctx))
+
+	for i := 0; i < 3; i++ {
+		_, err := sess1.Write([]byte(`unit-test`))
+		require.NoError(t, err)
+		readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+		n, err := sess0.Read(readBuf)
+		require.NoError(t, err)
+		assert.Equal(t, `unit-test`, string(readBuf[:n]))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_hybridKeyExchange_failClosed(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	unsupportedChan := make(chan struct{}, 1)
+	sess0 := identity0.NewSession(identity1, conn0, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		if err.(*xerrors.Error).Has(ErrHybridKeyExchangeUnsupported{}) {
+			select {
+			case unsupportedChan <- struct{}{}:
+			default:
+			}
+		}
+		return false
+	}), &SessionOptions{
+		KeyExchangerOptions: KeyExchangerOptions{
+			EnableHybridKeyExchange: true,
+		},
+	})
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		return false
+	}), nil)
+	require.NoError(t, sess1.Start(ctx))
+
+	<-unsupportedChan
+	assert.NotEqual(t, SessionStateEstablished, sess0.GetState())
+
+	_ = sess0.Close()
+	_ = sess1.Close()
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_cipherSuite(t *testing.T) {
+	for _, cipherSuite := range DefaultCipherSuites {
+		t.Run(cipherSuite.String(), func(t *testing.T) {
+			ctx := context.Background()
+
+			identity0, identity1, conn0, conn1 := testPair(t)
+
+			sess0 := identity0.NewSession(identity1, conn0, &testLogger{t}, &SessionOptions{
+				KeyExchangerOptions: KeyExchangerOptions{
+					KeyUpdateInterval: 100 * time.Millisecond,
+					CipherSuites:      []CipherSuite{cipherSuite},
+				},
+			})
+			require.NoError(t, sess0.Start(ctx))
+
+			sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, &SessionOptions{
+				KeyExchangerOptions: KeyExchangerOptions{
+					KeyUpdateInterval: 100 * time.Millisecond,
+				},
+			})
+			require.NoError(t, sess1.Start(ctx))
+
+			for i := 0; i < 3; i++ {
+				_, err := sess1.Write([]byte(`unit-test`))
+				require.NoError(t, err)
+				readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+				n, err := sess0.Read(readBuf)
+				require.NoError(t, err)
+				assert.Equal(t, `unit-test`, string(readBuf[:n]))
+				time.Sleep(100 * time.Millisecond)
+			}
+			assert.Equal(t, cipherSuite, sess0.GetCipherSuite())
+			assert.Equal(t, cipherSuite, sess1.GetCipherSuite())
+
+			assert.NoError(t, sess0.Close())
+			assert.NoError(t, sess1.Close())
+			waitForClosure(t, sess0, sess1)
+		})
+	}
+}
+
+func TestSession_cipherSuite_noCommon(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	noCommonChan := make(chan struct{}, 1)
+	sess0 := identity0.NewSession(identity1, conn0, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		if err.(*xerrors.Error).Has(ErrNoCommonCipherSuite{}) {
+			select {
+			case noCommonChan <- struct{}{}:
+			default:
+			}
+		}
+		return false
+	}), &SessionOptions{
+		KeyExchangerOptions: KeyExchangerOptions{
+			CipherSuites: []CipherSuite{CipherSuiteAES256GCM},
+		},
+	})
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		return false
+	}), &SessionOptions{
+		KeyExchangerOptions: KeyExchangerOptions{
+			CipherSuites: []CipherSuite{CipherSuiteChaCha20Poly1305},
+		},
+	})
+	require.NoError(t, sess1.Start(ctx))
+
+	<-noCommonChan
+	assert.Equal(t, CipherSuiteUndefined, sess0.GetCipherSuite())
+
+	_ = sess0.Close()
+	_ = sess1.Close()
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_protocolVersion(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	sess0 := identity0.NewSession(identity1, conn0, &testLogger{t}, nil)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, nil)
+	require.NoError(t, sess1.Start(ctx))
+
+	assert.Equal(t, SessionStateEstablished, sess0.WaitForState(ctx, SessionStateEstablished))
+	assert.Equal(t, SessionStateEstablished, sess1.WaitForState(ctx, SessionStateEstablished))
+
+	for _, sess := range []*Session{sess0, sess1} {
+		version, features := sess.GetProtocolVersion()
+		assert.Equal(t, ProtocolVersionCurrent, version)
+		assert.True(t, features.Has(ProtocolFeatureCipherSuites))
+		assert.False(t, features.Has(ProtocolFeatureHybridKeyExchange))
+	}
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_protocolVersion_mismatch(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	// The local side supports only ProtocolVersionCurrent, and the remote
+	// side requires a newer version, so the local side should detect
+	// the mismatch using the versions announced by the remote side.
+	mismatchChan := make(chan struct{}, 1)
+	sess0 := identity0.NewSession(identity1, conn0, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		if err.(*xerrors.Error).Has(ErrProtocolVersionMismatch{}) {
+			select {
+			case mismatchChan <- struct{}{}:
+			default:
+			}
+		}
+		return false
+	}), nil)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		return false
+	}), &SessionOptions{
+		KeyExchangerOptions: KeyExchangerOptions{
+			MinProtocolVersion: ProtocolVersionCurrent + 1,
+		},
+	})
+	require.NoError(t, sess1.Start(ctx))
+
+	select {
+	case <-mismatchChan:
+	case <-time.After(10 * time.Second):
+		t.Error("ErrProtocolVersionMismatch was not reported")
+	}
+	assert.NotEqual(t, SessionStateEstablished, sess0.GetState())
+
+	_ = sess0.Close()
+	_ = sess1.Close()
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_maximalTimeDifference(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	opts := &SessionOptions{
+		KeyExchangerOptions: KeyExchangerOptions{
+			KeyUpdateInterval:     100 * time.Millisecond,
+			MaximalTimeDifference: time.Second,
+		},
+	}
+
+	sess0 := identity0.NewSession(identity1, conn0, &testLogger{t}, opts)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, opts)
+	require.NoError(t, sess1.Start(ctx))
+
+	for i := 0; i < 3; i++ {
+		_, err := sess1.Write([]byte(`unit-test`))
+		require.NoError(t, err)
+		readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+		n, err := sess0.Read(readBuf)
+		require.NoError(t, err)
+		assert.Equal(t, `unit-test`, string(readBuf[:n]))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_keyUpdateEveryNPackets(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	opts := &SessionOptions{
+		SendDelay:              &[]time.Duration{0}[0],
+		KeyUpdateEveryNPackets: &[]uint64{5}[0],
+		KeyExchangerOptions: KeyExchangerOptions{
+			KeyUpdateInterval: time.Hour,
+		},
+	}
+
+	sess0 := identity0.NewSession(identity1, conn0, &testLogger{t}, opts)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, opts)
+	require.NoError(t, sess1.Start(ctx))
+
+	assert.Equal(t, SessionStateEstablished, sess1.WaitForState(ctx, SessionStateEstablished))
+	initialCipherKey := sess1.GetCipherKeys()[0]
+
+	for i := 0; i < 30; i++ {
+		_, err := sess1.Write([]byte(`unit-test`))
+		require.NoError(t, err)
+		readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+		n, err := sess0.Read(readBuf)
+		require.NoError(t, err)
+		assert.Equal(t, `unit-test`, string(readBuf[:n]))
+	}
+	assert.NotEqual(t, initialCipherKey, sess1.GetCipherKeys()[0])
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_Rekey(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	opts := &SessionOptions{
+		KeyExchangerOptions: KeyExchangerOptions{
+			KeyUpdateInterval: time.Hour,
+		},
+	}
+
+	sess0 := identity0.NewSession(identity1, conn0, &testLogger{t}, opts)
+	err := sess0.Rekey(ctx)
+	require.Error(t, err)
+	assert.True(t, err.(*xerrors.Error).Has(ErrKeyExchangeNotCompleted{}), err)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, opts)
+	require.NoError(t, sess1.Start(ctx))
+
+	assert.Equal(t, SessionStateEstablished, sess0.WaitForState(ctx, SessionStateEstablished))
+	assert.Equal(t, SessionStateEstablished, sess1.WaitForState(ctx, SessionStateEstablished))
+	initialCipherKey := sess1.GetCipherKeys()[0]
+
+	require.NoError(t, sess1.Rekey(ctx))
+	assert.NotEqual(t, initialCipherKey, sess1.GetCipherKeys()[0])
+
+	_, err = sess1.Write([]byte(`unit-test`))
+	require.NoError(t, err)
+	readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+	n, err := sess0.Read(readBuf)
+	require.NoError(t, err)
+	assert.Equal(t, `unit-test`, string(readBuf[:n]))
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+
+	err = sess1.Rekey(ctx)
+	require.Error(t, err)
+	assert.True(t, err.(*xerrors.Error).Has(ErrAlreadyClosed{}), err)
+}
+
+func TestSession_resumptionTicket(t *testing.T) {
+	ctx := context.Background()
+
+	issuer, err := NewResumptionTicketIssuer(nil, &ResumptionTicketIssuerOptions{
+		SingleUse: true,
+	})
+	require.NoError(t, err)
+
+	var invalidTicketCount uint32
+	connect := func(ticket *ResumptionTicket) (sess0, sess1 *Session) {
+		identity0, identity1, conn0, conn1 := testPair(t)
+
+		sess0 = identity0.NewSession(identity1, conn0, wrapErrorHandler(&testLogger{t}, func(sess *Session, err error) bool {
+			if err.(*xerrors.Error).Has(ErrInvalidResumptionTicket{}) {
+				atomic.AddUint32(&invalidTicketCount, 1)
+				return true
+			}
+			return false
+		}), &SessionOptions{
+			KeyExchangerOptions: KeyExchangerOptions{
+				ResumptionTicketIssuer: issuer,
+			},
+			PayloadSizeLimit: 2048,
+			NegotiatorOptions: NegotiatorOptions{
+				Enable: NegotiatorEnableTrue,
+			},
+		})
+		require.NoError(t, sess0.Start(ctx))
+
+		sess1 = identity1.NewSession(identity0, conn1, &testLogger{t}, &SessionOptions{
+			KeyExchangerOptions: KeyExchangerOptions{
+				ResumptionTicket: ticket,
+			},
+			PayloadSizeLimit: 2048,
+			NegotiatorOptions: NegotiatorOptions{
+				Enable: NegotiatorEnableTrue,
+			},
+		})
+		require.NoError(t, sess1.Start(ctx))
+
+		assert.Equal(t, SessionStateEstablished, sess0.WaitForState(ctx, SessionStateEstablished))
+		assert.Equal(t, SessionStateEstablished, sess1.WaitForState(ctx, SessionStateEstablished))
+
+		_, err := sess1.Write([]byte(`unit-test`))
+		require.NoError(t, err)
+		readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+		n, err := sess0.Read(readBuf)
+		require.NoError(t, err)
+		assert.Equal(t, `unit-test`, string(readBuf[:n]))
+		return
+	}
+	disconnect := func(sess0, sess1 *Session) {
+		assert.NoError(t, sess0.Close())
+		assert.NoError(t, sess1.Close())
+		waitForClosure(t, sess0, sess1)
+	}
+
+	sess0, sess1 := connect(nil)
+	assert.False(t, sess0.IsResumed())
+	assert.False(t, sess1.IsResumed())
+	assert.Nil(t, sess0.GetResumptionTicket())
+	assert.Eventually(t, func() bool {
+		return sess1.GetResumptionTicket() != nil
+	}, time.Second*10, time.Millisecond)
+	ticket := sess1.GetResumptionTicket()
+	payloadSize := sess1.GetEstablishedPayloadSize()
+	assert.Equal(t, payloadSize, ticket.PayloadSize)
+	assert.Equal(t, sess0.GetEstablishedPayloadSize(), ticket.PayloadSize)
+	disconnect(sess0, sess1)
+
+	sess0, sess1 = connect(ticket)
+	assert.True(t, sess0.IsResumed())
+	assert.True(t, sess1.IsResumed())
+	assert.Equal(t, payloadSize, sess0.GetEstablishedPayloadSize())
+	assert.Equal(t, payloadSize, sess1.GetEstablishedPayloadSize())
+	assert.Eventually(t, func() bool {
+		newTicket := sess1.GetResumptionTicket()
+		return newTicket != nil && !bytes.Equal(newTicket.Ticket, ticket.Ticket)
+	}, time.Second*10, time.Millisecond)
+	disconnect(sess0, sess1)
+
+	// The ticket is single-use
+	sess0, sess1 = connect(ticket)
+	assert.False(t, sess0.IsResumed())
+	assert.False(t, sess1.IsResumed())
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&invalidTicketCount))
+	disconnect(sess0, sess1)
+}
+
+type testPSKEventHandler struct {
+	*testLogger
+	deprecatedPSKIDs chan string
+}
+
+func (h *testPSKEventHandler) OnDeprecatedPSK(sess *Session, pskID string) {
+	h.deprecatedPSKIDs <- pskID
+}
+
+func TestSession_PSKRotation(t *testing.T) {
+	ctx := context.Background()
+
+	oldPSK := PSK{ID: `old`, Key: []byte(`old-psk`)}
+	newPSK := PSK{ID: `new`, Key: []byte(`new-psk`)}
+	deprecatedOldPSK := PSK{ID: oldPSK.ID, Key: oldPSK.Key, Deprecated: true}
+	unnamedPSK := PSK{Key: []byte(`unnamed-psk`)}
+	deprecatedUnnamedPSK := PSK{Key: unnamedPSK.Key, Deprecated: true}
+
+	type testCase struct {
+		PSKs             [2][]PSK
+		DeprecatedPSKIDs [2][]string
+	}
+	for name, testCase := range map[string]testCase{
+		`samePSK`: {
+			PSKs: [2][]PSK{{newPSK}, {newPSK, oldPSK}},
+		},
+		`rotation`: {
+			PSKs:             [2][]PSK{{newPSK, deprecatedOldPSK}, {oldPSK, newPSK}},
+			DeprecatedPSKIDs: [2][]string{{oldPSK.ID}, nil},
+		},
+		`unnamedPSK`: {
+			PSKs:             [2][]PSK{{unnamedPSK, newPSK}, {newPSK, deprecatedUnnamedPSK}},
+			DeprecatedPSKIDs: [2][]string{nil, {``}},
+		},
+	} {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			identity0, identity1, conn0, conn1 := testPair(t)
+
+			var eventHandlers [2]*testPSKEventHandler
+			var sessions [2]*Session
+			for idx, identities := range [][2]*Identity{{identity0, identity1}, {identity1, identity0}} {
+				eventHandlers[idx] = &testPSKEventHandler{
+					testLogger:       &testLogger{t},
+					deprecatedPSKIDs: make(chan string, 1),
+				}
+				opts := &SessionOptions{}
+				opts.KeyExchangerOptions.PSKs = testCase.PSKs[idx]
+				conn := conn0
+				if idx == 1 {
+					conn = conn1
+				}
+				sessions[idx] = identities[0].NewSession(identities[1], conn, eventHandlers[idx], opts)
+				require.NoError(t, sessions[idx].Start(ctx))
+			}
+
+			for _, sess := range sessions {
+				_, err := sess.Write([]byte(`unit-test`))
+				require.NoError(t, err)
+			}
+			for _, sess := range sessions {
+				readBuf := make([]byte, sess.GetPayloadSizeLimit())
+				n, err := sess.Read(readBuf)
+				require.NoError(t, err)
+				assert.Equal(t, `unit-test`, string(readBuf[:n]))
+			}
+			assert.Equal(t, sessions[0].GetCipherKeys(), sessions[1].GetCipherKeys())
+
+			for idx, eventHandler := range eventHandlers {
+				for _, expectedPSKID := range testCase.DeprecatedPSKIDs[idx] {
+					select {
+					case pskID := <-eventHandler.deprecatedPSKIDs:
+						assert.Equal(t, expectedPSKID, pskID)
+					case <-time.After(time.Second):
+						t.Errorf("OnDeprecatedPSK was not called on side %d", idx)
+					}
+				}
+				assert.Len(t, eventHandler.deprecatedPSKIDs, 0)
+			}
+
+			assert.NoError(t, sessions[0].Close())
+			assert.NoError(t, sessions[1].Close())
+			waitForClosure(t, sessions[0], sessions[1])
+		})
+	}
+}
+
+func TestSession_PSKOnly(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, conn0, conn1 := testPair(t)
+
+	err := NewPSKSession(conn0, &testLogger{t}, nil).Start(ctx)
+	assert.True(t, err.(*xerrors.Error).Has(ErrPSKRequired{}), err)
+
+	opts0 := &SessionOptions{}
+	opts0.KeyExchangerOptions.PSKs = []PSK{{ID: `new`, Key: []byte(`new-psk`)}, {ID: `old`, Key: []byte(`old-psk`)}}
+	opts1 := &SessionOptions{}
+	opts1.KeyExchangerOptions.PSKs = []PSK{{ID: `old`, Key: []byte(`old-psk`)}, {ID: `new`, Key: []byte(`new-psk`)}}
+
+	sess0 := NewPSKSession(conn0, &testLogger{t}, opts0)
+	require.NoError(t, sess0.Start(ctx))
+	sess1 := NewPSKSession(conn1, &testLogger{t}, opts1)
+	require.NoError(t, sess1.Start(ctx))
+
+	_, err = sess0.Write([]byte(`unit-test`))
+	require.NoError(t, err)
+	readBuf := make([]byte, sess1.GetPayloadSizeLimit())
+	n, err := sess1.Read(readBuf)
+	require.NoError(t, err)
+	assert.Equal(t, `unit-test`, string(readBuf[:n]))
+
+	assert.Nil(t, sess0.GetRemoteIdentity())
+	assert.Nil(t, sess1.GetRemoteIdentity())
+	authString0, err := sess0.AuthenticationString()
+	require.NoError(t, err)
+	authString1, err := sess1.AuthenticationString()
+	require.NoError(t, err)
+	assert.Equal(t, authString0, authString1)
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_PSKOnly_withIdentity(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, _, conn0, conn1 := testPair(t)
+
+	opts := &SessionOptions{
+		KeyExchangerOptions: KeyExchangerOptions{
+			PSK:     []byte(`unit-test`),
+			Timeout: 100 * time.Millisecond,
+		},
+	}
+
+	timeoutChan := make(chan struct{}, 1)
+	sess0 := NewPSKSession(conn0, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		if err.(*xerrors.Error).Has(ErrKeyExchangeTimeout{}) {
+			select {
+			case timeoutChan <- struct{}{}:
+			default:
+			}
+		}
+		return false
+	}), opts)
+	require.NoError(t, sess0.Start(ctx))
+
+	// A signed key exchange message is not accepted by a PSK-only session
+	// (even if the PSK is the same).
+	sess1 := identity0.NewSession(nil, conn1, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		return false
+	}), opts)
+	require.NoError(t, sess1.Start(ctx))
+
+	<-timeoutChan
+	assert.Nil(t, sess0.GetCipherKeys())
+
+	_ = sess0.Close()
+	_ = sess1.Close()
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_PSKOnly_reflection(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, conn0, conn1 := testPair(t)
+
+	opts := &SessionOptions{
+		KeyExchangerOptions: KeyExchangerOptions{
+			PSK:     []byte(`unit-test`),
+			Timeout: 500 * time.Millisecond,
+		},
+	}
+
+	reflectedChan := make(chan struct{}, 1)
+	timeoutChan := make(chan struct{}, 1)
+	sess0 := NewPSKSession(conn0, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		xerr := err.(*xerrors.Error)
+		for errType, ch := range map[error]chan struct{}{
+			ErrReflectedMessage{}:   reflectedChan,
+			ErrKeyExchangeTimeout{}: timeoutChan,
+		} {
+			if xerr.Has(errType) {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+		return false
+	}), opts)
+	require.NoError(t, sess0.Start(ctx))
+
+	// Send everything sent by sess0 back to sess0
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn1.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn1.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, ch := range []chan struct{}{reflectedChan, timeoutChan} {
+		select {
+		case <-ch:
+		case <-time.After(10 * time.Second):
+			t.Error("the reflected messages were not dropped")
+		}
+	}
+	assert.Nil(t, sess0.GetCipherKeys())
+
+	_ = sess0.Close()
+	_ = conn1.Close()
+	waitForClosure(t, sess0)
+}
+
+func TestSession_keysDestruction(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	opts := &SessionOptions{
+		KeyExchangerOptions: KeyExchangerOptions{
+			KeyUpdateInterval: time.Hour,
+			LockKeysInMemory:  true,
+		},
+	}
+
+	// Locking the memory depends on the OS and the limits of the environment
+	errorHandler := wrapErrorHandler(&testLogger{t}, func(sess *Session, err error) bool {
+		if err.(*xerrors.Error).Has(ErrCannotLockMemory{}) {
+			return false
+		}
+		t.Error(err)
+		return false
+	})
+
+	sess0 := identity0.NewSession(identity1, conn0, errorHandler, opts)
+	require.NoError(t, sess0.Start(ctx))
+	sess1 := identity1.NewSession(identity0, conn1, errorHandler, opts)
+	require.NoError(t, sess1.Start(ctx))
+
+	assert.Equal(t, SessionStateEstablished, sess0.WaitForState(ctx, SessionStateEstablished))
+	assert.Equal(t, SessionStateEstablished, sess1.WaitForState(ctx, SessionStateEstablished))
+
+	isZero := func(b []byte) bool {
+		return bytes.Equal(b, make([]byte, len(b)))
+	}
+
+	initialSecrets := append([][]byte{}, sess1.GetEphemeralKeys()...)
+	initialSecretsCopy := make([][]byte, 0, len(initialSecrets))
+	for _, secret := range initialSecrets {
+		initialSecretsCopy = append(initialSecretsCopy, append([]byte(nil), secret...))
+	}
+
+	require.NoError(t, sess1.Rekey(ctx))
+	require.NoError(t, sess1.Rekey(ctx))
+
+	// The secrets which are not used anymore should be overwritten
+	currentSecrets := sess1.GetEphemeralKeys()
+	destroyedCount := 0
+	for idx, secret := range initialSecrets {
+		if secret == nil {
+			continue
+		}
+		isInUse := false
+		for _, currentSecret := range currentSecrets {
+			if bytes.Equal(initialSecretsCopy[idx], currentSecret) {
+				isInUse = true
+			}
+		}
+		if isInUse {
+			assert.False(t, isZero(secret))
+			continue
+		}
+		assert.True(t, isZero(secret), idx)
+		destroyedCount++
+	}
+	assert.NotZero(t, destroyedCount)
+
+	_, err := sess1.Write([]byte(`unit-test`))
+	require.NoError(t, err)
+	readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+	n, err := sess0.Read(readBuf)
+	require.NoError(t, err)
+	assert.Equal(t, `unit-test`, string(readBuf[:n]))
+
+	// All the secrets should be overwritten on closing
+	secrets0 := sess0.GetEphemeralKeys()
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+
+	for _, secret := range secrets0 {
+		assert.True(t, isZero(secret))
+	}
+	assert.Nil(t, sess1.GetCipherKeys())
+}
+
+func TestSession_deadlines(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	sess0 := identity0.NewSession(identity1, conn0, &testLogger{t}, nil)
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, nil)
+	var _ net.Conn = sess0
+	assert.Equal(t, conn0.LocalAddr(), sess0.LocalAddr())
+	assert.Equal(t, conn0.RemoteAddr(), sess0.RemoteAddr())
+
+	// The remote side is not started, so the write blocks until
+	// the deadline.
+	require.NoError(t, sess0.Start(ctx))
+	require.NoError(t, sess0.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err := sess0.Write([]byte(`unit-test`))
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr), err)
+	assert.True(t, netErr.Timeout())
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	require.NoError(t, sess1.Start(ctx))
+	require.NoError(t, sess0.SetWriteDeadline(time.Time{}))
+	_, err = sess0.Write([]byte(`unit-test`))
+	require.NoError(t, err)
+
+	readBuf := make([]byte, sess1.GetPayloadSizeLimit())
+	n, err := sess1.Read(readBuf)
+	require.NoError(t, err)
+	assert.Equal(t, `unit-test`, string(readBuf[:n]))
+
+	require.NoError(t, sess1.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = sess1.Read(readBuf)
+	netErr, _ = err.(net.Error)
+	require.NotNil(t, netErr, err)
+	assert.True(t, netErr.Timeout())
+
+	// A deadline set in the past interrupts the blocked Read.
+	require.NoError(t, sess1.SetDeadline(time.Time{}))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = sess1.SetReadDeadline(time.Now())
+	}()
+	_, err = sess1.Read(readBuf)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+
+	// The messages are not lost due to the timeouts.
+	require.NoError(t, sess1.SetReadDeadline(time.Time{}))
+	_, err = sess0.Write([]byte(`unit-test`))
+	require.NoError(t, err)
+	n, err = sess1.Read(readBuf)
+	require.NoError(t, err)
+	assert.Equal(t, `unit-test`, string(readBuf[:n]))
+
+	// The rest of a message which does not fit into the buffer is
+	// returned by the next calls.
+	_, err = sess0.Write([]byte(`unit-test`))
+	require.NoError(t, err)
+	n, err = sess1.Read(readBuf[:4])
+	require.NoError(t, err)
+	assert.Equal(t, `unit`, string(readBuf[:n]))
+	n, err = sess1.Read(readBuf)
+	require.NoError(t, err)
+	assert.Equal(t, `-test`, string(readBuf[:n]))
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+
+	n, err = sess1.Read(readBuf)
+	assert.Zero(t, n)
+	assert.True(t, errors.As(err, &ErrAlreadyClosed{}), err)
+	assert.True(t, errors.Is(err, net.ErrClosed), err)
+}
+
+func TestSession_streamFraming(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, _, _ := testPair(t)
+
+	listener, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	conn0, err := net.Dial(`tcp`, listener.Addr().String())
+	require.NoError(t, err)
+	conn1, err := listener.Accept()
+	require.NoError(t, err)
+	require.True(t, IsStreamWriter(conn0))
+
+	sess0 := identity0.NewSession(identity1, conn0, &testLogger{t}, nil)
+	require.NoError(t, sess0.Start(ctx))
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, nil)
+	require.NoError(t, sess1.Start(ctx))
+
+	// Many messages are written at once, so TCP merges and splits
+	// the packets.
+	messages := make([][]byte, 100)
+	for idx := range messages {
+		messages[idx] = make([]byte, 1+rand.Intn(int(sess0.GetPayloadSizeLimit())))
+		rand.Read(messages[idx])
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, msg := range messages {
+			_, err := sess0.Write(msg)
+			assert.NoError(t, err)
+		}
+	}()
+
+	readBuf := make([]byte, sess1.GetPayloadSizeLimit())
+	for _, msg := range messages {
+		n, err := sess1.Read(readBuf)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(msg, readBuf[:n]))
+	}
+	wg.Wait()
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_ReplaceBackend(t *testing.T) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+	opts := &SessionOptions{
+		// The pings of the negotiation should fit into the socket
+		// buffers, because both sides negotiate concurrently.
+		PayloadSizeLimit: 1400,
+		NegotiatorOptions: NegotiatorOptions{
+			Enable:                      NegotiatorEnableTrue,
+			RenegotiateOnReplaceBackend: true,
+		},
+	}
+
+	sess0 := identity0.NewSession(identity1, conn0, &testLogger{t}, opts)
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, opts)
+	assert.Error(t, sess0.ReplaceBackend(conn0), "the session is not established yet")
+	require.NoError(t, sess0.Start(ctx))
+	require.NoError(t, sess1.Start(ctx))
+	require.Equal(t, SessionStateEstablished, sess0.WaitForState(ctx, SessionStateEstablished))
+	require.Equal(t, SessionStateEstablished, sess1.WaitForState(ctx, SessionStateEstablished))
+
+	readBuf := make([]byte, sess1.GetPayloadSizeLimit())
+	pingPong := func() {
+		_, err := sess0.Write([]byte(`ping`))
+		require.NoError(t, err)
+		n, err := sess1.Read(readBuf)
+		require.NoError(t, err)
+		assert.Equal(t, `ping`, string(readBuf[:n]))
+
+		_, err = sess1.Write([]byte(`pong`))
+		require.NoError(t, err)
+		n, err = sess0.Read(readBuf)
+		require.NoError(t, err)
+		assert.Equal(t, `pong`, string(readBuf[:n]))
+	}
+	pingPong()
+
+	_, _, newConn0, newConn1 := testPair(t)
+	require.NoError(t, sess0.ReplaceBackend(newConn0))
+	require.NoError(t, sess1.ReplaceBackend(newConn1))
+	assert.Equal(t, newConn0.LocalAddr(), sess0.LocalAddr())
+
+	// The old backends are closed.
+	_, err := conn0.Write([]byte(`unit-test`))
+	assert.Error(t, err)
+
+	// The keys are preserved, so no key exchange is required.
+	pingPong()
+	assert.Equal(t, SessionStateEstablished, sess0.GetState())
+	assert.Equal(t, SessionStateEstablished, sess1.GetState())
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
@@ -40,7 +40,9 @@ func TestHandlerByFuncs_Handle(t *testing.T) {
 
 func TestSession_checkMessagesChecksum_negative(t *testing.T) {
 	assert.True(t, (&Session{}).checkMessagesChecksum(
+		xchacha20Poly1305CipherSuite{},
 		nil,
+		make([]byte, ivSize),
 		&messagesContainerHeaders{},
 		nil,
 	).(*xerrors.Error).Has(ErrInvalidChecksum{}))
@@ -50,9 +52,35 @@ func TestSessionIDGetterType_Get(t *testing.T) {
 	id0 := globalSessionIDGetter.Get()
 	id1 := globalSessionIDGetter.Get()
 	timeNowNSec := int64(987654321)
+	defer func(origTimeNow func() time.Time) { timeNow = origTimeNow }(timeNow)
 	timeNow = func() time.Time {
 		return time.Unix(123456789, atomic.AddInt64(&timeNowNSec, 1))
 	}
 	assert.NotEqual(t, SessionID{}, id0)
 	assert.NotEqual(t, id0, id1)
 }
+
+func TestSession_acquireCipherKeys(t *testing.T) {
+	sess := &Session{}
+	sess.cipherKeys = sess.newCipherKeys(nil, nil)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	sess.replaceCipherKeys(sess.newCipherKeys([][]byte{secret}, nil))
+	keys := sess.acquireCipherKeys()
+	assert.Equal(t, [][]byte{secret}, keys.copy())
+
+	// The keys are copies, so the secrets could be overwritten right away
+	zeroBytes(secret)
+	assert.NotEqual(t, secret, keys.keys[0])
+
+	// The retired keys are not overwritten while they are in use
+	sess.replaceCipherKeys(&cipherKeys{isClosed: true, options: keys.options})
+	closedKeys := sess.acquireCipherKeys()
+	assert.True(t, closedKeys.isClosed)
+	closedKeys.release()
+	assert.NotEqual(t, secret, keys.keys[0])
+
+	keys.release()
+	assert.Equal(t, secret, keys.keys[0])
+}
@@ -0,0 +1,148 @@
+package secureio
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+const (
+	sshAgentSocketEnvVar = `SSH_AUTH_SOCK`
+)
+
+// SSHAgentSigner is a crypto.Signer which signs through an ssh-agent
+// (using the agent protocol), so the private key is never loaded
+// into the process memory.
+//
+// See `Identity.Signer` and `NewIdentityFromSSHAgent`.
+type SSHAgentSigner struct {
+	agent     agent.Agent
+	sshPubKey ssh.PublicKey
+	pubKey    ed25519.PublicKey
+	closer    io.Closer
+}
+
+var _ crypto.Signer = (*SSHAgentSigner)(nil)
+
+// NewSSHAgentSigner is a constructor for `SSHAgentSigner` based on
+// an agent client.
+//
+// If `pubKey` is nil then the first ED25519 key of the agent is used.
+func NewSSHAgentSigner(agentClient agent.Agent, pubKey ed25519.PublicKey) (*SSHAgentSigner, error) {
+	keys, err := agentClient.List()
+	if err != nil {
+		return nil, xerrors.Errorf("unable to list keys of the ssh-agent: %w", err)
+	}
+
+	for _, key := range keys {
+		if key.Type() != ssh.KeyAlgoED25519 {
+			continue
+		}
+		// *agent.Key does not provide the crypto public key, so re-parsing it
+		sshPubKey, err := ssh.ParsePublicKey(key.Marshal())
+		if err != nil {
+			continue
+		}
+		keyPubKey, err := sshPublicKeyToED25519(sshPubKey)
+		if err != nil {
+			continue
+		}
+		if pubKey != nil && !bytes.Equal(keyPubKey, pubKey) {
+			continue
+		}
+		return &SSHAgentSigner{
+			agent:     agentClient,
+			sshPubKey: key,
+			pubKey:    keyPubKey,
+		}, nil
+	}
+
+	if pubKey == nil {
+		return nil, newErrUnsupportedKeyFormat(`no ED25519 keys in the ssh-agent`)
+	}
+	return nil, newErrUnsupportedKeyFormat(fmt.Sprintf(`no key %X in the ssh-agent`, []byte(pubKey)))
+}
+
+// DialSSHAgentSigner connects to the ssh-agent listening on the unix socket
+// `socketPath` and returns a signer using key `pubKey` (see
+// `NewSSHAgentSigner`).
+//
+// If `socketPath` is empty then environment variable SSH_AUTH_SOCK is used.
+//
+// The connection is closed by `(*SSHAgentSigner).Close`.
+func DialSSHAgentSigner(socketPath string, pubKey ed25519.PublicKey) (*SSHAgentSigner, error) {
+	if socketPath == `` {
+		socketPath = os.Getenv(sshAgentSocketEnvVar)
+	}
+	conn, err := net.Dial(`unix`, socketPath)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to connect to the ssh-agent at '%s': %w", socketPath, err)
+	}
+
+	signer, err := NewSSHAgentSigner(agent.NewClient(conn), pubKey)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	signer.closer = conn
+	return signer, nil
+}
+
+// NewIdentityFromSSHAgent is a constructor for `Identity` which signs
+// through the ssh-agent (see `DialSSHAgentSigner`).
+//
+// The connection to the agent could be closed using
+// `identity.Signer.(*SSHAgentSigner).Close()`.
+func NewIdentityFromSSHAgent(socketPath string, pubKey ed25519.PublicKey) (*Identity, error) {
+	signer, err := DialSSHAgentSigner(socketPath, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := NewIdentityFromSigner(signer)
+	if err != nil {
+		_ = signer.Close()
+		return nil, err
+	}
+	return identity, nil
+}
+
+// Public implements crypto.Signer.
+func (signer *SSHAgentSigner) Public() crypto.PublicKey {
+	return signer.pubKey
+}
+
+// Sign implements crypto.Signer. `digest` is the message itself,
+// since ED25519 does not support pre-hashed messages (so `opts`
+// should be crypto.Hash(0)).
+func (signer *SSHAgentSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, xerrors.Errorf("ED25519 cannot sign hashed messages (hash function: %v): %w",
+			opts.HashFunc(), newErrUnsupportedKeyFormat(`ED25519 with pre-hashing`))
+	}
+	signature, err := signer.agent.Sign(signer.sshPubKey, digest)
+	if err != nil {
+		return nil, xerrors.Errorf("the ssh-agent returned an error: %w", err)
+	}
+	if signature.Format != ssh.KeyAlgoED25519 {
+		return nil, newErrUnsupportedKeyFormat(fmt.Sprintf(`signature of format "%s"`, signature.Format))
+	}
+	return signature.Blob, nil
+}
+
+// Close closes the connection to the ssh-agent if it was opened
+// by DialSSHAgentSigner.
+func (signer *SSHAgentSigner) Close() error {
+	if signer.closer == nil {
+		return nil
+	}
+	return signer.closer.Close()
+}
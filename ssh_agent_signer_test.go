@@ -0,0 +1,88 @@
+package secureio_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+
+	. "github.com/xaionaro-go/secureio"
+)
+
+func testSSHAgent(t *testing.T, keys ...ed25519.PrivateKey) (socketPath string, closeFunc func()) {
+	dirPath, err := ioutil.TempDir(os.TempDir(), `secureio-test`)
+	require.NoError(t, err)
+
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+	}
+
+	socketPath = path.Join(dirPath, `agent.sock`)
+	listener, err := net.Listen(`unix`, socketPath)
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return socketPath, func() {
+		_ = listener.Close()
+		_ = os.RemoveAll(dirPath)
+	}
+}
+
+func TestNewIdentityFromSSHAgent(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	socketPath, closeAgent := testSSHAgent(t, identity1.Keys.Private)
+	defer closeAgent()
+
+	_, err := NewIdentityFromSSHAgent(socketPath, identity0.Keys.Public)
+	assert.Error(t, err)
+
+	agentIdentity, err := NewIdentityFromSSHAgent(socketPath, nil)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, agentIdentity.Signer.(*SSHAgentSigner).Close()) }()
+	assert.Nil(t, agentIdentity.Keys.Private)
+	assert.Equal(t, identity1.Keys.Public, agentIdentity.Keys.Public)
+
+	signature := make([]byte, ed25519.SignatureSize)
+	require.NoError(t, agentIdentity.Sign(signature, []byte(`unit-test`)))
+	assert.NoError(t, identity1.VerifySignature(signature, []byte(`unit-test`)))
+
+	sess0 := identity0.NewSession(identity1, conn0, &testLogger{t}, nil)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := agentIdentity.NewSession(identity0, conn1, &testLogger{t}, nil)
+	require.NoError(t, sess1.Start(ctx))
+
+	_, err = sess1.Write([]byte(`unit-test`))
+	require.NoError(t, err)
+	readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+	n, err := sess0.Read(readBuf)
+	require.NoError(t, err)
+	assert.Equal(t, `unit-test`, string(readBuf[:n]))
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
@@ -0,0 +1,97 @@
+package secureio
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// frameHeaderSize is the size of the length prefix of each packet
+	// if the stream framing is enabled (see SessionOptions.StreamFraming).
+	frameHeaderSize = 4
+)
+
+// StreamFramingEnable controls if the stream framing should be enabled
+// (see SessionOptions.StreamFraming).
+type StreamFramingEnable uint8
+
+const (
+	// StreamFramingEnableAuto enables the stream framing only if
+	// the backend is detected to be a byte stream (see IsStreamWriter).
+	StreamFramingEnableAuto = StreamFramingEnable(iota)
+
+	// StreamFramingEnableFalse disables the stream framing.
+	StreamFramingEnableFalse
+
+	// StreamFramingEnableTrue enables the stream framing.
+	StreamFramingEnableTrue
+)
+
+// frameReader splits a byte stream into packets prefixed by their
+// lengths. It reassembles packets split across multiple reads and
+// splits multiple packets received by a single read.
+type frameReader struct {
+	reader io.Reader
+	buf    []byte
+	start  int
+	end    int
+	err    error
+}
+
+func newFrameReader(reader io.Reader, maxFrameSize int) *frameReader {
+	return &frameReader{
+		reader: reader,
+		buf:    make([]byte, frameHeaderSize+maxFrameSize),
+	}
+}
+
+// ReadFrame reads the next packet into `p`. The bytes of an incomplete
+// packet are kept until the next call if the reading fails (for
+// example due to a read deadline).
+//
+// If the length of a packet exceeds len(p) then the stream could not
+// be parsed anymore, and the same error is returned on any
+// further call (see IsBroken).
+func (r *frameReader) ReadFrame(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	for {
+		if r.end-r.start >= frameHeaderSize {
+			frameSize := binary.BigEndian.Uint32(r.buf[r.start:])
+			if uint64(frameSize) > uint64(len(p)) || uint64(frameSize) > uint64(len(r.buf)-frameHeaderSize) {
+				r.err = newErrFrameTooBig(uint(len(p)), uint(frameSize))
+				return 0, r.err
+			}
+			frameEnd := r.start + frameHeaderSize + int(frameSize)
+			if frameEnd <= r.end {
+				n := copy(p, r.buf[r.start+frameHeaderSize:frameEnd])
+				r.start = frameEnd
+				return n, nil
+			}
+		}
+
+		if r.start > 0 {
+			r.end = copy(r.buf, r.buf[r.start:r.end])
+			r.start = 0
+		}
+
+		n, err := r.reader.Read(r.buf[r.end:])
+		r.end += n
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// IsBroken returns true if the stream could not be parsed anymore.
+func (r *frameReader) IsBroken() bool {
+	return r != nil && r.err != nil
+}
+
+// putFrameHeader writes the length prefix of a packet of size
+// `frameSize` to `b`.
+func putFrameHeader(b []byte, frameSize int) {
+	binary.BigEndian.PutUint32(b, uint32(frameSize))
+}
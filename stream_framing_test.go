@@ -0,0 +1,75 @@
+package secureio
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+func testFrames(frames ...[]byte) []byte {
+	var stream []byte
+	for _, frame := range frames {
+		hdr := make([]byte, frameHeaderSize)
+		putFrameHeader(hdr, len(frame))
+		stream = append(stream, hdr...)
+		stream = append(stream, frame...)
+	}
+	return stream
+}
+
+func TestFrameReader(t *testing.T) {
+	frames := [][]byte{[]byte(`first`), {}, bytes.Repeat([]byte(`second`), 100), []byte(`third`)}
+
+	t.Run("fragmented", func(t *testing.T) {
+		r := newFrameReader(iotest.OneByteReader(bytes.NewReader(testFrames(frames...))), 1024)
+		buf := make([]byte, 1024)
+		for _, frame := range frames {
+			n, err := r.ReadFrame(buf)
+			require.NoError(t, err)
+			assert.Equal(t, frame, buf[:n])
+		}
+	})
+
+	t.Run("merged", func(t *testing.T) {
+		r := newFrameReader(bytes.NewReader(testFrames(frames...)), 1024)
+		buf := make([]byte, 1024)
+		for _, frame := range frames {
+			n, err := r.ReadFrame(buf)
+			require.NoError(t, err)
+			assert.Equal(t, frame, buf[:n])
+		}
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		stream := testFrames(frames...)
+		r := newFrameReader(iotest.TimeoutReader(bytes.NewReader(stream[:3])), 1024)
+		buf := make([]byte, 1024)
+		_, err := r.ReadFrame(buf)
+		assert.Equal(t, iotest.ErrTimeout, err)
+		r.reader = bytes.NewReader(stream[3:])
+		for _, frame := range frames {
+			n, err := r.ReadFrame(buf)
+			require.NoError(t, err)
+			assert.Equal(t, frame, buf[:n])
+		}
+	})
+
+	t.Run("tooBig", func(t *testing.T) {
+		r := newFrameReader(bytes.NewReader(testFrames(frames...)), 1024)
+		buf := make([]byte, 100)
+		_, err := r.ReadFrame(buf)
+		require.NoError(t, err)
+		_, err = r.ReadFrame(buf)
+		require.NoError(t, err)
+		_, err = r.ReadFrame(buf)
+		assert.True(t, err.(*xerrors.Error).Has(ErrFrameTooBig{}), err)
+		assert.True(t, r.IsBroken())
+		_, err = r.ReadFrame(buf)
+		assert.Error(t, err)
+	})
+}
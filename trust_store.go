@@ -0,0 +1,315 @@
+package secureio
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	xerrors "github.com/xaionaro-go/errors"
+)
+
+// TrustStore decides which remote identities are allowed to establish
+// a session.
+//
+// See `(*Identity).NewSessionWithTrustStore`.
+type TrustStore interface {
+	// FindRemoteIdentity returns the trusted identity with the public key
+	// `pubKey` or nil if the key is not trusted.
+	FindRemoteIdentity(pubKey ed25519.PublicKey) *Identity
+}
+
+// RemoteIdentitySet is a TrustStore which trusts a set of identities.
+//
+// It's safe to modify the set while it is in use.
+type RemoteIdentitySet struct {
+	locker     lockerRWMutex
+	identities map[[PublicKeySize]byte]*Identity
+}
+
+var _ RemoteIdentityRejecter = (*RemoteIdentitySet)(nil)
+
+// NewRemoteIdentitySet is a constructor for `RemoteIdentitySet` based on
+// a list of remote identities.
+func NewRemoteIdentitySet(identities ...*Identity) (*RemoteIdentitySet, error) {
+	set := &RemoteIdentitySet{
+		identities: map[[PublicKeySize]byte]*Identity{},
+	}
+	for _, identity := range identities {
+		if err := set.Add(identity); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// NewRemoteIdentitySetFromPublicKeys is a constructor for `RemoteIdentitySet`
+// based on a list of ED25519 public keys.
+func NewRemoteIdentitySetFromPublicKeys(pubKeys ...ed25519.PublicKey) (*RemoteIdentitySet, error) {
+	set, _ := NewRemoteIdentitySet()
+	for _, pubKey := range pubKeys {
+		identity, err := NewRemoteIdentityFromPublicKey(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := set.Add(identity); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// NewRemoteIdentitySetFromAuthorizedKeysFile is a constructor for
+// `RemoteIdentitySet` based on a file in the authorized_keys format
+// (one "ssh-ed25519 AAAA... comment" key per line).
+//
+// Empty lines, comments and keys of types other than ED25519 are skipped.
+// A malformed line is an error (the error includes the line number),
+// and so is a file without ED25519 keys.
+//
+// The options of authorized_keys (for example "cert-authority",
+// "from=..." or "restrict") are not supported, and ignoring them would
+// trust the keys more than the file permits. So a line with options
+// is an error (ErrUnsupportedKeyFormat, the error includes the line
+// number).
+func NewRemoteIdentitySetFromAuthorizedKeysFile(filePath string) (*RemoteIdentitySet, error) {
+	b, err := ioutil.ReadFile(filePath) // #nosec
+	if err != nil {
+		return nil, xerrors.Errorf("unable to read file '%s': %w", filePath, err)
+	}
+
+	set, _ := NewRemoteIdentitySet()
+	for lineIdx, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		sshPubKey, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to parse line %d of file '%s': %w", lineIdx+1, filePath, err)
+		}
+		if len(options) != 0 {
+			return nil, xerrors.Errorf("unable to use line %d of file '%s': %w", lineIdx+1, filePath,
+				newErrUnsupportedKeyFormat(fmt.Sprintf("a key with options %s", strings.Join(options, ","))))
+		}
+		pubKey, err := sshPublicKeyToED25519(sshPubKey)
+		if err != nil {
+			continue
+		}
+		identity, err := NewRemoteIdentityFromPublicKey(pubKey)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid key at line %d of file '%s': %w", lineIdx+1, filePath, err)
+		}
+		if err := set.Add(identity); err != nil {
+			return nil, err
+		}
+	}
+	if set.Len() == 0 {
+		return nil, newErrCannotLoadKeys(fmt.Errorf("no ED25519 keys found in file '%s'", filePath))
+	}
+	return set, nil
+}
+
+// NewRemoteIdentitySetFromKeysDir is the same as
+// NewRemoteIdentitySetFromAuthorizedKeysFile, but uses
+// file `authorized_keys` of directory `keysDir` (the same
+// directory as used for `NewIdentity`).
+func NewRemoteIdentitySetFromKeysDir(keysDir string) (*RemoteIdentitySet, error) {
+	return NewRemoteIdentitySetFromAuthorizedKeysFile(filepath.Join(keysDir, authorizedKeysFileName))
+}
+
+// Add adds the identity to the set of trusted identities.
+func (set *RemoteIdentitySet) Add(identity *Identity) error {
+	if identity == nil || len(identity.Keys.Public) != PublicKeySize {
+		return newErrRemotePublicKeyIsNil()
+	}
+	var key [PublicKeySize]byte
+	copy(key[:], identity.Keys.Public)
+	set.locker.LockDo(func() {
+		set.identities[key] = identity
+	})
+	return nil
+}
+
+// Remove removes the identity with public key `pubKey` from the set
+// of trusted identities. Returns false if there was no such identity.
+//
+// Already established sessions are not affected.
+func (set *RemoteIdentitySet) Remove(pubKey ed25519.PublicKey) (result bool) {
+	if len(pubKey) != PublicKeySize {
+		return false
+	}
+	var key [PublicKeySize]byte
+	copy(key[:], pubKey)
+	set.locker.LockDo(func() {
+		_, result = set.identities[key]
+		delete(set.identities, key)
+	})
+	return
+}
+
+// Len returns the amount of trusted identities.
+func (set *RemoteIdentitySet) Len() (result int) {
+	set.locker.RLockDo(func() {
+		result = len(set.identities)
+	})
+	return
+}
+
+// RejectRemoteIdentity implements RemoteIdentityRejecter.
+func (set *RemoteIdentitySet) RejectRemoteIdentity(sess *Session, pubKey ed25519.PublicKey) error {
+	set.Remove(pubKey)
+	return nil
+}
+
+// FindRemoteIdentity implements TrustStore.
+func (set *RemoteIdentitySet) FindRemoteIdentity(pubKey ed25519.PublicKey) (result *Identity) {
+	if len(pubKey) != PublicKeySize {
+		return nil
+	}
+	var key [PublicKeySize]byte
+	copy(key[:], pubKey)
+	set.locker.RLockDo(func() {
+		result = set.identities[key]
+	})
+	return
+}
+
+// RemoteIdentityVerifier is an optional interface of a TrustStore. If
+// the TrustStore of a session implements it, then it is used instead of
+// FindRemoteIdentity.
+//
+// Unlike FindRemoteIdentity it is called only after the remote side
+// has proven it owns the private key of `pubKey`, so it is safe
+// to remember the key (see `KnownPeers`).
+type RemoteIdentityVerifier interface {
+	// VerifyRemoteIdentity returns the trusted identity with the public
+	// key `pubKey` or an error if the key should not be trusted.
+	VerifyRemoteIdentity(sess *Session, pubKey ed25519.PublicKey) (*Identity, error)
+}
+
+// RemoteIdentityRejecter is an optional interface of a TrustStore. If
+// the TrustStore of a session implements it, then it is notified
+// when the user rejects the remote identity
+// (see `(*Session).RejectAuthenticationString`), so the identity
+// will not be trusted anymore.
+type RemoteIdentityRejecter interface {
+	// RejectRemoteIdentity marks the identity with the public key
+	// `pubKey` as untrusted.
+	RejectRemoteIdentity(sess *Session, pubKey ed25519.PublicKey) error
+}
+
+// CertificateVerifier is an optional interface of a TrustStore. If
+// the TrustStore of a session implements it, then the remote side
+// is allowed to introduce itself with a Certificate
+// (see `Identity.Certificate`).
+type CertificateVerifier interface {
+	// VerifyCertificate returns the trusted identity certified by `cert`
+	// or an error if the certificate should not be trusted.
+	//
+	// It's already checked that the remote side owns the private key
+	// of `cert.SubjectKey`.
+	VerifyCertificate(sess *Session, cert *Certificate) (*Identity, error)
+}
+
+// CertificateAuthoritySet is a TrustStore which trusts identities with
+// valid certificates signed by any of the certificate authorities
+// of the set. It also implements CertificateVerifier.
+//
+// It's safe to modify the set while it is in use.
+type CertificateAuthoritySet struct {
+	locker lockerRWMutex
+	caKeys map[[PublicKeySize]byte]struct{}
+}
+
+var _ CertificateVerifier = (*CertificateAuthoritySet)(nil)
+
+// NewCertificateAuthoritySet is a constructor for `CertificateAuthoritySet`
+// based on a list of public keys of trusted certificate authorities.
+func NewCertificateAuthoritySet(caPubKeys ...ed25519.PublicKey) (*CertificateAuthoritySet, error) {
+	set := &CertificateAuthoritySet{
+		caKeys: map[[PublicKeySize]byte]struct{}{},
+	}
+	for _, caPubKey := range caPubKeys {
+		if err := set.Add(caPubKey); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// Add adds the certificate authority to the set of trusted ones.
+func (set *CertificateAuthoritySet) Add(caPubKey ed25519.PublicKey) error {
+	if len(caPubKey) != PublicKeySize {
+		return newErrWrongKeyLength(PublicKeySize, uint(len(caPubKey)))
+	}
+	var key [PublicKeySize]byte
+	copy(key[:], caPubKey)
+	set.locker.LockDo(func() {
+		set.caKeys[key] = struct{}{}
+	})
+	return nil
+}
+
+// Remove removes the certificate authority from the set of trusted ones.
+// Returns false if there was no such certificate authority.
+//
+// Already established sessions are not affected.
+func (set *CertificateAuthoritySet) Remove(caPubKey ed25519.PublicKey) (result bool) {
+	if len(caPubKey) != PublicKeySize {
+		return false
+	}
+	var key [PublicKeySize]byte
+	copy(key[:], caPubKey)
+	set.locker.LockDo(func() {
+		_, result = set.caKeys[key]
+		delete(set.caKeys, key)
+	})
+	return
+}
+
+// FindRemoteIdentity implements TrustStore.
+//
+// CertificateAuthoritySet trusts only identities with certificates,
+// so it always returns nil.
+func (set *CertificateAuthoritySet) FindRemoteIdentity(pubKey ed25519.PublicKey) *Identity {
+	return nil
+}
+
+// VerifyCertificate implements CertificateVerifier.
+//
+// The validity period of the certificate is checked using
+// SessionOptions.Clock of `sess` (or the system clock if `sess` is nil).
+func (set *CertificateAuthoritySet) VerifyCertificate(sess *Session, cert *Certificate) (*Identity, error) {
+	if len(cert.SignatureKey) != PublicKeySize {
+		return nil, newErrInvalidCertificate(`invalid signature key length`)
+	}
+	var key [PublicKeySize]byte
+	copy(key[:], cert.SignatureKey)
+	var isTrusted bool
+	set.locker.RLockDo(func() {
+		_, isTrusted = set.caKeys[key]
+	})
+	if !isTrusted {
+		return nil, newErrUnknownCertificateAuthority(cert.SignatureKey)
+	}
+
+	var clock Clock = systemClock{}
+	if sess != nil {
+		clock = sess.getClock()
+	}
+	if err := cert.Verify(cert.SignatureKey, clock.Now()); err != nil {
+		return nil, err
+	}
+
+	identity, err := NewRemoteIdentityFromPublicKey(cert.SubjectKey)
+	if err != nil {
+		return nil, err
+	}
+	identity.Certificate = cert
+	return identity, nil
+}
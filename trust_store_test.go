@@ -0,0 +1,139 @@
+package secureio_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	xerrors "github.com/xaionaro-go/errors"
+
+	. "github.com/xaionaro-go/secureio"
+)
+
+func TestNewRemoteIdentitySetFromKeysDir(t *testing.T) {
+	dirPath, err := ioutil.TempDir(os.TempDir(), `secureio-test`)
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dirPath) }()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+	_ = conn0.Close()
+	_ = conn1.Close()
+
+	var authorizedKeys []byte
+	authorizedKeys = append(authorizedKeys, "# a comment\n\n"...)
+	for _, identity := range []*Identity{identity0, identity1} {
+		sshPubKey, err := ssh.NewPublicKey(identity.Keys.Public)
+		require.NoError(t, err)
+		authorizedKeys = append(authorizedKeys, ssh.MarshalAuthorizedKey(sshPubKey)...)
+	}
+	require.NoError(t, ioutil.WriteFile(path.Join(dirPath, `authorized_keys`), authorizedKeys, 0600))
+
+	set, err := NewRemoteIdentitySetFromKeysDir(dirPath)
+	require.NoError(t, err)
+	assert.Equal(t, 2, set.Len())
+	assert.Equal(t, identity0.Keys.Public, set.FindRemoteIdentity(identity0.Keys.Public).Keys.Public)
+	assert.Equal(t, identity1.Keys.Public, set.FindRemoteIdentity(identity1.Keys.Public).Keys.Public)
+
+	assert.True(t, set.Remove(identity0.Keys.Public))
+	assert.False(t, set.Remove(identity0.Keys.Public))
+	assert.Nil(t, set.FindRemoteIdentity(identity0.Keys.Public))
+	assert.Equal(t, 1, set.Len())
+
+	_, err = NewRemoteIdentitySetFromKeysDir(path.Join(dirPath, `non_existent`))
+	assert.Error(t, err)
+
+	// A malformed line is not skipped silently
+	malformedKeys := append(append([]byte{}, authorizedKeys...), "ssh-ed25519 AAAAtypo\n"...)
+	require.NoError(t, ioutil.WriteFile(path.Join(dirPath, `authorized_keys`), malformedKeys, 0600))
+	_, err = NewRemoteIdentitySetFromKeysDir(dirPath)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `line 5`)
+
+	// The options are not ignored, a line with options is rejected
+	for _, options := range []string{`cert-authority`, `from="192.0.2.1",restrict`} {
+		keysWithOptions := append(append([]byte{}, authorizedKeys...), options+" "...)
+		keysWithOptions = append(keysWithOptions, authorizedKeys[len("# a comment\n\n"):]...)
+		require.NoError(t, ioutil.WriteFile(path.Join(dirPath, `authorized_keys`), keysWithOptions, 0600))
+		_, err = NewRemoteIdentitySetFromKeysDir(dirPath)
+		require.Error(t, err)
+		assert.True(t, err.(*xerrors.Error).Has(ErrUnsupportedKeyFormat{}), err)
+		assert.Contains(t, err.Error(), `line 5`)
+	}
+
+	// No keys is an error
+	require.NoError(t, ioutil.WriteFile(path.Join(dirPath, `authorized_keys`), []byte("# a comment\n"), 0600))
+	_, err = NewRemoteIdentitySetFromKeysDir(dirPath)
+	assert.Error(t, err)
+}
+
+func TestSession_trustStore(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	otherPubKey, _, err := ed25519.GenerateKey(rand.New(rand.NewSource(1)))
+	require.NoError(t, err)
+	trustStore, err := NewRemoteIdentitySetFromPublicKeys(otherPubKey, identity1.Keys.Public)
+	require.NoError(t, err)
+
+	sess0 := identity0.NewSessionWithTrustStore(trustStore, conn0, &testLogger{t}, nil)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, &testLogger{t}, nil)
+	require.NoError(t, sess1.Start(ctx))
+
+	_, err = sess1.Write([]byte(`unit-test`))
+	require.NoError(t, err)
+	readBuf := make([]byte, sess0.GetPayloadSizeLimit())
+	n, err := sess0.Read(readBuf)
+	require.NoError(t, err)
+	assert.Equal(t, `unit-test`, string(readBuf[:n]))
+
+	remoteIdentity := sess0.GetRemoteIdentity()
+	assert.True(t, remoteIdentity == trustStore.FindRemoteIdentity(identity1.Keys.Public))
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
+
+func TestSession_trustStore_untrusted(t *testing.T) {
+	ctx := context.Background()
+
+	identity0, identity1, conn0, conn1 := testPair(t)
+
+	trustStore, err := NewRemoteIdentitySet()
+	require.NoError(t, err)
+
+	untrustedChan := make(chan struct{}, 1)
+	sess0 := identity0.NewSessionWithTrustStore(trustStore, conn0, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		if err.(*xerrors.Error).Has(ErrUntrustedRemoteIdentity{}) {
+			select {
+			case untrustedChan <- struct{}{}:
+			default:
+			}
+		}
+		return false
+	}), nil)
+	require.NoError(t, sess0.Start(ctx))
+
+	sess1 := identity1.NewSession(identity0, conn1, wrapErrorHandler(nil, func(sess *Session, err error) bool {
+		return false
+	}), nil)
+	require.NoError(t, sess1.Start(ctx))
+
+	<-untrustedChan
+	assert.Nil(t, sess0.GetRemoteIdentity())
+
+	assert.NoError(t, sess0.Close())
+	assert.NoError(t, sess1.Close())
+	waitForClosure(t, sess0, sess1)
+}
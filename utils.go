@@ -39,3 +39,26 @@ func u64min(args ...uint64) (result uint64) {
 	}
 	return
 }
+
+func zeroBytes(b []byte) {
+	for idx := range b {
+		b[idx] = 0
+	}
+}
+
+func zeroBytesSlices(s [][]byte) {
+	for _, b := range s {
+		zeroBytes(b)
+	}
+}
+
+// containsSlice returns true if `s` contains slice `b` (the same memory,
+// not just the same value).
+func containsSlice(s [][]byte, b []byte) bool {
+	for _, item := range s {
+		if len(item) != 0 && len(item) == len(b) && &item[0] == &b[0] {
+			return true
+		}
+	}
+	return false
+}